@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// accessLogger returns a middleware writing one line per request, or nil when
+// the access log is disabled. Model and key come from what sendUpstream
+// recorded for the request history.
+func accessLogger(config *keymanager.AccessLogConfig) gin.HandlerFunc {
+	if config == nil || !config.Enabled {
+		return nil
+	}
+
+	var output io.Writer = os.Stdout
+	if config.Output != "" && config.Output != "stdout" {
+		file, err := os.OpenFile(config.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Printf("ERROR: failed to open access log %s, logging to stdout: %v", config.Output, err)
+		} else {
+			output = file
+		}
+	}
+
+	return gin.LoggerWithConfig(gin.LoggerConfig{
+		Output: output,
+		Formatter: func(p gin.LogFormatterParams) string {
+			model, key := "-", "-"
+			if m, ok := p.Keys["history_model"].(string); ok && m != "" {
+				model = m
+			}
+			if k, ok := p.Keys["history_key"].(string); ok && k != "" {
+				key = keymanager.MaskKey(k)
+			}
+			return fmt.Sprintf("%s | %3d | %10v | %15s | %-6s %s | model=%s key=%s\n",
+				p.TimeStamp.Format("2006/01/02 15:04:05"),
+				p.StatusCode,
+				p.Latency.Round(time.Millisecond),
+				p.ClientIP,
+				p.Method,
+				p.Request.URL.Path, // Without the query, which may hold a key
+				model,
+				key,
+			)
+		},
+	})
+}
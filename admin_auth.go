@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// adminAuth rejects requests without the admin_auth credentials. It does nothing
+// while admin_auth is not configured.
+func adminAuth(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := km.Config().AdminAuth
+
+		if !config.Enabled() || config.Allows(c.Request) {
+			c.Next()
+			return
+		}
+		c.Header("WWW-Authenticate", `Basic realm="GeminiLooper"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Admin authentication required"})
+	}
+}
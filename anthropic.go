@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// Anthropic Messages API (/v1/messages) translated to Gemini generateContent.
+
+type AnthropicRequest struct {
+	Model         string             `json:"model"`
+	System        json.RawMessage    `json:"system,omitempty"` // A string or a list of text blocks
+	Messages      []AnthropicMessage `json:"messages"`
+	MaxTokens     int                `json:"max_tokens"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	TopK          *int               `json:"top_k,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+	Tools         []AnthropicTool    `json:"tools,omitempty"`
+}
+
+type AnthropicMessage struct {
+	Role    string          `json:"role"`    // user or assistant
+	Content json.RawMessage `json:"content"` // A string or a list of content blocks
+}
+
+type AnthropicTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	InputSchema map[string]any `json:"input_schema,omitempty"`
+}
+
+// AnthropicContentBlock covers text, image, document, tool_use and tool_result blocks.
+type AnthropicContentBlock struct {
+	Type      string           `json:"type"`
+	Text      string           `json:"text,omitempty"`
+	Source    *AnthropicSource `json:"source,omitempty"`
+	ID        string           `json:"id,omitempty"`
+	Name      string           `json:"name,omitempty"`
+	Input     any              `json:"input,omitempty"` // tool_use: a JSON object
+	ToolUseID string           `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage  `json:"content,omitempty"` // tool_result: a string or a list of text blocks
+	IsError   bool             `json:"is_error,omitempty"`
+}
+
+type AnthropicSource struct {
+	Type      string `json:"type"` // base64 or url
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type AnthropicResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   *string                 `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        AnthropicUsage          `json:"usage"`
+}
+
+func anthropicContentBlocks(raw json.RawMessage) ([]AnthropicContentBlock, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return []AnthropicContentBlock{{Type: "text", Text: text}}, nil
+	}
+	var blocks []AnthropicContentBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return nil, fmt.Errorf("content must be a string or a list of content blocks")
+	}
+	return blocks, nil
+}
+
+func anthropicSourcePart(source *AnthropicSource) (GeminiPart, error) {
+	if source == nil {
+		return GeminiPart{}, fmt.Errorf("image and document blocks require a source")
+	}
+	switch source.Type {
+	case "base64":
+		return GeminiPart{InlineData: &GeminiBlob{MimeType: source.MediaType, Data: source.Data}}, nil
+	case "url":
+		return imagePart(source.URL)
+	}
+	return GeminiPart{}, fmt.Errorf("unsupported source type '%s'", source.Type)
+}
+
+func translateAnthropicRequest(req *AnthropicRequest) (*GeminiRequest, error) {
+	geminiReq := &GeminiRequest{Contents: []GeminiContent{}}
+
+	systemBlocks, err := anthropicContentBlocks(req.System)
+	if err != nil {
+		return nil, fmt.Errorf("system must be a string or a list of text blocks")
+	}
+	var systemParts []GeminiPart
+	for _, block := range systemBlocks {
+		systemParts = append(systemParts, GeminiPart{Text: block.Text})
+	}
+	if len(systemParts) > 0 {
+		geminiReq.SystemInstruction = &GeminiContent{Parts: systemParts}
+	}
+
+	toolNames := make(map[string]string) // tool_use id -> tool name
+	for _, msg := range req.Messages {
+		blocks, err := anthropicContentBlocks(msg.Content)
+		if err != nil {
+			return nil, err
+		}
+		role := "user"
+		if msg.Role == "assistant" {
+			role = "model"
+		}
+
+		var parts []GeminiPart
+		for _, block := range blocks {
+			switch block.Type {
+			case "text":
+				parts = append(parts, GeminiPart{Text: block.Text})
+			case "image", "document":
+				part, err := anthropicSourcePart(block.Source)
+				if err != nil {
+					return nil, err
+				}
+				parts = append(parts, part)
+			case "tool_use":
+				toolNames[block.ID] = block.Name
+				args, _ := block.Input.(map[string]any)
+				parts = append(parts, GeminiPart{FunctionCall: &GeminiFunctionCall{Name: block.Name, Args: args}})
+			case "tool_result":
+				var output any
+				resultBlocks, err := anthropicContentBlocks(block.Content)
+				if err != nil {
+					return nil, err
+				}
+				var text strings.Builder
+				for _, resultBlock := range resultBlocks {
+					text.WriteString(resultBlock.Text)
+				}
+				output = text.String()
+				var parsed any
+				if json.Unmarshal([]byte(text.String()), &parsed) == nil {
+					output = parsed
+				}
+				name := toolNames[block.ToolUseID]
+				if name == "" {
+					name = block.ToolUseID
+				}
+				response := map[string]any{"output": output}
+				if block.IsError {
+					response = map[string]any{"error": output}
+				}
+				parts = append(parts, GeminiPart{FunctionResponse: &GeminiFunctionResponse{Name: name, Response: response}})
+			case "thinking", "redacted_thinking":
+				continue // Thinking from previous turns has no Gemini equivalent
+			default:
+				return nil, fmt.Errorf("unsupported content block type '%s'", block.Type)
+			}
+		}
+		geminiReq.Contents = appendContent(geminiReq.Contents, role, parts)
+	}
+	if len(geminiReq.Contents) == 0 {
+		return nil, fmt.Errorf("messages: at least one message is required")
+	}
+
+	var declarations []GeminiFunctionDeclaration
+	for _, tool := range req.Tools {
+		declarations = append(declarations, GeminiFunctionDeclaration{Name: tool.Name, Description: tool.Description, Parameters: sanitizeSchema(tool.InputSchema)})
+	}
+	if len(declarations) > 0 {
+		geminiReq.Tools = []GeminiTool{{FunctionDeclarations: declarations}}
+	}
+
+	config := &GeminiGenerationConfig{
+		Temperature:   req.Temperature,
+		TopP:          req.TopP,
+		TopK:          req.TopK,
+		StopSequences: req.StopSequences,
+	}
+	if req.MaxTokens > 0 {
+		config.MaxOutputTokens = &req.MaxTokens
+	}
+	geminiReq.GenerationConfig = config
+
+	return geminiReq, nil
+}
+
+// anthropicStopReason maps a Gemini finish reason. A response that calls tools
+// stops with tool_use regardless of what Gemini reports.
+func anthropicStopReason(finishReason string, calledTool bool) string {
+	if calledTool {
+		return "tool_use"
+	}
+	if finishReason == "MAX_TOKENS" {
+		return "max_tokens"
+	}
+	return "end_turn"
+}
+
+func anthropicUsage(usage keymanager.GeminiUsageMetadata) AnthropicUsage {
+	return AnthropicUsage{InputTokens: usage.PromptTokenCount, OutputTokens: usage.CandidatesTokenCount + usage.ThoughtsTokenCount}
+}
+
+func anthropicError(c *gin.Context, status int, errorType, message string) {
+	c.JSON(status, gin.H{"type": "error", "error": gin.H{"type": errorType, "message": message}})
+}
+
+// anthropicErrorType picks the Anthropic error type for an upstream status code.
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		return "overloaded_error"
+	}
+	return "api_error"
+}
+
+func anthropicMessagesHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req AnthropicRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			anthropicError(c, http.StatusBadRequest, "invalid_request_error", "Invalid request body")
+			return
+		}
+		if req.Model == "" {
+			anthropicError(c, http.StatusBadRequest, "invalid_request_error", "Model not specified in request body")
+			return
+		}
+
+		geminiReq, err := translateAnthropicRequest(&req)
+		if err != nil {
+			anthropicError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+		body, err := json.Marshal(geminiReq)
+		if err != nil {
+			anthropicError(c, http.StatusInternalServerError, "api_error", "Failed to marshal Gemini request body")
+			return
+		}
+
+		action := "generateContent"
+		if req.Stream {
+			action = "streamGenerateContent"
+		}
+		resp, modelName, apiKey, upstreamErr := callGemini(c, km, target, req.Model, action, body)
+		if upstreamErr != nil {
+			setRetryAfter(c, upstreamErr)
+			anthropicError(c, upstreamErr.StatusCode, anthropicErrorType(upstreamErr.StatusCode), geminiErrorMessage(upstreamErr))
+			return
+		}
+		defer resp.Body.Close()
+
+		if req.Stream {
+			streamAnthropic(c, km, resp, &req, modelName, apiKey)
+			return
+		}
+
+		var geminiResp GeminiResponse
+		if err := json.NewDecoder(resp.Body).Decode(&geminiResp); err != nil {
+			anthropicError(c, http.StatusBadGateway, "api_error", "Failed to parse upstream response")
+			return
+		}
+		recordUsage(c, km, modelName, apiKey, geminiResp.UsageMetadata)
+
+		result := AnthropicResponse{
+			ID:      randomID("msg_"),
+			Type:    "message",
+			Role:    "assistant",
+			Model:   req.Model,
+			Content: []AnthropicContentBlock{},
+			Usage:   anthropicUsage(geminiResp.UsageMetadata),
+		}
+		finishReason := ""
+		calledTool := false
+		if len(geminiResp.Candidates) > 0 {
+			candidate := geminiResp.Candidates[0]
+			finishReason = candidate.FinishReason
+			for _, part := range candidate.Content.Parts {
+				if part.Thought {
+					continue
+				}
+				if part.FunctionCall != nil {
+					calledTool = true
+					input := part.FunctionCall.Args
+					if input == nil {
+						input = map[string]any{} // input is required even without arguments
+					}
+					result.Content = append(result.Content, AnthropicContentBlock{Type: "tool_use", ID: randomID("toolu_"), Name: part.FunctionCall.Name, Input: input})
+					continue
+				}
+				if part.Text == "" {
+					continue
+				}
+				// Consecutive text parts form one text block
+				if n := len(result.Content); n > 0 && result.Content[n-1].Type == "text" {
+					result.Content[n-1].Text += part.Text
+				} else {
+					result.Content = append(result.Content, AnthropicContentBlock{Type: "text", Text: part.Text})
+				}
+			}
+		}
+		stopReason := anthropicStopReason(finishReason, calledTool)
+		result.StopReason = &stopReason
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// anthropicStream writes Messages API server-sent events.
+type anthropicStream struct {
+	c *gin.Context
+}
+
+func (s *anthropicStream) emit(eventType string, payload gin.H) {
+	payload["type"] = eventType
+	data, _ := json.Marshal(payload)
+	fmt.Fprintf(s.c.Writer, "event: %s\ndata: %s\n\n", eventType, data)
+	s.c.Writer.Flush()
+}
+
+func streamAnthropic(c *gin.Context, km *keymanager.KeyManager, resp *http.Response, req *AnthropicRequest, modelName, apiKey string) {
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	c.Writer.WriteHeader(http.StatusOK)
+
+	stream := &anthropicStream{c: c}
+	stream.emit("message_start", gin.H{"message": AnthropicResponse{
+		ID:      randomID("msg_"),
+		Type:    "message",
+		Role:    "assistant",
+		Model:   req.Model,
+		Content: []AnthropicContentBlock{},
+	}})
+
+	blockIndex := -1
+	textOpen := false // The current block is a text block that more deltas can be added to
+	closeBlock := func() {
+		if blockIndex >= 0 && textOpen {
+			stream.emit("content_block_stop", gin.H{"index": blockIndex})
+			textOpen = false
+		}
+	}
+	var usage keymanager.GeminiUsageMetadata
+	finishReason := ""
+	calledTool := false
+
+	events := newSSEReader(resp.Body)
+	for {
+		event, err := events.Next()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Messages API: error reading upstream stream: %v", err)
+			}
+			break
+		}
+		var chunk GeminiResponse
+		if err := json.Unmarshal(event.Data, &chunk); err != nil {
+			continue
+		}
+		if chunk.UsageMetadata.TotalTokenCount > 0 {
+			usage = chunk.UsageMetadata
+		}
+		if len(chunk.Candidates) == 0 {
+			continue
+		}
+		candidate := chunk.Candidates[0]
+		if candidate.FinishReason != "" {
+			finishReason = candidate.FinishReason
+		}
+
+		for _, part := range candidate.Content.Parts {
+			if part.Thought {
+				continue
+			}
+			if part.FunctionCall != nil {
+				closeBlock()
+				calledTool = true
+				blockIndex++
+				args, _ := json.Marshal(part.FunctionCall.Args)
+				if part.FunctionCall.Args == nil {
+					args = []byte("{}")
+				}
+				stream.emit("content_block_start", gin.H{"index": blockIndex, "content_block": gin.H{"type": "tool_use", "id": randomID("toolu_"), "name": part.FunctionCall.Name, "input": gin.H{}}})
+				stream.emit("content_block_delta", gin.H{"index": blockIndex, "delta": gin.H{"type": "input_json_delta", "partial_json": string(args)}})
+				stream.emit("content_block_stop", gin.H{"index": blockIndex})
+				continue
+			}
+			if part.Text == "" {
+				continue
+			}
+			if !textOpen {
+				blockIndex++
+				textOpen = true
+				stream.emit("content_block_start", gin.H{"index": blockIndex, "content_block": gin.H{"type": "text", "text": ""}})
+			}
+			stream.emit("content_block_delta", gin.H{"index": blockIndex, "delta": gin.H{"type": "text_delta", "text": part.Text}})
+		}
+	}
+	closeBlock()
+
+	if usage.TotalTokenCount > 0 {
+		recordUsage(c, km, modelName, apiKey, usage)
+	}
+	stream.emit("message_delta", gin.H{
+		"delta": gin.H{"stop_reason": anthropicStopReason(finishReason, calledTool), "stop_sequence": nil},
+		"usage": anthropicUsage(usage),
+	})
+	stream.emit("message_stop", gin.H{})
+}
@@ -3,44 +3,40 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
-	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
 	"github.com/gin-gonic/gin"
 )
 
 func setupLogging() {
-	logFile, err := os.OpenFile("geminilooper.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if dir := keymanager.DataDir(); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Fatalf("Failed to create data directory: %v", err)
+		}
+	}
+	logPath := keymanager.DataFilePath(nil, "geminilooper.log")
+	logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
 		log.Fatalf("Failed to open log file: %v", err)
 	}
 	// Create a multi-writer to write to both file and stdout
 	multiWriter := io.MultiWriter(os.Stdout, logFile)
 	log.SetOutput(multiWriter)
-	log.Println("Logging setup complete. Logs will be written to stdout and geminilooper.log")
-}
-
-type GeminiResponse struct {
-	Candidates []struct {
-		// ... other fields
-	} `json:"candidates"`
-	UsageMetadata struct {
-		PromptTokenCount     int `json:"promptTokenCount"`
-		CandidatesTokenCount int `json:"candidatesTokenCount"`
-		TotalTokenCount      int `json:"totalTokenCount"`
-	} `json:"usageMetadata"`
+	log.Printf("Logging setup complete. Logs will be written to stdout and %s", logPath)
 }
 
 type OpenAIUsage struct {
@@ -54,80 +50,224 @@ type OpenAIResponse struct {
 }
 
 type OllamaRequest struct {
-	Model    string `json:"model"`
-	Messages []struct {
-		Role    string `json:"role"`
-		Content string `json:"content"`
-	} `json:"messages"`
-	Stream *bool `json:"stream,omitempty"`
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	Tools    []OllamaTool    `json:"tools,omitempty"`
+	Stream   *bool           `json:"stream,omitempty"`
+	Format   json.RawMessage `json:"format,omitempty"` // "json" or a JSON schema
+	Options  *OllamaOptions  `json:"options,omitempty"`
+}
+
+type OllamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"` // Base64 encoded, without a data: prefix
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"` // On tool messages, the function whose result they carry
+}
+
+type OllamaTool struct {
+	Type     string `json:"type"` // "function"
+	Function struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Parameters  map[string]any `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+type OllamaToolCall struct {
+	Function struct {
+		Name      string         `json:"name"`
+		Arguments map[string]any `json:"arguments"`
+	} `json:"function"`
+}
+
+// OllamaOptions are the sampling options that have a Gemini equivalent; the
+// others (num_ctx, mirostat, ...) only make sense for local models.
+type OllamaOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	TopK        *int     `json:"top_k,omitempty"`
+	NumPredict  *int     `json:"num_predict,omitempty"` // -1 (infinite) and -2 (fill context) mean no limit
+	Stop        []string `json:"stop,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+}
+
+func isTextPart(part GeminiPart) bool {
+	return part.InlineData == nil && part.FileData == nil && part.FunctionCall == nil && part.FunctionResponse == nil
+}
+
+func ollamaTools(tools []OllamaTool) []GeminiTool {
+	var declarations []GeminiFunctionDeclaration
+	for _, tool := range tools {
+		if tool.Type != "" && tool.Type != "function" {
+			continue
+		}
+		declarations = append(declarations, GeminiFunctionDeclaration{Name: tool.Function.Name, Description: tool.Function.Description, Parameters: sanitizeSchema(tool.Function.Parameters)})
+	}
+	if len(declarations) == 0 {
+		return nil
+	}
+	return []GeminiTool{{FunctionDeclarations: declarations}}
+}
+
+// ollamaAssistantMessage translates the parts of a Gemini candidate into an
+// assistant message: text (without thoughts) and function calls.
+func ollamaAssistantMessage(parts []GeminiPart) OllamaMessage {
+	msg := OllamaMessage{Role: "assistant"}
+	var text strings.Builder
+	for _, part := range parts {
+		if part.FunctionCall != nil {
+			var call OllamaToolCall
+			call.Function.Name = part.FunctionCall.Name
+			call.Function.Arguments = part.FunctionCall.Args
+			if call.Function.Arguments == nil {
+				call.Function.Arguments = map[string]any{}
+			}
+			msg.ToolCalls = append(msg.ToolCalls, call)
+		} else if !part.Thought {
+			text.WriteString(part.Text)
+		}
+	}
+	msg.Content = text.String()
+	return msg
 }
 
-type GeminiRequest struct {
-	Contents []struct {
-		Role  string `json:"role"`
-		Parts []struct {
-			Text string `json:"text"`
-		} `json:"parts"`
-	} `json:"contents"`
+// ollamaImagePart converts a base64 image of an Ollama message into an
+// inlineData part. Ollama doesn't send the type, so it is sniffed from the data.
+func ollamaImagePart(image string) (GeminiPart, error) {
+	head := image[:min(len(image), 64)]
+	head = head[:len(head)/4*4]
+	decoded, err := base64.StdEncoding.DecodeString(head)
+	if err != nil || len(decoded) == 0 {
+		return GeminiPart{}, fmt.Errorf("images must be base64 encoded")
+	}
+	mimeType := http.DetectContentType(decoded)
+	if !strings.HasPrefix(mimeType, "image/") {
+		mimeType = "image/jpeg"
+	}
+	return GeminiPart{InlineData: &GeminiBlob{MimeType: mimeType, Data: image}}, nil
+}
+
+// withOllamaFormat adds format, "json" or a JSON schema, to a generation config
+// as the response MIME type and schema.
+func withOllamaFormat(config *GeminiGenerationConfig, format json.RawMessage) (*GeminiGenerationConfig, error) {
+	if len(format) == 0 || string(format) == "null" || string(format) == `""` {
+		return config, nil
+	}
+	var schema map[string]any
+	var name string
+	if json.Unmarshal(format, &name) == nil {
+		if name != "json" {
+			return nil, fmt.Errorf("format must be \"json\" or a JSON schema")
+		}
+	} else if err := json.Unmarshal(format, &schema); err != nil {
+		return nil, fmt.Errorf("format must be \"json\" or a JSON schema")
+	}
+	if config == nil {
+		config = &GeminiGenerationConfig{}
+	}
+	config.ResponseMimeType = "application/json"
+	config.ResponseSchema = sanitizeSchema(schema)
+	return config, nil
+}
+
+// generationConfig translates the options, nil when none of them is set.
+func (o *OllamaOptions) generationConfig() *GeminiGenerationConfig {
+	if o == nil {
+		return nil
+	}
+	config := &GeminiGenerationConfig{
+		Temperature:   o.Temperature,
+		TopP:          o.TopP,
+		TopK:          o.TopK,
+		StopSequences: o.Stop,
+		Seed:          o.Seed,
+	}
+	if o.NumPredict != nil && *o.NumPredict > 0 {
+		config.MaxOutputTokens = o.NumPredict
+	}
+	if config.Temperature == nil && config.TopP == nil && config.TopK == nil && config.MaxOutputTokens == nil && len(config.StopSequences) == 0 && config.Seed == nil {
+		return nil
+	}
+	return config
 }
 
 type OllamaStreamResponse struct {
-	Model     string    `json:"model"`
-	CreatedAt time.Time `json:"created_at"`
-	Response  string    `json:"response"`
-	Done      bool      `json:"done"`
+	Model     string         `json:"model"`
+	CreatedAt time.Time      `json:"created_at"`
+	Response  string         `json:"response"`
+	Message   *OllamaMessage `json:"message,omitempty"` // The chunk in /api/chat form, with tool calls
+	Done      bool           `json:"done"`
+	// Set on the final chunk
+	TotalDuration   int64 `json:"total_duration,omitempty"` // Nanoseconds
+	PromptEvalCount int   `json:"prompt_eval_count,omitempty"`
+	EvalCount       int   `json:"eval_count,omitempty"`
+}
+
+// OllamaChatResponse is the non-streaming /api/chat response.
+type OllamaChatResponse struct {
+	Model           string        `json:"model"`
+	CreatedAt       time.Time     `json:"created_at"`
+	Message         OllamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason,omitempty"`
+	TotalDuration   int64         `json:"total_duration"` // Nanoseconds
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			runBench(os.Args[2:])
+			return
+		case "validate":
+			runValidate(os.Args[2:])
+			return
+		case "test-keys":
+			runTestKeys(os.Args[2:])
+			return
+		case "usage":
+			runUsage(os.Args[2:])
+			return
+		}
+	}
+
+	dataDir := keymanager.DataDir()
+	flag.StringVar(&dataDir, "data-dir", dataDir, "directory for config.json, key_usage.json and other data files (env GEMINILOOPER_DATA_DIR)")
+	flag.Parse()
+	keymanager.SetDataDir(dataDir)
+
 	setupLogging()
-	keyManager, err := NewKeyManager()
+	keyManager, err := keymanager.NewKeyManager()
 	if err != nil {
 		log.Fatalf("Failed to create key manager: %v", err)
 	}
 
-	gin.SetMode(gin.ReleaseMode)
-	gin.DefaultWriter = io.Discard
-	r := gin.New()
-	r.Use(gin.Recovery())
-	r.LoadHTMLFiles("templates/status.html")
-
-	target, err := url.Parse("https://generativelanguage.googleapis.com")
+	target, err := url.Parse(keymanager.DefaultUpstreamURL)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(target)
-
-	proxy.ModifyResponse = func(resp *http.Response) error {
-		// We will handle the response in the handler
-		return nil
-	}
-
-	r.POST("/v1beta/models/:model_name", proxyHandler(keyManager, target))
-	r.POST("/v1/*path", openAIProxyHandler(keyManager, target))
-	r.POST("/api/chat", ollamaProxyHandler(keyManager, target))
+	r := newRouter(keyManager, target)
+	r.LoadHTMLFiles("templates/status.html")
 
-	r.GET("/status", func(c *gin.Context) {
+	r.GET("/status", adminAuth(keyManager), func(c *gin.Context) {
 		c.HTML(http.StatusOK, "status.html", nil)
 	})
 
-	r.GET("/api/status_data", func(c *gin.Context) {
-		statusData := keyManager.GetStatus()
-		c.JSON(http.StatusOK, statusData)
-	})
-
-	r.POST("/api/test_key", testKeyHandler(keyManager))
-	r.POST("/api/enable_model", enableModelHandler(keyManager))
-
 	srv := &http.Server{
 		Addr:    ":48888",
 		Handler: r,
 	}
+	config := keyManager.Config()
+	applyServerTimeouts(srv, config.Timeouts)
 
 	go func() {
 		// service connections
-		log.Println("Starting server on :48888")
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := listenAndServe(srv, config.TLS); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("listen: %s\n", err)
 		}
 	}()
@@ -155,7 +295,72 @@ func main() {
 	log.Println("Server exiting")
 }
 
-func proxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
+// newRouter registers the proxy and API routes. The status page is added by main
+// because it depends on the template files being present.
+func newRouter(keyManager *keymanager.KeyManager, target *url.URL) *gin.Engine {
+	gin.SetMode(gin.ReleaseMode)
+	gin.DefaultWriter = io.Discard
+	r := gin.New()
+	r.Use(gin.Recovery())
+	config := keyManager.Config()
+	if logger := accessLogger(config.AccessLog); logger != nil {
+		r.Use(logger)
+	}
+	r.Use(corsMiddleware(keyManager))
+
+	history := newRequestHistory(config.RequestHistory)
+	proxied := r.Group("", requestBodyLimit(keyManager), recordRequestHistory(history), requestTimeout(keyManager), byokPassthrough(keyManager, target), clientKeyAuth(keyManager), routeRequests(keyManager), requestPriorityClass(keyManager), idempotency())
+	v1beta := v1betaRouteHandler(keyManager, target)
+	for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE"} {
+		proxied.Handle(method, "/v1beta/*path", v1beta)
+	}
+	proxied.POST("/upload/v1beta/*path", filesUploadHandler(keyManager, target))
+	proxied.PUT("/upload/v1beta/*path", filesUploadHandler(keyManager, target))
+	proxied.POST("/v1/*path", openAIRouteHandler(keyManager, target))
+	proxied.POST("/api/chat", ollamaProxyHandler(keyManager, target))
+	proxied.POST("/api/embed", ollamaEmbedHandler(keyManager, target))
+	proxied.POST("/api/embeddings", ollamaEmbeddingsHandler(keyManager, target))
+	proxied.GET("/api/ps", ollamaPsHandler(keyManager))
+	// Live API sessions last as long as the client wants, so there is no request timeout
+	r.GET("/ws/*path", recordRequestHistory(history), clientKeyAuth(keyManager), routeRequests(keyManager), liveProxyHandler(keyManager, target))
+
+	r.GET("/healthz", healthzHandler())
+	r.GET("/readyz", readyzHandler(keyManager))
+	r.GET("/api/version", ollamaVersionHandler())
+	r.GET("/api/openapi.json", openAPIHandler())
+
+	admin := r.Group("", adminAuth(keyManager))
+	admin.GET("/api/status_data", statusDataHandler(keyManager))
+	admin.GET("/api/events", eventsHandler(keyManager))
+	admin.GET("/api/request_history", requestHistoryHandler(history))
+	admin.GET("/api/cluster", clusterStatusHandler(keyManager))
+	admin.GET("/api/usage", usageQueryHandler(keyManager))
+	admin.GET("/api/usage/export", usageExportHandler(keyManager))
+	admin.GET("/api/corpora", corpusKeysHandler(keyManager))
+	admin.GET("/api/files", fileKeysHandler(keyManager))
+	admin.POST("/api/reload", reloadHandler(keyManager))
+	admin.POST("/api/keys", addKeysHandler(keyManager))
+	admin.DELETE("/api/keys", removeKeysHandler(keyManager))
+	admin.POST("/api/keys/:key/pause", pauseKeyHandler(keyManager, true))
+	admin.POST("/api/keys/:key/resume", pauseKeyHandler(keyManager, false))
+	admin.GET("/api/client_keys", listClientKeysHandler(keyManager))
+	admin.POST("/api/client_keys", issueClientKeyHandler(keyManager))
+	admin.DELETE("/api/client_keys/:key", revokeClientKeyHandler(keyManager))
+
+	admin.POST("/api/test_key", testKeyHandler(keyManager, target))
+	admin.POST("/api/enable_model", enableModelHandler(keyManager))
+	admin.POST("/api/reset_quotas", resetQuotasHandler(keyManager))
+
+	admin.GET("/api/simulate_error", listSimulationsHandler(keyManager))
+	admin.POST("/api/simulate_error", simulateErrorHandler(keyManager))
+	admin.DELETE("/api/simulate_error", clearSimulationsHandler(keyManager))
+	admin.GET("/api/fault_injection", getFaultInjectionHandler(keyManager))
+	admin.POST("/api/fault_injection", setFaultInjectionHandler(keyManager))
+
+	return r
+}
+
+func proxyHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		fullModelName := c.Param("model_name")
 		if fullModelName == "" {
@@ -175,19 +380,69 @@ func proxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
 		var err error
 		var initialModelName = modelName
 
+		// generateAnswer over a corpus must use the key whose project owns the
+		// corpus, and a request referencing uploaded files the key that uploaded them
+		pinnedKey := ""
+		if action == "generateAnswer" || action == "generateContent" || action == "streamGenerateContent" || action == "countTokens" {
+			var status int
+			if action == "generateAnswer" {
+				pinnedKey, status, err = retrievalAffinityKey(c, km, target)
+			} else {
+				pinnedKey, status, err = fileAffinityKey(c, km, target)
+			}
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		// The body is read once, every attempt sends the same bytes
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read request body"})
+			return
+		}
+		estimatedTokens := 0
+		if action == "generateContent" || action == "streamGenerateContent" {
+			if body, err = withRequestOverrides(c, km, initialModelName, body); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+				return
+			}
+			if action == "generateContent" && serveCachedResponse(c, km, initialModelName, action, body) {
+				return
+			}
+			estimatedTokens = requestTokenEstimate(c, km, target, initialModelName, body)
+			if err := km.CheckTokenEstimate(initialModelName, estimatedTokens); err != nil {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		// Embedding responses report no usage, it is estimated from the input
+		embedTokens := 0
+		if isEmbedAction(action) {
+			embedTokens = estimateEmbedTokens(action, body)
+			estimatedTokens = embedTokens
+		}
+		getKey := func() (string, string, time.Duration, error) {
+			if pinnedKey != "" {
+				return pinnedKey, initialModelName, 0, nil
+			}
+			return km.WaitForKey(c.Request.Context(), initialModelName, estimatedTokens)
+		}
+
 		// Get the initial key
-		apiKey, modelName, delay, err = km.GetKey(initialModelName)
+		apiKey, modelName, delay, err = getKey()
 		if err != nil {
-			c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Failed to get initial API key: %v", err)})
+			geminiNoKeyError(c, "Failed to get initial API key", err)
 			return
 		}
 
-		for i := 0; i < 5; i++ { // Retry loop
+		retry := km.NewRetryPolicy()
+		for i := 0; retry.Next(); i++ { // Retry loop
 			// On subsequent retries, we might need a new key if the current one was disabled.
 			if i > 0 {
-				apiKey, modelName, delay, err = km.GetKey(initialModelName)
+				apiKey, modelName, delay, err = getKey()
 				if err != nil {
-					c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Failed to get API key for retry: %v", err)})
+					geminiNoKeyError(c, "Failed to get API key for retry", err)
 					return
 				}
 			}
@@ -196,14 +451,6 @@ func proxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
 				time.Sleep(delay)
 			}
 
-			// Read body
-			body, err := io.ReadAll(c.Request.Body)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read request body"})
-				return
-			}
-			c.Request.Body = io.NopCloser(bytes.NewBuffer(body)) // Restore body
-
 			// Construct the correct path including the action
 			path := fmt.Sprintf("/v1beta/models/%s:%s", modelName, action)
 			if action == "" {
@@ -211,28 +458,29 @@ func proxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
 			}
 
 			// Create new request
-			proxyReq, err := http.NewRequest(c.Request.Method, c.Request.URL.String(), bytes.NewBuffer(body))
+			proxyReq, err := http.NewRequest(c.Request.Method, c.Request.URL.String(), bytes.NewReader(body))
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create proxy request"})
 				return
 			}
 
-			proxyReq.Header = c.Request.Header
-			proxyReq.URL.Scheme = target.Scheme
-			proxyReq.URL.Host = target.Host
-			proxyReq.URL.Path = path
+			proxyReq.Header = km.ForwardHeaders(c.Request.Header)
+			upstreamURL := km.UpstreamURLFor(c.Request.Context(), target, apiKey, path)
+			proxyReq.URL.Scheme = upstreamURL.Scheme
+			proxyReq.URL.Host = upstreamURL.Host
+			proxyReq.URL.Path = upstreamURL.Path
 
 			// Set the content length to the size of the new body
 			proxyReq.ContentLength = int64(len(body))
 
-			// Add API key
-			q := proxyReq.URL.Query()
-			q.Set("key", apiKey)
-			proxyReq.URL.RawQuery = q.Encode()
-
 			// Send request
-			client := &http.Client{}
-			resp, err := client.Do(proxyReq)
+			client := km.UpstreamClient()
+			var resp *http.Response
+			if action == "generateContent" && pinnedKey == "" { // Streams and requests bound to a key aren't hedged
+				resp, apiKey, err = sendHedged(c, km, client, proxyReq, body, target, path, modelName, apiKey, estimatedTokens)
+			} else {
+				resp, err = sendUpstream(c, km, client, proxyReq, modelName, apiKey)
+			}
 			if err != nil {
 				c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send request to upstream server"})
 				return
@@ -241,73 +489,71 @@ func proxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
 
 			// Handle response
 			if resp.StatusCode == http.StatusOK {
+				if action == "generateContent" {
+					cacheResponseBody(c, km, initialModelName, action, body, resp)
+				}
 				// Copy headers
 				for k, v := range resp.Header {
 					c.Writer.Header()[k] = v
 				}
 				c.Writer.WriteHeader(resp.StatusCode)
 
-				// For streaming, we need to read and write simultaneously
-				// We also need to capture the response for token counting
-				var respBodyBuffer bytes.Buffer
-				teeReader := io.TeeReader(resp.Body, &respBodyBuffer)
+				// Image model responses have no usage, the images in them are counted
+				if action == "predict" {
+					respBody := getBuffer()
+					defer putBuffer(respBody)
+					if _, err := copyFlushing(c.Writer, io.TeeReader(resp.Body, respBody)); err != nil {
+						log.Printf("Error streaming response to client: %v", err)
+					}
+					if images := countGeneratedImages(respBody.Bytes()); images > 0 {
+						recordImageUsage(c, km, modelName, apiKey, images)
+					}
+					return
+				}
 
-				// Stream the response to the client
-				_, err := io.Copy(c.Writer, teeReader)
+				// Stream the response to the client as it arrives while decoding it for
+				// token counting. Works for single responses, JSON array streams and SSE (alt=sse).
+				usage := newUsageSniffer(geminiUsageTokens)
+				_, err := copyFlushing(c.Writer, io.TeeReader(resp.Body, usage))
 				if err != nil {
 					log.Printf("Error streaming response to client: %v", err)
 					// Don't return here, still try to record usage
 				}
 
-				// Now, process the captured response
-				// Note: For streaming responses, the full JSON might be a series of JSON objects.
-				// This simple Unmarshal will only get the last one if it's a stream of concatenated JSONs.
-				// A more robust solution would be to parse the stream properly.
-				// However, for Gemini, the usage data is usually at the end.
-				var geminiResp GeminiResponse
-				if err := json.Unmarshal(respBodyBuffer.Bytes(), &geminiResp); err == nil {
-					km.RecordUsage(modelName, apiKey, geminiResp.UsageMetadata.TotalTokenCount)
-				} else {
-					// It might be a streaming response with multiple JSON objects
-					// Try to find the usage data in the raw string
-					// This is a fallback and might not be perfect
-					content := respBodyBuffer.String()
-					if strings.Contains(content, "usageMetadata") {
-						// A simplified parser to extract totalTokenCount
-						// This is not robust, but a decent fallback.
-						// A proper implementation should handle JSON stream parsing.
-						// Example stream part: ... "usageMetadata": { "promptTokenCount": 1, "candidatesTokenCount": 2, "totalTokenCount": 3 } }
-						re := regexp.MustCompile(`"totalTokenCount":\s*(\d+)`)
-						matches := re.FindStringSubmatch(content)
-						if len(matches) > 1 {
-							if tokenCount, err := strconv.Atoi(matches[1]); err == nil {
-								km.RecordUsage(modelName, apiKey, tokenCount)
-							}
-						}
-					}
+				if metadata, ok := usage.Total(); ok {
+					recordUsage(c, km, modelName, apiKey, metadata)
+				} else if embedTokens > 0 {
+					recordUsage(c, km, modelName, apiKey, embedUsage(embedTokens))
+				} else if estimatedTokens > 0 { // Cut off before the usage arrived
+					recordUsage(c, km, modelName, apiKey, estimatedPromptUsage(estimatedTokens))
 				}
 
 				return
 			}
 
-			if resp.StatusCode == http.StatusForbidden { // 403
+			if resp.StatusCode == http.StatusForbidden && pinnedKey == "" { // 403; a pinned key can't be swapped, so pass the error through
+				resp.Body.Close()
 				km.PermanentlyDisableKey(apiKey)
-				log.Printf("Key %s permanently disabled due to 403 Forbidden error.", apiKey[:4])
+				log.Printf("Key %s permanently disabled due to 403 Forbidden error.", keymanager.MaskKey(apiKey))
 				continue // Retry with a new key
 			}
 
 			if resp.StatusCode == http.StatusTooManyRequests {
-				km.HandleRateLimitError(modelName, apiKey)
-				log.Printf("Rate limit hit for model %s with key %s. Retrying...", modelName, apiKey[:4])
+				respBody, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				km.HandleRateLimitError(modelName, apiKey, parseRateLimitError(resp.Header, respBody))
+				log.Printf("Rate limit hit for model %s with key %s. Retrying...", modelName, keymanager.MaskKey(apiKey))
 				// The key is now flagged. The next call to GetKey will either return the same key with a delay,
 				// or a new key if the current one was disabled after repeated failures.
 				continue
 			}
 
-			if resp.StatusCode == http.StatusServiceUnavailable {
-				log.Printf("Service unavailable (503) for model %s with key %s. Retrying in 5 seconds...", modelName, apiKey[:4])
-				time.Sleep(5 * time.Second)
-				continue // Retry with the same key
+			if retry.Retryable(resp.StatusCode) {
+				resp.Body.Close()
+				wait := retry.Backoff()
+				log.Printf("Upstream returned %d for model %s with key %s. Retrying in %v...", resp.StatusCode, modelName, keymanager.MaskKey(apiKey), wait)
+				time.Sleep(wait)
+				continue
 			}
 
 			// Other errors
@@ -321,12 +567,55 @@ func proxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
 	}
 }
 
+func statusDataHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if sinceParam := c.Query("since"); sinceParam != "" {
+			since, err := strconv.ParseInt(sinceParam, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'since' parameter, expected a Unix timestamp"})
+				return
+			}
+			c.Header("Cache-Control", "no-cache")
+			c.JSON(http.StatusOK, km.GetStatusDelta(since))
+			return
+		}
+
+		version, modified := km.StatusVersion()
+		// Chart labels and the last-minute windows move with the clock, so the current
+		// minute is part of the tag even when no usage has been recorded.
+		etag := fmt.Sprintf(`"%d-%d"`, version, time.Now().Unix()/60)
+
+		c.Header("ETag", etag)
+		c.Header("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		c.Header("Cache-Control", "no-cache")
+
+		if match := c.GetHeader("If-None-Match"); match != "" {
+			for _, candidate := range strings.Split(match, ",") {
+				candidate = strings.TrimSpace(candidate)
+				if candidate == etag || candidate == "*" {
+					c.Status(http.StatusNotModified)
+					return
+				}
+			}
+		} else if since := c.GetHeader("If-Modified-Since"); since != "" {
+			// HTTP dates have second precision, so compare truncated times.
+			if t, err := http.ParseTime(since); err == nil && !modified.Truncate(time.Second).After(t) && time.Since(t) < time.Minute {
+				c.Status(http.StatusNotModified)
+				return
+			}
+		}
+
+		statusData := km.GetStatus()
+		c.JSON(http.StatusOK, statusData)
+	}
+}
+
 type TestRequest struct {
 	APIKey    string `json:"api_key"`
 	ModelName string `json:"model_name"`
 }
 
-func testKeyHandler(km *KeyManager) gin.HandlerFunc {
+func testKeyHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req TestRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -334,22 +623,9 @@ func testKeyHandler(km *KeyManager) gin.HandlerFunc {
 			return
 		}
 
-		// Construct a minimal request to the Gemini API
-		requestBody := `{
-			"contents": [{"parts":[{"text": "test"}]}]
-		}`
-
-		url := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:generateContent?key=%s", req.ModelName, req.APIKey)
-
-		httpReq, err := http.NewRequest("POST", url, strings.NewReader(requestBody))
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
-			return
-		}
-		httpReq.Header.Set("Content-Type", "application/json")
-
+		upstreamURL := km.UpstreamURL(target, req.APIKey, fmt.Sprintf("/v1beta/models/%s:generateContent", req.ModelName))
 		client := &http.Client{Timeout: 20 * time.Second}
-		resp, err := client.Do(httpReq)
+		resp, err := testKey(c.Request.Context(), client, upstreamURL, req.APIKey)
 		if err != nil {
 			c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Failed to send request to upstream server: %v", err)})
 			return
@@ -361,7 +637,7 @@ func testKeyHandler(km *KeyManager) gin.HandlerFunc {
 	}
 }
 
-func enableModelHandler(km *KeyManager) gin.HandlerFunc {
+func enableModelHandler(km *keymanager.KeyManager) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req TestRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -374,7 +650,59 @@ func enableModelHandler(km *KeyManager) gin.HandlerFunc {
 	}
 }
 
-func openAIProxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
+type ResetQuotasRequest struct {
+	ModelName string `json:"model_name,omitempty"` // Only reset this model
+	APIKey    string `json:"api_key,omitempty"`    // Only reset this key
+}
+
+type resetQuotasResponse struct {
+	Reset     int    `json:"reset"` // Number of key/model pairs reset
+	NextReset string `json:"next_reset"`
+}
+
+func resetQuotasHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ResetQuotasRequest
+		if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		reset, next, err := km.ResetQuotas(req.ModelName, req.APIKey)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, resetQuotasResponse{Reset: reset, NextReset: next.Format("2006-01-02 15:04")})
+	}
+}
+
+// openAIRouteHandler dispatches /v1/* requests. gin cannot register /v1/responses
+// or /v1/messages next to the /v1/*path wildcard, so the Responses and Anthropic
+// Messages APIs are routed here.
+func openAIRouteHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
+	responses := openAIResponsesHandler(km, target)
+	messages := anthropicMessagesHandler(km, target)
+	images := openAIImagesHandler(km, target)
+	embeddings := openAIEmbeddingsHandler(km, target)
+	passthrough := openAIProxyHandler(km, target)
+	return func(c *gin.Context) {
+		switch c.Param("path") {
+		case "/responses":
+			responses(c)
+		case "/images/generations":
+			images(c)
+		case "/embeddings":
+			embeddings(c)
+		case "/messages":
+			messages(c)
+		default:
+			passthrough(c)
+		}
+	}
+}
+
+func openAIProxyHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		body, err := io.ReadAll(c.Request.Body)
 		if err != nil {
@@ -384,7 +712,11 @@ func openAIProxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
 		c.Request.Body = io.NopCloser(bytes.NewBuffer(body)) // Restore for safety/consistency
 
 		var bodyJSON struct {
-			Model string `json:"model"`
+			Model         string `json:"model"`
+			Stream        bool   `json:"stream"`
+			StreamOptions *struct {
+				IncludeUsage bool `json:"include_usage"`
+			} `json:"stream_options"`
 		}
 		if err := json.Unmarshal(body, &bodyJSON); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body, cannot parse model name"})
@@ -395,25 +727,63 @@ func openAIProxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Model not specified in request body"})
 			return
 		}
+		if c.Param("path") == "/chat/completions" {
+			if body, err = withOpenAIRequestOverrides(c, km, clientModelName, body); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+				return
+			}
+		}
+		clientBody := body // For the fallback provider
+
+		// Streams only report usage when asked to. Ask on the client's behalf and
+		// hide the extra usage chunk from clients that didn't.
+		hideUsageChunk := false
+		if bodyJSON.Stream && (bodyJSON.StreamOptions == nil || !bodyJSON.StreamOptions.IncludeUsage) {
+			if body, err = withStreamUsage(body); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+				return
+			}
+			hideUsageChunk = true
+		}
 
 		var apiKey string
 		var returnedModelName string
 		var delay time.Duration
 		var initialModelName = clientModelName
+		cacheAction := ""
+		if !bodyJSON.Stream && c.Param("path") == "/chat/completions" {
+			cacheAction = "chat/completions"
+			if serveCachedResponse(c, km, initialModelName, cacheAction, body) {
+				return
+			}
+		}
+		estimatedTokens := requestTokenEstimate(c, km, target, initialModelName, nil)
+		if estimatedTokens == 0 && c.Param("path") == "/chat/completions" && km.LocalTokenEstimation() {
+			estimatedTokens = estimateRequestTokens(body)
+		}
+		if err := km.CheckTokenEstimate(initialModelName, estimatedTokens); err != nil {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
 
 		// Get the initial key
-		apiKey, returnedModelName, delay, err = km.GetKey(initialModelName)
+		apiKey, returnedModelName, delay, err = km.WaitForKey(c.Request.Context(), initialModelName, estimatedTokens)
 		if err != nil {
-			c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Failed to get initial API key: %v", err)})
+			if !forwardToFallbackProvider(c, km, clientBody, err) {
+				openAINoKeyError(c, "Failed to get initial API key", err)
+			}
 			return
 		}
 
-		for i := 0; i < 5; i++ { // Retry loop
+		retry := km.NewRetryPolicy()
+		for i := 0; retry.Next(); i++ { // Retry loop
 			// On subsequent retries, we might need a new key if the current one was disabled.
 			if i > 0 {
-				apiKey, returnedModelName, delay, err = km.GetKey(initialModelName)
+				apiKey, returnedModelName, delay, err = km.WaitForKey(c.Request.Context(), initialModelName, estimatedTokens)
 				if err != nil {
-					c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Failed to get API key for retry: %v", err)})
+					if !forwardToFallbackProvider(c, km, clientBody, err) {
+						openAINoKeyError(c, "Failed to get API key for retry", err)
+					}
 					return
 				}
 			}
@@ -426,27 +796,37 @@ func openAIProxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
 			originalPath := c.Param("path")
 			path := "/v1beta/openai" + originalPath
 
+			// A fallback or routed model was picked, the body must ask for it too
+			requestBody := body
+			if returnedModelName != clientModelName && (km.HasModel(clientModelName) || keymanager.RoutedModel(c.Request.Context()) != "") {
+				if requestBody, err = withModel(body, returnedModelName); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+					return
+				}
+			}
+
 			// Create new request
-			proxyReq, err := http.NewRequest(c.Request.Method, c.Request.URL.String(), bytes.NewBuffer(body))
+			proxyReq, err := http.NewRequest(c.Request.Method, c.Request.URL.String(), bytes.NewBuffer(requestBody))
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create proxy request"})
 				return
 			}
 
-			proxyReq.Header = c.Request.Header
-			proxyReq.URL.Scheme = target.Scheme
-			proxyReq.URL.Host = target.Host
-			proxyReq.URL.Path = path
-			proxyReq.ContentLength = int64(len(body))
-
-			// Add API key
-			q := proxyReq.URL.Query()
-			q.Set("key", apiKey)
-			proxyReq.URL.RawQuery = q.Encode()
+			proxyReq.Header = km.ForwardHeaders(c.Request.Header)
+			upstreamURL := km.UpstreamURLFor(c.Request.Context(), target, apiKey, path)
+			proxyReq.URL.Scheme = upstreamURL.Scheme
+			proxyReq.URL.Host = upstreamURL.Host
+			proxyReq.URL.Path = upstreamURL.Path
+			proxyReq.ContentLength = int64(len(requestBody))
 
 			// Send request
-			client := &http.Client{}
-			resp, err := client.Do(proxyReq)
+			client := km.UpstreamClient()
+			var resp *http.Response
+			if cacheAction != "" { // Non-streaming chat completions
+				resp, apiKey, err = sendHedged(c, km, client, proxyReq, requestBody, target, path, returnedModelName, apiKey, estimatedTokens)
+			} else {
+				resp, err = sendUpstream(c, km, client, proxyReq, returnedModelName, apiKey)
+			}
 			if err != nil {
 				c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send request to upstream server"})
 				return
@@ -455,57 +835,57 @@ func openAIProxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
 
 			// Handle response
 			if resp.StatusCode == http.StatusOK {
+				if cacheAction != "" {
+					cacheResponseBody(c, km, initialModelName, cacheAction, body, resp)
+				}
 				for k, v := range resp.Header {
 					c.Writer.Header()[k] = v
 				}
 				c.Writer.WriteHeader(resp.StatusCode)
 
-				var respBodyBuffer bytes.Buffer
-				teeReader := io.TeeReader(resp.Body, &respBodyBuffer)
-
-				_, err := io.Copy(c.Writer, teeReader)
+				usage := newUsageSniffer(openAIUsageTokens)
+				if hideUsageChunk {
+					filter := newSSEFilter(c.Writer, openAIUsageOnlyChunk)
+					_, err = io.Copy(filter, io.TeeReader(resp.Body, usage))
+					filter.Close()
+				} else {
+					_, err = copyFlushing(c.Writer, io.TeeReader(resp.Body, usage))
+				}
 				if err != nil {
 					log.Printf("Error streaming response to client: %v", err)
 				}
 
-				var openAIResp OpenAIResponse
-				if err := json.Unmarshal(respBodyBuffer.Bytes(), &openAIResp); err == nil {
-					if openAIResp.Usage.TotalTokens > 0 {
-						km.RecordUsage(returnedModelName, apiKey, openAIResp.Usage.TotalTokens)
-					}
-				} else {
-					content := respBodyBuffer.String()
-					if strings.Contains(content, `"usage"`) {
-						re := regexp.MustCompile(`"total_tokens":\s*(\d+)`)
-						matches := re.FindStringSubmatch(content)
-						if len(matches) > 1 {
-							if tokenCount, err := strconv.Atoi(matches[1]); err == nil {
-								km.RecordUsage(returnedModelName, apiKey, tokenCount)
-							}
-						}
-					}
+				if metadata, ok := usage.Total(); ok {
+					recordUsage(c, km, returnedModelName, apiKey, metadata)
+				} else if estimatedTokens > 0 && c.Param("path") == "/chat/completions" { // Cut off before the usage arrived
+					recordUsage(c, km, returnedModelName, apiKey, estimatedPromptUsage(estimatedTokens))
 				}
 				return
 			}
 
 			if resp.StatusCode == http.StatusForbidden { // 403
+				resp.Body.Close()
 				km.PermanentlyDisableKey(apiKey)
-				log.Printf("Key %s permanently disabled due to 403 Forbidden error (OpenAI Proxy).", apiKey[:4])
+				log.Printf("Key %s permanently disabled due to 403 Forbidden error (OpenAI Proxy).", keymanager.MaskKey(apiKey))
 				continue // Retry with a new key
 			}
 
 			if resp.StatusCode == http.StatusTooManyRequests {
-				km.HandleRateLimitError(returnedModelName, apiKey)
-				log.Printf("Rate limit hit for model %s with key %s. Retrying...", returnedModelName, apiKey[:4])
+				respBody, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				km.HandleRateLimitError(returnedModelName, apiKey, parseRateLimitError(resp.Header, respBody))
+				log.Printf("Rate limit hit for model %s with key %s. Retrying...", returnedModelName, keymanager.MaskKey(apiKey))
 				// The key is now flagged. The next call to GetKey will either return the same key with a delay,
 				// or a new key if the current one was disabled after repeated failures.
 				continue
 			}
 
-			if resp.StatusCode == http.StatusServiceUnavailable {
-				log.Printf("Service unavailable (503) for model %s with key %s. Retrying in 5 seconds...", returnedModelName, apiKey[:4])
-				time.Sleep(5 * time.Second)
-				continue // Retry with the same key
+			if retry.Retryable(resp.StatusCode) {
+				resp.Body.Close()
+				wait := retry.Backoff()
+				log.Printf("Upstream returned %d for model %s with key %s. Retrying in %v...", resp.StatusCode, returnedModelName, keymanager.MaskKey(apiKey), wait)
+				time.Sleep(wait)
+				continue
 			}
 
 			// Other errors
@@ -519,7 +899,72 @@ func openAIProxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
 	}
 }
 
-func ollamaProxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
+// withStreamUsage sets stream_options.include_usage in an OpenAI request body,
+// keeping every other field as sent.
+func withStreamUsage(body []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	options := make(map[string]any)
+	if raw, ok := fields["stream_options"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &options); err != nil {
+			return nil, err
+		}
+	}
+	options["include_usage"] = true
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	fields["stream_options"] = encoded
+	return json.Marshal(fields)
+}
+
+// withModel replaces the model of an OpenAI request body.
+func withModel(body []byte, model string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	fields["model"] = encoded
+	return json.Marshal(fields)
+}
+
+// ollamaChatResponse translates a complete Gemini response. Only the first
+// candidate is used, Ollama has no notion of several choices.
+func ollamaChatResponse(model string, geminiResp *GeminiResponse, elapsed time.Duration) OllamaChatResponse {
+	resp := OllamaChatResponse{
+		Model:           model,
+		CreatedAt:       time.Now(),
+		Done:            true,
+		TotalDuration:   elapsed.Nanoseconds(),
+		PromptEvalCount: geminiResp.UsageMetadata.PromptTokenCount,
+		EvalCount:       geminiResp.UsageMetadata.CandidatesTokenCount,
+	}
+	resp.Message.Role = "assistant"
+
+	if len(geminiResp.Candidates) > 0 {
+		candidate := geminiResp.Candidates[0]
+		resp.Message = ollamaAssistantMessage(candidate.Content.Parts)
+		switch candidate.FinishReason {
+		case "STOP":
+			resp.DoneReason = "stop"
+		case "MAX_TOKENS":
+			resp.DoneReason = "length"
+		case "":
+		default:
+			resp.DoneReason = strings.ToLower(candidate.FinishReason)
+		}
+	}
+	return resp
+}
+
+func ollamaProxyHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		bodyBytes, err := io.ReadAll(c.Request.Body)
 		if err != nil {
@@ -542,44 +987,68 @@ func ollamaProxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
 		}
 
 		// Translate Ollama request to Gemini request
-		geminiReq := GeminiRequest{
-			Contents: []struct {
-				Role  string `json:"role"`
-				Parts []struct {
-					Text string `json:"text"`
-				} `json:"parts"`
-			}{},
-		}
+		geminiReq := GeminiRequest{Contents: []GeminiContent{}}
 
 		// Translate and merge messages
+		var pendingCalls []string // Functions called by the last assistant message, for tool messages without tool_name
+		var systemParts []GeminiPart
 		for _, msg := range ollamaReq.Messages {
+			if msg.Role == "system" {
+				systemParts = append(systemParts, GeminiPart{Text: msg.Content})
+				continue
+			}
 			role := msg.Role
 			if role == "assistant" {
 				role = "model"
-			} else if role == "system" {
-				// Gemini API expects alternating user/model roles, so we'll treat the system role as a user role.
+			} else if role == "tool" {
+				// Function responses are sent by the user
 				role = "user"
 			}
+			var parts []GeminiPart
+			if msg.Role == "tool" {
+				name := msg.ToolName
+				if name == "" && len(pendingCalls) > 0 {
+					name = pendingCalls[0]
+				}
+				if len(pendingCalls) > 0 {
+					pendingCalls = pendingCalls[1:]
+				}
+				parts = append(parts, GeminiPart{FunctionResponse: &GeminiFunctionResponse{Name: name, Response: map[string]any{"content": msg.Content}}})
+			} else if msg.Content != "" || (len(msg.Images) == 0 && len(msg.ToolCalls) == 0) {
+				parts = append(parts, GeminiPart{Text: msg.Content})
+			}
+			if len(msg.ToolCalls) > 0 {
+				pendingCalls = nil
+			}
+			for _, call := range msg.ToolCalls {
+				parts = append(parts, GeminiPart{FunctionCall: &GeminiFunctionCall{Name: call.Function.Name, Args: call.Function.Arguments}})
+				pendingCalls = append(pendingCalls, call.Function.Name)
+			}
+			for _, image := range msg.Images {
+				part, err := ollamaImagePart(image)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				parts = append(parts, part)
+			}
 			// Gemini API requires alternating roles (user, model, user, model...)
 			// We merge consecutive messages from the same role.
 			if len(geminiReq.Contents) > 0 && geminiReq.Contents[len(geminiReq.Contents)-1].Role == role {
-				// Merge with the previous message
+				// Merge with the previous message, joining text with the previous text part
 				lastContent := &geminiReq.Contents[len(geminiReq.Contents)-1]
-				lastContent.Parts[0].Text += "\n" + msg.Content
+				lastPart := &lastContent.Parts[len(lastContent.Parts)-1]
+				if isTextPart(parts[0]) && isTextPart(*lastPart) {
+					lastPart.Text += "\n" + parts[0].Text
+					parts = parts[1:]
+				}
+				lastContent.Parts = append(lastContent.Parts, parts...)
 			} else {
 				// Add a new message
-				newContent := struct {
-					Role  string `json:"role"`
-					Parts []struct {
-						Text string `json:"text"`
-					} `json:"parts"`
-				}{
-					Role: role,
-					Parts: []struct {
-						Text string `json:"text"`
-					}{{Text: msg.Content}},
-				}
-				geminiReq.Contents = append(geminiReq.Contents, newContent)
+				geminiReq.Contents = append(geminiReq.Contents, GeminiContent{
+					Role:  role,
+					Parts: parts,
+				})
 			}
 		}
 
@@ -593,14 +1062,42 @@ func ollamaProxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: No user messages found after processing."})
 			return
 		}
+		if len(systemParts) > 0 {
+			geminiReq.SystemInstruction = &GeminiContent{Parts: systemParts}
+		}
+		geminiReq.Tools = ollamaTools(ollamaReq.Tools)
+		geminiReq.GenerationConfig, err = withOllamaFormat(ollamaReq.Options.generationConfig(), ollamaReq.Format)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
 		var apiKey, modelName string
 		var delay time.Duration
+		start := time.Now()
 
-		for i := 0; i < 5; i++ { // Retry loop
+		// Marshal the new Gemini request body
+		geminiBody, err := json.Marshal(geminiReq)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal Gemini request body"})
+			return
+		}
+		if geminiBody, err = withRequestOverrides(c, km, ollamaReq.Model, geminiBody); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal Gemini request body"})
+			return
+		}
+		estimatedTokens := requestTokenEstimate(c, km, target, ollamaReq.Model, geminiBody)
+		if err := km.CheckTokenEstimate(ollamaReq.Model, estimatedTokens); err != nil {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+
+		retry := km.NewRetryPolicy()
+		for retry.Next() { // Retry loop
 			// Get API key
-			apiKey, modelName, delay, err = km.GetKey(ollamaReq.Model)
+			apiKey, modelName, delay, err = km.WaitForKey(c.Request.Context(), ollamaReq.Model, estimatedTokens)
 			if err != nil {
+				setRetryAfter(c, err)
 				c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Failed to get API key: %v", err)})
 				return
 			}
@@ -610,13 +1107,6 @@ func ollamaProxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
 				time.Sleep(delay)
 			}
 
-			// Marshal the new Gemini request body
-			geminiBody, err := json.Marshal(geminiReq)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal Gemini request body"})
-				return
-			}
-
 			// Determine if streaming is requested
 			isStreaming := ollamaReq.Stream != nil && *ollamaReq.Stream
 
@@ -627,11 +1117,10 @@ func ollamaProxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
 
 			// Construct the upstream URL
 			path := fmt.Sprintf("/v1beta/models/%s:%s", modelName, action)
-			upstreamURL := *target
-			upstreamURL.Path = path
-			q := upstreamURL.Query()
-			q.Set("key", apiKey)
-			upstreamURL.RawQuery = q.Encode()
+			upstreamURL := km.UpstreamURLFor(c.Request.Context(), target, apiKey, path)
+			if isStreaming {
+				upstreamURL.RawQuery = "alt=sse" // Server-sent events instead of a JSON array
+			}
 
 			// Create the request to the upstream server
 			proxyReq, err := http.NewRequest(c.Request.Method, upstreamURL.String(), bytes.NewBuffer(geminiBody))
@@ -640,12 +1129,11 @@ func ollamaProxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
 				return
 			}
 
-			proxyReq.Header.Set("Content-Type", "application/json")
-			proxyReq.Header.Set("Accept", "application/json")
+			proxyReq.Header = km.ForwardHeaders(http.Header{"Content-Type": {"application/json"}, "Accept": {"application/json"}})
 
 			// Send the request
-			client := &http.Client{}
-			resp, err := client.Do(proxyReq)
+			client := km.UpstreamClient()
+			resp, err := sendUpstream(c, km, client, proxyReq, modelName, apiKey)
 			if err != nil {
 				c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send request to upstream server"})
 				return
@@ -653,103 +1141,103 @@ func ollamaProxyHandler(km *KeyManager, target *url.URL) gin.HandlerFunc {
 			defer resp.Body.Close()
 
 			if resp.StatusCode == http.StatusOK {
-				// Set headers for streaming
-				c.Writer.Header().Set("Content-Type", "application/x-ndjson")
-				c.Writer.Header().Set("Cache-Control", "no-cache")
-				c.Writer.Header().Set("Connection", "keep-alive")
-				c.Writer.WriteHeader(resp.StatusCode)
-
 				if isStreaming {
-					// Handle streaming response by reading all at once, then processing.
-					body, err := io.ReadAll(resp.Body)
-					if err != nil {
-						log.Printf("Ollama proxy: failed to read streaming response body: %v", err)
-						// We can't send a JSON error because headers are already written.
-						return
-					}
-
-					lines := strings.Split(string(body), "\n")
-					for _, line := range lines {
-						if strings.HasPrefix(line, "data: ") {
-							jsonData := strings.TrimPrefix(line, "data: ")
-							if len(strings.TrimSpace(jsonData)) == 0 {
-								continue
+					c.Writer.Header().Set("Content-Type", "application/x-ndjson")
+					c.Writer.Header().Set("Cache-Control", "no-cache")
+					c.Writer.Header().Set("Connection", "keep-alive")
+					c.Writer.WriteHeader(resp.StatusCode)
+
+					// Translate each event as it arrives. Every chunk carries the usage so far.
+					var usage keymanager.GeminiUsageMetadata
+					var output strings.Builder
+					events := newSSEReader(resp.Body)
+					for {
+						event, err := events.Next()
+						if err != nil {
+							if err != io.EOF {
+								// We can't send a JSON error because headers are already written.
+								log.Printf("Ollama proxy: failed to read streaming response body: %v", err)
 							}
-							var geminiChunk struct {
-								Candidates []struct {
-									Content struct {
-										Parts []struct {
-											Text string `json:"text"`
-										} `json:"parts"`
-									} `json:"content"`
-								} `json:"candidates"`
+							break
+						}
+						var geminiChunk GeminiResponse
+						if err := json.Unmarshal(event.Data, &geminiChunk); err == nil {
+							if geminiChunk.UsageMetadata.TotalTokenCount > 0 {
+								usage = geminiChunk.UsageMetadata
 							}
-							if err := json.Unmarshal([]byte(jsonData), &geminiChunk); err == nil {
-								if len(geminiChunk.Candidates) > 0 && len(geminiChunk.Candidates[0].Content.Parts) > 0 {
-									responseText := geminiChunk.Candidates[0].Content.Parts[0].Text
-									ollamaResp := OllamaStreamResponse{
-										Model:     ollamaReq.Model,
-										CreatedAt: time.Now(),
-										Response:  responseText,
-										Done:      false,
-									}
-									jsonResp, _ := json.Marshal(ollamaResp)
-									fmt.Fprintln(c.Writer, string(jsonResp))
-									c.Writer.Flush()
+							if len(geminiChunk.Candidates) > 0 && len(geminiChunk.Candidates[0].Content.Parts) > 0 {
+								message := ollamaAssistantMessage(geminiChunk.Candidates[0].Content.Parts)
+								output.WriteString(message.Content)
+								ollamaResp := OllamaStreamResponse{
+									Model:     ollamaReq.Model,
+									CreatedAt: time.Now(),
+									Response:  message.Content,
+									Message:   &message,
+									Done:      false,
 								}
+								jsonResp, _ := json.Marshal(ollamaResp)
+								fmt.Fprintln(c.Writer, string(jsonResp))
+								c.Writer.Flush()
 							}
 						}
 					}
+					// A stream cut short may have reported no usage, so it is estimated from the text
+					if usage.TotalTokenCount == 0 {
+						usage = estimatedUsage(&geminiReq, output.String())
+					}
+					recordUsage(c, km, modelName, apiKey, usage)
+
 					// Send final done message
 					ollamaResp := OllamaStreamResponse{
-						Model:     ollamaReq.Model,
-						CreatedAt: time.Now(),
-						Response:  "",
-						Done:      true,
+						Model:           ollamaReq.Model,
+						CreatedAt:       time.Now(),
+						Response:        "",
+						Message:         &OllamaMessage{Role: "assistant"},
+						Done:            true,
+						TotalDuration:   time.Since(start).Nanoseconds(),
+						PromptEvalCount: usage.PromptTokenCount,
+						EvalCount:       usage.CandidatesTokenCount,
 					}
 					jsonResp, _ := json.Marshal(ollamaResp)
 					fmt.Fprintln(c.Writer, string(jsonResp))
 					c.Writer.Flush()
 				} else {
 					// Handle non-streaming response
-					body, _ := io.ReadAll(resp.Body)
+					body := getBuffer()
+					body.ReadFrom(resp.Body)
 					var geminiResp GeminiResponse
-					if err := json.Unmarshal(body, &geminiResp); err == nil {
-						km.RecordUsage(modelName, apiKey, geminiResp.UsageMetadata.TotalTokenCount)
-						// Translate to Ollama format
-						var fullText strings.Builder
-						// for _, cand := range geminiResp.Candidates {
-						// 	// For simplicity, we'll just concatenate the text from all parts and candidates.
-						// 	// A more sophisticated approach might handle different candidate choices.
-						// 	// fullText.WriteString(cand.Content.Parts[0].Text)
-						// }
-						// Create a single response object that mimics Ollama's non-streaming response.
-						// This part is complex and depends on the exact format expected by the client.
-						// We'll send a simplified response for now.
-						c.JSON(http.StatusOK, gin.H{"model": ollamaReq.Model, "response": fullText.String(), "done": true})
+					if err := json.Unmarshal(body.Bytes(), &geminiResp); err == nil {
+						recordUsage(c, km, modelName, apiKey, geminiResp.UsageMetadata)
+						c.JSON(http.StatusOK, ollamaChatResponse(ollamaReq.Model, &geminiResp, time.Since(start)))
 					} else {
-						c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), body)
+						c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), body.Bytes())
 					}
+					putBuffer(body)
 				}
 				return // Success, exit loop
 			}
 
 			if resp.StatusCode == http.StatusForbidden { // 403
+				resp.Body.Close()
 				km.PermanentlyDisableKey(apiKey)
-				log.Printf("Key %s permanently disabled due to 403 Forbidden error (Ollama Proxy).", apiKey[:4])
+				log.Printf("Key %s permanently disabled due to 403 Forbidden error (Ollama Proxy).", keymanager.MaskKey(apiKey))
 				continue // Retry with a new key
 			}
 
 			if resp.StatusCode == http.StatusTooManyRequests {
-				km.HandleRateLimitError(modelName, apiKey)
-				log.Printf("Ollama proxy: Rate limit hit for model %s with key %s. Retrying...", modelName, apiKey[:4])
+				respBody, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				km.HandleRateLimitError(modelName, apiKey, parseRateLimitError(resp.Header, respBody))
+				log.Printf("Ollama proxy: Rate limit hit for model %s with key %s. Retrying...", modelName, keymanager.MaskKey(apiKey))
 				continue // Retry with a new key
 			}
 
-			if resp.StatusCode == http.StatusServiceUnavailable {
-				log.Printf("Ollama proxy: Service unavailable (503) for model %s with key %s. Retrying in 5 seconds...", modelName, apiKey[:4])
-				time.Sleep(5 * time.Second)
-				continue // Retry with the same key
+			if retry.Retryable(resp.StatusCode) {
+				resp.Body.Close()
+				wait := retry.Backoff()
+				log.Printf("Ollama proxy: Upstream returned %d for model %s with key %s. Retrying in %v...", resp.StatusCode, modelName, keymanager.MaskKey(apiKey), wait)
+				time.Sleep(wait)
+				continue
 			}
 
 			// Other errors
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+)
+
+const benchMutexWaitMetric = "/sync/mutex/wait/total:seconds"
+
+// runBench runs the proxy against an in-process mock upstream and reports
+// throughput, key selection latency, allocation rates and lock contention.
+// Nothing is persisted.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	concurrency := fs.Int("concurrency", 16, "number of concurrent clients")
+	requests := fs.Int("requests", 5000, "total number of requests to send")
+	numKeys := fs.Int("keys", 10, "number of fake API keys in the pool")
+	stream := fs.Bool("stream", false, "use streamGenerateContent instead of generateContent")
+	tokens := fs.Int("tokens", 100, "totalTokenCount reported by the mock upstream per request")
+	promptBytes := fs.Int("prompt-bytes", 9, "size of the prompt text sent with each request")
+	responseBytes := fs.Int("response-bytes", 2, "size of the text in each mock upstream response")
+	tpmLimit := fs.Int("tpm", 0, "TPM limit per key, 0 for none; with limits, requests wait in the queue for a key")
+	rpmLimit := fs.Int("rpm", 0, "RPM limit per key, 0 for none")
+	fs.Parse(args)
+
+	if *concurrency < 1 || *requests < 1 || *numKeys < 1 {
+		fmt.Fprintln(os.Stderr, "concurrency, requests and keys must be positive")
+		os.Exit(2)
+	}
+	if *promptBytes < 0 || *responseBytes < 0 || *tpmLimit < 0 || *rpmLimit < 0 {
+		fmt.Fprintln(os.Stderr, "prompt-bytes, response-bytes, tpm and rpm can't be negative")
+		os.Exit(2)
+	}
+
+	// The key manager logs on every state change; keep the report readable.
+	log.SetOutput(io.Discard)
+
+	upstream := httptest.NewServer(mockUpstreamHandler(*tokens, *responseBytes))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	const modelName = "bench-model"
+	model := keymanager.LanguageModel{ModelName: modelName, TpmLimit: 1 << 50, RpmLimit: *rpmLimit} // By default GetKey never introduces a delay
+	if *tpmLimit > 0 {
+		model.TpmLimit = *tpmLimit
+	}
+	config := &keymanager.Config{
+		Models:                 map[string]keymanager.LanguageModel{modelName: model},
+		ResetAfter:             "00:00",
+		NextQuotaResetDatetime: time.Now().AddDate(1, 0, 0).Format("2006-01-02 15:04"),
+		Timezone:               "UTC",
+		DefaultModel:           modelName,
+	}
+	if *tpmLimit > 0 || *rpmLimit > 0 {
+		config.Queue = &keymanager.QueueConfig{MaxQueueWait: 300, MaxQueued: *concurrency}
+	}
+	for i := 0; i < *numKeys; i++ {
+		config.PriorityKeys = append(config.PriorityKeys, fmt.Sprintf("bench-key-%04d", i))
+	}
+	km, err := keymanager.New(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create key manager: %v\n", err)
+		os.Exit(1)
+	}
+	defer km.Stop()
+	var selectionMutex sync.Mutex
+	selections := make([]time.Duration, 0, *requests)
+	delays := make([]time.Duration, 0, *requests)
+	km.ObserveKeySelection(func(took, delay time.Duration) {
+		selectionMutex.Lock()
+		selections = append(selections, took)
+		delays = append(delays, delay)
+		selectionMutex.Unlock()
+	})
+
+	proxy := httptest.NewServer(newRouter(km, target))
+	defer proxy.Close()
+
+	action := "generateContent"
+	if *stream {
+		action = "streamGenerateContent"
+	}
+	endpoint := fmt.Sprintf("%s/v1beta/models/%s:%s", proxy.URL, modelName, action)
+	body := []byte(fmt.Sprintf(`{"contents":[{"role":"user","parts":[{"text":%q}]}]}`, benchText(*promptBytes)))
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency}}
+
+	fmt.Printf("Benchmarking %d requests, concurrency %d, %d keys, action %s, %d-byte requests\n", *requests, *concurrency, *numKeys, action, len(body))
+
+	runtime.GC()
+	var memBefore, memAfter runtime.MemStats
+	runtime.ReadMemStats(&memBefore)
+	mutexWaitBefore := readMutexWait()
+
+	var next, failures int64
+	latencies := make([]time.Duration, *requests)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := atomic.AddInt64(&next, 1) - 1
+				if i >= int64(*requests) {
+					return
+				}
+				reqStart := time.Now()
+				resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+				if err != nil {
+					atomic.AddInt64(&failures, 1)
+					continue
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					atomic.AddInt64(&failures, 1)
+				}
+				latencies[i] = time.Since(reqStart)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	runtime.ReadMemStats(&memAfter)
+	mutexWait := readMutexWait() - mutexWaitBefore
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(float64(len(latencies)-1)*p)]
+	}
+	selectionMutex.Lock()
+	sort.Slice(selections, func(i, j int) bool { return selections[i] < selections[j] })
+	sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+	selectionMutex.Unlock()
+	durationPercentile := func(sorted []time.Duration, p float64) time.Duration {
+		if len(sorted) == 0 {
+			return 0
+		}
+		return sorted[int(float64(len(sorted)-1)*p)].Round(time.Microsecond)
+	}
+	delayed := 0
+	for _, d := range delays {
+		if d > 0 {
+			delayed++
+		}
+	}
+
+	n := float64(*requests)
+	fmt.Printf("\nRequests:        %d (%d failed)\n", *requests, failures)
+	fmt.Printf("Elapsed:         %v\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("Throughput:      %.1f req/s\n", n/elapsed.Seconds())
+	fmt.Printf("Latency:         p50 %v, p95 %v, p99 %v, max %v\n",
+		percentile(0.50).Round(time.Microsecond), percentile(0.95).Round(time.Microsecond),
+		percentile(0.99).Round(time.Microsecond), latencies[len(latencies)-1].Round(time.Microsecond))
+	fmt.Printf("Key selection:   p50 %v, p95 %v, p99 %v, max %v (%d selections, including queueing)\n",
+		durationPercentile(selections, 0.50), durationPercentile(selections, 0.95),
+		durationPercentile(selections, 0.99), durationPercentile(selections, 1), len(selections))
+	fmt.Printf("Scheduled delay: p50 %v, p95 %v, max %v (%d of %d selections delayed)\n",
+		durationPercentile(delays, 0.50), durationPercentile(delays, 0.95), durationPercentile(delays, 1), delayed, len(delays))
+	fmt.Printf("Allocations:     %.0f allocs/req, %.1f KB/req (includes client and mock upstream)\n",
+		float64(memAfter.Mallocs-memBefore.Mallocs)/n, float64(memAfter.TotalAlloc-memBefore.TotalAlloc)/n/1024)
+	fmt.Printf("GC cycles:       %d\n", memAfter.NumGC-memBefore.NumGC)
+	fmt.Printf("Mutex wait:      %v total, %v/req\n",
+		time.Duration(mutexWait*float64(time.Second)).Round(time.Microsecond),
+		time.Duration(mutexWait*float64(time.Second)/n).Round(time.Nanosecond))
+
+	status := km.GetStatus()
+	fmt.Printf("Tokens recorded: %d\n", status.GrandTotalTokens)
+}
+
+func readMutexWait() float64 {
+	sample := []metrics.Sample{{Name: benchMutexWaitMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindFloat64 {
+		return 0
+	}
+	return sample[0].Value.Float64()
+}
+
+// benchText returns n bytes of filler text.
+func benchText(n int) string {
+	return strings.Repeat("benchmark ", n/10+1)[:n]
+}
+
+// mockUpstreamHandler imitates the Gemini generateContent and streamGenerateContent
+// endpoints, answering with textBytes of text.
+func mockUpstreamHandler(totalTokens, textBytes int) http.Handler {
+	single := fmt.Sprintf(`{"candidates":[{"content":{"parts":[{"text":%q}],"role":"model"},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":%d,"candidatesTokenCount":%d,"totalTokenCount":%d}}`,
+		benchText(textBytes), totalTokens/2, totalTokens-totalTokens/2, totalTokens)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if bytes.HasSuffix([]byte(r.URL.Path), []byte(":streamGenerateContent")) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintf(w, "data: %s\r\n\r\n", `{"candidates":[{"content":{"parts":[{"text":"o"}],"role":"model"}}]}`)
+			fmt.Fprintf(w, "data: %s\r\n\r\n", single)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		io.WriteString(w, single)
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// requestBodyLimit answers 413 for request bodies over the limit before any
+// handler reads them. A body without Content-Length is read up to the limit here.
+func requestBodyLimit(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body == nil || c.Request.Body == http.NoBody || strings.HasPrefix(c.Request.URL.Path, "/upload/") {
+			c.Next()
+			return
+		}
+		limit := km.MaxRequestBodyBytes()
+		tooLarge := func() {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Request body is larger than %d bytes", limit)})
+		}
+		if c.Request.ContentLength > limit {
+			tooLarge()
+			return
+		}
+		if c.Request.ContentLength < 0 {
+			body, err := io.ReadAll(io.LimitReader(c.Request.Body, limit+1))
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+				return
+			}
+			if int64(len(body)) > limit {
+				tooLarge()
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+			c.Request.ContentLength = int64(len(body))
+		}
+		c.Next()
+	}
+}
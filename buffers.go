@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Response bodies pass through the proxy in 32 KB chunks, and bodies that have
+// to be inspected whole are read into buffers; both are pooled so a busy proxy
+// doesn't allocate them again for every request.
+
+var copyBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, 32*1024)
+	return &buf
+}}
+
+var bodyBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// Buffers that grew larger than this, for an unusually large body, are left to
+// the garbage collector instead of being kept in the pool.
+const maxPooledBufferSize = 1 << 20
+
+// getBuffer returns an empty buffer from the pool. It must not be used after
+// putBuffer.
+func getBuffer() *bytes.Buffer {
+	return bodyBuffers.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	bodyBuffers.Put(buf)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// With allow_client_gemini_keys, clients may bring their own Gemini key (BYOK).
+// Requests to the native Gemini endpoints that carry one, where a client key
+// would go, are forwarded with it as they are: no key is taken from the rotation
+// and nothing counts against the configured keys' quotas or the client key
+// limits. The request history still lists them, under the client's key.
+
+// isGeminiAPIKey reports whether a client token looks like a Google API key.
+func isGeminiAPIKey(token string) bool {
+	return len(token) == 39 && strings.HasPrefix(token, "AIza")
+}
+
+// isNativeGeminiPath reports whether a path is a Gemini API endpoint that can
+// be forwarded without translation.
+func isNativeGeminiPath(path string) bool {
+	return strings.HasPrefix(path, "/v1beta/") || strings.HasPrefix(path, "/upload/v1beta/")
+}
+
+// byokPassthrough forwards native Gemini requests that carry the client's own
+// Gemini key and ends the chain; everything else goes on to clientKeyAuth.
+func byokPassthrough(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		enabled := km.Config().AllowClientGeminiKeys
+		token := clientToken(c)
+		if !enabled || !isGeminiAPIKey(token) || !isNativeGeminiPath(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		upstreamURL := km.UpstreamURL(target, token, c.Request.URL.Path)
+		upstreamURL.RawQuery = c.Request.URL.RawQuery
+		proxyReq, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, upstreamURL.String(), c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to create proxy request"})
+			return
+		}
+		proxyReq.ContentLength = c.Request.ContentLength
+		proxyReq.Header = km.ForwardHeaders(c.Request.Header)
+		keymanager.SetUpstreamKey(proxyReq, token)
+		c.Set("history_model", passthroughModel(km, strings.TrimPrefix(c.Request.URL.Path, "/v1beta")))
+		c.Set("history_key", token)
+
+		resp, err := km.UpstreamClient().Do(proxyReq)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "Failed to send request to upstream server"})
+			return
+		}
+		defer resp.Body.Close()
+
+		for k, v := range resp.Header {
+			c.Writer.Header()[k] = v
+		}
+		c.Writer.WriteHeader(resp.StatusCode)
+		var src io.Reader = resp.Body
+		var usage *usageSniffer
+		contentType := resp.Header.Get("Content-Type")
+		if resp.StatusCode == http.StatusOK && (strings.Contains(contentType, "json") || strings.Contains(contentType, "event-stream")) {
+			usage = newUsageSniffer(geminiUsageTokens)
+			src = io.TeeReader(resp.Body, usage)
+		}
+		if _, err := copyFlushing(c.Writer, src); err != nil {
+			log.Printf("Error streaming response to client: %v", err)
+		}
+		if usage != nil {
+			if metadata, ok := usage.Total(); ok {
+				c.Set("history_tokens", metadata.TotalTokenCount)
+			}
+		}
+		c.Abort()
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+type ClientKeyRequest struct {
+	Name            string `json:"name"`
+	DailyTokenLimit int    `json:"daily_token_limit,omitempty"`
+}
+
+type clientKeysResponse struct {
+	ClientKeys []keymanager.ClientKeyStatus `json:"client_keys"`
+}
+
+// clientKeyAuth rejects proxy requests without a valid client key, or whose
+// client has used up its daily tokens, before an upstream key is picked. It does
+// nothing while no client keys are configured.
+func clientKeyAuth(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(km.Config().ClientKeys) == 0 {
+			c.Next()
+			return
+		}
+		ck, used, ok := km.ClientKey(clientToken(c))
+
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or missing client API key"})
+			return
+		}
+		if ck.DailyTokenLimit > 0 && used >= ck.DailyTokenLimit {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Daily token quota of %d tokens used up for client '%s'", ck.DailyTokenLimit, ck.Name)})
+			return
+		}
+
+		// The client key must not reach Gemini, which only gets the upstream key
+		c.Request.Header.Del("Authorization")
+		c.Request.Header.Del("x-goog-api-key")
+		c.Request.Header.Del("x-api-key")
+		c.Set("client_key", ck.Key)
+		c.Next()
+	}
+}
+
+func listClientKeysHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, clientKeysResponse{ClientKeys: km.ClientKeys()})
+	}
+}
+
+func issueClientKeyHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ClientKeyRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.Name == "" || req.DailyTokenLimit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body, expected {\"name\": \"...\", \"daily_token_limit\": 100000}"})
+			return
+		}
+
+		ck, err := km.IssueClientKey(req.Name, req.DailyTokenLimit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, keymanager.ClientKeyStatus{Key: ck.Key, Name: ck.Name, DailyTokenLimit: ck.DailyTokenLimit})
+	}
+}
+
+func revokeClientKeyHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.Param("key")
+		known, err := km.RevokeClientKey(key)
+		if !known {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Unknown client key '%s'", keymanager.MaskKey(key))})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Client key was revoked but config.json could not be saved: %v", err)})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+func clusterStatusHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		members, owners, ok := km.ClusterStatus()
+		if !ok {
+			c.JSON(http.StatusOK, gin.H{"enabled": false})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"enabled": true,
+			"members": members,
+			"owners":  owners,
+		})
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "io"
+
+// releasingBody gives back a concurrency slot when the response body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "x-goog-api-key", "x-api-key", "anthropic-version", idempotencyKeyHeader, priorityHeader, "X-Goog-Upload-Protocol", "X-Goog-Upload-Command", "X-Goog-Upload-Offset", "X-Goog-Upload-Header-Content-Length", "X-Goog-Upload-Header-Content-Type"}
+	defaultCORSMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+)
+
+// corsMiddleware adds the CORS headers for allowed origins and answers
+// preflight requests itself. Without a cors block it does nothing.
+func corsMiddleware(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		config := km.Config().CORS
+		if origin == "" || config == nil || !config.AllowsOrigin(origin) {
+			c.Next()
+			return
+		}
+
+		header := c.Writer.Header()
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Add("Vary", "Origin")
+		header.Set("Access-Control-Expose-Headers", strings.Join([]string{tokenEstimateHeader, fallbackProviderHeader, "X-Goog-Upload-URL", "X-Goog-Upload-Status", "Retry-After"}, ", "))
+		if c.Request.Method != http.MethodOptions || c.GetHeader("Access-Control-Request-Method") == "" {
+			c.Next()
+			return
+		}
+
+		headers, methods, maxAge := config.AllowedHeaders, config.AllowedMethods, config.MaxAge
+		if len(headers) == 0 {
+			headers = defaultCORSHeaders
+		}
+		if len(methods) == 0 {
+			methods = defaultCORSMethods
+		}
+		if maxAge <= 0 {
+			maxAge = 600
+		}
+		header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		header.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		header.Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
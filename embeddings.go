@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// Gemini embedding requests and responses. Embedding responses carry no
+// usageMetadata, so their tokens are estimated from the request text.
+
+type GeminiEmbedContentRequest struct {
+	Model                string        `json:"model,omitempty"` // models/<name>, required in batches
+	Content              GeminiContent `json:"content"`
+	TaskType             string        `json:"taskType,omitempty"`
+	Title                string        `json:"title,omitempty"`
+	OutputDimensionality int           `json:"outputDimensionality,omitempty"`
+}
+
+type GeminiBatchEmbedContentsRequest struct {
+	Requests []GeminiEmbedContentRequest `json:"requests"`
+}
+
+type GeminiContentEmbedding struct {
+	Values []float64 `json:"values"`
+}
+
+type GeminiEmbedContentResponse struct {
+	Embedding GeminiContentEmbedding `json:"embedding"`
+}
+
+type GeminiBatchEmbedContentsResponse struct {
+	Embeddings []GeminiContentEmbedding `json:"embeddings"`
+}
+
+func isEmbedAction(action string) bool {
+	return action == "embedContent" || action == "batchEmbedContents"
+}
+
+// estimateTextTokens approximates the token count of text at about four
+// characters per token, rounded up. CJK characters are about one token each.
+func estimateTextTokens(text string) int {
+	chars, wide := 0, 0
+	for _, r := range text {
+		if r >= 0x2E80 && r <= 0xD7FF || r >= 0xF900 && r <= 0xFAFF { // CJK, kana and hangul
+			wide++
+		} else {
+			chars++
+		}
+	}
+	return wide + (chars+3)/4
+}
+
+func estimateEmbedRequestTokens(req GeminiEmbedContentRequest) int {
+	tokens := estimateTextTokens(req.Title)
+	for _, part := range req.Content.Parts {
+		tokens += estimateTextTokens(part.Text)
+	}
+	return tokens
+}
+
+// estimateEmbedTokens estimates the input tokens of an embedContent or
+// batchEmbedContents request body. 0 means the body couldn't be read.
+func estimateEmbedTokens(action string, body []byte) int {
+	if action == "batchEmbedContents" {
+		var batch GeminiBatchEmbedContentsRequest
+		if json.Unmarshal(body, &batch) != nil {
+			return 0
+		}
+		tokens := 0
+		for _, req := range batch.Requests {
+			tokens += estimateEmbedRequestTokens(req)
+		}
+		return tokens
+	}
+	var req GeminiEmbedContentRequest
+	if json.Unmarshal(body, &req) != nil {
+		return 0
+	}
+	return estimateEmbedRequestTokens(req)
+}
+
+// embedUsage is the usage recorded for an embedding request: input tokens only.
+func embedUsage(tokens int) keymanager.GeminiUsageMetadata {
+	return keymanager.GeminiUsageMetadata{PromptTokenCount: tokens, TotalTokenCount: tokens}
+}
+
+// Gemini accepts at most this many requests in one batchEmbedContents call
+const maxEmbedBatchSize = 100
+
+// embedTexts embeds inputs with batchEmbedContents calls of up to
+// maxEmbedBatchSize texts, recording the estimated tokens of each batch. It
+// returns one vector per input and the estimated tokens in total.
+func embedTexts(c *gin.Context, km *keymanager.KeyManager, target *url.URL, model string, inputs []string, dimensions int) ([][]float64, int, *upstreamError) {
+	embeddings := make([][]float64, 0, len(inputs))
+	totalTokens := 0
+	for start := 0; start < len(inputs); start += maxEmbedBatchSize {
+		batch := inputs[start:min(start+maxEmbedBatchSize, len(inputs))]
+		batchReq := GeminiBatchEmbedContentsRequest{}
+		tokens := 0
+		for _, input := range batch {
+			embedReq := GeminiEmbedContentRequest{
+				Model:                "models/" + model,
+				Content:              GeminiContent{Parts: []GeminiPart{{Text: input}}},
+				OutputDimensionality: dimensions,
+			}
+			tokens += estimateEmbedRequestTokens(embedReq)
+			batchReq.Requests = append(batchReq.Requests, embedReq)
+		}
+		body, err := json.Marshal(batchReq)
+		if err != nil {
+			return nil, 0, &upstreamError{StatusCode: http.StatusInternalServerError, Message: "Failed to marshal Gemini request body"}
+		}
+
+		resp, modelName, apiKey, upstreamErr := callGemini(c, km, target, model, "batchEmbedContents", body)
+		if upstreamErr != nil {
+			return nil, 0, upstreamErr
+		}
+		var batchResp GeminiBatchEmbedContentsResponse
+		err = json.NewDecoder(resp.Body).Decode(&batchResp)
+		resp.Body.Close()
+		if err != nil || len(batchResp.Embeddings) != len(batch) {
+			return nil, 0, &upstreamError{StatusCode: http.StatusBadGateway, Message: "Failed to parse upstream response"}
+		}
+		recordUsage(c, km, modelName, apiKey, embedUsage(tokens))
+		totalTokens += tokens
+		for _, embedding := range batchResp.Embeddings {
+			embeddings = append(embeddings, embedding.Values)
+		}
+	}
+	return embeddings, totalTokens, nil
+}
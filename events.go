@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// keyEvent is a key lifecycle event as sent by /api/events.
+type keyEvent struct {
+	Type  keymanager.EventType `json:"type"`
+	Time  string               `json:"time"`
+	Model string               `json:"model,omitempty"`
+	Key   string               `json:"key,omitempty"` // Masked
+	Until string               `json:"until,omitempty"`
+}
+
+// eventsHandler streams key lifecycle events as server-sent events until the
+// client disconnects. The status page refreshes on them instead of waiting for
+// its next poll.
+func eventsHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		events := make(chan keymanager.Event, 16)
+		unsubscribe := km.Subscribe(func(event keymanager.Event) {
+			select {
+			case events <- event:
+			default: // The client is too slow, it will catch up on the next poll
+			}
+		})
+		defer unsubscribe()
+
+		c.Writer.Header().Set("Content-Type", "text/event-stream")
+		c.Writer.Header().Set("Cache-Control", "no-cache")
+		c.Writer.Header().Set("Connection", "keep-alive")
+		c.Writer.WriteHeader(http.StatusOK)
+		c.Writer.Flush()
+
+		// Comments keep proxies from closing an idle stream
+		keepAlive := time.NewTicker(30 * time.Second)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case event := <-events:
+				payload := keyEvent{Type: event.Type, Time: event.Time.Format(time.RFC3339), Model: event.Model}
+				if event.Key != "" {
+					payload.Key = keymanager.MaskKey(event.Key)
+				}
+				if !event.Until.IsZero() {
+					payload.Until = event.Until.Format(time.RFC3339)
+				}
+				data, _ := json.Marshal(payload)
+				fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event.Type, data)
+				c.Writer.Flush()
+			case <-keepAlive.C:
+				fmt.Fprint(c.Writer, ": keep-alive\n\n")
+				c.Writer.Flush()
+			case <-c.Request.Context().Done():
+				return
+			}
+		}
+	}
+}
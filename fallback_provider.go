@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+const fallbackProviderHeader = "X-Fallback-Provider"
+
+// forwardToFallbackProvider sends an OpenAI-format request that found no Gemini
+// key to the fallback provider and relays its response. It returns false, with
+// nothing written, when no provider is configured or err isn't about keys.
+func forwardToFallbackProvider(c *gin.Context, km *keymanager.KeyManager, body []byte, err error) bool {
+	var noKey *keymanager.NoKeyError
+	if !errors.As(err, &noKey) {
+		return false
+	}
+	provider := km.Config().FallbackProvider
+	if provider == nil || provider.URL == "" {
+		return false
+	}
+
+	name := provider.Name
+	if name == "" {
+		name = provider.URL
+	}
+	requestBody, err := fallbackProviderBody(provider, body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return true
+	}
+	providerURL := strings.TrimSuffix(provider.URL, "/") + c.Param("path")
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, providerURL, bytes.NewReader(requestBody))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create fallback provider request"})
+		return true
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if accept := c.GetHeader("Accept"); accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if provider.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+provider.APIKey)
+	}
+
+	log.Printf("No Gemini key available (%v), forwarding %s to fallback provider %s.", noKey, c.Request.URL.Path, name)
+	resp, err := km.UpstreamClient().Do(req)
+	if err != nil {
+		log.Printf("Fallback provider %s failed: %v", name, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": gin.H{"message": fmt.Sprintf("No Gemini key available and the fallback provider failed: %v", err), "type": "api_error"}})
+		return true
+	}
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		c.Writer.Header()[k] = v
+	}
+	c.Writer.Header().Set(fallbackProviderHeader, name)
+	c.Writer.WriteHeader(resp.StatusCode)
+	var src io.Reader = resp.Body
+	var usage *usageSniffer
+	if resp.StatusCode == http.StatusOK {
+		usage = newUsageSniffer(openAIUsageTokens)
+		src = io.TeeReader(resp.Body, usage)
+	}
+	if _, err := copyFlushing(c.Writer, src); err != nil {
+		log.Printf("Error streaming fallback provider response to client: %v", err)
+	}
+	if usage != nil {
+		// No Gemini key was used, the tokens only count against the client key
+		if metadata, ok := usage.Total(); ok {
+			if clientKey := c.GetString("client_key"); clientKey != "" {
+				km.RecordClientUsage(clientKey, metadata.TotalTokenCount)
+			}
+			c.Set("history_tokens", c.GetInt("history_tokens")+metadata.TotalTokenCount)
+		}
+	}
+	return true
+}
+
+// fallbackProviderBody swaps the requested model for the provider's.
+func fallbackProviderBody(provider *keymanager.FallbackProviderConfig, body []byte) ([]byte, error) {
+	var request struct {
+		Model string `json:"model"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+	model := provider.Models[request.Model]
+	if model == "" {
+		model = provider.Model
+	}
+	if model == "" || model == request.Model {
+		return body, nil
+	}
+	return withModel(body, model)
+}
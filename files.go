@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// fileName extracts "files/{id}" from a resource name or file URI such as
+// "files/abc", "files/abc:download" or
+// "https://generativelanguage.googleapis.com/v1beta/files/abc".
+func fileName(resource string) string {
+	i := strings.LastIndex(resource, "files/")
+	if i < 0 || (i > 0 && resource[i-1] != '/') {
+		return ""
+	}
+	id := resource[i+len("files/"):]
+	if j := strings.IndexAny(id, "/:?"); j >= 0 {
+		id = id[:j]
+	}
+	if id == "" {
+		return ""
+	}
+	return "files/" + id
+}
+
+// fileAffinityKey returns the key owning the files a generation request
+// references in fileData parts, or "" when it references none.
+func fileAffinityKey(c *gin.Context, km *keymanager.KeyManager, target *url.URL) (string, int, error) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return "", http.StatusInternalServerError, fmt.Errorf("failed to read request body")
+	}
+	c.Request.Body = io.NopCloser(bytes.NewBuffer(body)) // Restore body
+
+	var req GeminiRequest
+	if json.Unmarshal(body, &req) != nil {
+		return "", 0, nil
+	}
+	owner := ""
+	for _, content := range req.Contents {
+		for _, part := range content.Parts {
+			if part.FileData == nil {
+				continue
+			}
+			file := fileName(part.FileData.FileURI)
+			if file == "" {
+				continue
+			}
+			key, status, err := km.ResolveFileKey(target, file, c.GetString("client_key"))
+			if err != nil {
+				return "", status, err
+			}
+			if owner != "" && key != owner {
+				return "", http.StatusBadRequest, fmt.Errorf("the referenced files were uploaded with different keys and can't be used in one request")
+			}
+			owner = key
+		}
+	}
+	return owner, 0, nil
+}
+
+// proxyBaseURL is the proxy's own URL as seen by the client, for upload URLs
+// handed back to it.
+func proxyBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	host := c.Request.Host
+	if forwarded := c.GetHeader("X-Forwarded-Host"); forwarded != "" {
+		host = forwarded
+	}
+	return scheme + "://" + host
+}
+
+// filesUploadHandler proxies /upload/v1beta/files: multipart uploads and the
+// start and upload/finalize steps of resumable uploads. The request body is
+// streamed, so uploads are not retried.
+func filesUploadHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var apiKey string
+		var err error
+		uploadID := c.Query("upload_id")
+		if uploadID != "" {
+			var ok bool
+			if apiKey, ok = km.UploadSessionKey(uploadID, c.GetString("client_key")); !ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Unknown or expired upload session"})
+				return
+			}
+		} else if apiKey, err = km.KeyForNewFile(); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("Failed to get API key: %v", err)})
+			return
+		}
+
+		upstreamURL := km.UpstreamURLFor(c.Request.Context(), target, apiKey, c.Request.URL.Path)
+		upstreamURL.RawQuery = c.Request.URL.RawQuery
+		proxyReq, err := http.NewRequest(c.Request.Method, upstreamURL.String(), c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create proxy request"})
+			return
+		}
+		proxyReq.Header = km.ForwardHeaders(c.Request.Header)
+		proxyReq.ContentLength = c.Request.ContentLength
+
+		resp, err := sendUpstream(c, km, km.UpstreamClient(), proxyReq, "", apiKey)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send request to upstream server"})
+			return
+		}
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to read upstream response"})
+			return
+		}
+
+		// The upload URL of a resumable upload carries the key; hand out one
+		// pointing at the proxy instead and remember the session's key
+		if location := resp.Header.Get("X-Goog-Upload-URL"); location != "" {
+			if parsed, err := url.Parse(location); err == nil && parsed.Query().Get("upload_id") != "" {
+				km.StartUploadSession(parsed.Query().Get("upload_id"), apiKey, c.GetString("client_key"))
+
+				proxyQuery := parsed.Query()
+				proxyQuery.Del("key")
+				resp.Header.Set("X-Goog-Upload-URL", proxyBaseURL(c)+c.Request.URL.Path+"?"+proxyQuery.Encode())
+			}
+		}
+		if resp.StatusCode == http.StatusOK {
+			km.RecordUploadedFile(respBody, apiKey, c.GetString("client_key"))
+			if uploadID != "" && strings.Contains(c.GetHeader("X-Goog-Upload-Command"), "finalize") {
+				km.EndUploadSession(uploadID)
+			}
+		} else {
+			log.Printf("Files upload: upstream server returned error: %d %s", resp.StatusCode, string(respBody))
+		}
+
+		for k, v := range resp.Header {
+			c.Writer.Header()[k] = v
+		}
+		c.Writer.WriteHeader(resp.StatusCode)
+		c.Writer.Write(respBody)
+	}
+}
+
+// filesProxyHandler proxies /v1beta/files and everything below it.
+func filesProxyHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		file := fileName(c.Param("path"))
+
+		// Listing spans every key's project, but only the client's own files
+		if file == "" && c.Request.Method == http.MethodGet {
+			files := km.DiscoverFiles(target, c.GetString("client_key"))
+			if files == nil {
+				files = []json.RawMessage{}
+			}
+			c.JSON(http.StatusOK, gin.H{"files": files})
+			return
+		}
+
+		var apiKey string
+		var err error
+		if file == "" {
+			if c.Request.Method != http.MethodPost {
+				c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Only GET and POST are supported on /v1beta/files"})
+				return
+			}
+			apiKey, err = km.KeyForNewFile()
+			if err != nil {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("Failed to get API key: %v", err)})
+				return
+			}
+		} else {
+			var status int
+			apiKey, status, err = km.ResolveFileKey(target, file, c.GetString("client_key"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read request body"})
+			return
+		}
+		upstreamURL := km.UpstreamURLFor(c.Request.Context(), target, apiKey, c.Request.URL.Path)
+		upstreamURL.RawQuery = c.Request.URL.RawQuery
+		proxyReq, err := http.NewRequest(c.Request.Method, upstreamURL.String(), bytes.NewReader(body))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create proxy request"})
+			return
+		}
+		proxyReq.Header = km.ForwardHeaders(c.Request.Header)
+
+		resp, err := sendUpstream(c, km, km.UpstreamClient(), proxyReq, "", apiKey)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send request to upstream server"})
+			return
+		}
+		defer resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusOK && file == "":
+			respBody, err := io.ReadAll(resp.Body)
+			if err != nil {
+				c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to read upstream response"})
+				return
+			}
+			km.RecordUploadedFile(respBody, apiKey, c.GetString("client_key"))
+			c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), respBody)
+			return
+		case resp.StatusCode == http.StatusOK && c.Request.Method == http.MethodDelete:
+			km.DeleteFileKey(file)
+		case resp.StatusCode == http.StatusNotFound:
+			km.DeleteFileKey(file) // Expired or deleted elsewhere
+		}
+
+		// Downloads can be large, stream them
+		for k, v := range resp.Header {
+			c.Writer.Header()[k] = v
+		}
+		c.Writer.WriteHeader(resp.StatusCode)
+		if _, err := copyFlushing(c.Writer, resp.Body); err != nil {
+			log.Printf("Error streaming response to client: %v", err)
+		}
+	}
+}
+
+func fileKeysHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, fileKeysResponse{Files: km.FileKeys()})
+	}
+}
+
+type fileKeysResponse struct {
+	Files []keymanager.FileKeyStatus `json:"files"`
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// Gemini API types shared by the translation layers (Ollama, OpenAI Responses, ...).
+
+type GeminiBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"` // Base64 encoded
+}
+
+type GeminiFileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
+}
+
+type GeminiFunctionCall struct {
+	Name string         `json:"name"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+type GeminiFunctionResponse struct {
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+type GeminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	InlineData       *GeminiBlob             `json:"inlineData,omitempty"`
+	FileData         *GeminiFileData         `json:"fileData,omitempty"`
+	FunctionCall     *GeminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *GeminiFunctionResponse `json:"functionResponse,omitempty"`
+	Thought          bool                    `json:"thought,omitempty"`
+}
+
+type GeminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []GeminiPart `json:"parts"`
+}
+
+type GeminiFunctionDeclaration struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+}
+
+type GeminiTool struct {
+	FunctionDeclarations []GeminiFunctionDeclaration `json:"functionDeclarations,omitempty"`
+}
+
+type GeminiGenerationConfig struct {
+	Temperature      *float64       `json:"temperature,omitempty"`
+	TopP             *float64       `json:"topP,omitempty"`
+	TopK             *int           `json:"topK,omitempty"`
+	MaxOutputTokens  *int           `json:"maxOutputTokens,omitempty"`
+	StopSequences    []string       `json:"stopSequences,omitempty"`
+	Seed             *int           `json:"seed,omitempty"`
+	ResponseMimeType string         `json:"responseMimeType,omitempty"`
+	ResponseSchema   map[string]any `json:"responseSchema,omitempty"`
+}
+
+type GeminiRequest struct {
+	Contents          []GeminiContent         `json:"contents"`
+	SystemInstruction *GeminiContent          `json:"systemInstruction,omitempty"`
+	Tools             []GeminiTool            `json:"tools,omitempty"`
+	GenerationConfig  *GeminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type GeminiCandidate struct {
+	Content      GeminiContent `json:"content"`
+	FinishReason string        `json:"finishReason,omitempty"`
+	Index        int           `json:"index"`
+}
+
+type GeminiResponse struct {
+	Candidates    []GeminiCandidate              `json:"candidates"`
+	UsageMetadata keymanager.GeminiUsageMetadata `json:"usageMetadata"`
+	ModelVersion  string                         `json:"modelVersion,omitempty"`
+}
+
+// upstreamError is returned by callGemini when no successful response could be
+// obtained. Translation handlers render it in their own API's error format.
+type upstreamError struct {
+	StatusCode  int
+	Message     string
+	Body        []byte // Raw upstream error body, if any
+	ContentType string
+	Err         error // Why no key could be picked, if that was the problem
+}
+
+func (e *upstreamError) Error() string {
+	if len(e.Body) > 0 {
+		return fmt.Sprintf("upstream returned %d: %s", e.StatusCode, string(e.Body))
+	}
+	return e.Message
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.Err
+}
+
+// callGemini sends a translated request to the Gemini API for the given model and
+// action (e.g. generateContent), rotating keys on 403/429 and retrying on 503
+// like the native proxy does. On success the caller owns the response body and
+// is responsible for recording usage against the returned model and key.
+func callGemini(c *gin.Context, km *keymanager.KeyManager, target *url.URL, requestedModel, action string, body []byte) (*http.Response, string, string, *upstreamError) {
+	if action == "generateContent" || action == "streamGenerateContent" {
+		overridden, err := withRequestOverrides(c, km, requestedModel, body)
+		if err != nil {
+			return nil, "", "", &upstreamError{StatusCode: http.StatusInternalServerError, Message: "Failed to apply the configured request settings"}
+		}
+		body = overridden
+	}
+	if action == "generateContent" {
+		if cached, ok := km.CachedResponseBody(c.GetString("client_key"), requestedModel, action, body); ok {
+			return cacheHitResponse(c, requestedModel, cached), requestedModel, "", nil
+		}
+	}
+	client := km.UpstreamClient()
+	estimatedTokens := 0
+	if action == "generateContent" || action == "streamGenerateContent" { // countTokens only takes generation requests
+		estimatedTokens = requestTokenEstimate(c, km, target, requestedModel, body)
+		if err := km.CheckTokenEstimate(requestedModel, estimatedTokens); err != nil {
+			return nil, "", "", &upstreamError{StatusCode: http.StatusRequestEntityTooLarge, Message: err.Error()}
+		}
+	}
+
+	retry := km.NewRetryPolicy()
+	for retry.Next() { // Retry loop
+		apiKey, modelName, delay, err := km.WaitForKey(c.Request.Context(), requestedModel, estimatedTokens)
+		if err != nil {
+			return nil, "", "", &upstreamError{StatusCode: http.StatusTooManyRequests, Message: fmt.Sprintf("Failed to get API key: %v", err), Err: err}
+		}
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+
+		path := fmt.Sprintf("/v1beta/models/%s:%s", modelName, action)
+		upstreamURL := km.UpstreamURLFor(c.Request.Context(), target, apiKey, path)
+		if action == "streamGenerateContent" {
+			upstreamURL.RawQuery = "alt=sse"
+		}
+
+		proxyReq, err := http.NewRequest("POST", upstreamURL.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, "", "", &upstreamError{StatusCode: http.StatusInternalServerError, Message: "Failed to create proxy request"}
+		}
+		proxyReq.Header = km.ForwardHeaders(http.Header{"Content-Type": {"application/json"}})
+
+		var resp *http.Response
+		if action == "generateContent" {
+			resp, apiKey, err = sendHedged(c, km, client, proxyReq, body, target, path, modelName, apiKey, estimatedTokens)
+		} else {
+			resp, err = sendUpstream(c, km, client, proxyReq, modelName, apiKey)
+		}
+		if err != nil {
+			return nil, "", "", &upstreamError{StatusCode: http.StatusBadGateway, Message: "Failed to send request to upstream server"}
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			if action == "generateContent" {
+				cacheResponseBody(c, km, requestedModel, action, body, resp)
+			}
+			return resp, modelName, apiKey, nil
+		case resp.StatusCode == http.StatusForbidden:
+			resp.Body.Close()
+			km.PermanentlyDisableKey(apiKey)
+			log.Printf("Key %s permanently disabled due to 403 Forbidden error.", keymanager.MaskKey(apiKey))
+			continue // Retry with a new key
+		case resp.StatusCode == http.StatusTooManyRequests:
+			respBody, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			km.HandleRateLimitError(modelName, apiKey, parseRateLimitError(resp.Header, respBody))
+			log.Printf("Rate limit hit for model %s with key %s. Retrying...", modelName, keymanager.MaskKey(apiKey))
+			continue
+		case retry.Retryable(resp.StatusCode):
+			resp.Body.Close()
+			wait := retry.Backoff()
+			log.Printf("Upstream returned %d for model %s with key %s. Retrying in %v...", resp.StatusCode, modelName, keymanager.MaskKey(apiKey), wait)
+			time.Sleep(wait)
+			continue
+		}
+
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		log.Printf("Gemini call: upstream server returned error: %d %s", resp.StatusCode, string(respBody))
+		return nil, "", "", &upstreamError{StatusCode: resp.StatusCode, Body: respBody, ContentType: resp.Header.Get("Content-Type")}
+	}
+
+	return nil, "", "", &upstreamError{StatusCode: http.StatusServiceUnavailable, Message: "Service unavailable after multiple retries"}
+}
+
+// geminiErrorMessage extracts error.message from a Gemini error body.
+func geminiErrorMessage(e *upstreamError) string {
+	var parsed struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if len(e.Body) > 0 && json.Unmarshal(e.Body, &parsed) == nil && parsed.Error.Message != "" {
+		return parsed.Error.Message
+	}
+	return e.Error()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+)
+
+// snakeCase turns a camelCase field name into snake_case, which the Gemini API accepts too.
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// withDefaultGenerationConfig adds the defaults a Gemini request body doesn't
+// set to its generationConfig.
+func withDefaultGenerationConfig(body []byte, defaults map[string]json.RawMessage) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	name := "generationConfig"
+	if _, ok := fields["generation_config"]; ok {
+		name = "generation_config"
+	}
+	config := make(map[string]json.RawMessage)
+	if raw, ok := fields[name]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return nil, err
+		}
+	}
+	for key, value := range defaults {
+		if _, ok := config[key]; ok {
+			continue
+		}
+		if _, ok := config[snakeCase(key)]; ok {
+			continue
+		}
+		if _, ok := config[camelCase(key)]; ok {
+			continue
+		}
+		config[key] = value
+	}
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	fields[name] = encoded
+	return json.Marshal(fields)
+}
+
+// openAIGenerationFields maps generationConfig fields to the OpenAI chat
+// completions parameters they correspond to.
+var openAIGenerationFields = map[string][]string{
+	"temperature":      {"temperature"},
+	"topP":             {"top_p"},
+	"maxOutputTokens":  {"max_tokens", "max_completion_tokens"},
+	"stopSequences":    {"stop"},
+	"candidateCount":   {"n"},
+	"presencePenalty":  {"presence_penalty"},
+	"frequencyPenalty": {"frequency_penalty"},
+	"seed":             {"seed"},
+}
+
+// withOpenAIDefaultGenerationConfig adds the defaults an OpenAI chat completions
+// body doesn't set, for the fields that have an OpenAI counterpart.
+func withOpenAIDefaultGenerationConfig(body []byte, defaults map[string]json.RawMessage) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range defaults {
+		names, ok := openAIGenerationFields[key]
+		if !ok {
+			names, ok = openAIGenerationFields[camelCase(key)]
+		}
+		if !ok {
+			continue
+		}
+		set := false
+		for _, name := range names {
+			if _, ok := fields[name]; ok {
+				set = true
+			}
+		}
+		if !set {
+			fields[names[0]] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// camelCase turns a snake_case field name into camelCase.
+func camelCase(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
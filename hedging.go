@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+type hedgedResult struct {
+	resp *http.Response
+	key  string
+	err  error
+}
+
+// sendHedged is sendUpstream for a non-streaming request, hedged when hedging
+// is configured for model. body is the request body and path the upstream API
+// path, to send the request again with another key. It returns the key the
+// response came with.
+func sendHedged(c *gin.Context, km *keymanager.KeyManager, client *http.Client, req *http.Request, body []byte, target *url.URL, path, modelName, apiKey string, estimatedTokens int) (*http.Response, string, error) {
+	after, ok := km.HedgeDelay(modelName)
+	if !ok {
+		resp, err := sendUpstream(c, km, client, req, modelName, apiKey)
+		return resp, apiKey, err
+	}
+
+	results := make(chan hedgedResult, 2)
+	cancels := make(map[string]context.CancelFunc)
+	send := func(req *http.Request, key string) {
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		cancels[key] = cancel
+		go func() {
+			resp, err := sendUpstreamContext(ctx, c, km, client, req, modelName, key)
+			results <- hedgedResult{resp: resp, key: key, err: err}
+		}()
+	}
+	hedgeReq := req.Clone(c.Request.Context()) // Before sendUpstream sets the key on req
+	send(req, apiKey)
+	pending := 1
+
+	timer := time.NewTimer(after)
+	defer timer.Stop()
+	var failed *hedgedResult // The first unsuccessful response, used when none succeeds
+	for {
+		select {
+		case <-timer.C:
+			hedgeKey, ok := km.HedgeKey(c.Request.Context(), modelName, apiKey, estimatedTokens)
+			if !ok {
+				log.Printf("No response for model %s with key %s after %v, no other key to hedge with.", modelName, keymanager.MaskKey(apiKey), after)
+				continue
+			}
+			upstreamURL := km.UpstreamURLFor(c.Request.Context(), target, hedgeKey, path)
+			hedgeReq.URL.Scheme = upstreamURL.Scheme
+			hedgeReq.URL.Host = upstreamURL.Host
+			hedgeReq.URL.Path = upstreamURL.Path
+			hedgeReq.Body = io.NopCloser(bytes.NewReader(body))
+			hedgeReq.ContentLength = int64(len(body))
+			log.Printf("No response for model %s with key %s after %v, hedging with key %s.", modelName, keymanager.MaskKey(apiKey), after, keymanager.MaskKey(hedgeKey))
+			send(hedgeReq, hedgeKey)
+			pending++
+
+		case r := <-results:
+			pending--
+			if r.err == nil && r.resp.StatusCode == http.StatusOK || pending == 0 && failed == nil {
+				for key, cancel := range cancels {
+					if key != r.key {
+						cancel()
+					}
+				}
+				if pending > 0 {
+					go func() { discardHedgedResult(km, modelName, <-results, false) }()
+				}
+				if r.err != nil {
+					cancels[r.key]()
+				} else {
+					r.resp.Body = &releasingBody{ReadCloser: r.resp.Body, release: cancels[r.key]}
+				}
+				if failed != nil {
+					discardHedgedResult(km, modelName, *failed, true)
+				}
+				c.Set("history_key", r.key)
+				return r.resp, r.key, r.err
+			}
+			if failed == nil {
+				failed = &r // Wait for the other request
+				continue
+			}
+			// Both failed, the first one is reported
+			discardHedgedResult(km, modelName, r, true)
+			if failed.err == nil {
+				failed.resp.Body = io.NopCloser(bytes.NewReader(readAndClose(failed.resp.Body)))
+			}
+			for _, cancel := range cancels {
+				cancel()
+			}
+			c.Set("history_key", failed.key)
+			return failed.resp, failed.key, failed.err
+		}
+	}
+}
+
+// discardHedgedResult closes a response that isn't passed on, flagging its key
+// like the retry loops would when it was rejected upstream.
+func discardHedgedResult(km *keymanager.KeyManager, modelName string, r hedgedResult, handleErrors bool) {
+	if r.err != nil {
+		return
+	}
+	respBody := readAndClose(r.resp.Body)
+	if !handleErrors {
+		return
+	}
+	switch r.resp.StatusCode {
+	case http.StatusForbidden:
+		km.PermanentlyDisableKey(r.key)
+		log.Printf("Key %s permanently disabled due to 403 Forbidden error.", keymanager.MaskKey(r.key))
+	case http.StatusTooManyRequests:
+		km.HandleRateLimitError(modelName, r.key, parseRateLimitError(r.resp.Header, respBody))
+		log.Printf("Rate limit hit for model %s with key %s on a hedged request.", modelName, keymanager.MaskKey(r.key))
+	}
+}
+
+func readAndClose(body io.ReadCloser) []byte {
+	data, _ := io.ReadAll(body)
+	body.Close()
+	return data
+}
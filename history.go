@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// RequestRecord describes one proxied request. Bodies are only filled in for
+// clients that opted in to content logging.
+type RequestRecord struct {
+	Time         time.Time `json:"time"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	Client       string    `json:"client"`
+	Model        string    `json:"model,omitempty"`
+	Key          string    `json:"key,omitempty"`
+	Status       int       `json:"status"`
+	LatencyMs    int64     `json:"latency_ms"`
+	Tokens       int       `json:"tokens"`
+	Images       int       `json:"images,omitempty"` // Generated by image models
+	RequestBody  string    `json:"request_body,omitempty"`
+	ResponseBody string    `json:"response_body,omitempty"`
+}
+
+type requestHistory struct {
+	records         []RequestRecord
+	next            int
+	full            bool
+	contentClients  map[string]bool
+	maxContentBytes int
+	mutex           sync.Mutex
+}
+
+func newRequestHistory(config *keymanager.RequestHistoryConfig) *requestHistory {
+	h := &requestHistory{
+		records:         make([]RequestRecord, 200),
+		contentClients:  make(map[string]bool),
+		maxContentBytes: 64 * 1024,
+	}
+	if config != nil {
+		if config.Size > 0 {
+			h.records = make([]RequestRecord, config.Size)
+		}
+		if config.MaxContentBytes > 0 {
+			h.maxContentBytes = config.MaxContentBytes
+		}
+		for _, client := range config.ContentLoggingClients {
+			h.contentClients[client] = true
+		}
+	}
+	return h
+}
+
+func (h *requestHistory) add(record RequestRecord) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.records[h.next] = record
+	h.next = (h.next + 1) % len(h.records)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// recent returns up to limit records, newest first.
+func (h *requestHistory) recent(limit int) []RequestRecord {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	count := h.next
+	if h.full {
+		count = len(h.records)
+	}
+	if limit <= 0 || limit > count {
+		limit = count
+	}
+	result := make([]RequestRecord, 0, limit)
+	for i := 1; i <= limit; i++ {
+		result = append(result, h.records[(h.next-i+len(h.records))%len(h.records)])
+	}
+	return result
+}
+
+// clientToken extracts the credential a client sent, in the places Gemini,
+// OpenAI and Ollama clients usually put it.
+func clientToken(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key := c.GetHeader("x-goog-api-key"); key != "" {
+		return key
+	}
+	if key := c.GetHeader("x-api-key"); key != "" { // Anthropic clients
+		return key
+	}
+	return c.Query("key")
+}
+
+// captureWriter copies up to limit bytes of the response body while writing it through.
+type captureWriter struct {
+	gin.ResponseWriter
+	buf   bytes.Buffer
+	limit int
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if remaining := w.limit - w.buf.Len(); remaining > 0 {
+		if len(b) < remaining {
+			remaining = len(b)
+		}
+		w.buf.Write(b[:remaining])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func truncateContent(b []byte, limit int) string {
+	if len(b) > limit {
+		b = b[:limit]
+	}
+	return string(b)
+}
+
+// recordRequestHistory stores metadata for every proxied request, and the request
+// and response bodies for clients listed in content_logging_clients.
+func recordRequestHistory(h *requestHistory) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		token := clientToken(c)
+		logContent := token != "" && h.contentClients[token]
+
+		var requestBody []byte
+		var capture *captureWriter
+		if logContent {
+			requestBody, _ = io.ReadAll(c.Request.Body)
+			c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody)) // Restore body
+			capture = &captureWriter{ResponseWriter: c.Writer, limit: h.maxContentBytes}
+			c.Writer = capture
+		}
+
+		c.Next()
+
+		record := RequestRecord{
+			Time:      start,
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Client:    "anonymous",
+			Model:     c.GetString("history_model"),
+			Status:    c.Writer.Status(),
+			LatencyMs: time.Since(start).Milliseconds(),
+			Tokens:    c.GetInt("history_tokens"),
+			Images:    c.GetInt("history_images"),
+		}
+		if token != "" {
+			record.Client = keymanager.MaskKey(token)
+		}
+		if key := c.GetString("history_key"); key != "" {
+			record.Key = keymanager.MaskKey(key)
+		}
+		if logContent {
+			record.RequestBody = truncateContent(requestBody, h.maxContentBytes)
+			record.ResponseBody = capture.buf.String()
+		}
+		h.add(record)
+	}
+}
+
+// recordUsage records token usage in the key manager and attaches it to the request history.
+func recordUsage(c *gin.Context, km *keymanager.KeyManager, modelName, apiKey string, metadata keymanager.GeminiUsageMetadata) {
+	if c.GetBool(responseCacheHitKey) { // Served without calling upstream
+		return
+	}
+	tokenCount := metadata.TotalTokenCount
+	km.RecordUsage(modelName, apiKey, metadata)
+	if clientKey := c.GetString("client_key"); clientKey != "" {
+		km.RecordClientUsage(clientKey, tokenCount)
+	}
+	c.Set("history_tokens", c.GetInt("history_tokens")+tokenCount)
+}
+
+func requestHistoryHandler(h *requestHistory) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		c.JSON(http.StatusOK, gin.H{"requests": h.recent(limit)})
+	}
+}
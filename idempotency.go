@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A client that retries a POST after a network flake can send the same
+// Idempotency-Key header with it. While the original request is in flight the
+// retry waits for it, and for idempotencyWindow after it the original response
+// is replayed, so upstream is called and tokens are counted only once. Keys are
+// scoped to the client; 429 and 5xx responses aren't replayed so they can be retried.
+// Uploads and streaming requests aren't deduplicated, since their bodies and
+// responses would have to be held in memory in full.
+
+const idempotencyWindow = 10 * time.Minute
+
+const (
+	idempotencyMaxResponseBytes = 1 << 20 // Larger responses aren't kept for replaying
+	idempotencyMaxEntries       = 10000   // Further keys aren't deduplicated until entries expire
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+type idempotentRequest struct {
+	fingerprint string        // Method, path and body the key was first used with
+	done        chan struct{} // Closed once the response below is set
+	completed   time.Time
+	kept        bool // Whether the response below can be replayed
+	status      int
+	header      http.Header
+	body        []byte
+}
+
+type idempotencyStore struct {
+	requests map[string]*idempotentRequest
+	mutex    sync.Mutex
+}
+
+func replayable(status int) bool {
+	return status != http.StatusTooManyRequests && status < 500
+}
+
+// begin returns the request registered for key, or registers a new one, in
+// which case the caller must finish it. It returns nil when the store is full.
+func (s *idempotencyStore) begin(key, fingerprint string) (*idempotentRequest, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.requests == nil {
+		s.requests = make(map[string]*idempotentRequest)
+	}
+	if r, ok := s.requests[key]; ok {
+		return r, false
+	}
+	if len(s.requests) >= idempotencyMaxEntries {
+		return nil, false
+	}
+	r := &idempotentRequest{fingerprint: fingerprint, done: make(chan struct{})}
+	s.requests[key] = r
+	return r, true
+}
+
+// finish sets the response of a request begin registered. Responses that can't
+// be replayed, or are too large to keep, free the key again.
+func (s *idempotencyStore) finish(key string, r *idempotentRequest, status int, header http.Header, body []byte) {
+	s.mutex.Lock()
+	r.completed = time.Now()
+	r.kept = replayable(status) && len(body) <= idempotencyMaxResponseBytes
+	if r.kept {
+		r.status, r.header, r.body = status, header, body
+	} else {
+		delete(s.requests, key)
+	}
+	s.mutex.Unlock()
+	close(r.done)
+}
+
+// expire drops the requests completed longer than idempotencyWindow ago, once a
+// minute.
+func (s *idempotencyStore) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mutex.Lock()
+		for k, r := range s.requests {
+			if !r.completed.IsZero() && time.Since(r.completed) > idempotencyWindow {
+				delete(s.requests, k)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// deduplicated reports whether a request can be deduplicated by its
+// Idempotency-Key, which isn't the case for uploads and streaming requests.
+func deduplicated(c *gin.Context) bool {
+	path := c.Request.URL.Path
+	return !strings.HasPrefix(path, "/upload/") && !strings.HasSuffix(path, ":streamGenerateContent") && c.Query("alt") != "sse"
+}
+
+func idempotency() gin.HandlerFunc {
+	store := &idempotencyStore{}
+	go store.expire()
+	return func(c *gin.Context) {
+		idempotencyKey := c.GetHeader(idempotencyKeyHeader)
+		if idempotencyKey == "" || c.Request.Method != http.MethodPost || !deduplicated(c) {
+			c.Next()
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body) // Limited by requestBodyLimit
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewBuffer(body)) // Restore body
+		var stream struct {
+			Stream bool `json:"stream"` // OpenAI, Anthropic and Ollama streaming requests
+		}
+		if json.Unmarshal(body, &stream) == nil && stream.Stream {
+			c.Next()
+			return
+		}
+		sum := sha256.Sum256([]byte(c.Request.URL.RequestURI() + "\n" + string(body)))
+		fingerprint := hex.EncodeToString(sum[:])
+
+		owner := c.GetString("client_key")
+		if owner == "" {
+			owner = clientToken(c)
+		}
+		key := owner + "\n" + idempotencyKey
+		request, isNew := store.begin(key, fingerprint)
+		if request == nil {
+			c.Next()
+			return
+		}
+		if isNew {
+			// One byte over the limit tells finish the response was too large
+			capture := &captureWriter{ResponseWriter: c.Writer, limit: idempotencyMaxResponseBytes + 1}
+			c.Writer = capture
+			defer func() {
+				store.finish(key, request, capture.Status(), capture.Header().Clone(), capture.buf.Bytes())
+			}()
+			c.Next()
+			return
+		}
+
+		if request.fingerprint != fingerprint {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different request"})
+			return
+		}
+		select {
+		case <-request.done:
+		case <-c.Request.Context().Done():
+			c.Abort()
+			return
+		}
+		if !request.kept { // The original failed or was too large, so this is a retry in its own right
+			c.Next()
+			return
+		}
+		for k, v := range request.header {
+			c.Writer.Header()[k] = v
+		}
+		c.Header("Idempotent-Replayed", "true")
+		c.Writer.WriteHeader(request.status)
+		c.Writer.Write(request.body)
+		c.Abort()
+	}
+}
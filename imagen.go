@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// Imagen models generate images with :predict. Their responses carry no
+// usageMetadata, so they are counted in images, priced with the model's
+// image_price and limited with its ipd_limit.
+
+type ImagenPredictRequest struct {
+	Instances  []ImagenInstance `json:"instances"`
+	Parameters ImagenParameters `json:"parameters"`
+}
+
+type ImagenInstance struct {
+	Prompt string `json:"prompt"`
+}
+
+type ImagenParameters struct {
+	SampleCount int    `json:"sampleCount,omitempty"`
+	AspectRatio string `json:"aspectRatio,omitempty"` // 1:1, 3:4, 4:3, 9:16 or 16:9
+}
+
+type ImagenPrediction struct {
+	BytesBase64Encoded string `json:"bytesBase64Encoded,omitempty"`
+	MimeType           string `json:"mimeType,omitempty"`
+	RaiFilteredReason  string `json:"raiFilteredReason,omitempty"` // Set instead of the image when it was filtered
+}
+
+type ImagenPredictResponse struct {
+	Predictions []ImagenPrediction `json:"predictions"`
+}
+
+// countGeneratedImages returns the number of images in a :predict response.
+// Filtered predictions have no image and aren't counted.
+func countGeneratedImages(body []byte) int {
+	var resp ImagenPredictResponse
+	if json.Unmarshal(body, &resp) != nil {
+		return 0
+	}
+	images := 0
+	for _, prediction := range resp.Predictions {
+		if prediction.BytesBase64Encoded != "" {
+			images++
+		}
+	}
+	return images
+}
+
+func recordImageUsage(c *gin.Context, km *keymanager.KeyManager, modelName, apiKey string, images int) {
+	km.RecordImageUsage(modelName, apiKey, images)
+	c.Set("history_images", c.GetInt("history_images")+images)
+}
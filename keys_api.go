@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// Runtime key management. Changes go to config.json so they survive a restart;
+// keys from key providers are not listed there and can't be removed here.
+
+type KeysRequest struct {
+	Keys []string `json:"keys"`
+	Pool string   `json:"pool,omitempty"` // "priority" (default) or "secondary", only used when adding
+}
+
+type keysResponse struct {
+	Changed []string `json:"changed"` // Masked keys that were added or removed
+	Skipped []string `json:"skipped"` // Masked keys already present (add) or not in config.json (remove)
+}
+
+type pauseKeyResponse struct {
+	Key    string `json:"key"` // Masked
+	Paused bool   `json:"paused"`
+}
+
+func maskKeys(keys []string) []string {
+	masked := make([]string, 0, len(keys))
+	for _, key := range keys {
+		masked = append(masked, keymanager.MaskKey(key))
+	}
+	return masked
+}
+
+func addKeysHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req KeysRequest
+		if err := c.ShouldBindJSON(&req); err != nil || len(req.Keys) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body, expected {\"keys\": [...]}"})
+			return
+		}
+		if req.Pool != "" && req.Pool != "priority" && req.Pool != "secondary" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown pool '%s', expected priority or secondary", req.Pool)})
+			return
+		}
+
+		for _, key := range req.Keys {
+			if err := keymanager.CheckKey(strings.TrimSpace(key)); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Key %s %v", keymanager.MaskKey(strings.TrimSpace(key)), err)})
+				return
+			}
+		}
+
+		added, skipped, err := km.AddKeys(req.Keys, req.Pool != "secondary")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Keys were added but config.json could not be saved: %v", err)})
+			return
+		}
+		c.JSON(http.StatusOK, keysResponse{Changed: maskKeys(added), Skipped: maskKeys(skipped)})
+	}
+}
+
+func removeKeysHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req KeysRequest
+		if err := c.ShouldBindJSON(&req); err != nil || len(req.Keys) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body, expected {\"keys\": [...]}"})
+			return
+		}
+
+		removed, skipped, err := km.RemoveKeys(req.Keys)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Keys were removed but config.json could not be saved: %v", err)})
+			return
+		}
+		c.JSON(http.StatusOK, keysResponse{Changed: maskKeys(removed), Skipped: maskKeys(skipped)})
+	}
+}
+
+func pauseKeyHandler(km *keymanager.KeyManager, paused bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.Param("key")
+		known, err := km.SetKeyPaused(key, paused)
+		if !known {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Unknown key '%s'", keymanager.MaskKey(key))})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Key state was changed but config.json could not be saved: %v", err)})
+			return
+		}
+		c.JSON(http.StatusOK, pauseKeyResponse{Key: keymanager.MaskKey(key), Paused: paused})
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// The Gemini Live API (BidiGenerateContent) is a WebSocket session. The client
+// opens it on /ws/..., like upstream, and sends a setup message naming the
+// model first; the proxy then picks a key for that model, opens the upstream
+// session with it and relays messages both ways until either side closes.
+
+// How long the client has to send the setup message, and upstream to confirm it
+const liveSetupTimeout = 30 * time.Second
+
+// liveFrame is one WebSocket message, kept as text or binary like it arrived.
+type liveFrame struct {
+	data        []byte
+	payloadType byte
+}
+
+var liveCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		frame := v.(liveFrame)
+		return frame.data, frame.payloadType, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		frame := v.(*liveFrame)
+		frame.data = data
+		frame.payloadType = payloadType
+		return nil
+	},
+}
+
+type liveSetupMessage struct {
+	Setup *struct {
+		Model string `json:"model"` // models/<name>
+	} `json:"setup"`
+}
+
+type liveServerMessage struct {
+	SetupComplete json.RawMessage    `json:"setupComplete"`
+	UsageMetadata *liveUsageMetadata `json:"usageMetadata"`
+}
+
+type liveUsageMetadata struct {
+	PromptTokenCount   int `json:"promptTokenCount"`
+	ResponseTokenCount int `json:"responseTokenCount"`
+	ThoughtsTokenCount int `json:"thoughtsTokenCount"`
+	TotalTokenCount    int `json:"totalTokenCount"`
+}
+
+func (u liveUsageMetadata) gemini() keymanager.GeminiUsageMetadata {
+	return keymanager.GeminiUsageMetadata{
+		PromptTokenCount:     u.PromptTokenCount,
+		CandidatesTokenCount: u.ResponseTokenCount,
+		ThoughtsTokenCount:   u.ThoughtsTokenCount,
+		TotalTokenCount:      u.TotalTokenCount,
+	}
+}
+
+// liveSetupWithModel replaces the model of a setup message, for fallback models.
+func liveSetupWithModel(data []byte, model string) ([]byte, error) {
+	var message map[string]json.RawMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, err
+	}
+	setup, err := withModel(message["setup"], "models/"+model)
+	if err != nil {
+		return nil, err
+	}
+	message["setup"] = setup
+	return json.Marshal(message)
+}
+
+func liveProxyHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		server := websocket.Server{
+			// Live clients are mostly not browsers and send no Origin
+			Handshake: func(*websocket.Config, *http.Request) error { return nil },
+			Handler: func(client *websocket.Conn) {
+				defer client.Close()
+				serveLiveSession(c, km, target, client)
+			},
+		}
+		server.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+func serveLiveSession(c *gin.Context, km *keymanager.KeyManager, target *url.URL, client *websocket.Conn) {
+	var setup liveFrame
+	client.SetReadDeadline(time.Now().Add(liveSetupTimeout))
+	if err := liveCodec.Receive(client, &setup); err != nil {
+		log.Printf("Live session from %s closed before setup: %v", c.ClientIP(), err)
+		return
+	}
+	client.SetReadDeadline(time.Time{})
+	var message liveSetupMessage
+	if json.Unmarshal(setup.data, &message) != nil || message.Setup == nil {
+		log.Printf("Live session from %s didn't start with a setup message, closing.", c.ClientIP())
+		return
+	}
+	requestedModel := strings.TrimPrefix(message.Setup.Model, "models/")
+	keyModel := requestedModel
+	if !km.HasModel(keyModel) {
+		keyModel = km.Config().DefaultModel
+	}
+
+	retry := km.NewRetryPolicy()
+	for retry.Next() {
+		apiKey, modelName, delay, err := km.WaitForKey(c.Request.Context(), keyModel, 0)
+		if err != nil {
+			log.Printf("No key for live session with model %s: %v", requestedModel, err)
+			return
+		}
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+		setupData := setup.data
+		if modelName != keyModel {
+			if setupData, err = liveSetupWithModel(setup.data, modelName); err != nil {
+				log.Printf("Failed to switch live session to model %s: %v", modelName, err)
+				return
+			}
+		}
+
+		upstream, reply, err := dialLiveUpstream(c, km, target, apiKey, liveFrame{data: setupData, payloadType: setup.payloadType})
+		if err != nil {
+			wait := retry.Backoff()
+			log.Printf("Live session setup failed for model %s with key %s: %v. Retrying in %v...", modelName, keymanager.MaskKey(apiKey), err, wait)
+			time.Sleep(wait)
+			continue
+		}
+		if err := liveCodec.Send(client, reply); err != nil {
+			upstream.Close()
+			return
+		}
+		log.Printf("Live session for model %s started with key %s.", modelName, keymanager.MaskKey(apiKey))
+		relayLiveSession(c, km, modelName, apiKey, client, upstream)
+		return
+	}
+	log.Printf("Live session for model %s failed after multiple retries.", requestedModel)
+}
+
+// dialLiveUpstream opens the upstream session with apiKey and sends the setup
+// message. Upstream answers it with setupComplete, or closes the connection
+// when the key can't be used, e.g. it is out of quota.
+func dialLiveUpstream(c *gin.Context, km *keymanager.KeyManager, target *url.URL, apiKey string, setup liveFrame) (*websocket.Conn, liveFrame, error) {
+	upstreamURL := km.UpstreamURLFor(c.Request.Context(), target, apiKey, c.Request.URL.Path)
+	origin := upstreamURL.Scheme + "://" + upstreamURL.Host
+	if upstreamURL.Scheme == "https" {
+		upstreamURL.Scheme = "wss"
+	} else {
+		upstreamURL.Scheme = "ws"
+	}
+	q := c.Request.URL.Query()
+	q.Del("key") // The client's own key, upstream gets ours in the header
+	upstreamURL.RawQuery = q.Encode()
+
+	config, err := websocket.NewConfig(upstreamURL.String(), origin)
+	if err != nil {
+		return nil, liveFrame{}, err
+	}
+	config.Header = http.Header{"X-Goog-Api-Key": {apiKey}}
+	upstream, err := config.DialContext(c.Request.Context())
+	if err != nil {
+		return nil, liveFrame{}, err
+	}
+	if err := liveCodec.Send(upstream, setup); err != nil {
+		upstream.Close()
+		return nil, liveFrame{}, err
+	}
+
+	var reply liveFrame
+	upstream.SetReadDeadline(time.Now().Add(liveSetupTimeout))
+	if err := liveCodec.Receive(upstream, &reply); err != nil {
+		upstream.Close()
+		return nil, liveFrame{}, fmt.Errorf("no setupComplete: %v", err)
+	}
+	upstream.SetReadDeadline(time.Time{})
+	var message liveServerMessage
+	if json.Unmarshal(reply.data, &message) != nil || message.SetupComplete == nil {
+		upstream.Close()
+		return nil, liveFrame{}, errors.New("unexpected reply to setup")
+	}
+	return upstream, reply, nil
+}
+
+// relayLiveSession forwards messages between client and upstream until either
+// side closes, recording the usageMetadata upstream reports along the way.
+func relayLiveSession(c *gin.Context, km *keymanager.KeyManager, modelName, apiKey string, client, upstream *websocket.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		for {
+			var frame liveFrame
+			if liveCodec.Receive(client, &frame) != nil || liveCodec.Send(upstream, frame) != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		for {
+			var frame liveFrame
+			if liveCodec.Receive(upstream, &frame) != nil || liveCodec.Send(client, frame) != nil {
+				break
+			}
+			var message liveServerMessage
+			if json.Unmarshal(frame.data, &message) == nil && message.UsageMetadata != nil {
+				recordUsage(c, km, modelName, apiKey, message.UsageMetadata.gemini())
+			}
+		}
+		done <- struct{}{}
+	}()
+	// Closing both connections ends the other direction too
+	<-done
+	client.Close()
+	upstream.Close()
+	<-done
+	log.Printf("Live session for model %s with key %s ended.", modelName, keymanager.MaskKey(apiKey))
+}
@@ -0,0 +1,69 @@
+package main
+
+import "encoding/json"
+
+// overLimit reports whether a requested token limit must be replaced by limit:
+// it is missing, not a positive number, or higher.
+func overLimit(raw json.RawMessage, limit int) bool {
+	var requested int
+	if raw == nil || json.Unmarshal(raw, &requested) != nil || requested <= 0 {
+		return true
+	}
+	return requested > limit
+}
+
+// withMaxOutputTokens caps generationConfig.maxOutputTokens in a Gemini request body.
+func withMaxOutputTokens(body []byte, limit int) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	name := "generationConfig"
+	if _, ok := fields["generation_config"]; ok {
+		name = "generation_config"
+	}
+	config := make(map[string]json.RawMessage)
+	if raw, ok := fields[name]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return nil, err
+		}
+	}
+	key := "maxOutputTokens"
+	if _, ok := config["max_output_tokens"]; ok {
+		key = "max_output_tokens"
+	}
+	if !overLimit(config[key], limit) {
+		return body, nil
+	}
+	config[key], _ = json.Marshal(limit)
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	fields[name] = encoded
+	return json.Marshal(fields)
+}
+
+// withOpenAIMaxOutputTokens caps max_tokens and max_completion_tokens in an
+// OpenAI chat completions body, setting max_tokens when neither is there.
+func withOpenAIMaxOutputTokens(body []byte, limit int) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	found := false
+	for _, name := range []string{"max_tokens", "max_completion_tokens"} {
+		raw, ok := fields[name]
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		found = true
+		if overLimit(raw, limit) {
+			fields[name], _ = json.Marshal(limit)
+		}
+	}
+	if !found {
+		fields["max_tokens"], _ = json.Marshal(limit)
+	}
+	return json.Marshal(fields)
+}
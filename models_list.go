@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+func isModelListRequest(c *gin.Context) bool {
+	return c.Request.Method == http.MethodGet && strings.TrimSuffix(c.Param("path"), "/") == "/models"
+}
+
+// filterModelList drops the models that aren't configured from a models.list
+// response. Other fields, like nextPageToken, are kept; a page may end up with
+// fewer models than pageSize. Responses that can't be parsed are returned as is.
+func filterModelList(km *keymanager.KeyManager, body []byte) []byte {
+	var list map[string]json.RawMessage
+	if json.Unmarshal(body, &list) != nil {
+		return body
+	}
+	var models []map[string]any
+	if raw, ok := list["models"]; ok {
+		if json.Unmarshal(raw, &models) != nil {
+			return body
+		}
+	}
+
+	filtered := make([]map[string]any, 0, len(models))
+	for _, model := range models {
+		name, _ := model["name"].(string)
+		if km.HasModel(strings.TrimPrefix(name, "models/")) {
+			filtered = append(filtered, model)
+		}
+	}
+	raw, err := json.Marshal(filtered)
+	if err != nil {
+		return body
+	}
+	list["models"] = raw
+	out, err := json.Marshal(list)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// serveModelList writes a models.list response, filtered when only configured
+// models are listed.
+func serveModelList(c *gin.Context, km *keymanager.KeyManager, body []byte) {
+	if km.ListsConfiguredModelsOnly() {
+		body = filterModelList(km, body)
+	}
+	c.Data(http.StatusOK, "application/json", body)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// Ollama embedding APIs translated to Gemini batchEmbedContents: /api/embed
+// and the older /api/embeddings, which Open WebUI uses for RAG.
+
+type OllamaEmbedRequest struct {
+	Model      string          `json:"model"`
+	Input      json.RawMessage `json:"input"` // A string or an array of strings
+	Dimensions int             `json:"dimensions,omitempty"`
+}
+
+type OllamaEmbedResponse struct {
+	Model           string      `json:"model"`
+	Embeddings      [][]float64 `json:"embeddings"`
+	TotalDuration   int64       `json:"total_duration"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+}
+
+type OllamaEmbeddingsRequest struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+}
+
+type OllamaEmbeddingsResponse struct {
+	Embedding []float64 `json:"embedding"`
+}
+
+// ollamaEmbed resolves the model and embeds inputs, writing the error response
+// itself when it fails.
+func ollamaEmbed(c *gin.Context, km *keymanager.KeyManager, target *url.URL, requested string, inputs []string, dimensions int) ([][]float64, int, bool) {
+	if requested == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Model not specified in request body"})
+		return nil, 0, false
+	}
+	model := km.EmbeddingModel(requested)
+	if model == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Model '" + requested + "' is not configured and no default_embedding_model is set"})
+		return nil, 0, false
+	}
+	embeddings, tokens, upstreamErr := embedTexts(c, km, target, model, inputs, dimensions)
+	if upstreamErr != nil {
+		setRetryAfter(c, upstreamErr)
+		c.JSON(upstreamErr.StatusCode, gin.H{"error": geminiErrorMessage(upstreamErr)})
+		return nil, 0, false
+	}
+	return embeddings, tokens, true
+}
+
+func ollamaEmbedHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req OllamaEmbedRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+		inputs, err := embeddingInputs(req.Input)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		start := time.Now()
+		embeddings, tokens, ok := ollamaEmbed(c, km, target, req.Model, inputs, req.Dimensions)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, OllamaEmbedResponse{
+			Model:           req.Model,
+			Embeddings:      embeddings,
+			TotalDuration:   time.Since(start).Nanoseconds(),
+			PromptEvalCount: tokens,
+		})
+	}
+}
+
+func ollamaEmbeddingsHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req OllamaEmbeddingsRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+		embeddings, _, ok := ollamaEmbed(c, km, target, req.Model, []string{req.Prompt}, 0)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, OllamaEmbeddingsResponse{Embedding: embeddings[0]})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// Open WebUI and the Ollama CLI probe /api/version and /api/ps before using a
+// server, so the proxy answers them like an Ollama instance would.
+
+// ollamaVersion is the Ollama release the proxy reports being compatible with.
+const ollamaVersion = "0.5.7"
+
+type OllamaModelDetails struct {
+	ParentModel       string   `json:"parent_model"`
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+type OllamaRunningModel struct {
+	Name      string             `json:"name"`
+	Model     string             `json:"model"`
+	Size      int64              `json:"size"`
+	Digest    string             `json:"digest"`
+	Details   OllamaModelDetails `json:"details"`
+	ExpiresAt time.Time          `json:"expires_at"`
+	SizeVRAM  int64              `json:"size_vram"`
+}
+
+type OllamaPsResponse struct {
+	Models []OllamaRunningModel `json:"models"`
+}
+
+func ollamaVersionHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"version": ollamaVersion})
+	}
+}
+
+// ollamaPsHandler lists the configured models as running. They stay "loaded"
+// until the next quota reset.
+func ollamaPsHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		models := km.Config().Models
+		names := make([]string, 0, len(models))
+		for name := range models {
+			names = append(names, name)
+		}
+		expiresAt := km.NextReset()
+		sort.Strings(names)
+
+		resp := OllamaPsResponse{Models: []OllamaRunningModel{}}
+		for _, name := range names {
+			digest := sha256.Sum256([]byte(name))
+			resp.Models = append(resp.Models, OllamaRunningModel{
+				Name:   name,
+				Model:  name,
+				Digest: hex.EncodeToString(digest[:]),
+				Details: OllamaModelDetails{
+					Format:   "gemini",
+					Family:   "gemini",
+					Families: []string{"gemini"},
+				},
+				ExpiresAt: expiresAt,
+			})
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
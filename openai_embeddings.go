@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAI embeddings API (/v1/embeddings) translated to Gemini batchEmbedContents.
+
+type OpenAIEmbeddingRequest struct {
+	Model          string          `json:"model"`
+	Input          json.RawMessage `json:"input"`                     // A string or an array of strings
+	EncodingFormat string          `json:"encoding_format,omitempty"` // "float" (default) or "base64"
+	Dimensions     int             `json:"dimensions,omitempty"`
+}
+
+type OpenAIEmbedding struct {
+	Object    string `json:"object"` // "embedding"
+	Index     int    `json:"index"`
+	Embedding any    `json:"embedding"` // []float64, or a base64 string of little-endian float32s
+}
+
+type OpenAIEmbeddingUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+type OpenAIEmbeddingResponse struct {
+	Object string               `json:"object"` // "list"
+	Data   []OpenAIEmbedding    `json:"data"`
+	Model  string               `json:"model"`
+	Usage  OpenAIEmbeddingUsage `json:"usage"`
+}
+
+// embeddingInputs reads input, a string or an array of strings. Token arrays
+// can't be translated, Gemini has a different tokenizer.
+func embeddingInputs(raw json.RawMessage) ([]string, error) {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return []string{single}, nil
+	}
+	var inputs []string
+	if err := json.Unmarshal(raw, &inputs); err != nil || len(inputs) == 0 {
+		return nil, fmt.Errorf("input must be a string or a non-empty array of strings")
+	}
+	return inputs, nil
+}
+
+func encodeEmbeddingBase64(values []float64) string {
+	var buf bytes.Buffer
+	for _, v := range values {
+		binary.Write(&buf, binary.LittleEndian, math.Float32bits(float32(v)))
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func openAIEmbeddingsHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req OpenAIEmbeddingRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			responsesError(c, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		if req.EncodingFormat != "" && req.EncodingFormat != "float" && req.EncodingFormat != "base64" {
+			responsesError(c, http.StatusBadRequest, "encoding_format must be 'float' or 'base64'")
+			return
+		}
+		inputs, err := embeddingInputs(req.Input)
+		if err != nil {
+			responsesError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		model := km.EmbeddingModel(req.Model)
+		if model == "" {
+			responsesError(c, http.StatusBadRequest, fmt.Sprintf("Model '%s' is not configured and no default_embedding_model is set", req.Model))
+			return
+		}
+
+		embeddings, tokens, upstreamErr := embedTexts(c, km, target, model, inputs, req.Dimensions)
+		if upstreamErr != nil {
+			setRetryAfter(c, upstreamErr)
+			c.JSON(upstreamErr.StatusCode, gin.H{"error": gin.H{"message": geminiErrorMessage(upstreamErr), "type": "upstream_error", "code": upstreamErr.StatusCode}})
+			return
+		}
+		result := OpenAIEmbeddingResponse{Object: "list", Data: []OpenAIEmbedding{}, Model: req.Model, Usage: OpenAIEmbeddingUsage{PromptTokens: tokens, TotalTokens: tokens}}
+		for i, values := range embeddings {
+			var embedding any = values
+			if req.EncodingFormat == "base64" {
+				embedding = encodeEmbeddingBase64(values)
+			}
+			result.Data = append(result.Data, OpenAIEmbedding{Object: "embedding", Index: i, Embedding: embedding})
+		}
+		c.JSON(http.StatusOK, result)
+	}
+}
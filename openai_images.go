@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAI images API (/v1/images/generations) translated to Imagen :predict.
+
+type OpenAIImageRequest struct {
+	Model          string `json:"model,omitempty"`
+	Prompt         string `json:"prompt"`
+	N              int    `json:"n,omitempty"`
+	Size           string `json:"size,omitempty"`            // e.g. 1024x1024, mapped to the closest Imagen aspect ratio
+	ResponseFormat string `json:"response_format,omitempty"` // "url" (default, a data: URL) or "b64_json"
+}
+
+type OpenAIImage struct {
+	URL     string `json:"url,omitempty"`
+	B64JSON string `json:"b64_json,omitempty"`
+}
+
+type OpenAIImageResponse struct {
+	Created int64         `json:"created"`
+	Data    []OpenAIImage `json:"data"`
+}
+
+// Imagen generates at most four images per request
+const maxImagenSamples = 4
+
+var imagenAspectRatios = []struct {
+	name  string
+	ratio float64
+}{
+	{"1:1", 1}, {"3:4", 3.0 / 4}, {"4:3", 4.0 / 3}, {"9:16", 9.0 / 16}, {"16:9", 16.0 / 9},
+}
+
+// imagenAspectRatio returns the Imagen aspect ratio closest to an OpenAI size.
+func imagenAspectRatio(size string) (string, error) {
+	if size == "" || size == "auto" {
+		return "", nil
+	}
+	w, h, ok := strings.Cut(size, "x")
+	width, err1 := strconv.Atoi(w)
+	height, err2 := strconv.Atoi(h)
+	if !ok || err1 != nil || err2 != nil || width <= 0 || height <= 0 {
+		return "", fmt.Errorf("invalid size '%s', expected WIDTHxHEIGHT", size)
+	}
+	ratio := float64(width) / float64(height)
+	best := imagenAspectRatios[0]
+	for _, candidate := range imagenAspectRatios[1:] {
+		if math.Abs(math.Log(candidate.ratio/ratio)) < math.Abs(math.Log(best.ratio/ratio)) {
+			best = candidate
+		}
+	}
+	return best.name, nil
+}
+
+func translateImageRequest(req *OpenAIImageRequest) (*ImagenPredictRequest, error) {
+	if req.Prompt == "" {
+		return nil, fmt.Errorf("prompt is required")
+	}
+	n := req.N
+	if n == 0 {
+		n = 1
+	}
+	if n < 1 || n > maxImagenSamples {
+		return nil, fmt.Errorf("n must be between 1 and %d", maxImagenSamples)
+	}
+	aspectRatio, err := imagenAspectRatio(req.Size)
+	if err != nil {
+		return nil, err
+	}
+	return &ImagenPredictRequest{
+		Instances:  []ImagenInstance{{Prompt: req.Prompt}},
+		Parameters: ImagenParameters{SampleCount: n, AspectRatio: aspectRatio},
+	}, nil
+}
+
+func openAIImageResponse(predictResp *ImagenPredictResponse, responseFormat string) OpenAIImageResponse {
+	result := OpenAIImageResponse{Created: time.Now().Unix(), Data: []OpenAIImage{}}
+	for _, prediction := range predictResp.Predictions {
+		if prediction.BytesBase64Encoded == "" {
+			continue // Filtered
+		}
+		if responseFormat == "b64_json" {
+			result.Data = append(result.Data, OpenAIImage{B64JSON: prediction.BytesBase64Encoded})
+			continue
+		}
+		mimeType := prediction.MimeType
+		if mimeType == "" {
+			mimeType = "image/png"
+		}
+		result.Data = append(result.Data, OpenAIImage{URL: "data:" + mimeType + ";base64," + prediction.BytesBase64Encoded})
+	}
+	return result
+}
+
+func openAIImagesHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req OpenAIImageRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			responsesError(c, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		if req.ResponseFormat != "" && req.ResponseFormat != "url" && req.ResponseFormat != "b64_json" {
+			responsesError(c, http.StatusBadRequest, "response_format must be 'url' or 'b64_json'")
+			return
+		}
+		model := km.ImageModel(req.Model)
+		if model == "" {
+			responsesError(c, http.StatusBadRequest, fmt.Sprintf("Model '%s' is not configured and no default_image_model is set", req.Model))
+			return
+		}
+		predictReq, err := translateImageRequest(&req)
+		if err != nil {
+			responsesError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		body, err := json.Marshal(predictReq)
+		if err != nil {
+			responsesError(c, http.StatusInternalServerError, "Failed to marshal Imagen request body")
+			return
+		}
+
+		resp, modelName, apiKey, upstreamErr := callGemini(c, km, target, model, "predict", body)
+		if upstreamErr != nil {
+			setRetryAfter(c, upstreamErr)
+			c.JSON(upstreamErr.StatusCode, gin.H{"error": gin.H{"message": geminiErrorMessage(upstreamErr), "type": "upstream_error", "code": upstreamErr.StatusCode}})
+			return
+		}
+		defer resp.Body.Close()
+
+		respBody, err := io.ReadAll(resp.Body)
+		var predictResp ImagenPredictResponse
+		if err != nil || json.Unmarshal(respBody, &predictResp) != nil {
+			responsesError(c, http.StatusBadGateway, "Failed to parse upstream response")
+			return
+		}
+		result := openAIImageResponse(&predictResp, req.ResponseFormat)
+		if len(result.Data) > 0 {
+			recordImageUsage(c, km, modelName, apiKey, len(result.Data))
+		}
+		c.JSON(http.StatusOK, result)
+	}
+}
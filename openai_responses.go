@@ -0,0 +1,561 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAI Responses API (/v1/responses) translated to Gemini generateContent.
+
+type ResponsesRequest struct {
+	Model           string          `json:"model"`
+	Input           json.RawMessage `json:"input"` // A string or a list of input items
+	Instructions    string          `json:"instructions,omitempty"`
+	Tools           []ResponsesTool `json:"tools,omitempty"`
+	Stream          bool            `json:"stream,omitempty"`
+	MaxOutputTokens *int            `json:"max_output_tokens,omitempty"`
+	Temperature     *float64        `json:"temperature,omitempty"`
+	TopP            *float64        `json:"top_p,omitempty"`
+	Text            *ResponsesText  `json:"text,omitempty"`
+	Metadata        map[string]any  `json:"metadata,omitempty"`
+}
+
+type ResponsesTool struct {
+	Type        string         `json:"type"` // Only "function" is translated
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+}
+
+type ResponsesText struct {
+	Format struct {
+		Type   string         `json:"type"` // text, json_object or json_schema
+		Schema map[string]any `json:"schema,omitempty"`
+	} `json:"format"`
+}
+
+// ResponsesInputItem covers messages, function calls and function call outputs.
+type ResponsesInputItem struct {
+	Type      string          `json:"type,omitempty"` // message (default), function_call, function_call_output
+	Role      string          `json:"role,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"` // A string or a list of content parts
+	CallID    string          `json:"call_id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Arguments string          `json:"arguments,omitempty"`
+	Output    json.RawMessage `json:"output,omitempty"`
+}
+
+type ResponsesContentPart struct {
+	Type     string `json:"type"` // input_text, output_text, input_image, input_file
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+	FileID   string `json:"file_id,omitempty"`
+	FileData string `json:"file_data,omitempty"`
+	Filename string `json:"filename,omitempty"`
+}
+
+type ResponsesOutputContent struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations"`
+}
+
+type ResponsesOutputItem struct {
+	Type      string                   `json:"type"` // message or function_call
+	ID        string                   `json:"id"`
+	Status    string                   `json:"status"`
+	Role      string                   `json:"role,omitempty"`
+	Content   []ResponsesOutputContent `json:"content,omitempty"`
+	CallID    string                   `json:"call_id,omitempty"`
+	Name      string                   `json:"name,omitempty"`
+	Arguments string                   `json:"arguments,omitempty"`
+}
+
+type ResponsesUsage struct {
+	InputTokens         int `json:"input_tokens"`
+	OutputTokens        int `json:"output_tokens"`
+	TotalTokens         int `json:"total_tokens"`
+	OutputTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"output_tokens_details"`
+}
+
+type ResponsesResponse struct {
+	ID                string                `json:"id"`
+	Object            string                `json:"object"`
+	CreatedAt         int64                 `json:"created_at"`
+	Status            string                `json:"status"`
+	Model             string                `json:"model"`
+	Output            []ResponsesOutputItem `json:"output"`
+	Usage             *ResponsesUsage       `json:"usage,omitempty"`
+	IncompleteDetails *struct {
+		Reason string `json:"reason"`
+	} `json:"incomplete_details"`
+	Error    any            `json:"error"`
+	Metadata map[string]any `json:"metadata,omitempty"`
+}
+
+func randomID(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+// sanitizeSchema drops JSON Schema keywords that Gemini's OpenAPI-subset schema rejects.
+func sanitizeSchema(schema map[string]any) map[string]any {
+	if schema == nil {
+		return nil
+	}
+	result := make(map[string]any, len(schema))
+	for k, v := range schema {
+		switch k {
+		case "$schema", "additionalProperties", "strict", "$id", "$defs", "definitions":
+			continue
+		}
+		switch value := v.(type) {
+		case map[string]any:
+			if k == "properties" {
+				props := make(map[string]any, len(value))
+				for name, prop := range value {
+					if propSchema, ok := prop.(map[string]any); ok {
+						props[name] = sanitizeSchema(propSchema)
+					} else {
+						props[name] = prop
+					}
+				}
+				result[k] = props
+			} else {
+				result[k] = sanitizeSchema(value)
+			}
+		case []any:
+			items := make([]any, len(value))
+			for i, item := range value {
+				if itemSchema, ok := item.(map[string]any); ok {
+					items[i] = sanitizeSchema(itemSchema)
+				} else {
+					items[i] = item
+				}
+			}
+			result[k] = items
+		default:
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// imagePart converts an image URL (data URL or remote URI) into a Gemini part.
+func imagePart(imageURL string) (GeminiPart, error) {
+	if strings.HasPrefix(imageURL, "data:") {
+		header, data, ok := strings.Cut(strings.TrimPrefix(imageURL, "data:"), ",")
+		if !ok || !strings.HasSuffix(header, ";base64") {
+			return GeminiPart{}, fmt.Errorf("only base64 data URLs are supported")
+		}
+		return GeminiPart{InlineData: &GeminiBlob{MimeType: strings.TrimSuffix(header, ";base64"), Data: data}}, nil
+	}
+	mimeType := mime.TypeByExtension(path.Ext(strings.SplitN(imageURL, "?", 2)[0]))
+	if mimeType == "" {
+		mimeType = "image/jpeg"
+	}
+	return GeminiPart{FileData: &GeminiFileData{MimeType: mimeType, FileURI: imageURL}}, nil
+}
+
+func responsesContentParts(raw json.RawMessage) ([]GeminiPart, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return []GeminiPart{{Text: text}}, nil
+	}
+	var items []ResponsesContentPart
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, fmt.Errorf("invalid message content")
+	}
+	var parts []GeminiPart
+	for _, item := range items {
+		switch item.Type {
+		case "input_text", "output_text", "text":
+			parts = append(parts, GeminiPart{Text: item.Text})
+		case "input_image":
+			if item.ImageURL == "" {
+				return nil, fmt.Errorf("input_image requires image_url")
+			}
+			part, err := imagePart(item.ImageURL)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+		case "input_file":
+			if item.FileData == "" {
+				return nil, fmt.Errorf("input_file requires file_data")
+			}
+			part, err := imagePart(item.FileData)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+		default:
+			return nil, fmt.Errorf("unsupported content type '%s'", item.Type)
+		}
+	}
+	return parts, nil
+}
+
+// appendContent adds parts to the conversation, merging consecutive turns of the
+// same role because Gemini expects alternating user/model turns.
+func appendContent(contents []GeminiContent, role string, parts []GeminiPart) []GeminiContent {
+	if len(parts) == 0 {
+		return contents
+	}
+	if len(contents) > 0 && contents[len(contents)-1].Role == role {
+		contents[len(contents)-1].Parts = append(contents[len(contents)-1].Parts, parts...)
+		return contents
+	}
+	return append(contents, GeminiContent{Role: role, Parts: parts})
+}
+
+func translateResponsesRequest(req *ResponsesRequest) (*GeminiRequest, error) {
+	geminiReq := &GeminiRequest{Contents: []GeminiContent{}}
+	var systemParts []GeminiPart
+	if req.Instructions != "" {
+		systemParts = append(systemParts, GeminiPart{Text: req.Instructions})
+	}
+
+	var items []ResponsesInputItem
+	var inputText string
+	if json.Unmarshal(req.Input, &inputText) == nil {
+		items = []ResponsesInputItem{{Role: "user", Content: req.Input}}
+	} else if err := json.Unmarshal(req.Input, &items); err != nil {
+		return nil, fmt.Errorf("input must be a string or a list of input items")
+	}
+
+	callNames := make(map[string]string) // call_id -> function name
+	for _, item := range items {
+		switch item.Type {
+		case "", "message":
+			parts, err := responsesContentParts(item.Content)
+			if err != nil {
+				return nil, err
+			}
+			switch item.Role {
+			case "system", "developer":
+				systemParts = append(systemParts, parts...)
+			case "assistant":
+				geminiReq.Contents = appendContent(geminiReq.Contents, "model", parts)
+			default:
+				geminiReq.Contents = appendContent(geminiReq.Contents, "user", parts)
+			}
+		case "function_call":
+			args := make(map[string]any)
+			if item.Arguments != "" {
+				if err := json.Unmarshal([]byte(item.Arguments), &args); err != nil {
+					return nil, fmt.Errorf("function_call arguments must be a JSON object")
+				}
+			}
+			callNames[item.CallID] = item.Name
+			geminiReq.Contents = appendContent(geminiReq.Contents, "model", []GeminiPart{{FunctionCall: &GeminiFunctionCall{Name: item.Name, Args: args}}})
+		case "function_call_output":
+			var output any
+			var outputText string
+			if json.Unmarshal(item.Output, &outputText) == nil {
+				output = outputText
+				var parsed any
+				if json.Unmarshal([]byte(outputText), &parsed) == nil {
+					output = parsed
+				}
+			} else {
+				json.Unmarshal(item.Output, &output)
+			}
+			name := callNames[item.CallID]
+			if name == "" {
+				name = item.CallID
+			}
+			geminiReq.Contents = appendContent(geminiReq.Contents, "user", []GeminiPart{{FunctionResponse: &GeminiFunctionResponse{Name: name, Response: map[string]any{"output": output}}}})
+		case "reasoning":
+			continue // Reasoning items from previous turns have no Gemini equivalent
+		default:
+			return nil, fmt.Errorf("unsupported input item type '%s'", item.Type)
+		}
+	}
+
+	if len(geminiReq.Contents) == 0 {
+		return nil, fmt.Errorf("no input messages found")
+	}
+	if len(systemParts) > 0 {
+		geminiReq.SystemInstruction = &GeminiContent{Parts: systemParts}
+	}
+
+	var declarations []GeminiFunctionDeclaration
+	for _, tool := range req.Tools {
+		if tool.Type != "function" {
+			log.Printf("Responses API: ignoring unsupported tool type '%s'", tool.Type)
+			continue
+		}
+		declarations = append(declarations, GeminiFunctionDeclaration{Name: tool.Name, Description: tool.Description, Parameters: sanitizeSchema(tool.Parameters)})
+	}
+	if len(declarations) > 0 {
+		geminiReq.Tools = []GeminiTool{{FunctionDeclarations: declarations}}
+	}
+
+	config := &GeminiGenerationConfig{
+		Temperature:     req.Temperature,
+		TopP:            req.TopP,
+		MaxOutputTokens: req.MaxOutputTokens,
+	}
+	if req.Text != nil {
+		switch req.Text.Format.Type {
+		case "json_object":
+			config.ResponseMimeType = "application/json"
+		case "json_schema":
+			config.ResponseMimeType = "application/json"
+			config.ResponseSchema = sanitizeSchema(req.Text.Format.Schema)
+		}
+	}
+	if config.Temperature != nil || config.TopP != nil || config.MaxOutputTokens != nil || config.ResponseMimeType != "" {
+		geminiReq.GenerationConfig = config
+	}
+
+	return geminiReq, nil
+}
+
+func responsesUsage(usage keymanager.GeminiUsageMetadata) *ResponsesUsage {
+	result := &ResponsesUsage{
+		InputTokens:  usage.PromptTokenCount,
+		OutputTokens: usage.CandidatesTokenCount + usage.ThoughtsTokenCount,
+		TotalTokens:  usage.TotalTokenCount,
+	}
+	result.OutputTokensDetails.ReasoningTokens = usage.ThoughtsTokenCount
+	return result
+}
+
+func newResponsesResponse(model string, metadata map[string]any) *ResponsesResponse {
+	return &ResponsesResponse{
+		ID:        randomID("resp_"),
+		Object:    "response",
+		CreatedAt: time.Now().Unix(),
+		Status:    "in_progress",
+		Model:     model,
+		Output:    []ResponsesOutputItem{},
+		Metadata:  metadata,
+	}
+}
+
+// finish sets the final status from the Gemini finish reason.
+func (r *ResponsesResponse) finish(finishReason string) {
+	r.Status = "completed"
+	if finishReason == "MAX_TOKENS" {
+		r.Status = "incomplete"
+		r.IncompleteDetails = &struct {
+			Reason string `json:"reason"`
+		}{Reason: "max_output_tokens"}
+	}
+}
+
+func responsesError(c *gin.Context, status int, message string) {
+	c.JSON(status, gin.H{"error": gin.H{"message": message, "type": "invalid_request_error"}})
+}
+
+func openAIResponsesHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ResponsesRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			responsesError(c, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		if req.Model == "" {
+			responsesError(c, http.StatusBadRequest, "Model not specified in request body")
+			return
+		}
+
+		geminiReq, err := translateResponsesRequest(&req)
+		if err != nil {
+			responsesError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		body, err := json.Marshal(geminiReq)
+		if err != nil {
+			responsesError(c, http.StatusInternalServerError, "Failed to marshal Gemini request body")
+			return
+		}
+
+		action := "generateContent"
+		if req.Stream {
+			action = "streamGenerateContent"
+		}
+		resp, modelName, apiKey, upstreamErr := callGemini(c, km, target, req.Model, action, body)
+		if upstreamErr != nil {
+			setRetryAfter(c, upstreamErr)
+			c.JSON(upstreamErr.StatusCode, gin.H{"error": gin.H{"message": geminiErrorMessage(upstreamErr), "type": "upstream_error", "code": upstreamErr.StatusCode}})
+			return
+		}
+		defer resp.Body.Close()
+
+		if req.Stream {
+			streamResponses(c, km, resp, &req, modelName, apiKey)
+			return
+		}
+
+		var geminiResp GeminiResponse
+		if err := json.NewDecoder(resp.Body).Decode(&geminiResp); err != nil {
+			responsesError(c, http.StatusBadGateway, "Failed to parse upstream response")
+			return
+		}
+		recordUsage(c, km, modelName, apiKey, geminiResp.UsageMetadata)
+
+		result := newResponsesResponse(req.Model, req.Metadata)
+		finishReason := ""
+		if len(geminiResp.Candidates) > 0 {
+			candidate := geminiResp.Candidates[0]
+			finishReason = candidate.FinishReason
+			var text strings.Builder
+			for _, part := range candidate.Content.Parts {
+				if part.Thought {
+					continue
+				}
+				if part.FunctionCall != nil {
+					args, _ := json.Marshal(part.FunctionCall.Args)
+					result.Output = append(result.Output, ResponsesOutputItem{
+						Type: "function_call", ID: randomID("fc_"), Status: "completed",
+						CallID: randomID("call_"), Name: part.FunctionCall.Name, Arguments: string(args),
+					})
+				}
+				text.WriteString(part.Text)
+			}
+			if text.Len() > 0 {
+				message := ResponsesOutputItem{
+					Type: "message", ID: randomID("msg_"), Status: "completed", Role: "assistant",
+					Content: []ResponsesOutputContent{{Type: "output_text", Text: text.String(), Annotations: []any{}}},
+				}
+				result.Output = append([]ResponsesOutputItem{message}, result.Output...)
+			}
+		}
+		result.finish(finishReason)
+		result.Usage = responsesUsage(geminiResp.UsageMetadata)
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// responsesStream writes Responses API server-sent events.
+type responsesStream struct {
+	c        *gin.Context
+	sequence int
+}
+
+func (s *responsesStream) emit(eventType string, payload gin.H) {
+	payload["type"] = eventType
+	payload["sequence_number"] = s.sequence
+	s.sequence++
+	data, _ := json.Marshal(payload)
+	fmt.Fprintf(s.c.Writer, "event: %s\ndata: %s\n\n", eventType, data)
+	s.c.Writer.Flush()
+}
+
+func streamResponses(c *gin.Context, km *keymanager.KeyManager, resp *http.Response, req *ResponsesRequest, modelName, apiKey string) {
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	c.Writer.WriteHeader(http.StatusOK)
+
+	stream := &responsesStream{c: c}
+	result := newResponsesResponse(req.Model, req.Metadata)
+	stream.emit("response.created", gin.H{"response": result})
+	stream.emit("response.in_progress", gin.H{"response": result})
+
+	var message *ResponsesOutputItem
+	messageIndex := -1
+	var text strings.Builder
+	var usage keymanager.GeminiUsageMetadata
+	finishReason := ""
+
+	events := newSSEReader(resp.Body)
+	for {
+		event, err := events.Next()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Responses API: error reading upstream stream: %v", err)
+			}
+			break
+		}
+		var chunk GeminiResponse
+		if err := json.Unmarshal(event.Data, &chunk); err != nil {
+			continue
+		}
+		if chunk.UsageMetadata.TotalTokenCount > 0 {
+			usage = chunk.UsageMetadata
+		}
+		if len(chunk.Candidates) == 0 {
+			continue
+		}
+		candidate := chunk.Candidates[0]
+		if candidate.FinishReason != "" {
+			finishReason = candidate.FinishReason
+		}
+
+		for _, part := range candidate.Content.Parts {
+			if part.Thought {
+				continue
+			}
+			if part.FunctionCall != nil {
+				args, _ := json.Marshal(part.FunctionCall.Args)
+				item := ResponsesOutputItem{Type: "function_call", ID: randomID("fc_"), Status: "in_progress", CallID: randomID("call_"), Name: part.FunctionCall.Name}
+				outputIndex := len(result.Output)
+				result.Output = append(result.Output, item)
+				stream.emit("response.output_item.added", gin.H{"output_index": outputIndex, "item": item})
+				stream.emit("response.function_call_arguments.delta", gin.H{"item_id": item.ID, "output_index": outputIndex, "delta": string(args)})
+				stream.emit("response.function_call_arguments.done", gin.H{"item_id": item.ID, "output_index": outputIndex, "arguments": string(args)})
+				item.Status = "completed"
+				item.Arguments = string(args)
+				result.Output[outputIndex] = item
+				stream.emit("response.output_item.done", gin.H{"output_index": outputIndex, "item": item})
+			}
+			if part.Text == "" {
+				continue
+			}
+			if message == nil {
+				message = &ResponsesOutputItem{Type: "message", ID: randomID("msg_"), Status: "in_progress", Role: "assistant", Content: []ResponsesOutputContent{}}
+				messageIndex = len(result.Output)
+				result.Output = append(result.Output, *message)
+				stream.emit("response.output_item.added", gin.H{"output_index": messageIndex, "item": message})
+				stream.emit("response.content_part.added", gin.H{"item_id": message.ID, "output_index": messageIndex, "content_index": 0,
+					"part": ResponsesOutputContent{Type: "output_text", Text: "", Annotations: []any{}}})
+			}
+			text.WriteString(part.Text)
+			stream.emit("response.output_text.delta", gin.H{"item_id": message.ID, "output_index": messageIndex, "content_index": 0, "delta": part.Text})
+		}
+	}
+
+	if message != nil {
+		content := ResponsesOutputContent{Type: "output_text", Text: text.String(), Annotations: []any{}}
+		stream.emit("response.output_text.done", gin.H{"item_id": message.ID, "output_index": messageIndex, "content_index": 0, "text": content.Text})
+		stream.emit("response.content_part.done", gin.H{"item_id": message.ID, "output_index": messageIndex, "content_index": 0, "part": content})
+		message.Status = "completed"
+		message.Content = []ResponsesOutputContent{content}
+		result.Output[messageIndex] = *message
+		stream.emit("response.output_item.done", gin.H{"output_index": messageIndex, "item": message})
+	}
+
+	if usage.TotalTokenCount > 0 {
+		recordUsage(c, km, modelName, apiKey, usage)
+	}
+	result.finish(finishReason)
+	result.Usage = responsesUsage(usage)
+	if result.Status == "incomplete" {
+		stream.emit("response.incomplete", gin.H{"response": result})
+	} else {
+		stream.emit("response.completed", gin.H{"response": result})
+	}
+}
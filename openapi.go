@@ -0,0 +1,295 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// apiOperation describes one endpoint in the generated OpenAPI document.
+// Request and Response are zero values of the Go types used by the handler.
+type apiOperation struct {
+	Method      string
+	Path        string // OpenAPI path template, e.g. /v1beta/models/{model}
+	Tag         string
+	Summary     string
+	Query       []string // Optional query parameters
+	Request     any
+	Response    any
+	ContentType string // Response content type, defaults to application/json
+}
+
+type statusCodeResponse struct {
+	StatusCode int `json:"status_code"`
+}
+
+type statusOKResponse struct {
+	Status string `json:"status"`
+}
+
+type simulationsResponse struct {
+	Simulations []keymanager.ErrorSimulation `json:"simulations"`
+}
+
+type requestHistoryResponse struct {
+	Requests []RequestRecord `json:"requests"`
+}
+
+type clusterStatusResponse struct {
+	Enabled bool                       `json:"enabled"`
+	Members []keymanager.ClusterMember `json:"members"`
+	Owners  map[string][]string        `json:"owners"`
+}
+
+type corpusKeysResponse struct {
+	Corpora []keymanager.CorpusKey `json:"corpora"`
+}
+
+type openAIChatRequest struct {
+	Model    string `json:"model"`
+	Messages []struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	} `json:"messages"`
+	Stream bool `json:"stream,omitempty"`
+}
+
+var apiOperations = []apiOperation{
+	{Method: "POST", Path: "/v1beta/models/{model}", Tag: "Gemini", Summary: "Proxy a Gemini API call. {model} may include an action, e.g. gemini-1.5-pro-latest:generateContent",
+		Request: GeminiRequest{}, Response: GeminiResponse{}},
+	{Method: "POST", Path: "/v1/{path}", Tag: "OpenAI", Summary: "Proxy an OpenAI-compatible call (e.g. /v1/chat/completions) to Gemini's OpenAI endpoint",
+		Request: openAIChatRequest{}, Response: OpenAIResponse{}},
+	{Method: "POST", Path: "/v1/responses", Tag: "OpenAI", Summary: "OpenAI Responses API translated to Gemini generateContent, with server-sent events when stream is true",
+		Request: ResponsesRequest{}, Response: ResponsesResponse{}},
+	{Method: "POST", Path: "/v1/images/generations", Tag: "OpenAI", Summary: "OpenAI images API translated to an Imagen :predict call",
+		Request: OpenAIImageRequest{}, Response: OpenAIImageResponse{}},
+	{Method: "POST", Path: "/v1/embeddings", Tag: "OpenAI", Summary: "OpenAI embeddings API translated to Gemini batchEmbedContents",
+		Request: OpenAIEmbeddingRequest{}, Response: OpenAIEmbeddingResponse{}},
+	{Method: "POST", Path: "/v1/messages", Tag: "Anthropic", Summary: "Anthropic Messages API translated to Gemini generateContent, with server-sent events when stream is true",
+		Request: AnthropicRequest{}, Response: AnthropicResponse{}},
+	{Method: "GET", Path: "/ws/{path}", Tag: "Gemini", Summary: "Live API (BidiGenerateContent) WebSocket session, opened upstream with a key for the model of the setup message"},
+	{Method: "GET", Path: "/v1beta/models", Tag: "Gemini", Summary: "List the available models, only the configured ones when list_configured_models is set"},
+	{Method: "GET", Path: "/v1beta/models/{model}", Tag: "Gemini", Summary: "Get a model's info"},
+	{Method: "GET", Path: "/v1beta/corpora", Tag: "Gemini", Summary: "List the semantic retriever corpora of every configured key"},
+	{Method: "POST", Path: "/v1beta/corpora", Tag: "Gemini", Summary: "Create a corpus under the key owning the fewest corpora"},
+	{Method: "POST", Path: "/v1beta/corpora/{path}", Tag: "Gemini", Summary: "Proxy a corpus, document or chunk call (GET, POST, PATCH and DELETE) with the key that owns the corpus"},
+	{Method: "POST", Path: "/upload/v1beta/files", Tag: "Gemini", Summary: "Upload a file (multipart or resumable) with the key owning the fewest files; the upload URL returned for resumable uploads points at the proxy"},
+	{Method: "GET", Path: "/v1beta/files", Tag: "Gemini", Summary: "List the uploaded files of every configured key"},
+	{Method: "GET", Path: "/v1beta/files/{path}", Tag: "Gemini", Summary: "Get, download or delete (DELETE) a file with the key that uploaded it"},
+	{Method: "GET", Path: "/v1beta/{path}", Tag: "Gemini", Summary: "Pass any other Gemini API call (GET, POST, PUT, PATCH and DELETE), e.g. models.get or tunedModels, through with a key from the rotation"},
+	{Method: "POST", Path: "/api/chat", Tag: "Ollama", Summary: "Ollama chat API translated to Gemini generateContent",
+		Request: OllamaRequest{}, Response: OllamaStreamResponse{}, ContentType: "application/x-ndjson"},
+	{Method: "POST", Path: "/api/embed", Tag: "Ollama", Summary: "Ollama embed API translated to Gemini batchEmbedContents",
+		Request: OllamaEmbedRequest{}, Response: OllamaEmbedResponse{}},
+	{Method: "POST", Path: "/api/embeddings", Tag: "Ollama", Summary: "Older Ollama embeddings API for a single prompt",
+		Request: OllamaEmbeddingsRequest{}, Response: OllamaEmbeddingsResponse{}},
+	{Method: "GET", Path: "/api/version", Tag: "Ollama", Summary: "Ollama version, for clients detecting an Ollama server"},
+	{Method: "GET", Path: "/api/ps", Tag: "Ollama", Summary: "The configured models, listed as running Ollama models",
+		Response: OllamaPsResponse{}},
+	{Method: "GET", Path: "/healthz", Tag: "Status", Summary: "Liveness probe",
+		Response: statusOKResponse{}},
+	{Method: "GET", Path: "/readyz", Tag: "Status", Summary: "Readiness probe, 503 while a config reload is in progress",
+		Response: statusOKResponse{}},
+	{Method: "GET", Path: "/api/status_data", Tag: "Status", Summary: "Full status snapshot, or a delta when since is given",
+		Query: []string{"since"}, Response: keymanager.StatusData{}},
+	{Method: "GET", Path: "/api/events", Tag: "Status", Summary: "Server-sent key lifecycle events: key_exhausted, key_cooled_down, quota_reset, key_invalid and all_keys_down",
+		Response: keyEvent{}, ContentType: "text/event-stream"},
+	{Method: "GET", Path: "/api/request_history", Tag: "Status", Summary: "Recent proxied requests, newest first",
+		Query: []string{"limit"}, Response: requestHistoryResponse{}},
+	{Method: "GET", Path: "/api/usage", Tag: "Status", Summary: "Token usage over a time range in minute, hour or day buckets, optionally for one model or key",
+		Query: []string{"model", "key", "from", "to", "granularity"}, Response: usageQueryResponse{}},
+	{Method: "GET", Path: "/api/usage/export", Tag: "Status", Summary: "CSV download of daily tokens, requests and estimated cost per key and model",
+		Query: []string{"model", "key", "from", "to"}, Response: "", ContentType: "text/csv"},
+	{Method: "GET", Path: "/api/cluster", Tag: "Status", Summary: "Cluster members and which instance owns each key",
+		Response: clusterStatusResponse{}},
+	{Method: "GET", Path: "/api/corpora", Tag: "Status", Summary: "Known corpora and the (masked) key whose project owns each",
+		Response: corpusKeysResponse{}},
+	{Method: "GET", Path: "/api/files", Tag: "Status", Summary: "Uploaded files and the (masked) key whose project owns each",
+		Response: fileKeysResponse{}},
+	{Method: "POST", Path: "/api/test_key", Tag: "Admin", Summary: "Test an API key against a model",
+		Request: TestRequest{}, Response: statusCodeResponse{}},
+	{Method: "POST", Path: "/api/reload", Tag: "Admin", Summary: "Reload config.json (keys, models, limits) without a restart",
+		Response: statusOKResponse{}},
+	{Method: "POST", Path: "/api/keys", Tag: "Admin", Summary: "Add keys to the priority (default) or secondary pool and save config.json",
+		Request: KeysRequest{}, Response: keysResponse{}},
+	{Method: "DELETE", Path: "/api/keys", Tag: "Admin", Summary: "Remove keys from config.json; their usage is archived",
+		Request: KeysRequest{}, Response: keysResponse{}},
+	{Method: "POST", Path: "/api/keys/{key}/pause", Tag: "Admin", Summary: "Take a key out of rotation, keeping its usage",
+		Response: pauseKeyResponse{}},
+	{Method: "POST", Path: "/api/keys/{key}/resume", Tag: "Admin", Summary: "Put a paused key back into rotation",
+		Response: pauseKeyResponse{}},
+	{Method: "GET", Path: "/api/client_keys", Tag: "Admin", Summary: "Issued client keys (masked) with today's token usage",
+		Response: clientKeysResponse{}},
+	{Method: "POST", Path: "/api/client_keys", Tag: "Admin", Summary: "Issue a client key with an optional daily token limit; the full key is only returned here",
+		Request: ClientKeyRequest{}, Response: keymanager.ClientKeyStatus{}},
+	{Method: "DELETE", Path: "/api/client_keys/{key}", Tag: "Admin", Summary: "Revoke a client key",
+		Response: statusOKResponse{}},
+	{Method: "POST", Path: "/api/enable_model", Tag: "Admin", Summary: "Re-enable a temporarily disabled key/model pair",
+		Request: TestRequest{}, Response: statusOKResponse{}},
+	{Method: "POST", Path: "/api/reset_quotas", Tag: "Admin", Summary: "Reset daily quotas now, optionally only for one model or key, and reschedule the next reset",
+		Request: ResetQuotasRequest{}, Response: resetQuotasResponse{}},
+	{Method: "GET", Path: "/api/simulate_error", Tag: "Testing", Summary: "List active error simulations",
+		Response: simulationsResponse{}},
+	{Method: "POST", Path: "/api/simulate_error", Tag: "Testing", Summary: "Add an error simulation",
+		Request: keymanager.ErrorSimulation{}, Response: simulationsResponse{}},
+	{Method: "DELETE", Path: "/api/simulate_error", Tag: "Testing", Summary: "Clear all error simulations",
+		Response: statusOKResponse{}},
+	{Method: "GET", Path: "/api/fault_injection", Tag: "Testing", Summary: "Current fault injection settings",
+		Response: keymanager.FaultInjectionConfig{}},
+	{Method: "POST", Path: "/api/fault_injection", Tag: "Testing", Summary: "Replace fault injection settings (test_mode only)",
+		Request: keymanager.FaultInjectionConfig{}, Response: keymanager.FaultInjectionConfig{}},
+}
+
+// schemaGenerator converts Go types into OpenAPI schemas, collecting named
+// struct types under components/schemas.
+type schemaGenerator struct {
+	components map[string]any
+}
+
+func (g *schemaGenerator) schemaFor(t reflect.Type) map[string]any {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := g.schemaFor(t.Elem())
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		if _, ok := g.components[t.Name()]; !ok {
+			g.components[t.Name()] = map[string]any{} // Placeholder to stop recursion
+			g.components[t.Name()] = g.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]any{}
+	}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	g.addFields(t, properties)
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+func (g *schemaGenerator) addFields(t reflect.Type, properties map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || !field.IsExported() {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			g.addFields(embedded, properties)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schemaFor(field.Type)
+	}
+}
+
+func buildOpenAPISpec() map[string]any {
+	g := &schemaGenerator{components: make(map[string]any)}
+	paths := make(map[string]map[string]any)
+
+	for _, op := range apiOperations {
+		operation := map[string]any{
+			"summary": op.Summary,
+			"tags":    []string{op.Tag},
+		}
+
+		var parameters []map[string]any
+		for _, segment := range strings.Split(op.Path, "/") {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				parameters = append(parameters, map[string]any{
+					"name": strings.Trim(segment, "{}"), "in": "path", "required": true,
+					"schema": map[string]any{"type": "string"},
+				})
+			}
+		}
+		for _, name := range op.Query {
+			parameters = append(parameters, map[string]any{
+				"name": name, "in": "query", "required": false,
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+
+		if op.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": g.schemaFor(reflect.TypeOf(op.Request))},
+				},
+			}
+		}
+
+		contentType := op.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		response := map[string]any{"description": "Success"}
+		if op.Response != nil {
+			response["content"] = map[string]any{
+				contentType: map[string]any{"schema": g.schemaFor(reflect.TypeOf(op.Response))},
+			}
+		}
+		operation["responses"] = map[string]any{"200": response}
+
+		if paths[op.Path] == nil {
+			paths[op.Path] = make(map[string]any)
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "GeminiLooper",
+			"description": "Gemini API key rotation proxy with OpenAI and Ollama compatible endpoints",
+			"version":     "1.0.0",
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": g.components},
+	}
+}
+
+func openAPIHandler() gin.HandlerFunc {
+	var once sync.Once
+	var spec map[string]any
+	return func(c *gin.Context) {
+		once.Do(func() { spec = buildOpenAPISpec() })
+		c.JSON(http.StatusOK, spec)
+	}
+}
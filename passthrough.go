@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// v1betaRouteHandler serves everything under /v1beta. Generation calls on a
+// model, corpora and files have their own handlers; any other endpoint (models.get,
+// tunedModels, cachedContents, ...) is passed through with a rotated key.
+func v1betaRouteHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
+	generate := proxyHandler(km, target)
+	retrieval := retrievalProxyHandler(km, target)
+	files := filesProxyHandler(km, target)
+	passthrough := v1betaPassthroughHandler(km, target)
+	return func(c *gin.Context) {
+		path := c.Param("path")
+		modelName, isModelCall := strings.CutPrefix(path, "/models/")
+		switch {
+		case path == "/corpora" || strings.HasPrefix(path, "/corpora/"):
+			// retrievalProxyHandler expects the path below /v1beta/corpora
+			setParam(c, "path", strings.TrimPrefix(path, "/corpora"))
+			retrieval(c)
+		case path == "/files" || strings.HasPrefix(path, "/files/"):
+			files(c)
+		case c.Request.Method == http.MethodPost && isModelCall && strings.Contains(modelName, ":") && !strings.Contains(modelName, "/"):
+			setParam(c, "model_name", modelName)
+			generate(c)
+		default:
+			passthrough(c)
+		}
+	}
+}
+
+func setParam(c *gin.Context, key, value string) {
+	for i := range c.Params {
+		if c.Params[i].Key == key {
+			c.Params[i].Value = value
+			return
+		}
+	}
+	c.Params = append(c.Params, gin.Param{Key: key, Value: value})
+}
+
+// passthroughModel returns the configured model a /v1beta path is about, e.g.
+// gemini-1.5-pro-latest for /models/gemini-1.5-pro-latest, or "".
+func passthroughModel(km *keymanager.KeyManager, path string) string {
+	rest, ok := strings.CutPrefix(path, "/models/")
+	if !ok {
+		return ""
+	}
+	modelName, _, _ := strings.Cut(rest, "/")
+	modelName, _, _ = strings.Cut(modelName, ":")
+	if !km.HasModel(modelName) {
+		return ""
+	}
+	return modelName
+}
+
+// v1betaPassthroughHandler forwards any method on a /v1beta endpoint with a key
+// from the rotation: the requested model's pool for model endpoints, the default
+// model's otherwise. Usage reported in the response is recorded for the model.
+func v1betaPassthroughHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read request body"})
+			return
+		}
+		if isModelListRequest(c) {
+			if cached, ok := km.CachedModelList(c.Request.URL.RawQuery); ok {
+				c.Header(responseCacheHeader, "HIT")
+				serveModelList(c, km, cached)
+				return
+			}
+		}
+		keyModel := passthroughModel(km, c.Param("path"))
+		if keyModel == "" {
+			keyModel = km.Config().DefaultModel
+		}
+
+		retry := km.NewRetryPolicy()
+		for retry.Next() {
+			apiKey, modelName, delay, err := km.WaitForKey(c.Request.Context(), keyModel, 0)
+			if err != nil {
+				geminiNoKeyError(c, "Failed to get API key", err)
+				return
+			}
+			if delay > 0 {
+				time.Sleep(delay)
+			}
+
+			upstreamURL := km.UpstreamURLFor(c.Request.Context(), target, apiKey, c.Request.URL.Path)
+			upstreamURL.RawQuery = c.Request.URL.RawQuery
+			proxyReq, err := http.NewRequest(c.Request.Method, upstreamURL.String(), bytes.NewReader(body))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create proxy request"})
+				return
+			}
+			proxyReq.Header = km.ForwardHeaders(c.Request.Header)
+
+			resp, err := sendUpstream(c, km, km.UpstreamClient(), proxyReq, modelName, apiKey)
+			if err != nil {
+				c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send request to upstream server"})
+				return
+			}
+
+			// A 403 here may only mean the resource (a tuned model, a cached content)
+			// belongs to another key's project, so it's passed through without disabling the key
+			switch {
+			case resp.StatusCode == http.StatusTooManyRequests:
+				respBody, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				km.HandleRateLimitError(modelName, apiKey, parseRateLimitError(resp.Header, respBody))
+				log.Printf("Rate limit hit for model %s with key %s (passthrough). Retrying...", modelName, keymanager.MaskKey(apiKey))
+				continue
+			case retry.Retryable(resp.StatusCode):
+				resp.Body.Close()
+				wait := retry.Backoff()
+				log.Printf("Upstream returned %d for %s with key %s. Retrying in %v...", resp.StatusCode, c.Request.URL.Path, keymanager.MaskKey(apiKey), wait)
+				time.Sleep(wait)
+				continue
+			}
+
+			if resp.StatusCode == http.StatusOK && isModelListRequest(c) {
+				respBody, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to read upstream response"})
+					return
+				}
+				km.StoreModelList(c.Request.URL.RawQuery, respBody)
+				serveModelList(c, km, respBody)
+				return
+			}
+
+			for k, v := range resp.Header {
+				c.Writer.Header()[k] = v
+			}
+			c.Writer.WriteHeader(resp.StatusCode)
+			var src io.Reader = resp.Body
+			var usage *usageSniffer
+			contentType := resp.Header.Get("Content-Type")
+			if resp.StatusCode == http.StatusOK && (strings.Contains(contentType, "json") || strings.Contains(contentType, "event-stream")) {
+				usage = newUsageSniffer(geminiUsageTokens)
+				src = io.TeeReader(resp.Body, usage)
+			}
+			if _, err := copyFlushing(c.Writer, src); err != nil {
+				log.Printf("Error streaming response to client: %v", err)
+			}
+			resp.Body.Close()
+			if usage != nil {
+				if metadata, ok := usage.Total(); ok {
+					recordUsage(c, km, modelName, apiKey, metadata)
+				}
+			}
+			return
+		}
+
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service unavailable after multiple retries"})
+	}
+}
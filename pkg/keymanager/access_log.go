@@ -0,0 +1,6 @@
+package keymanager
+
+type AccessLogConfig struct {
+	Enabled bool   `json:"enabled"`
+	Output  string `json:"output,omitempty"` // "stdout" (default) or a file path
+}
@@ -0,0 +1,78 @@
+package keymanager
+
+import (
+	"log"
+	"strings"
+)
+
+// With adaptive_tpm, the TPM limit used for delays and key selection is learned
+// per key and model instead of taken from tpm_limit as is, since Google changes
+// the real limits without notice. A per-minute 429 well below the limit lowers
+// it; running close to it without a 429 raises it again, up to twice tpm_limit.
+// Each step moves only part of the way, so a single 429 caused by another client
+// of the same project doesn't halve a key's throughput, but consistent ones do.
+
+const (
+	tpmNearLimit       = 90 // Percent of the limit counted as "at the limit"
+	tpmMinLearnedShare = 10 // The learned limit never drops below this percentage of tpm_limit
+	tpmMaxLearnedShare = 200
+)
+
+// tpmLimit returns the TPM limit of a key and model: the learned one when
+// adaptive_tpm is on and something was learned, else tpm_limit. Must be called
+// with km.mutex held.
+func (km *KeyManager) tpmLimit(modelName string, usage *LanguageModelUsage) int {
+	configured := km.config.Models[modelName].TpmLimit
+	if !km.config.AdaptiveTPM || usage == nil || usage.LearnedTpmLimit <= 0 || configured <= 0 {
+		return configured
+	}
+	return min(max(usage.LearnedTpmLimit, configured*tpmMinLearnedShare/100), configured*tpmMaxLearnedShare/100)
+}
+
+// learnTPMFromRateLimit lowers the learned limit of a key and model that got a
+// per-minute 429 well below it. Must be called with km.mutex held.
+func (km *KeyManager) learnTPMFromRateLimit(modelName, key string, usage *LanguageModelUsage, info RateLimitInfo) {
+	usage.LastRateLimited = km.now().Unix()
+	if !km.config.AdaptiveTPM || info.Scope == RateLimitPerDay {
+		return
+	}
+	if info.QuotaID != "" && !strings.Contains(info.QuotaID, "Tokens") {
+		return // A request limit, it says nothing about tokens
+	}
+	limit := km.tpmLimit(modelName, usage)
+	past60sTokens := usage.Past24HoursTokenUsage.LastMinuteTokens(usage.LastRateLimited)
+	if limit <= 0 || past60sTokens >= limit*tpmNearLimit/100 {
+		return // Hit where expected
+	}
+	usage.LearnedTpmLimit = limit - (limit-past60sTokens)/4
+	usage.LearnedTpmLimit = km.tpmLimit(modelName, usage) // Not below the floor
+	usage.TpmLimitAdjusted = usage.LastRateLimited
+	km.touchUsage(usage)
+	log.Printf("Key %s for model %s was rate limited at %d tokens per minute. TPM limit lowered from %d to %d.", MaskKey(key), modelName, past60sTokens, limit, usage.LearnedTpmLimit)
+}
+
+// learnTPMFromUsage raises the learned limit of a key and model that used close
+// to it in the last minute without a 429, at most once a minute. Must be called
+// with km.mutex held.
+func (km *KeyManager) learnTPMFromUsage(modelName, key string, usage *LanguageModelUsage) {
+	if !km.config.AdaptiveTPM {
+		return
+	}
+	now := km.now().Unix()
+	if usage.ProbablyExceeded || now-usage.LastRateLimited < 60 || now-usage.TpmLimitAdjusted < 60 {
+		return
+	}
+	limit := km.tpmLimit(modelName, usage)
+	past60sTokens := usage.Past24HoursTokenUsage.LastMinuteTokens(now)
+	if limit <= 0 || past60sTokens < limit*tpmNearLimit/100 {
+		return
+	}
+	usage.LearnedTpmLimit = limit + limit/10
+	usage.LearnedTpmLimit = km.tpmLimit(modelName, usage) // Capped
+	if usage.LearnedTpmLimit == limit {
+		return
+	}
+	usage.TpmLimitAdjusted = now
+	km.touchUsage(usage)
+	log.Printf("Key %s for model %s used %d tokens in the last minute without a rate limit. TPM limit raised from %d to %d.", MaskKey(key), modelName, past60sTokens, limit, usage.LearnedTpmLimit)
+}
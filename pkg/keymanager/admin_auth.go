@@ -0,0 +1,40 @@
+package keymanager
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// AdminAuthConfig protects the status page and the /api admin endpoints. Either
+// or both of token and username/password can be set.
+type AdminAuthConfig struct {
+	Token    string `json:"token,omitempty"` // Sent as "Authorization: Bearer <token>", or as the basic auth password
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Enabled reports whether admin_auth sets any credentials, false for nil.
+func (a *AdminAuthConfig) Enabled() bool {
+	return a != nil && (a.Token != "" || a.Password != "")
+}
+
+func secretEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Allows reports whether the request carries the admin credentials.
+func (a *AdminAuthConfig) Allows(r *http.Request) bool {
+	if auth := r.Header.Get("Authorization"); a.Token != "" && strings.HasPrefix(auth, "Bearer ") {
+		return secretEqual(strings.TrimPrefix(auth, "Bearer "), a.Token)
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	if a.Password != "" && secretEqual(username, a.Username) && secretEqual(password, a.Password) {
+		return true
+	}
+	// Lets browsers log into the status page with the token through the basic auth prompt
+	return a.Token != "" && secretEqual(password, a.Token)
+}
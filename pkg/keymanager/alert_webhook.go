@@ -0,0 +1,115 @@
+package keymanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// AlertWebhookConfig posts to a URL when a model has no available keys left, so
+// the outage is noticed before clients start reporting 429s.
+type AlertWebhookConfig struct {
+	URL string `json:"url"`
+	// Go text/template for the request body, with .Model, .Message and .Time.
+	// {{json .Message}} renders a quoted JSON string.
+	Template        string            `json:"template,omitempty"`
+	ContentType     string            `json:"content_type,omitempty"` // Default application/json
+	Headers         map[string]string `json:"headers,omitempty"`
+	CooldownSeconds int               `json:"cooldown_seconds,omitempty"` // Minimum time between alerts for a model, default 600
+}
+
+const defaultAlertTemplate = `{"model": {{json .Model}}, "message": {{json .Message}}, "time": {{json .Time}}}`
+
+type alertData struct {
+	Model   string
+	Message string
+	Time    string
+}
+
+var alertFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// alertNoKeys publishes AllKeysDown for a model that ran out of keys, at most
+// once per cooldown. Must be called with km.mutex held.
+func (km *KeyManager) alertNoKeys(modelName string) {
+	config := km.config.AlertWebhook
+	cooldown := 600 * time.Second
+	if config != nil && config.CooldownSeconds > 0 {
+		cooldown = time.Duration(config.CooldownSeconds) * time.Second
+	}
+	if km.now().Sub(km.alertsSent[modelName]) < cooldown {
+		return
+	}
+	km.alertsSent[modelName] = km.now()
+	km.publish(Event{Type: AllKeysDown, Model: modelName})
+}
+
+// alertWebhookEvent fires the webhook for AllKeysDown events.
+func (km *KeyManager) alertWebhookEvent(event Event) {
+	if event.Type != AllKeysDown {
+		return
+	}
+	km.mutex.Lock()
+	config := km.config.AlertWebhook
+	km.mutex.Unlock()
+	if config == nil || config.URL == "" {
+		return
+	}
+	sendAlertWebhook(*config, alertData{
+		Model:   event.Model,
+		Message: fmt.Sprintf("No available keys for model %s", event.Model),
+		Time:    event.Time.Format(time.RFC3339),
+	})
+}
+
+func sendAlertWebhook(config AlertWebhookConfig, data alertData) {
+	text := config.Template
+	if text == "" {
+		text = defaultAlertTemplate
+	}
+	tmpl, err := template.New("alert").Funcs(alertFuncs).Parse(text)
+	if err != nil {
+		log.Printf("ERROR: invalid alert webhook template: %v", err)
+		return
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		log.Printf("ERROR: failed to render alert webhook template: %v", err)
+		return
+	}
+
+	req, err := http.NewRequest("POST", config.URL, &body)
+	if err != nil {
+		log.Printf("ERROR: failed to create alert webhook request: %v", err)
+		return
+	}
+	contentType := config.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("ERROR: alert webhook failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("ERROR: alert webhook returned status %d", resp.StatusCode)
+		return
+	}
+	log.Printf("Alert webhook sent: %s", data.Message)
+}
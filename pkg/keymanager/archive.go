@@ -0,0 +1,130 @@
+package keymanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// UsageArchiveConfig controls the dated files written at each quota reset.
+// Archiving is on by default whenever usage is persisted.
+type UsageArchiveConfig struct {
+	Disabled      bool   `json:"disabled,omitempty"`
+	Dir           string `json:"dir,omitempty"`            // Defaults to the directory of key_usage.json
+	RetentionDays int    `json:"retention_days,omitempty"` // Archives older than this are deleted (default 30, -1 keeps all)
+}
+
+// DailyUsageArchive is the content of one key_usage-YYYY-MM-DD.json file.
+type DailyUsageArchive struct {
+	Date        string                              `json:"date"` // Day the quota period started, in the configured timezone
+	PeriodStart time.Time                           `json:"period_start"`
+	PeriodEnd   time.Time                           `json:"period_end"`
+	Keys        map[string]map[string]ArchivedUsage `json:"keys"` // apiKey -> modelName -> usage
+	ModelTotals map[string]int                      `json:"model_totals"`
+	TotalTokens int                                 `json:"total_tokens"`
+	TotalCost   float64                             `json:"total_cost,omitempty"` // Estimated USD
+}
+
+type ArchivedUsage struct {
+	Tokens   int     `json:"tokens"`
+	Requests int     `json:"requests,omitempty"`
+	Cost     float64 `json:"cost,omitempty"` // Estimated USD
+	Images   int     `json:"images,omitempty"`
+	Exceeded bool    `json:"exceeded,omitempty"`
+}
+
+// dailyUsageArchive snapshots the day's counters before they are reset. Must be called with km.mutex held.
+func (km *KeyManager) dailyUsageArchive() *DailyUsageArchive {
+	archive := &DailyUsageArchive{
+		Date:        km.nextReset.AddDate(0, 0, -1).Format("2006-01-02"),
+		PeriodStart: km.nextReset.AddDate(0, 0, -1),
+		PeriodEnd:   km.nextReset,
+		Keys:        make(map[string]map[string]ArchivedUsage),
+		ModelTotals: make(map[string]int),
+	}
+	for _, key := range km.allKeys() {
+		for modelName := range km.config.Models {
+			usage, ok := km.usage[modelName+"_"+key]
+			if !ok || (usage.TodayUsage == 0 && usage.TodayRequests == 0 && usage.TodayImages == 0 && !usage.Exceeded) {
+				continue
+			}
+			if archive.Keys[key] == nil {
+				archive.Keys[key] = make(map[string]ArchivedUsage)
+			}
+			archive.Keys[key][modelName] = ArchivedUsage{Tokens: usage.TodayUsage, Requests: usage.TodayRequests, Cost: usage.TodayCost, Images: usage.TodayImages, Exceeded: usage.Exceeded}
+			archive.ModelTotals[modelName] += usage.TodayUsage
+			archive.TotalTokens += usage.TodayUsage
+			archive.TotalCost += usage.TodayCost
+		}
+	}
+	return archive
+}
+
+// usageArchivePath returns where the archive for a date is written, next to
+// key_usage.json by default: key_usage-2006-01-02.json.
+func (km *KeyManager) usageArchivePath(date string) string {
+	dir := filepath.Dir(km.usageFile)
+	if km.config.UsageArchive != nil && km.config.UsageArchive.Dir != "" {
+		dir = DataFilePath(km.config, km.config.UsageArchive.Dir)
+	}
+	base := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(km.usageFile), ".json"), gobUsageSuffix)
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.json", base, date))
+}
+
+func (km *KeyManager) writeUsageArchive(archive *DailyUsageArchive) {
+	if km.usageFile == "" || (km.config.UsageArchive != nil && km.config.UsageArchive.Disabled) {
+		return
+	}
+
+	path := km.usageArchivePath(archive.Date)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Printf("ERROR: failed to create usage archive directory: %v", err)
+		return
+	}
+	data, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		log.Printf("ERROR: failed to marshal usage archive: %v", err)
+		return
+	}
+	if err := writeFileAtomic(path, data, false); err != nil {
+		log.Printf("ERROR: failed to write usage archive %s: %v", path, err)
+		return
+	}
+	log.Printf("Usage for %s archived to %s (%d tokens).", archive.Date, path, archive.TotalTokens)
+
+	km.pruneUsageArchives()
+}
+
+// pruneUsageArchives deletes archives older than the retention period.
+func (km *KeyManager) pruneUsageArchives() {
+	retentionDays := 30
+	if km.config.UsageArchive != nil && km.config.UsageArchive.RetentionDays != 0 {
+		retentionDays = km.config.UsageArchive.RetentionDays
+	}
+	if retentionDays < 0 {
+		return
+	}
+
+	pattern := km.usageArchivePath("*")
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return
+	}
+	prefix, suffix, _ := strings.Cut(filepath.Base(pattern), "*")
+	cutoff := km.nextReset.AddDate(0, 0, -1-retentionDays)
+	for _, path := range matches {
+		date, err := time.ParseInLocation("2006-01-02", strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), prefix), suffix), km.nextReset.Location())
+		if err != nil || !date.Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to remove old usage archive %s: %v", path, err)
+			continue
+		}
+		log.Printf("Removed usage archive %s (older than %d days).", path, retentionDays)
+	}
+}
@@ -0,0 +1,93 @@
+package keymanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces the file at path so that a crash leaves either the
+// old or the new content, never a truncated file: the data is written to a temp
+// file in the same directory, synced and renamed over path. With backup, the
+// previous content is kept as path + ".bak".
+func writeFileAtomic(path string, data []byte, backup bool) error {
+	// Replace the file a symlink points to, not the link
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	dir := filepath.Dir(path)
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if backup {
+		if _, err := os.Stat(path); err == nil {
+			backupPath := path + ".bak"
+			os.Remove(backupPath)
+			if err := os.Link(path, backupPath); err != nil {
+				log.Printf("WARN: failed to keep a backup of %s: %v", path, err)
+			}
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// readJSONWithBackup decodes the JSON file at path, falling back to the backup
+// kept by writeFileAtomic when the file is missing, empty or corrupt. The error
+// is the one for path when neither can be read.
+func readJSONWithBackup(path string, v any) error {
+	err := readJSONFile(path, v)
+	if err == nil {
+		return nil
+	}
+	backupPath := path + ".bak"
+	if backupErr := readJSONFile(backupPath, v); backupErr == nil {
+		log.Printf("WARN: %s could not be read (%v), loaded the backup %s instead.", path, err, backupPath)
+		return nil
+	}
+	return err
+}
+
+func readJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("%s is empty", path)
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,16 @@
+package keymanager
+
+// Proxied request bodies are buffered, and buffered again for every retry, so
+// their size is capped by max_request_body_mb. Resumable uploads stream their
+// body upstream and aren't limited.
+const defaultMaxRequestBodyMB = 32
+
+func (km *KeyManager) MaxRequestBodyBytes() int64 {
+	km.mutex.RLock()
+	mb := km.config.MaxRequestBodyMB
+	km.mutex.RUnlock()
+	if mb <= 0 {
+		mb = defaultMaxRequestBodyMB
+	}
+	return int64(mb) << 20
+}
@@ -0,0 +1,226 @@
+package keymanager
+
+import (
+	"bytes"
+	"log"
+)
+
+// CircuitBreakerConfig takes a key out of rotation for a model while too many of
+// its requests fail. Only failures that say something about the key or upstream
+// count, see keyFailure; 429s are left to the rate limit cooldown, and errors
+// caused by the client's request don't count at all.
+type CircuitBreakerConfig struct {
+	ErrorRate     float64 `json:"error_rate,omitempty"`     // Fraction of failed requests that trips the breaker, default 0.5
+	MinRequests   int     `json:"min_requests,omitempty"`   // Requests in the window before the rate is judged, default 5
+	WindowSeconds int     `json:"window_seconds,omitempty"` // Default 60
+	OpenSeconds   int     `json:"open_seconds,omitempty"`   // How long a tripped key is skipped, default 300
+}
+
+const (
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// circuitBreaker tracks the outcomes of one key/model pair. After the open
+// window the breaker is half-open: the next request picking the key is sent as a
+// trial while other requests keep skipping it, and its outcome either closes the
+// breaker or opens it for another window. A trial that doesn't report back
+// within breakerTrialTimeout, e.g. because the client left, is given to the next
+// request.
+type circuitBreaker struct {
+	outcomes   []breakerOutcome
+	openUntil  int64 // Unix time, 0 unless open or half-open
+	trialSince int64 // Unix time the trial request was sent, 0 if none is in flight
+}
+
+const breakerTrialTimeout = 60 // Seconds
+
+func (b *circuitBreaker) halfOpen(now int64) bool {
+	return b.openUntil != 0 && now >= b.openUntil
+}
+
+func (b *circuitBreaker) trialInFlight(now int64) bool {
+	return b.trialSince != 0 && now-b.trialSince < breakerTrialTimeout
+}
+
+type breakerOutcome struct {
+	at     int64
+	failed bool
+}
+
+func (b *circuitBreaker) errorRate() float64 {
+	if len(b.outcomes) == 0 {
+		return 0
+	}
+	failed := 0
+	for _, o := range b.outcomes {
+		if o.failed {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(b.outcomes))
+}
+
+func (c CircuitBreakerConfig) withDefaults() CircuitBreakerConfig {
+	if c.ErrorRate <= 0 {
+		c.ErrorRate = 0.5
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = 5
+	}
+	if c.WindowSeconds <= 0 {
+		c.WindowSeconds = 60
+	}
+	if c.OpenSeconds <= 0 {
+		c.OpenSeconds = 300
+	}
+	return c
+}
+
+// keyFailure reports whether an upstream error is the key's or upstream's fault
+// rather than the client's: a failed connection (0), 401, 403, a 5xx, or a 400
+// for an invalid key or a project that can't use the API. errorBody is the start
+// of the response body, only looked at for 400s.
+func keyFailure(statusCode int, errorBody []byte) bool {
+	switch {
+	case statusCode == 0, statusCode == 401, statusCode == 403, statusCode >= 500:
+		return true
+	case statusCode == 400:
+		return bytes.Contains(errorBody, []byte("API_KEY_INVALID")) || bytes.Contains(errorBody, []byte("FAILED_PRECONDITION"))
+	}
+	return false
+}
+
+// RecordUpstreamResult feeds an upstream response status, or 0 for a failed
+// connection, into the key's circuit breaker for the model. errorBody is the
+// start of the body of a 400 response, which tells a bad key from a bad request.
+func (km *KeyManager) RecordUpstreamResult(modelName, key string, statusCode int, errorBody []byte) {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	if km.config.CircuitBreaker == nil {
+		return
+	}
+	config := km.config.CircuitBreaker.withDefaults()
+	usageKey := modelName + "_" + key
+	failed := keyFailure(statusCode, errorBody)
+	counted := statusCode != 429 && (statusCode < 400 || failed)
+	now := km.now().Unix()
+
+	km.breakerMutex.Lock()
+	changed := km.recordBreakerOutcome(config, usageKey, modelName, key, statusCode, failed, counted, now)
+	km.breakerMutex.Unlock()
+	if changed {
+		km.touchBreaker(usageKey)
+	}
+}
+
+// recordBreakerOutcome updates the breaker of a key/model pair and reports
+// whether its state changed. Must be called with km.breakerMutex held.
+func (km *KeyManager) recordBreakerOutcome(config CircuitBreakerConfig, usageKey, modelName, key string, statusCode int, failed, counted bool, now int64) bool {
+	b := km.breakers[usageKey]
+	if b == nil {
+		if !counted {
+			return false
+		}
+		b = &circuitBreaker{}
+		km.breakers[usageKey] = b
+	}
+
+	if b.halfOpen(now) {
+		if !counted {
+			b.trialSince = 0 // Says nothing about the key, let the next request try
+			return false
+		}
+		b.trialSince = 0
+		if failed {
+			b.openUntil = now + int64(config.OpenSeconds)
+			log.Printf("Circuit breaker for key %s, model %s: trial request failed with %d, open again for %ds.", MaskKey(key), modelName, statusCode, config.OpenSeconds)
+		} else {
+			b.openUntil = 0
+			log.Printf("Circuit breaker for key %s, model %s: trial request succeeded, closed.", MaskKey(key), modelName)
+		}
+		return true
+	}
+	if !counted || b.openUntil != 0 { // Open: requests sent before it tripped don't count
+		return false
+	}
+
+	b.outcomes = append(b.outcomes, breakerOutcome{at: now, failed: failed})
+	start := 0
+	for start < len(b.outcomes) && b.outcomes[start].at <= now-int64(config.WindowSeconds) {
+		start++
+	}
+	b.outcomes = b.outcomes[start:]
+
+	if failed && len(b.outcomes) >= config.MinRequests && b.errorRate() >= config.ErrorRate {
+		log.Printf("Circuit breaker for key %s, model %s tripped: %.0f%% of %d requests failed. Skipping the key for %ds.", MaskKey(key), modelName, b.errorRate()*100, len(b.outcomes), config.OpenSeconds)
+		b.openUntil = now + int64(config.OpenSeconds)
+		b.outcomes = nil
+		return true
+	}
+	return false
+}
+
+// breakerTripped reports whether the key's breaker for the model is open, or
+// half-open with its trial request in flight. Must be called with km.mutex held.
+func (km *KeyManager) breakerTripped(modelName, key string, now int64) bool {
+	if km.config.CircuitBreaker == nil {
+		return false
+	}
+	km.breakerMutex.Lock()
+	defer km.breakerMutex.Unlock()
+	b := km.breakers[modelName+"_"+key]
+	return b != nil && b.openUntil != 0 && (now < b.openUntil || b.trialInFlight(now))
+}
+
+// startBreakerTrial makes the request that picked the key the trial request of
+// its half-open breaker, if it has one. Must be called with km.mutex held for
+// writing.
+func (km *KeyManager) startBreakerTrial(modelName, key string, now int64) {
+	if km.config.CircuitBreaker == nil {
+		return
+	}
+	usageKey := modelName + "_" + key
+	km.breakerMutex.Lock()
+	b := km.breakers[usageKey]
+	started := b != nil && b.halfOpen(now) && !b.trialInFlight(now)
+	if started {
+		b.trialSince = now
+	}
+	km.breakerMutex.Unlock()
+	if started {
+		log.Printf("Circuit breaker for key %s, model %s is half-open, sending a trial request.", MaskKey(key), modelName)
+		km.touchBreaker(usageKey)
+	}
+}
+
+// breakerState returns "open", "half_open" or "" for the status page. Must be
+// called with km.mutex held.
+func (km *KeyManager) breakerState(usageKey string, now int64) string {
+	if km.config.CircuitBreaker == nil {
+		return ""
+	}
+	km.breakerMutex.Lock()
+	defer km.breakerMutex.Unlock()
+	b := km.breakers[usageKey]
+	switch {
+	case b == nil || b.openUntil == 0:
+		return ""
+	case b.openUntil > now:
+		return breakerOpen
+	}
+	return breakerHalfOpen
+}
+
+// touchBreaker marks the key's usage as changed for the delta status API. Must
+// be called with km.mutex held, and without the usage entry's lock.
+func (km *KeyManager) touchBreaker(usageKey string) {
+	usage, ok := km.usage[usageKey]
+	if !ok {
+		return
+	}
+	lock := km.usageLock(usageKey)
+	lock.Lock()
+	km.touchUsage(usage)
+	lock.Unlock()
+}
@@ -0,0 +1,73 @@
+package keymanager
+
+import (
+	"testing"
+	"time"
+)
+
+func newBreakerTestKeyManager(t *testing.T) (*KeyManager, *FakeClock) {
+	t.Helper()
+	km, err := New(&Config{
+		PriorityKeys:           []string{"AIzaTestKey1", "AIzaTestKey2"},
+		Models:                 map[string]LanguageModel{"m": {TpmLimit: 1000000}},
+		ResetAfter:             "01:00",
+		NextQuotaResetDatetime: "2099-01-02 01:00",
+		Timezone:               "UTC",
+		DefaultModel:           "m",
+		CircuitBreaker:         &CircuitBreakerConfig{MinRequests: 3, OpenSeconds: 60},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(km.Stop)
+	clock := NewFakeClock(fakeStart)
+	km.SetClock(clock)
+	return km, clock
+}
+
+func TestCircuitBreakerIgnoresClientErrors(t *testing.T) {
+	km, _ := newBreakerTestKeyManager(t)
+	for _, statusCode := range []int{400, 404, 413, 429} {
+		for i := 0; i < 5; i++ {
+			km.RecordUpstreamResult("m", "AIzaTestKey1", statusCode, []byte(`{"error":{"status":"INVALID_ARGUMENT"}}`))
+		}
+	}
+	if state := km.breakerState("m_AIzaTestKey1", fakeStart.Unix()); state != "" {
+		t.Fatalf("breaker %s after client errors, want closed", state)
+	}
+
+	for i := 0; i < 3; i++ {
+		km.RecordUpstreamResult("m", "AIzaTestKey1", 400, []byte(`{"error":{"details":[{"reason":"API_KEY_INVALID"}]}}`))
+	}
+	if state := km.breakerState("m_AIzaTestKey1", fakeStart.Unix()); state != breakerOpen {
+		t.Fatalf("breaker %q after invalid key errors, want open", state)
+	}
+}
+
+func TestCircuitBreakerSingleTrial(t *testing.T) {
+	km, clock := newBreakerTestKeyManager(t)
+	for i := 0; i < 3; i++ {
+		km.RecordUpstreamResult("m", "AIzaTestKey1", 500, nil)
+	}
+	for i := 0; i < 3; i++ {
+		if key, _, _, _ := km.GetKey("m"); key != "AIzaTestKey2" {
+			t.Fatalf("got %s while the breaker is open, want AIzaTestKey2", key)
+		}
+	}
+
+	clock.Advance(61 * time.Second)
+	picked := 0
+	for i := 0; i < 5; i++ {
+		if key, _, _, _ := km.GetKey("m"); key == "AIzaTestKey1" {
+			picked++
+		}
+	}
+	if picked != 1 {
+		t.Fatalf("half-open key picked %d times, want a single trial request", picked)
+	}
+
+	km.RecordUpstreamResult("m", "AIzaTestKey1", 200, nil)
+	if state := km.breakerState("m_AIzaTestKey1", clock.Now().Unix()); state != "" {
+		t.Fatalf("breaker %s after a successful trial, want closed", state)
+	}
+}
@@ -0,0 +1,109 @@
+package keymanager
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// Client keys are API keys the proxy issues to its own users. When any are
+// configured, proxy requests must carry one (in the same places clients put a
+// Gemini, OpenAI or Anthropic key), and each client's tokens are counted
+// against its daily_token_limit until the next quota reset.
+
+type ClientKeyConfig struct {
+	Key             string `json:"key"`
+	Name            string `json:"name"`
+	DailyTokenLimit int    `json:"daily_token_limit,omitempty"` // 0 means unlimited
+	SystemPrompt    string `json:"system_prompt,omitempty"`     // Put in front of the system instruction of the client's requests
+	Priority        string `json:"priority,omitempty"`          // "low" for batch clients, see priority.go
+}
+
+type ClientKeyStatus struct {
+	Key             string `json:"key"` // Masked, except in the response that issues the key
+	Name            string `json:"name"`
+	DailyTokenLimit int    `json:"daily_token_limit"`
+	TodayUsage      int    `json:"today_usage"`
+}
+
+// clientKeyFor returns the configured client key matching token.
+// Must be called with km.mutex held.
+func (km *KeyManager) clientKeyFor(token string) (ClientKeyConfig, bool) {
+	for _, ck := range km.config.ClientKeys {
+		if token != "" && ck.Key == token {
+			return ck, true
+		}
+	}
+	return ClientKeyConfig{}, false
+}
+
+// ClientKey returns the configured client key matching token and the tokens it
+// used since the last quota reset.
+func (km *KeyManager) ClientKey(token string) (ClientKeyConfig, int, bool) {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	ck, ok := km.clientKeyFor(token)
+	return ck, km.clientUsage[ck.Key], ok
+}
+
+// RecordClientUsage counts tokens against a client key's daily limit.
+func (km *KeyManager) RecordClientUsage(clientKey string, tokens int) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+	km.clientUsage[clientKey] += tokens
+}
+
+// ClientKeys lists the issued client keys with today's usage.
+func (km *KeyManager) ClientKeys() []ClientKeyStatus {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	statuses := make([]ClientKeyStatus, 0, len(km.config.ClientKeys))
+	for _, ck := range km.config.ClientKeys {
+		statuses = append(statuses, ClientKeyStatus{
+			Key:             MaskKey(ck.Key),
+			Name:            ck.Name,
+			DailyTokenLimit: ck.DailyTokenLimit,
+			TodayUsage:      km.clientUsage[ck.Key],
+		})
+	}
+	return statuses
+}
+
+// IssueClientKey creates a new client key and persists config.json.
+func (km *KeyManager) IssueClientKey(name string, dailyTokenLimit int) (ClientKeyConfig, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return ClientKeyConfig{}, fmt.Errorf("failed to generate client key: %v", err)
+	}
+	ck := ClientKeyConfig{Key: "glk-" + hex.EncodeToString(b), Name: name, DailyTokenLimit: dailyTokenLimit}
+
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+	km.config.ClientKeys = append(km.config.ClientKeys, ck)
+	log.Printf("Client key %s issued for '%s'.", MaskKey(ck.Key), name)
+	return ck, km.saveConfig()
+}
+
+// RevokeClientKey removes a client key and persists config.json. known is false
+// if no such key was issued.
+func (km *KeyManager) RevokeClientKey(key string) (known bool, err error) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	kept := make([]ClientKeyConfig, 0, len(km.config.ClientKeys))
+	for _, ck := range km.config.ClientKeys {
+		if ck.Key == key {
+			known = true
+			continue
+		}
+		kept = append(kept, ck)
+	}
+	if !known {
+		return false, nil
+	}
+	km.config.ClientKeys = kept
+	delete(km.clientUsage, key)
+	log.Printf("Client key %s revoked.", MaskKey(key))
+	return true, km.saveConfig()
+}
@@ -0,0 +1,92 @@
+package keymanager
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells a KeyManager the time. Quota resets, the rate limit windows,
+// cooldowns and scheduled delays all go by it, so tests can move time forward
+// instead of waiting. Timers and tickers of the background workers still run
+// on the real time.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the real time, the default Clock.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// FakeClock is a Clock that only moves when told to, for tests.
+type FakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewFakeClock returns a FakeClock standing at now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to t, e.g. just past a quota reset.
+func (c *FakeClock) Set(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = t
+}
+
+// SetClock makes km, and the usage store it created, tell the time by clock
+// instead of the real time. Set it right after creating km, before recording
+// usage.
+func (km *KeyManager) SetClock(clock Clock) {
+	km.clock.Store(&clock)
+	if store, ok := km.usageStore.(interface{ setClock(Clock) }); ok {
+		store.setClock(clock)
+	}
+	if km.sharedState != nil {
+		km.sharedState.setClock(clock)
+	}
+}
+
+// now is the time of km's clock.
+func (km *KeyManager) now() time.Time {
+	if clock := km.clock.Load(); clock != nil {
+		return (*clock).Now()
+	}
+	return time.Now()
+}
+
+// storeClock tells a usage store the time for the 24 hour windows it rebuilds
+// and the events it expires. It is the real time until SetClock hands it the
+// KeyManager's clock.
+type storeClock struct {
+	clock atomic.Pointer[Clock]
+}
+
+func (c *storeClock) setClock(clock Clock) {
+	c.clock.Store(&clock)
+}
+
+func (c *storeClock) now() time.Time {
+	if clock := c.clock.Load(); clock != nil {
+		return (*clock).Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,79 @@
+package keymanager
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// The fake clock starts far past the real time, so the reset scheduler, which
+// checks once right at start, never resets on its own during a test.
+var fakeStart = time.Date(2099, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func newClockTestKeyManager(t *testing.T, model LanguageModel) (*KeyManager, *FakeClock) {
+	t.Helper()
+	km, err := New(&Config{
+		PriorityKeys:           []string{"AIzaTestKey1"},
+		Models:                 map[string]LanguageModel{"m": model},
+		ResetAfter:             "01:00",
+		NextQuotaResetDatetime: "2099-01-02 01:00",
+		Timezone:               "UTC",
+		DefaultModel:           "m",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(km.Stop)
+	clock := NewFakeClock(fakeStart)
+	km.SetClock(clock)
+	return km, clock
+}
+
+func TestFakeClockDailyReset(t *testing.T) {
+	km, clock := newClockTestKeyManager(t, LanguageModel{TpmLimit: 1000000, RpdLimit: 2})
+
+	for i := 0; i < 2; i++ {
+		if _, _, _, err := km.GetKey("m"); err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+	}
+	var noKey *NoKeyError
+	if _, _, _, err := km.GetKey("m"); !errors.As(err, &noKey) {
+		t.Fatalf("got %v after using up rpd_limit, want a NoKeyError", err)
+	}
+
+	// Not due yet
+	clock.Set(time.Date(2099, 1, 2, 0, 59, 0, 0, time.UTC))
+	km.resetIfDue()
+	if _, _, _, err := km.GetKey("m"); err == nil {
+		t.Fatal("key available again before the reset")
+	}
+
+	clock.Set(time.Date(2099, 1, 2, 1, 1, 0, 0, time.UTC))
+	km.resetIfDue()
+	if _, _, _, err := km.GetKey("m"); err != nil {
+		t.Fatalf("no key after the daily reset: %v", err)
+	}
+	if want := time.Date(2099, 1, 3, 1, 0, 0, 0, time.UTC); !km.NextReset().Equal(want) {
+		t.Errorf("next reset %v, want %v", km.NextReset(), want)
+	}
+}
+
+func TestFakeClockTPMWindow(t *testing.T) {
+	km, clock := newClockTestKeyManager(t, LanguageModel{TpmLimit: 1000})
+
+	key, model, delay, err := km.GetKey("m")
+	if err != nil || delay != 0 {
+		t.Fatalf("first request: delay %v, err %v", delay, err)
+	}
+	km.RecordUsage(model, key, GeminiUsageMetadata{TotalTokenCount: 1000})
+
+	if _, _, delay, err = km.GetKey("m"); err != nil || delay <= 0 || delay > time.Minute {
+		t.Fatalf("with the TPM limit used up: delay %v, err %v, want a wait of up to a minute", delay, err)
+	}
+
+	clock.Advance(61 * time.Second)
+	if _, _, delay, err = km.GetKey("m"); err != nil || delay != 0 {
+		t.Fatalf("after the window passed: delay %v, err %v, want no wait", delay, err)
+	}
+}
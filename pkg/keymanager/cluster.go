@@ -0,0 +1,201 @@
+package keymanager
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClusterConfig enables key ownership partitioning across several proxy
+// instances. Every key is owned by exactly one live instance, chosen by
+// consistent hashing, so TPM accounting for a key stays on a single writer.
+type ClusterConfig struct {
+	Self                string   `json:"self"`                  // This instance's base URL as seen by its peers
+	Peers               []string `json:"peers"`                 // Base URLs of the other instances
+	HealthCheckInterval int      `json:"health_check_interval"` // Seconds between peer health checks (default 5)
+	FailureThreshold    int      `json:"failure_threshold"`     // Consecutive failed checks before a peer's keys are taken over (default 3)
+	VirtualNodes        int      `json:"virtual_nodes"`         // Points per instance on the hash ring (default 100)
+}
+
+type ClusterMember struct {
+	URL      string `json:"url"`
+	Alive    bool   `json:"alive"`
+	Failures int    `json:"failures"`
+	Self     bool   `json:"self"`
+}
+
+type ringPoint struct {
+	hash   uint64
+	member string
+}
+
+type keyOwnership struct {
+	config  ClusterConfig
+	members map[string]*ClusterMember
+	ring    []ringPoint
+	client  *http.Client
+	mutex   sync.RWMutex
+}
+
+func newKeyOwnership(config ClusterConfig) (*keyOwnership, error) {
+	if config.Self == "" {
+		return nil, fmt.Errorf("cluster.self is required")
+	}
+	if config.HealthCheckInterval <= 0 {
+		config.HealthCheckInterval = 5
+	}
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = 3
+	}
+	if config.VirtualNodes <= 0 {
+		config.VirtualNodes = 100
+	}
+
+	o := &keyOwnership{
+		config:  config,
+		members: make(map[string]*ClusterMember),
+		client:  &http.Client{Timeout: 2 * time.Second},
+	}
+	self := strings.TrimRight(config.Self, "/")
+	o.members[self] = &ClusterMember{URL: self, Alive: true, Self: true}
+	for _, peer := range config.Peers {
+		peer = strings.TrimRight(peer, "/")
+		if peer != self {
+			// Peers start alive so a restarting instance doesn't grab every key at once.
+			o.members[peer] = &ClusterMember{URL: peer, Alive: true}
+		}
+	}
+	o.rebuildRing()
+	return o, nil
+}
+
+func ringHash(value string) uint64 {
+	sum := sha256.Sum256([]byte(value))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// rebuildRing recomputes the hash ring from the live members. Must be called with o.mutex held for writing.
+func (o *keyOwnership) rebuildRing() {
+	o.ring = o.ring[:0]
+	for url, member := range o.members {
+		if !member.Alive {
+			continue
+		}
+		for i := 0; i < o.config.VirtualNodes; i++ {
+			o.ring = append(o.ring, ringPoint{hash: ringHash(fmt.Sprintf("%s#%d", url, i)), member: url})
+		}
+	}
+	sort.Slice(o.ring, func(i, j int) bool { return o.ring[i].hash < o.ring[j].hash })
+}
+
+func (o *keyOwnership) ownerOf(key string) string {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	if len(o.ring) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(o.ring), func(i int) bool { return o.ring[i].hash >= h })
+	if i == len(o.ring) {
+		i = 0
+	}
+	return o.ring[i].member
+}
+
+func (o *keyOwnership) owns(key string) bool {
+	return o.ownerOf(key) == strings.TrimRight(o.config.Self, "/")
+}
+
+func (o *keyOwnership) snapshot() []ClusterMember {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	result := make([]ClusterMember, 0, len(o.members))
+	for _, member := range o.members {
+		result = append(result, *member)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].URL < result[j].URL })
+	return result
+}
+
+func (o *keyOwnership) checkPeers() {
+	o.mutex.RLock()
+	var peers []string
+	for url, member := range o.members {
+		if !member.Self {
+			peers = append(peers, url)
+		}
+	}
+	o.mutex.RUnlock()
+
+	for _, peer := range peers {
+		healthy := false
+		resp, err := o.client.Get(peer + "/healthz")
+		if err == nil {
+			healthy = resp.StatusCode == http.StatusOK
+			resp.Body.Close()
+		}
+
+		o.mutex.Lock()
+		member := o.members[peer]
+		if healthy {
+			member.Failures = 0
+			if !member.Alive {
+				member.Alive = true
+				o.rebuildRing()
+				log.Printf("Cluster: peer %s is back, handing its keys back.", peer)
+			}
+		} else {
+			member.Failures++
+			if member.Alive && member.Failures >= o.config.FailureThreshold {
+				member.Alive = false
+				o.rebuildRing()
+				log.Printf("Cluster: peer %s failed %d health checks, taking over its keys.", peer, member.Failures)
+			}
+		}
+		o.mutex.Unlock()
+	}
+}
+
+func (km *KeyManager) clusterHealthChecker() {
+	ticker := time.NewTicker(time.Duration(km.ownership.config.HealthCheckInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			km.ownership.checkPeers()
+		case <-km.stopChan:
+			return
+		}
+	}
+}
+
+// ownsKey reports whether this instance may use the key. Without cluster mode every key is owned.
+func (km *KeyManager) ownsKey(key string) bool {
+	return km.ownership == nil || km.ownership.owns(key)
+}
+
+// ClusterStatus returns the instances of the cluster and the keys each of them
+// owns, masked, by instance URL. ok is false when cluster mode is off.
+func (km *KeyManager) ClusterStatus() (members []ClusterMember, owners map[string][]string, ok bool) {
+	if km.ownership == nil {
+		return nil, nil, false
+	}
+	km.mutex.RLock()
+	keys := km.allKeys()
+	km.mutex.RUnlock()
+
+	owners = make(map[string][]string)
+	for _, key := range keys {
+		owner := km.ownership.ownerOf(key)
+		owners[owner] = append(owners[owner], MaskKey(key))
+	}
+	return km.ownership.snapshot(), owners, true
+}
@@ -0,0 +1,58 @@
+package keymanager
+
+import (
+	"context"
+	"sync"
+)
+
+// max_concurrency on a model caps its upstream requests in flight, counted
+// until the response body is closed. A burst of parallel requests then waits
+// for a slot instead of setting off a wave of 429s that puts every key into
+// cooldown at once.
+
+type concurrencyLimiter struct {
+	slots map[string]chan struct{} // key: model name, capacity: max_concurrency
+	mutex sync.Mutex
+}
+
+// modelSlots returns the semaphore of a model, or nil when it has no limit.
+// A changed limit gets a new semaphore; requests holding a slot of the old one
+// release it there.
+func (km *KeyManager) modelSlots(modelName string) chan struct{} {
+	km.mutex.RLock()
+	limit := km.config.Models[modelName].MaxConcurrency
+	km.mutex.RUnlock()
+
+	l := &km.concurrency
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if limit <= 0 {
+		delete(l.slots, modelName)
+		return nil
+	}
+	slots, ok := l.slots[modelName]
+	if !ok || cap(slots) != limit {
+		if l.slots == nil {
+			l.slots = make(map[string]chan struct{})
+		}
+		slots = make(chan struct{}, limit)
+		l.slots[modelName] = slots
+	}
+	return slots
+}
+
+// AcquireModelSlot waits for a free slot of the model, returning the function
+// that gives it back.
+func (km *KeyManager) AcquireModelSlot(ctx context.Context, modelName string) (func(), error) {
+	slots := km.modelSlots(modelName)
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-slots }) }, nil
+}
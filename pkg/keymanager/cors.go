@@ -0,0 +1,21 @@
+package keymanager
+
+import "strings"
+
+// CORSConfig lets browser-based clients, e.g. a web UI calling
+// /v1/chat/completions, use the proxy directly.
+type CORSConfig struct {
+	AllowedOrigins []string `json:"allowed_origins"`           // "*" allows any origin
+	AllowedHeaders []string `json:"allowed_headers,omitempty"` // Default: the headers clients send keys and bodies with
+	AllowedMethods []string `json:"allowed_methods,omitempty"` // Default: GET, POST, PUT, PATCH, DELETE
+	MaxAge         int      `json:"max_age,omitempty"`         // Seconds browsers may cache a preflight response, default 600
+}
+
+func (config *CORSConfig) AllowsOrigin(origin string) bool {
+	for _, allowed := range config.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,32 @@
+package keymanager
+
+// Cost estimates use the per-model prices in config.json (USD per million
+// tokens). Thinking tokens are billed at the output price.
+
+func (m LanguageModel) cost(usage GeminiUsageMetadata) float64 {
+	input := float64(usage.PromptTokenCount) * m.InputPrice
+	output := float64(usage.CandidatesTokenCount+usage.ThoughtsTokenCount) * m.OutputPrice
+	return (input + output) / 1e6
+}
+
+// costChartData is a single-dataset chart of today's cost per model, for a bar chart.
+func costChartData(costs map[string]float64, modelOrder []string) ChartData {
+	chartData := ChartData{Labels: []string{}, Datasets: []ChartDataset{}}
+	dataset := ChartDataset{
+		Label:           "Estimated cost today (USD)",
+		Data:            []float64{},
+		BorderColor:     "rgba(75, 192, 192, 1)",
+		BackgroundColor: "rgba(75, 192, 192, 0.2)",
+	}
+	for _, modelName := range modelOrder {
+		if costs[modelName] == 0 {
+			continue
+		}
+		chartData.Labels = append(chartData.Labels, modelName)
+		dataset.Data = append(dataset.Data, costs[modelName])
+	}
+	if len(dataset.Data) > 0 {
+		chartData.Datasets = append(chartData.Datasets, dataset)
+	}
+	return chartData
+}
@@ -0,0 +1,50 @@
+package keymanager
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// dataDir holds config.json, key_usage.json and the other files the proxy
+// writes, e.g. a mounted volume in a container. It is set with the -data-dir
+// flag or the GEMINILOOPER_DATA_DIR environment variable; empty means the
+// working directory.
+var dataDir string
+
+func init() {
+	SetDataDir(os.Getenv("GEMINILOOPER_DATA_DIR"))
+}
+
+// SetDataDir points the proxy at a data directory. config.json is looked up
+// there unless GEMINILOOPER_CONFIG names it explicitly.
+func SetDataDir(dir string) {
+	dataDir = dir
+	configPath = filepath.Join(dir, "config.json")
+	if path := os.Getenv("GEMINILOOPER_CONFIG"); path != "" {
+		configPath = path
+	}
+}
+
+// DataDir returns the data directory, "" for the working directory.
+func DataDir() string {
+	return dataDir
+}
+
+// ConfigPath returns the path config.json is read from.
+func ConfigPath() string {
+	return configPath
+}
+
+// DataFilePath resolves a data file against the data directory: the one set by
+// flag or environment, else data_dir in config.json, else the working
+// directory. Absolute paths are returned as they are.
+func DataFilePath(config *Config, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	dir := dataDir
+	if dir == "" && config != nil {
+		dir = config.DataDir
+	}
+	return filepath.Join(dir, name)
+}
@@ -0,0 +1,20 @@
+// Package keymanager rotates Gemini API keys across their per-model rate
+// limits and daily quotas. It is the core of the GeminiLooper proxy, which
+// wires it to HTTP handlers, and can be used on its own:
+//
+//	km, err := keymanager.New(&keymanager.Config{...})
+//	if err != nil {
+//		return err
+//	}
+//	defer km.Stop()
+//	key, model, delay, err := km.GetKey("gemini-2.5-flash")
+//	if err != nil {
+//		return err // A *NoKeyError when every key is exhausted
+//	}
+//	time.Sleep(delay) // Until the key has room under its limits
+//	// ...send the request for model with key...
+//	km.RecordUsage(model, key, metadata)
+//
+// NewKeyManager instead loads config.json and the saved usage from the data
+// directory (see SetDataDir) and keeps saving usage there, as the proxy does.
+package keymanager
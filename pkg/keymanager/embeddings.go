@@ -0,0 +1,13 @@
+package keymanager
+
+// EmbeddingModel picks the Gemini model for a translated embedding request: the
+// requested one if it is configured, else default_embedding_model (OpenAI and
+// Ollama names like text-embedding-3-small or nomic-embed-text end up there).
+func (km *KeyManager) EmbeddingModel(requested string) string {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	if _, ok := km.config.Models[requested]; ok {
+		return requested
+	}
+	return km.config.DefaultEmbeddingModel
+}
@@ -0,0 +1,110 @@
+package keymanager
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Key lifecycle events are published on an event bus as they happen, so the
+// notification backends, the alert webhook, the status page and embedding
+// programs learn about them without re-deriving state from the usage map.
+
+// EventType names a key lifecycle event.
+type EventType string
+
+const (
+	KeyExhausted  EventType = "key_exhausted"   // A key used up its daily quota for a model
+	KeyCooledDown EventType = "key_cooled_down" // A key is out of rotation for a model after rate limiting, until Until
+	QuotaReset    EventType = "quota_reset"     // The daily quotas were reset, the next reset is at Until
+	KeyInvalid    EventType = "key_invalid"     // A key was rejected with 403 Forbidden and disabled
+	AllKeysDown   EventType = "all_keys_down"   // No key is available for a model
+)
+
+// Event is one key lifecycle event.
+type Event struct {
+	Type  EventType
+	Time  time.Time
+	Model string    // Empty for QuotaReset and KeyInvalid
+	Key   string    // Empty for QuotaReset and AllKeysDown
+	Until time.Time // Set for KeyCooledDown and QuotaReset
+}
+
+// eventBufferSize is how many events a subscriber can fall behind before
+// events for it are dropped.
+const eventBufferSize = 64
+
+// eventBus delivers events to every subscriber on its own goroutine, so
+// publishing never waits for a subscriber and is safe with km.mutex held.
+type eventBus struct {
+	mutex       sync.Mutex
+	subscribers map[chan Event]bool
+	closed      bool
+}
+
+func (b *eventBus) publish(event Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for events := range b.subscribers {
+		select {
+		case events <- event:
+		default:
+			log.Printf("WARN: event subscriber is falling behind, dropped a %s event.", event.Type)
+		}
+	}
+}
+
+func (b *eventBus) subscribe(handler func(Event)) (unsubscribe func()) {
+	events := make(chan Event, eventBufferSize)
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return func() {}
+	}
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan Event]bool)
+	}
+	b.subscribers[events] = true
+	b.mutex.Unlock()
+
+	go func() {
+		for event := range events {
+			handler(event)
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+			if b.subscribers[events] {
+				delete(b.subscribers, events)
+				close(events)
+			}
+		})
+	}
+}
+
+// close ends the delivery to every subscriber.
+func (b *eventBus) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for events := range b.subscribers {
+		close(events)
+	}
+	b.subscribers = nil
+	b.closed = true
+}
+
+// Subscribe calls handler with every event published from now on, in order,
+// on a goroutine of its own. Events are dropped for a handler that falls far
+// behind. The returned function unsubscribes; Stop unsubscribes everyone.
+func (km *KeyManager) Subscribe(handler func(Event)) (unsubscribe func()) {
+	return km.events.subscribe(handler)
+}
+
+// publish sends an event to the subscribers. Safe to call with km.mutex held.
+func (km *KeyManager) publish(event Event) {
+	event.Time = km.now()
+	km.events.publish(event)
+}
@@ -0,0 +1,12 @@
+package keymanager
+
+// FallbackProviderConfig is an OpenAI-compatible API that OpenAI-format requests
+// are forwarded to when no Gemini key is available, e.g. OpenRouter or a local
+// Ollama, so clients get an answer from another model instead of a 429.
+type FallbackProviderConfig struct {
+	Name   string            `json:"name,omitempty"` // For logs and the X-Fallback-Provider response header
+	URL    string            `json:"url"`            // Base URL of the OpenAI API, e.g. https://openrouter.ai/api/v1
+	APIKey string            `json:"api_key,omitempty"`
+	Models map[string]string `json:"models,omitempty"` // Requested model -> provider model
+	Model  string            `json:"model,omitempty"`  // Provider model for models not in models, empty keeps the requested name
+}
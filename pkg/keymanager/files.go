@@ -0,0 +1,270 @@
+package keymanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Files uploaded through the Files API belong to the project of the key that
+// uploaded them, like corpora. The proxy remembers which key owns each file and
+// uses it for the file's own endpoints and for generateContent calls that
+// reference the file. Gemini deletes files after 48 hours, the mapping is pruned
+// once they expire.
+//
+// With client keys, a file also belongs to the client that uploaded it: other
+// clients don't see it in listings and get 404 for it. Files found on the keys
+// without an upload through the proxy belong to no client, so they are only
+// served while no client keys are configured.
+
+// FileKey is the key owning an uploaded file.
+type FileKey struct {
+	Key       string `json:"key"`
+	Client    string `json:"client,omitempty"`     // Client key that uploaded the file, empty without client keys
+	ExpiresAt int64  `json:"expires_at,omitempty"` // Unix seconds, from the file's expirationTime
+}
+
+// Resumable uploads are started and finished in separate requests, which must
+// use the same key and come from the same client.
+type uploadSession struct {
+	key     string
+	client  string
+	started time.Time
+}
+
+// How long a started resumable upload can take to finish
+const uploadSessionTTL = 24 * time.Hour
+
+// setFileKey records the owner of a file. expiration is the file's
+// expirationTime, empty if unknown. A file found by listing the key's files
+// (discovered) keeps the client it was recorded with.
+func (km *KeyManager) setFileKey(file, key, client, expiration string, discovered bool) {
+	entry := FileKey{Key: key, Client: client}
+	if t, err := time.Parse(time.RFC3339Nano, expiration); err == nil {
+		entry.ExpiresAt = t.Unix()
+	} else {
+		entry.ExpiresAt = km.now().Add(48 * time.Hour).Unix()
+	}
+
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+	if known, ok := km.fileKeys[file]; ok && discovered {
+		entry.Client = known.Client
+	}
+	if km.fileKeys[file] != entry {
+		km.fileKeys[file] = entry
+		km.markStatusChanged()
+	}
+}
+
+func (km *KeyManager) DeleteFileKey(file string) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+	if _, ok := km.fileKeys[file]; ok {
+		delete(km.fileKeys, file)
+		km.markStatusChanged()
+	}
+}
+
+// pruneFileKeys drops files that have expired. Must be called with km.mutex held.
+func (km *KeyManager) pruneFileKeys() {
+	now := km.now().Unix()
+	for file, entry := range km.fileKeys {
+		if entry.ExpiresAt > 0 && entry.ExpiresAt < now {
+			delete(km.fileKeys, file)
+		}
+	}
+	for uploadID, session := range km.uploadSessions {
+		if km.now().Sub(session.started) > uploadSessionTTL {
+			delete(km.uploadSessions, uploadID)
+		}
+	}
+}
+
+// KeyForNewFile picks the usable key owning the fewest files, spreading uploads
+// over the projects' storage quotas.
+func (km *KeyManager) KeyForNewFile() (string, error) {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+
+	counts := make(map[string]int)
+	for _, entry := range km.fileKeys {
+		counts[entry.Key]++
+	}
+	best := ""
+	for _, key := range km.allKeys() {
+		if km.permanentlyBannedKeys[key] || km.keyPaused(key) {
+			continue
+		}
+		if best == "" || counts[key] < counts[best] {
+			best = key
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no usable API keys")
+	}
+	return best, nil
+}
+
+// ResolveFileKey returns the key owning a file, listing the files of every key
+// once if the file isn't known yet (e.g. it was uploaded before the proxy).
+// Files of other clients than client are reported as not found.
+func (km *KeyManager) ResolveFileKey(target *url.URL, file, client string) (string, int, error) {
+	km.mutex.RLock()
+	entry, known := km.fileKeys[file]
+	usable := known && km.retrievalKeyUsable(entry.Key)
+	km.mutex.RUnlock()
+
+	if known && entry.Client != client {
+		return "", http.StatusNotFound, fmt.Errorf("%s was not found", file)
+	}
+	if known && !usable {
+		return "", http.StatusServiceUnavailable, fmt.Errorf("%s belongs to key %s, which is no longer available", file, MaskKey(entry.Key))
+	}
+	if known {
+		return entry.Key, 0, nil
+	}
+
+	km.DiscoverFiles(target, client)
+
+	km.mutex.RLock()
+	entry, known = km.fileKeys[file]
+	km.mutex.RUnlock()
+	if !known || entry.Client != client {
+		return "", http.StatusNotFound, fmt.Errorf("%s was not found under any configured key", file)
+	}
+	return entry.Key, 0, nil
+}
+
+// FileKeys lists the known files by name with the key owning each.
+func (km *KeyManager) FileKeys() []FileKeyStatus {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+	km.pruneFileKeys()
+	files := make([]FileKeyStatus, 0, len(km.fileKeys))
+	for file, entry := range km.fileKeys {
+		status := FileKeyStatus{File: file, Key: MaskKey(entry.Key), ExpiresAt: entry.ExpiresAt, Available: km.retrievalKeyUsable(entry.Key)}
+		if entry.Client != "" {
+			status.Client = MaskKey(entry.Client)
+		}
+		files = append(files, status)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].File < files[j].File })
+	return files
+}
+
+// StartUploadSession remembers the key and client a resumable upload was
+// started with.
+func (km *KeyManager) StartUploadSession(uploadID, key, client string) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+	km.pruneFileKeys()
+	km.uploadSessions[uploadID] = uploadSession{key: key, client: client, started: km.now()}
+}
+
+// UploadSessionKey returns the key of a resumable upload the client started.
+func (km *KeyManager) UploadSessionKey(uploadID, client string) (string, bool) {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	session, ok := km.uploadSessions[uploadID]
+	if !ok || session.client != client {
+		return "", false
+	}
+	return session.key, true
+}
+
+func (km *KeyManager) EndUploadSession(uploadID string) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+	delete(km.uploadSessions, uploadID)
+}
+
+// DiscoverFiles lists the files of every usable key, records which key owns
+// each one and returns the merged list of the files belonging to client.
+func (km *KeyManager) DiscoverFiles(target *url.URL, client string) []json.RawMessage {
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	var files []json.RawMessage
+
+	for _, key := range km.retrievalKeys() {
+		pageToken := ""
+		for {
+			listURL := km.UpstreamURL(target, key, "/v1beta/files")
+			q := url.Values{}
+			q.Set("pageSize", "100")
+			if pageToken != "" {
+				q.Set("pageToken", pageToken)
+			}
+			listURL.RawQuery = q.Encode()
+
+			req, err := http.NewRequest(http.MethodGet, listURL.String(), nil)
+			if err != nil {
+				break
+			}
+			SetUpstreamKey(req, key)
+			resp, err := httpClient.Do(req)
+			if err != nil {
+				log.Printf("Failed to list files for key %s: %v", MaskKey(key), err)
+				break
+			}
+			var page struct {
+				Files         []json.RawMessage `json:"files"`
+				NextPageToken string            `json:"nextPageToken"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&page)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || err != nil {
+				log.Printf("Failed to list files for key %s: status %d", MaskKey(key), resp.StatusCode)
+				break
+			}
+
+			for _, raw := range page.Files {
+				var file struct {
+					Name           string `json:"name"`
+					ExpirationTime string `json:"expirationTime"`
+				}
+				if json.Unmarshal(raw, &file) != nil || file.Name == "" {
+					continue
+				}
+				km.setFileKey(file.Name, key, "", file.ExpirationTime, true)
+				km.mutex.RLock()
+				owner := km.fileKeys[file.Name].Client
+				km.mutex.RUnlock()
+				if owner == client {
+					files = append(files, raw)
+				}
+			}
+			if page.NextPageToken == "" {
+				break
+			}
+			pageToken = page.NextPageToken
+		}
+	}
+	return files
+}
+
+// RecordUploadedFile remembers the key and client owning the file in an upload
+// or create response: {"file": {"name": "files/...", "expirationTime": "..."}}.
+func (km *KeyManager) RecordUploadedFile(body []byte, key, client string) {
+	var created struct {
+		File struct {
+			Name           string `json:"name"`
+			ExpirationTime string `json:"expirationTime"`
+		} `json:"file"`
+	}
+	if json.Unmarshal(body, &created) == nil && created.File.Name != "" {
+		km.setFileKey(created.File.Name, key, client, created.File.ExpirationTime, false)
+		log.Printf("File %s uploaded with key %s.", created.File.Name, MaskKey(key))
+	}
+}
+
+type FileKeyStatus struct {
+	File      string `json:"file"`
+	Key       string `json:"key"`              // Masked
+	Client    string `json:"client,omitempty"` // Masked client key that uploaded the file
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Available bool   `json:"available"` // False once the key was removed or banned
+}
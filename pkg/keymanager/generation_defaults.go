@@ -0,0 +1,13 @@
+package keymanager
+
+import "encoding/json"
+
+// default_generation_config on a model holds generationConfig fields, e.g.
+// {"temperature": 0.7, "maxOutputTokens": 2048}, that are put into its
+// requests which don't set them, to tune all clients in one place.
+
+func (km *KeyManager) DefaultGenerationConfig(model string) map[string]json.RawMessage {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	return km.config.Models[model].DefaultGenerationConfig
+}
@@ -0,0 +1,72 @@
+package keymanager
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// HedgingConfig cuts the tail latency of non-streaming generation requests: when
+// upstream hasn't answered with response headers after AfterMs, the request is
+// sent again with a second key and whichever response arrives first is used.
+// The other request is cancelled, but the tokens it used upstream, if any,
+// aren't counted.
+type HedgingConfig struct {
+	AfterMs int      `json:"after_ms"`         // Milliseconds to wait for the first response, 0 disables hedging
+	Models  []string `json:"models,omitempty"` // Only hedge requests for these models, default all
+}
+
+// HedgeDelay returns how long to wait before hedging a request for model.
+func (km *KeyManager) HedgeDelay(modelName string) (time.Duration, bool) {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	config := km.config.Hedging
+	if config == nil || config.AfterMs <= 0 {
+		return 0, false
+	}
+	if len(config.Models) > 0 && !slices.Contains(config.Models, modelName) {
+		return 0, false
+	}
+	return time.Duration(config.AfterMs) * time.Millisecond, true
+}
+
+// HedgeKey returns a key other than exclude that can take a request for model
+// right away: one that isn't cooling down and has TPM and RPM left, so
+// getModelKey would hand it out without a delay. The key is from the key group
+// the request in ctx was routed to, if any.
+func (km *KeyManager) HedgeKey(ctx context.Context, modelName, exclude string, estimatedTokens int) (string, bool) {
+	group := ""
+	if state := routeStateFromContext(ctx); state != nil {
+		if rule := state.rule.Load(); rule != nil {
+			group = rule.KeyGroup
+		}
+	}
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+	if _, ok := km.config.Models[modelName]; !ok {
+		return "", false
+	}
+	now := km.now().Unix()
+	for _, keyInfo := range km.keys {
+		key := keyInfo.Key
+		if key == exclude || km.permanentlyBannedKeys[key] || !km.ownsKey(key) || km.keyPaused(key) || !km.keyInGroup(group, key) || !km.keyServesModel(key, modelName) {
+			continue
+		}
+		usage, ok := km.usage[modelName+"_"+key]
+		if !ok || usage.Exceeded || usage.ProbablyExceeded || km.breakerTripped(modelName, key, now) {
+			continue
+		}
+		UpdateLanguageModelUsage(usage, now)
+		if len(km.keysWithBudget(modelName, []KeyInfo{keyInfo}, estimatedTokens)) == 0 {
+			continue
+		}
+		if km.keyWait(modelName, usage, estimatedTokens, km.now()) > 0 {
+			continue
+		}
+		km.startBreakerTrial(modelName, key, now)
+		usage.RecentRequests = append(usage.RecentRequests, km.now().UnixMilli())
+		usage.TodayRequests++
+		return key, true
+	}
+	return "", false
+}
@@ -0,0 +1,7 @@
+package keymanager
+
+type RequestHistoryConfig struct {
+	Size                  int      `json:"size"`                    // Number of requests kept in memory
+	ContentLoggingClients []string `json:"content_logging_clients"` // Client tokens whose prompts/responses are stored
+	MaxContentBytes       int      `json:"max_content_bytes"`       // Per-body cap for stored content
+}
@@ -0,0 +1,24 @@
+package keymanager
+
+// RecordImageUsage counts images generated with key and their cost.
+func (km *KeyManager) RecordImageUsage(modelName, key string, images int) {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+
+	usageKey := modelName + "_" + key
+	usage, ok := km.usage[usageKey]
+	if !ok {
+		return
+	}
+	lock := km.usageLock(usageKey)
+	lock.Lock()
+	defer lock.Unlock()
+	cost := float64(images) * km.config.Models[modelName].ImagePrice
+	usage.TotalImages += images
+	usage.TodayImages += images
+	usage.TotalCost += cost
+	usage.TodayCost += cost
+	km.appendEvents(UsageEvent{Timestamp: km.now().Unix(), Model: modelName, Key: key, Cost: cost}, false)
+	usage.JustHit429 = false
+	km.touchUsage(usage)
+}
@@ -0,0 +1,1989 @@
+package keymanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Config struct {
+	PriorityKeys           []string                 `json:"priority_keys"`
+	SecondaryKeys          []string                 `json:"secondary_keys"`
+	KeyModels              map[string][]string      `json:"key_models,omitempty"`        // Restricts keys to the listed models, key: API key
+	UpstreamURL            string                   `json:"upstream_url,omitempty"`      // Base URL of the Gemini API, e.g. a regional endpoint or a relay
+	KeyUpstreamURLs        map[string]string        `json:"key_upstream_urls,omitempty"` // Overrides upstream_url for single keys, key: API key
+	PausedKeys             []string                 `json:"paused_keys,omitempty"`       // Kept out of rotation, set through /api/keys/:key/pause
+	KeyPolicy              string                   `json:"key_policy,omitempty"`        // expr-lang expression deciding which keys a request may use
+	KeyGroups              map[string][]string      `json:"key_groups,omitempty"`        // Named sets of keys that routing rules restrict requests to
+	RoutingRules           []RoutingRule            `json:"routing_rules,omitempty"`     // The first matching rule picks the model, key group and upstream of a request
+	Models                 map[string]LanguageModel `json:"models"`
+	ListConfiguredModels   bool                     `json:"list_configured_models,omitempty"`   // GET /v1beta/models only lists the models configured in models
+	ModelListCacheSeconds  int                      `json:"model_list_cache_seconds,omitempty"` // How long GET /v1beta/models is served from a cache, default 300, negative disables
+	ResetAfter             string                   `json:"reset_after"`                        // Format: "00:00" (HH:MM)
+	NextQuotaResetDatetime string                   `json:"next_quota_reset_datetime"`
+	Timezone               string                   `json:"timezone"` // e.g., "America/Los_Angeles"
+	DefaultModel           string                   `json:"default_model"`
+	DefaultImageModel      string                   `json:"default_image_model,omitempty"`     // Imagen model for /v1/images/generations requests naming an unconfigured model
+	DefaultEmbeddingModel  string                   `json:"default_embedding_model,omitempty"` // Embedding model for /v1/embeddings requests naming an unconfigured model
+	KeyProviders           []KeyProviderConfig      `json:"key_providers,omitempty"`
+	KeyRefreshInterval     int                      `json:"key_refresh_interval,omitempty"`  // Seconds between key provider refreshes
+	ConfigWatchInterval    int                      `json:"config_watch_interval,omitempty"` // Seconds between checks for config file changes, 0 disables
+	Cluster                *ClusterConfig           `json:"cluster,omitempty"`
+	RequestHistory         *RequestHistoryConfig    `json:"request_history,omitempty"`
+	UsageArchive           *UsageArchiveConfig      `json:"usage_archive,omitempty"`
+	UsageStore             *UsageStoreConfig        `json:"usage_store,omitempty"`
+	FallbackProvider       *FallbackProviderConfig  `json:"fallback_provider,omitempty"` // OpenAI-compatible API for OpenAI-format requests when no key is available
+	DataDir                string                   `json:"data_dir,omitempty"`          // For key_usage.json and other data files, -data-dir and GEMINILOOPER_DATA_DIR take precedence
+	TLS                    *TLSConfig               `json:"tls,omitempty"`
+	AccessLog              *AccessLogConfig         `json:"access_log,omitempty"`
+	AlertWebhook           *AlertWebhookConfig      `json:"alert_webhook,omitempty"`
+	Notifications          *NotificationsConfig     `json:"notifications,omitempty"`            // Telegram/Discord messages
+	AdminAuth              *AdminAuthConfig         `json:"admin_auth,omitempty"`               // Protects /status and the /api admin endpoints
+	ClientKeys             []ClientKeyConfig        `json:"client_keys,omitempty"`              // Keys issued to downstream users; when set, proxy requests must use one
+	AllowClientGeminiKeys  bool                     `json:"allow_client_gemini_keys,omitempty"` // Forward native requests carrying the client's own Gemini key with it
+	HeaderPolicy           *HeaderPolicyConfig      `json:"header_policy,omitempty"`            // Request headers forwarded upstream
+	MaxRequestBodyMB       int                      `json:"max_request_body_mb,omitempty"`      // Larger proxied request bodies get 413, default 32
+	CORS                   *CORSConfig              `json:"cors,omitempty"`                     // Lets browser clients call the proxy
+	ResponseCache          *ResponseCacheConfig     `json:"response_cache,omitempty"`           // Serve identical non-streaming requests from a cache
+	TokenEstimation        *TokenEstimationConfig   `json:"token_estimation,omitempty"`         // Estimate request size before picking a key
+	CircuitBreaker         *CircuitBreakerConfig    `json:"circuit_breaker,omitempty"`
+	Queue                  *QueueConfig             `json:"queue,omitempty"`        // Wait for a key instead of failing with 429
+	Priority               *PriorityConfig          `json:"priority,omitempty"`     // How low-priority requests are held back
+	Timeouts               *TimeoutsConfig          `json:"timeouts,omitempty"`     // Seconds
+	Hedging                *HedgingConfig           `json:"hedging,omitempty"`      // Send slow non-streaming requests again with a second key
+	AdaptiveTPM            bool                     `json:"adaptive_tpm,omitempty"` // Learn each key's TPM limit from its 429s
+	Retry                  *RetryConfig             `json:"retry,omitempty"`
+	TestMode               bool                     `json:"test_mode,omitempty"`       // Allows changing fault injection at runtime, requires admin_auth
+	FaultInjection         *FaultInjectionConfig    `json:"fault_injection,omitempty"` // Requires test_mode
+}
+
+// UsageStoreConfig selects where usage is persisted. The default is the
+// key_usage.json file, which is rewritten in full on every save.
+type UsageStoreConfig struct {
+	Type   string `json:"type"`             // "json" (default), "sqlite" or "redis"
+	Format string `json:"format,omitempty"` // json and redis: usage file format, "json" (default) or "gob" for a gzipped binary key_usage.gob.gz
+
+	// sqlite
+	Path               string `json:"path,omitempty"`                 // Database file (default key_usage.db)
+	EventRetentionDays int    `json:"event_retention_days,omitempty"` // Raw usage events older than this are deleted (default 30); daily rollups are kept
+
+	// redis: usage, cooldown flags and bans are shared by all instances using the same prefix
+	Address      string `json:"address,omitempty"` // host:port (default localhost:6379)
+	Password     string `json:"password,omitempty"`
+	DB           int    `json:"db,omitempty"`
+	Prefix       string `json:"prefix,omitempty"`        // Key prefix (default geminilooper)
+	SyncInterval int    `json:"sync_interval,omitempty"` // Milliseconds between syncs with Redis (default 1000)
+}
+
+type LanguageModel struct {
+	ModelName               string                     `json:"-"`
+	TpmLimit                int                        `json:"tpm_limit"`
+	TpdLimit                *int                       `json:"tpd_limit"`
+	RpmLimit                int                        `json:"rpm_limit,omitempty"`                 // Requests per minute per key, 0 for no limit
+	RpdLimit                int                        `json:"rpd_limit,omitempty"`                 // Requests per day per key, 0 for no limit
+	FallbackModels          []string                   `json:"fallback_models,omitempty"`           // Tried in order when no key is available for this model
+	InputPrice              float64                    `json:"input_price,omitempty"`               // USD per 1M input tokens, for cost estimates
+	OutputPrice             float64                    `json:"output_price,omitempty"`              // USD per 1M output (including thinking) tokens
+	ImagePrice              float64                    `json:"image_price,omitempty"`               // USD per generated image, for image models like Imagen
+	IpdLimit                int                        `json:"ipd_limit,omitempty"`                 // Generated images per day per key, 0 for no limit
+	SystemPrompt            string                     `json:"system_prompt,omitempty"`             // Put in front of the system instruction of every request for the model
+	SafetySettings          []GeminiSafetySetting      `json:"safety_settings,omitempty"`           // Replace the client's thresholds for these categories
+	DefaultGenerationConfig map[string]json.RawMessage `json:"default_generation_config,omitempty"` // generationConfig fields for requests that don't set them
+	MaxOutputTokens         int                        `json:"max_output_tokens,omitempty"`         // Cap on maxOutputTokens, set when requests leave it out
+	ThinkingConfig          *ThinkingConfig            `json:"thinking_config,omitempty"`           // Replaces the client's, for Gemini 2.5 models
+	MaxConcurrency          int                        `json:"max_concurrency,omitempty"`           // Upstream requests in flight at once, 0 for no limit
+}
+
+type UsageData struct {
+	Timestamp int `json:"timestamp"`
+	CostToken int `json:"cost_token"`
+}
+
+type LanguageModelUsage struct {
+	LanguageModel
+	TotalTokenUse         int         `json:"total_tokens"`
+	TodayUsage            int         `json:"today_usage,omitempty"`
+	TodayRequests         int         `json:"today_requests,omitempty"` // Requests sent since the last quota reset
+	TotalCost             float64     `json:"total_cost,omitempty"`     // Estimated USD, from the model's prices
+	TodayCost             float64     `json:"today_cost,omitempty"`
+	TotalImages           int         `json:"total_images,omitempty"` // Images generated by image models
+	TodayImages           int         `json:"today_images,omitempty"`
+	Past24HoursTokenUsage UsageWindow `json:"past_24hrs_usage_data"`
+	ProbablyExceeded      bool        `json:"probably_exceeded"`
+	Exceeded              bool        `json:"exceeded"`
+	CooldownUntil         int64       `json:"cooldown_until,omitempty"`    // Unix time when a probably exceeded key is re-admitted
+	CooldownLevel         int         `json:"cooldown_level,omitempty"`    // Cooldowns in a row, selects the next backoff step
+	LearnedTpmLimit       int         `json:"learned_tpm_limit,omitempty"` // With adaptive_tpm, the TPM limit learned from 429s
+	// Fields calculated at runtime
+	JustHit429       bool    `json:"-"`
+	RecentRequests   []int64 `json:"-"` // Unix milliseconds of requests sent in the last 60s, for RPM
+	LastChanged      int64   `json:"-"` // Unix time of the last state change, used by the delta status API
+	LastRateLimited  int64   `json:"-"` // Unix time of the last 429
+	TpmLimitAdjusted int64   `json:"-"` // Unix time the learned TPM limit last changed
+}
+
+func (u *LanguageModelUsage) deepCopy() *LanguageModelUsage {
+	if u == nil {
+		return nil
+	}
+
+	newU := *u // Copies the usage window too
+	newU.RecentRequests = nil
+
+	return &newU
+}
+
+type KeyInfo struct {
+	Key          string
+	IsPriority   bool
+	CurrentIndex int
+}
+
+type KeyManager struct {
+	config                *Config
+	keys                  []KeyInfo
+	usage                 map[string]*LanguageModelUsage // key: modelName_key
+	permanentlyBannedKeys map[string]bool                // key: apiKey
+	usageFile             string                         // Empty disables persistence
+	configFile            string                         // config.json, empty for a KeyManager built by New
+	keyProviders          []*keyProviderEntry
+	providerPriorityKeys  []string // Keys supplied by key providers, not stored in config.json
+	providerSecondaryKeys []string
+	mutex                 sync.RWMutex // Status readers, RecordUsage and read-only accessors take it for reading
+	usageLocks            usageLocks   // Per usage entry, see usage_locks.go
+	lastSaved             time.Time
+	ticker                *time.Ticker
+	stopChan              chan struct{}
+	nextReset             time.Time
+
+	// For status page
+	lastHourTokenUsage map[string][]UsageData // key: modelName, value: usage data
+	lastHourKeyUsage   map[string][]UsageData // key: apiKey, value: usage data
+	usageHistoryMutex  sync.Mutex
+
+	// Bumped whenever state shown on the status page changes, used for ETag/Last-Modified
+	statusVersion  atomic.Uint64
+	statusModified atomic.Int64 // Unix nanoseconds
+
+	// Tells the time, set by SetClock; the real time if nil
+	clock atomic.Pointer[Clock]
+
+	// Key lifecycle events, see Subscribe
+	events eventBus
+
+	// Compiled key_policy, see key_policy.go
+	policy *keyPolicy
+
+	// Called with the time each WaitForKey call took and the delay it returned,
+	// see ObserveKeySelection
+	keySelectionObserver func(took, delay time.Duration)
+
+	// Injected upstream errors for chaos testing
+	simulator ErrorSimulator
+
+	// Upstream requests in flight per model, for max_concurrency
+	concurrency concurrencyLimiter
+
+	// Cached responses of identical generation requests
+	responses responseCache
+
+	// Upstream models.list responses, key: query string
+	modelLists responseCache
+
+	// Config reloads pending or being applied, /readyz reports not ready while
+	// above 0. reloadMutex lets one reload apply at a time.
+	reloading   atomic.Int32
+	reloadMutex sync.Mutex
+
+	// Set in cluster mode; keys owned by other instances are skipped
+	ownership *keyOwnership
+
+	// Semantic retriever corpus name -> key whose project owns it, persisted with usage
+	corpusKeys map[string]string
+
+	// Uploaded file name -> key whose project owns it, persisted with usage
+	fileKeys       map[string]FileKey
+	uploadSessions map[string]uploadSession // Resumable upload ID -> key
+
+	// Usage of keys/models removed from the config, key: modelName_key
+	retiredUsage map[string]*LanguageModelUsage
+
+	// Tokens used by each client key since the last quota reset, key: client key
+	clientUsage map[string]int
+
+	// Last "no available keys" alert per model, key: modelName
+	alertsSent map[string]time.Time
+
+	// Error tracking per key and model, key: modelName_key
+	breakers     map[string]*circuitBreaker
+	breakerMutex sync.Mutex // Guards breakers, taken after km.mutex
+
+	// Requests waiting in WaitForKey, and how many of them aren't low-priority
+	queued       atomic.Int64
+	queuedUrgent atomic.Int64
+
+	// Shared upstream transport, built for the timeouts it was created with
+	transport         *http.Transport
+	transportTimeouts TimeoutsConfig
+	transportMutex    sync.Mutex
+
+	// Where usage is saved, nil if it isn't; events are queued until the next save
+	usageStore    UsageStore
+	pendingEvents []UsageEvent
+	eventsMutex   sync.Mutex // Guards pendingEvents and sharedEvents
+
+	// Set when usage is shared through Redis; changes are published on the next sync
+	sharedState  *redisUsageStore
+	sharedEvents []UsageEvent
+	sharedFlags  map[string]usageFlags // Flags as last published or received, key: modelName_key
+	sharedBans   map[string]bool
+}
+
+// UsageSnapshot is the persisted usage state, in the format of key_usage.json.
+type UsageSnapshot struct {
+	Usage                 map[string]*LanguageModelUsage `json:"usage"`
+	PermanentlyBannedKeys map[string]bool                `json:"permanently_banned_keys"`
+	CorpusKeys            map[string]string              `json:"corpus_keys,omitempty"`
+	FileKeys              map[string]FileKey             `json:"file_keys,omitempty"`
+	RetiredUsage          map[string]*LanguageModelUsage `json:"retired_usage,omitempty"`
+	ClientUsage           map[string]int                 `json:"client_usage,omitempty"`
+}
+
+// ReadSavedUsage reads the usage saved for config from the store usage_store
+// selects, without loading it into a KeyManager, e.g. while the proxy is
+// running. usage and retiredUsage are keyed by modelName_key; source describes
+// where they were read from.
+func ReadSavedUsage(config *Config) (usage, retiredUsage map[string]*LanguageModelUsage, source string, err error) {
+	saved, source, err := readSavedUsage(config)
+	return saved.Usage, saved.RetiredUsage, source, err
+}
+
+func readSavedUsage(config *Config) (UsageSnapshot, string, error) {
+	storeType := ""
+	if config.UsageStore != nil {
+		storeType = config.UsageStore.Type
+	}
+	usagePath := DataFilePath(config, usageFileName(config))
+	switch storeType {
+	case "", "json":
+		saved, err := NewJSONUsageStore(usagePath).Snapshot()
+		if err != nil {
+			return saved, "", fmt.Errorf("failed to read usage: %v", err)
+		}
+		return saved, usagePath, nil
+	case "sqlite":
+		loc, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			return UsageSnapshot{}, "", fmt.Errorf("invalid timezone: %v", err)
+		}
+		storeConfig := *config.UsageStore
+		if storeConfig.Path == "" {
+			storeConfig.Path = "key_usage.db"
+		}
+		storeConfig.Path = DataFilePath(config, storeConfig.Path)
+		if _, err := os.Stat(storeConfig.Path); err != nil {
+			return UsageSnapshot{}, "", fmt.Errorf("failed to read usage: %v", err)
+		}
+		store, err := openSQLiteUsageStore(&storeConfig, loc)
+		if err != nil {
+			return UsageSnapshot{}, "", err
+		}
+		defer store.Close()
+		saved, err := store.Snapshot()
+		if err != nil {
+			return saved, "", fmt.Errorf("failed to load usage database: %v", err)
+		}
+		return saved, storeConfig.Path, nil
+	case "redis":
+		// The shared counters are in Redis, costs and request counts only in the
+		// local file
+		saved, _ := NewJSONUsageStore(usagePath).Snapshot()
+		shared, err := openRedisUsageStore(config.UsageStore)
+		if err != nil {
+			return saved, "", err
+		}
+		defer shared.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		sharedSaved, _, _, err := shared.load(ctx)
+		if err != nil {
+			return saved, "", fmt.Errorf("failed to load shared usage from Redis: %v", err)
+		}
+		if saved.Usage == nil {
+			saved.Usage = make(map[string]*LanguageModelUsage)
+		}
+		for usageKey, sharedEntry := range sharedSaved.Usage {
+			entry, ok := saved.Usage[usageKey]
+			if !ok {
+				entry = &LanguageModelUsage{}
+				saved.Usage[usageKey] = entry
+			}
+			entry.TotalTokenUse = sharedEntry.TotalTokenUse
+			entry.TodayUsage = sharedEntry.TodayUsage
+			entry.Past24HoursTokenUsage = sharedEntry.Past24HoursTokenUsage
+		}
+		return saved, "Redis and " + usagePath, nil
+	default:
+		return UsageSnapshot{}, "", fmt.Errorf("unknown usage_store type '%s'", storeType)
+	}
+}
+
+// Status page data structures
+type StatusData struct {
+	GrandTotalTokens        int                    `json:"grand_total_tokens"`
+	GrandTotalTodayUsage    int                    `json:"grand_total_today_usage"`
+	GrandTotalCost          float64                `json:"grand_total_cost"` // Estimated USD
+	GrandTodayCost          float64                `json:"grand_today_cost"`
+	CurrentMaskedKey        string                 `json:"current_masked_key"`
+	CurrentRawKey           string                 `json:"-"` // Internal use, not marshalled
+	KeyUsageStatus          map[string]KeyStatus   `json:"key_usage_status"`
+	PriorityKeys            []string               `json:"priority_keys"`
+	SecondaryKeys           []string               `json:"secondary_keys"`
+	UnavailableKeys         []string               `json:"unavailable_keys"`
+	RateLimitedKeys         []string               `json:"rate_limited_keys"`
+	QuotaExhaustedKeys      []string               `json:"quota_exhausted_keys"`
+	PermanentlyBannedKeys   []string               `json:"permanently_banned_keys"`
+	PausedKeys              []string               `json:"paused_keys"`
+	ModelOrder              []string               `json:"model_order"`
+	ModelsConfig            map[string]ModelConfig `json:"models_config"`
+	ModelChartData          ChartData              `json:"model_chart_data"`
+	KeyChartData            ChartData              `json:"key_chart_data"`
+	ActiveKeyModelChartData ChartData              `json:"active_key_model_chart_data"`
+	ModelCostChartData      ChartData              `json:"model_cost_chart_data"` // Today's estimated cost per model
+	QueuedRequests          int64                  `json:"queued_requests"`       // Requests waiting for a key
+}
+
+// StatusDelta is returned by /api/status_data?since=<timestamp> and only carries
+// data that changed after the given time.
+type StatusDelta struct {
+	Since                 int64                  `json:"since"`
+	Timestamp             int64                  `json:"timestamp"` // Pass as `since` on the next poll
+	GrandTotalTokens      int                    `json:"grand_total_tokens"`
+	GrandTotalTodayUsage  int                    `json:"grand_total_today_usage"`
+	GrandTotalCost        float64                `json:"grand_total_cost"`
+	GrandTodayCost        float64                `json:"grand_today_cost"`
+	KeyUsageStatus        map[string]KeyStatus   `json:"key_usage_status"`
+	RateLimitedKeys       []string               `json:"rate_limited_keys"`
+	QuotaExhaustedKeys    []string               `json:"quota_exhausted_keys"`
+	PermanentlyBannedKeys []string               `json:"permanently_banned_keys"`
+	PausedKeys            []string               `json:"paused_keys"`
+	ModelUsage            map[string][]UsageData `json:"model_usage"` // key: modelName
+	KeyUsage              map[string][]UsageData `json:"key_usage"`   // key: apiKey
+}
+
+type KeyStatus map[string]ModelUsageStatus // key: modelName
+
+type ModelUsageStatus struct {
+	TokensLastMinute      int     `json:"tokens_last_minute"`
+	TotalTokens           int     `json:"total_tokens"`
+	TodayUsage            int     `json:"today_usage"`
+	TodayRequests         int     `json:"today_requests"`
+	TotalCost             float64 `json:"total_cost"`
+	TodayCost             float64 `json:"today_cost"`
+	TotalImages           int     `json:"total_images,omitempty"`
+	TodayImages           int     `json:"today_images,omitempty"`
+	IsTemporarilyDisabled bool    `json:"is_temporarily_disabled"`
+	CooldownUntil         int64   `json:"cooldown_until,omitempty"` // Unix time the temporary disable ends
+	DailyQuotaExceeded    bool    `json:"daily_quota_exceeded"`
+	CircuitBreaker        string  `json:"circuit_breaker,omitempty"` // "open" or "half_open"
+	TpmLimit              int     `json:"tpm_limit,omitempty"`       // Learned with adaptive_tpm, else tpm_limit
+}
+
+type ModelConfig struct {
+	TpmLimit int `json:"tpm_limit"`
+}
+
+type ChartData struct {
+	Labels   []string       `json:"labels"`
+	Datasets []ChartDataset `json:"datasets"`
+}
+
+type ChartDataset struct {
+	Label           string    `json:"label"`
+	Data            []float64 `json:"data"`
+	Fill            bool      `json:"fill"`
+	BorderColor     string    `json:"borderColor"`
+	BackgroundColor string    `json:"backgroundColor"`
+	Tension         float64   `json:"tension"`
+}
+
+func NewKeyManager() (*KeyManager, error) {
+	config, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	keyProviders, err := newKeyProviderEntries(config.KeyProviders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key provider: %v", err)
+	}
+	providerPriorityKeys, providerSecondaryKeys := fetchProviderKeys(keyProviders)
+
+	usagePath := DataFilePath(config, usageFileName(config))
+	if err := os.MkdirAll(filepath.Dir(usagePath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+
+	// Usage is loaded for the whole pool so provider keys keep their history across restarts
+	poolConfig := *config
+	poolConfig.PriorityKeys = append(append([]string{}, config.PriorityKeys...), providerPriorityKeys...)
+	poolConfig.SecondaryKeys = append(append([]string{}, config.SecondaryKeys...), providerSecondaryKeys...)
+	storeType := ""
+	if config.UsageStore != nil {
+		storeType = config.UsageStore.Type
+		if !ValidUsageFormat(config.UsageStore.Format) {
+			return nil, fmt.Errorf("unknown usage_store format '%s'", config.UsageStore.Format)
+		}
+	}
+	var store UsageStore
+	switch storeType {
+	case "", "json", "redis":
+		// With Redis, key_usage.json is still written for local state (corpora,
+		// retired usage), the shared counters in Redis take precedence over it.
+		store = NewJSONUsageStore(usagePath)
+	case "sqlite":
+		loc, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone: %v", err)
+		}
+		storeConfig := *config.UsageStore
+		if storeConfig.Path == "" {
+			storeConfig.Path = "key_usage.db"
+		}
+		storeConfig.Path = DataFilePath(config, storeConfig.Path)
+		store, err = openSQLiteUsageStore(&storeConfig, loc)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown usage_store type '%s'", storeType)
+	}
+	saved, found, err := store.Load()
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to load usage: %v", err)
+	}
+	var importedEvents []UsageEvent
+	if !found && storeType == "sqlite" {
+		// First start with SQLite: carry over key_usage.json if there is one
+		saved, _, _ = NewJSONUsageStore(usagePath).Load()
+		importedEvents = importUsageEvents(&poolConfig, saved.Usage)
+		if saved.Usage != nil {
+			log.Printf("Importing key_usage.json into the usage database.")
+		}
+	}
+	usage := newPoolUsage(&poolConfig)
+	applySavedUsage(usage, saved.Usage)
+
+	var shared *redisUsageStore
+	var sharedFlags map[string]usageFlags
+	sharedBans := make(map[string]bool)
+	if storeType == "redis" {
+		shared, err = openRedisUsageStore(config.UsageStore)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		sharedSaved, flags, found, err := shared.load(ctx)
+		cancel()
+		if err != nil {
+			shared.Close()
+			return nil, fmt.Errorf("failed to load shared usage from Redis: %v", err)
+		}
+		if found {
+			applySharedUsage(usage, sharedSaved.Usage)
+			if saved.PermanentlyBannedKeys == nil {
+				saved.PermanentlyBannedKeys = make(map[string]bool)
+			}
+			for key := range sharedSaved.PermanentlyBannedKeys {
+				saved.PermanentlyBannedKeys[key] = true
+				sharedBans[key] = true
+			}
+			sharedFlags = flags
+		} else {
+			log.Printf("Redis has no usage yet, it will be seeded from this instance.")
+		}
+	}
+
+	km, err := newKeyManager(config, usage, store, usagePath, configPath)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	km.restoreSaved(saved)
+	km.pendingEvents = importedEvents
+	if shared != nil {
+		km.sharedState = shared
+		km.sharedFlags = make(map[string]usageFlags)
+		for usageKey, f := range sharedFlags {
+			km.sharedFlags[usageKey] = f
+		}
+		km.sharedBans = sharedBans
+		if sharedFlags == nil {
+			// Nothing shared yet: this instance's counters are the starting point
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := shared.seed(ctx, km.usage); err != nil {
+				log.Printf("ERROR: failed to seed shared usage in Redis: %v", err)
+			}
+			cancel()
+		}
+		interval := time.Second
+		if config.UsageStore.SyncInterval > 0 {
+			interval = time.Duration(config.UsageStore.SyncInterval) * time.Millisecond
+		}
+		go km.sharedStateSync(interval)
+	}
+	if !found {
+		km.saveUsage(true) // The store exists from the first start on
+	}
+
+	if len(keyProviders) > 0 {
+		km.keyProviders = keyProviders
+		km.setProviderKeys(providerPriorityKeys, providerSecondaryKeys)
+
+		interval := 300 * time.Second
+		if config.KeyRefreshInterval > 0 {
+			interval = time.Duration(config.KeyRefreshInterval) * time.Second
+		}
+		go km.keyProviderRefresher(interval)
+		for _, entry := range keyProviders {
+			if renewer, ok := entry.provider.(tokenRenewer); ok {
+				go renewer.renewLoop(km.stopChan)
+			}
+		}
+	}
+
+	if config.ConfigWatchInterval > 0 {
+		go km.configWatcher(time.Duration(config.ConfigWatchInterval) * time.Second)
+	}
+	// Only here: New and NewWithStore leave SIGHUP to the program embedding them
+	go km.reloadOnSIGHUP()
+
+	return km, nil
+}
+
+// New builds a KeyManager for config with fresh usage that isn't saved, e.g. to
+// use the key rotation in another program. NewKeyManager loads config.json and
+// the saved usage from the data directory instead. Stop releases it.
+func New(config *Config) (*KeyManager, error) {
+	return newKeyManager(config, newPoolUsage(config), nil, "", "")
+}
+
+// NewWithStore is New with usage loaded from and saved to store, e.g. a
+// MemoryUsageStore in tests or a database of the embedding program. Stop
+// closes the store.
+func NewWithStore(config *Config, store UsageStore) (*KeyManager, error) {
+	saved, _, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load usage: %v", err)
+	}
+	usage := newPoolUsage(config)
+	applySavedUsage(usage, saved.Usage)
+	km, err := newKeyManager(config, usage, store, "", "")
+	if err != nil {
+		return nil, err
+	}
+	km.restoreSaved(saved)
+	return km, nil
+}
+
+// newKeyManager builds a KeyManager from already loaded usage and starts its
+// background workers. Usage is saved to store, if any; usageFile is where the
+// daily usage archives go next to, empty for none. Changes to the config, like
+// the next quota reset, are saved to configFile, empty for none.
+func newKeyManager(config *Config, usage map[string]*LanguageModelUsage, store UsageStore, usageFile, configFile string) (*KeyManager, error) {
+	keys := buildKeyInfos(config.PriorityKeys, config.SecondaryKeys)
+
+	loc, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %v (run `geminilooper validate` to check the whole config)", config.Timezone, err)
+	}
+	nextReset, err := time.ParseInLocation("2006-01-02 15:04", config.NextQuotaResetDatetime, loc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid next_quota_reset_datetime %q, expected YYYY-MM-DD HH:MM (run `geminilooper validate` to check the whole config)", config.NextQuotaResetDatetime)
+	}
+	if err := ValidateUpstreamURLs(config); err != nil {
+		return nil, err
+	}
+	if err := ValidateRouting(config); err != nil {
+		return nil, err
+	}
+	if err := ValidateTestMode(config); err != nil {
+		return nil, err
+	}
+	if config.KeyPolicy != "" {
+		if _, err := CompileKeyPolicy(config.KeyPolicy); err != nil {
+			return nil, fmt.Errorf("invalid key_policy: %v", err)
+		}
+	}
+
+	km := &KeyManager{
+		config:                config,
+		keys:                  keys,
+		usage:                 usage,
+		permanentlyBannedKeys: make(map[string]bool),
+		usageStore:            store,
+		usageFile:             usageFile,
+		configFile:            configFile,
+		ticker:                time.NewTicker(1 * time.Minute),
+		stopChan:              make(chan struct{}),
+		nextReset:             nextReset,
+		lastHourTokenUsage:    make(map[string][]UsageData),
+		lastHourKeyUsage:      make(map[string][]UsageData),
+		corpusKeys:            make(map[string]string),
+		fileKeys:              make(map[string]FileKey),
+		uploadSessions:        make(map[string]uploadSession),
+		retiredUsage:          make(map[string]*LanguageModelUsage),
+		clientUsage:           make(map[string]int),
+		alertsSent:            make(map[string]time.Time),
+		breakers:              make(map[string]*circuitBreaker),
+	}
+	km.statusModified.Store(time.Now().UnixNano())
+	km.Subscribe(km.notifyEvent)
+	km.Subscribe(km.alertWebhookEvent)
+
+	if config.Cluster != nil {
+		km.ownership, err = newKeyOwnership(*config.Cluster)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster config: %v", err)
+		}
+		go km.clusterHealthChecker()
+	}
+
+	if config.FaultInjection != nil && config.FaultInjection.Enabled {
+		km.simulator.SetFaults(*config.FaultInjection)
+		log.Println("WARNING: fault injection is enabled, upstream responses will be tampered with.")
+	}
+
+	go km.autoSave()
+	go km.usageHistoryTracker()
+	go km.resetScheduler()
+	go km.responseCacheSweeper()
+
+	return km, nil
+}
+
+// restoreSaved takes over the saved state besides the counters of the pool:
+// banned keys, retired usage, corpus and file ownership and client usage.
+func (km *KeyManager) restoreSaved(saved UsageSnapshot) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+	if saved.PermanentlyBannedKeys != nil {
+		km.permanentlyBannedKeys = saved.PermanentlyBannedKeys
+	}
+	for usageKey, retired := range saved.RetiredUsage {
+		km.retiredUsage[usageKey] = retired
+	}
+	// Keys removed from the config while the proxy was stopped
+	for usageKey, savedUsage := range saved.Usage {
+		if _, ok := km.usage[usageKey]; !ok {
+			km.retiredUsage[usageKey] = savedUsage
+		}
+	}
+	if saved.CorpusKeys != nil {
+		km.corpusKeys = saved.CorpusKeys
+	}
+	if saved.FileKeys != nil {
+		km.fileKeys = saved.FileKeys
+		km.pruneFileKeys()
+	}
+	if saved.ClientUsage != nil {
+		km.clientUsage = saved.ClientUsage
+	}
+}
+
+// buildKeyInfos lays out the key pool in rotation order, priority keys first.
+// Duplicate keys are only added once.
+func buildKeyInfos(priorityKeys, secondaryKeys []string) []KeyInfo {
+	var keys []KeyInfo
+	seen := make(map[string]bool)
+	for _, key := range priorityKeys {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, KeyInfo{Key: key, IsPriority: true, CurrentIndex: len(keys)})
+		}
+	}
+	for _, key := range secondaryKeys {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, KeyInfo{Key: key, IsPriority: false, CurrentIndex: len(keys)})
+		}
+	}
+	return keys
+}
+
+// allKeys returns every key in the pool in rotation order.
+// Must be called with km.mutex held.
+func (km *KeyManager) allKeys() []string {
+	keys := make([]string, 0, len(km.keys))
+	for _, keyInfo := range km.keys {
+		keys = append(keys, keyInfo.Key)
+	}
+	return keys
+}
+
+// poolKeys returns the priority or secondary keys of the pool.
+// Must be called with km.mutex held.
+func (km *KeyManager) poolKeys(priority bool) []string {
+	keys := []string{}
+	for _, keyInfo := range km.keys {
+		if keyInfo.IsPriority == priority {
+			keys = append(keys, keyInfo.Key)
+		}
+	}
+	return keys
+}
+
+func (km *KeyManager) Stop() {
+	km.ticker.Stop()
+	close(km.stopChan)
+	km.saveUsage(true)
+	km.events.close()
+	if km.usageStore != nil {
+		km.usageStore.Close()
+	}
+	if km.sharedState != nil {
+		km.syncSharedState() // Publish what's left
+		km.sharedState.Close()
+	}
+}
+
+func (km *KeyManager) autoSave() {
+	for {
+		select {
+		case <-km.ticker.C:
+			km.SaveUsage()
+		case <-km.stopChan:
+			return
+		}
+	}
+}
+
+func (km *KeyManager) usageHistoryTracker() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			km.recordUsageHistory()
+		case <-km.stopChan:
+			return
+		}
+	}
+}
+
+func (km *KeyManager) recordUsageHistory() {
+	now := km.now().Unix()
+	totalTokensPerModel := make(map[string]int)
+	totalTokensPerKey := make(map[string]int)
+
+	km.mutex.RLock()
+	allKeys := km.allKeys()
+	keyExists := make(map[string]bool)
+	for _, k := range allKeys {
+		keyExists[k] = true
+	}
+
+	for usageKey, usage := range km.usage {
+		modelName := usage.LanguageModel.ModelName
+		// Extract key from usageKey (format: modelName_key)
+		key := strings.TrimPrefix(usageKey, modelName+"_")
+		if !keyExists[key] {
+			continue // Skip usage data for keys no longer in config
+		}
+
+		lock := km.usageLock(usageKey)
+		lock.Lock()
+		tokensLastMinute := usage.Past24HoursTokenUsage.LastMinuteTokens(now)
+		lock.Unlock()
+		totalTokensPerModel[modelName] += tokensLastMinute
+		totalTokensPerKey[key] += tokensLastMinute
+	}
+	km.mutex.RUnlock()
+
+	km.usageHistoryMutex.Lock()
+	changed := false
+	// Update model usage history
+	for modelName, totalTokens := range totalTokensPerModel {
+		newData := UsageData{Timestamp: int(now), CostToken: totalTokens}
+		history := km.lastHourTokenUsage[modelName]
+		if len(history) == 0 || history[len(history)-1].CostToken != totalTokens {
+			changed = true
+		}
+		history = append(history, newData)
+		// Keep only the last hour
+		var updatedHistory []UsageData
+		for _, data := range history {
+			if int64(data.Timestamp) >= now-3600 {
+				updatedHistory = append(updatedHistory, data)
+			}
+		}
+		km.lastHourTokenUsage[modelName] = updatedHistory
+	}
+
+	// Update key usage history
+	for key, totalTokens := range totalTokensPerKey {
+		newData := UsageData{Timestamp: int(now), CostToken: totalTokens}
+		history := km.lastHourKeyUsage[key]
+		history = append(history, newData)
+		// Keep only the last hour
+		var updatedHistory []UsageData
+		for _, data := range history {
+			if int64(data.Timestamp) >= now-3600 {
+				updatedHistory = append(updatedHistory, data)
+			}
+		}
+		km.lastHourKeyUsage[key] = updatedHistory
+	}
+	km.usageHistoryMutex.Unlock()
+
+	if changed {
+		km.markStatusChanged()
+	}
+}
+
+// markStatusChanged records that the data returned by GetStatus has changed.
+func (km *KeyManager) markStatusChanged() {
+	km.statusModified.Store(time.Now().UnixNano())
+	km.statusVersion.Add(1)
+}
+
+// touchUsage marks a single key/model usage entry as changed.
+// Must be called with km.mutex held, or its usage lock.
+func (km *KeyManager) touchUsage(usage *LanguageModelUsage) {
+	usage.LastChanged = km.now().Unix()
+	km.markStatusChanged()
+}
+
+// StatusVersion returns the current status snapshot version and the time it
+// last changed. It takes no lock, for cheap conditional status requests.
+func (km *KeyManager) StatusVersion() (uint64, time.Time) {
+	version := km.statusVersion.Load()
+	return version, time.Unix(0, km.statusModified.Load())
+}
+
+func (km *KeyManager) resetScheduler() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		km.resetIfDue()
+		select {
+		case <-ticker.C:
+		case <-km.stopChan:
+			return
+		}
+	}
+}
+
+// resetIfDue resets the daily quotas once the clock has passed the reset time.
+// The reset scheduler calls it every minute; tests with a FakeClock call it
+// after moving the clock.
+func (km *KeyManager) resetIfDue() {
+	km.mutex.Lock()
+	nextReset := km.nextReset
+	km.mutex.Unlock()
+	if !km.now().After(nextReset) {
+		return
+	}
+	km.resetQuotas()
+	if km.sharedState != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := km.sharedState.resetDaily(ctx, nextReset); err != nil {
+			log.Printf("ERROR: failed to reset shared daily usage in Redis: %v", err)
+		}
+		cancel()
+	}
+	next := km.scheduleNextReset()
+	km.publish(Event{Type: QuotaReset, Until: next})
+}
+
+// scheduleNextReset moves nextReset to the next reset_after time and saves it
+// to config.json, if km was loaded from it.
+func (km *KeyManager) scheduleNextReset() time.Time {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	resetTime, _ := time.Parse("15:04", km.config.ResetAfter)
+	today := km.now().In(km.nextReset.Location())
+	next := time.Date(today.Year(), today.Month(), today.Day(), resetTime.Hour(), resetTime.Minute(), 0, 0, km.nextReset.Location())
+	if next.Before(today) {
+		next = next.AddDate(0, 0, 1)
+	}
+	km.nextReset = next
+	km.config.NextQuotaResetDatetime = km.nextReset.Format("2006-01-02 15:04")
+	if err := km.saveConfig(); err != nil {
+		log.Printf("ERROR: failed to save config after quota reset: %v", err)
+	}
+	log.Printf("Quotas reset. Next reset scheduled for: %s", km.nextReset.Format("2006-01-02 15:04:05"))
+	return next
+}
+
+func (km *KeyManager) resetQuotas() {
+	km.mutex.Lock()
+	archive := km.dailyUsageArchive()
+	defer km.writeUsageArchive(archive) // Runs after the unlock below
+	defer km.mutex.Unlock()
+
+	km.clearDailyUsage("", "")
+	km.clientUsage = make(map[string]int)
+	log.Println("All daily quotas have been reset.")
+}
+
+// clearDailyUsage clears the daily counters and flags. An empty modelName or key
+// matches every model or key. Returns the usage keys (modelName_key) that were
+// cleared. Must be called with km.mutex held.
+func (km *KeyManager) clearDailyUsage(modelName, key string) []string {
+	var cleared []string
+	for usageKey, usage := range km.usage {
+		if modelName != "" && !strings.HasPrefix(usageKey, modelName+"_") {
+			continue
+		}
+		if key != "" && !strings.HasSuffix(usageKey, "_"+key) {
+			continue
+		}
+		// usage.TotalTokenUse is a lifetime cumulative value.
+		// We only reset the daily counters.
+		usage.TodayUsage = 0
+		usage.TodayRequests = 0
+		usage.TodayCost = 0
+		usage.TodayImages = 0
+		usage.Past24HoursTokenUsage = UsageWindow{}
+		usage.Exceeded = false
+		usage.ProbablyExceeded = false
+		usage.CooldownUntil = 0
+		usage.CooldownLevel = 0
+		km.touchUsage(usage)
+		cleared = append(cleared, usageKey)
+	}
+	return cleared
+}
+
+// keyServesModel reports whether key_models allows the key to be used for the
+// model. Keys without an entry serve every model.
+func (km *KeyManager) keyServesModel(key, modelName string) bool {
+	allowed, ok := km.config.KeyModels[key]
+	if !ok || len(allowed) == 0 {
+		return true
+	}
+	for _, m := range allowed {
+		if m == modelName {
+			return true
+		}
+	}
+	return false
+}
+
+// Config returns a copy of the current configuration. Its slices and maps are
+// shared with the KeyManager and must not be changed.
+func (km *KeyManager) Config() Config {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	return *km.config
+}
+
+// NextReset returns the time of the next daily quota reset, in the configured
+// timezone.
+func (km *KeyManager) NextReset() time.Time {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	return km.nextReset
+}
+
+// HasModel reports whether the model is configured.
+func (km *KeyManager) HasModel(modelName string) bool {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	_, ok := km.config.Models[modelName]
+	return ok
+}
+
+// GetKey picks a key for the model. If the model has no available key, its
+// fallback_models are tried in order; the returned model name is the one the
+// key was picked for.
+func (km *KeyManager) GetKey(modelName string) (string, string, time.Duration, error) {
+	return km.GetKeyFor(modelName, 0)
+}
+
+// GetKeyFor is GetKey for a request expected to use estimatedTokens. Keys with
+// enough TPM and TPD budget left for it are preferred, so a large request goes
+// to a key that can take it instead of running into a 429.
+func (km *KeyManager) GetKeyFor(modelName string, estimatedTokens int) (string, string, time.Duration, error) {
+	return km.getKeyFor(modelName, estimatedTokens, PriorityNormal, "")
+}
+
+// getKeyFor picks a key as GetKeyFor does, only from the key group if one is
+// given.
+func (km *KeyManager) getKeyFor(modelName string, estimatedTokens int, priority Priority, group string) (string, string, time.Duration, error) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	originalModelName := modelName
+	if _, ok := km.config.Models[modelName]; !ok {
+		modelName = km.config.DefaultModel
+		log.Printf("Model '%s' not found, falling back to default model '%s'", originalModelName, modelName)
+	}
+
+	key, delay, err := km.getModelKey(modelName, estimatedTokens, priority, group)
+	if err == nil {
+		return key, modelName, delay, nil
+	}
+	for _, fallback := range km.config.Models[modelName].FallbackModels {
+		if _, ok := km.config.Models[fallback]; !ok || fallback == modelName {
+			continue
+		}
+		if fallbackKey, fallbackDelay, fallbackErr := km.getModelKey(fallback, estimatedTokens, priority, group); fallbackErr == nil {
+			log.Printf("No available keys for model %s, falling back to %s", modelName, fallback)
+			return fallbackKey, fallback, fallbackDelay, nil
+		}
+	}
+	if priority == PriorityNormal { // Low-priority requests find no key long before the model runs out
+		km.alertNoKeys(modelName)
+	}
+
+	retryAfter := km.keyAvailableIn(modelName)
+	for _, fallback := range km.config.Models[modelName].FallbackModels {
+		if _, ok := km.config.Models[fallback]; !ok {
+			continue
+		}
+		if wait := km.keyAvailableIn(fallback); wait > 0 && (retryAfter == 0 || wait < retryAfter) {
+			retryAfter = wait
+		}
+	}
+	return "", modelName, 0, &NoKeyError{ModelName: modelName, RetryAfter: retryAfter}
+}
+
+// getModelKey picks a key for one model. Must be called with km.mutex held.
+func (km *KeyManager) getModelKey(modelName string, estimatedTokens int, priority Priority, group string) (string, time.Duration, error) {
+	model := km.config.Models[modelName]
+
+	now := km.now().Unix()
+
+	var availableKeys []KeyInfo
+	var probablyAvailableKeys []KeyInfo
+	var trippedKeys []KeyInfo // Circuit breaker open, only used when nothing else is left
+
+	for _, keyInfo := range km.keys {
+		if km.permanentlyBannedKeys[keyInfo.Key] {
+			continue // Skip permanently banned keys
+		}
+		if !km.ownsKey(keyInfo.Key) {
+			continue // Owned by another instance in cluster mode
+		}
+		if km.keyPaused(keyInfo.Key) {
+			continue
+		}
+		if !km.keyInGroup(group, keyInfo.Key) {
+			continue // Routed to another key group
+		}
+
+		if !km.keyServesModel(keyInfo.Key, modelName) {
+			continue
+		}
+
+		usageKey := modelName + "_" + keyInfo.Key
+		usage, ok := km.usage[usageKey]
+		if !ok {
+			log.Printf("Usage key '%s' not found, skipping key %s", usageKey, MaskKey(keyInfo.Key))
+			continue
+		}
+
+		UpdateLanguageModelUsage(usage, now)
+
+		// Check for daily usage limit of 4.1M tokens
+		if usage.TodayUsage >= 4100000 {
+			km.markExceeded(usage, modelName, keyInfo.Key)
+			log.Printf("Key %s for model %s reached daily usage limit of 4.1M tokens. Marked as 'exceeded'.", MaskKey(keyInfo.Key), modelName)
+			continue
+		}
+
+		// Check TPD limit
+		if model.TpdLimit != nil && *model.TpdLimit > 0 && usage.Past24HoursTokenUsage.LastDayTokens(now) >= *model.TpdLimit {
+			km.markExceeded(usage, modelName, keyInfo.Key)
+			continue // Skip this key
+		}
+
+		// Check RPD limit
+		if model.RpdLimit > 0 && usage.TodayRequests >= model.RpdLimit {
+			if !usage.Exceeded {
+				log.Printf("Key %s for model %s reached its limit of %d requests per day. Marked as 'exceeded'.", MaskKey(keyInfo.Key), modelName, model.RpdLimit)
+			}
+			km.markExceeded(usage, modelName, keyInfo.Key)
+			continue
+		}
+
+		// Check the daily image limit of image models
+		if model.IpdLimit > 0 && usage.TodayImages >= model.IpdLimit {
+			if !usage.Exceeded {
+				log.Printf("Key %s for model %s reached its limit of %d images per day. Marked as 'exceeded'.", MaskKey(keyInfo.Key), modelName, model.IpdLimit)
+			}
+			km.markExceeded(usage, modelName, keyInfo.Key)
+			continue
+		}
+
+		if usage.Exceeded {
+			continue
+		}
+		if km.breakerTripped(modelName, keyInfo.Key, now) {
+			trippedKeys = append(trippedKeys, keyInfo)
+			continue
+		}
+		if usage.ProbablyExceeded {
+			// Re-admit the key once its cooldown is over
+			if now >= usage.CooldownUntil {
+				log.Printf("Cooldown of key %s for model %s is over. Re-enabling.", MaskKey(keyInfo.Key), modelName)
+				usage.ProbablyExceeded = false
+				usage.CooldownUntil = 0
+				usage.JustHit429 = false // Reset consecutive error flag
+				km.touchUsage(usage)
+				availableKeys = append(availableKeys, keyInfo)
+			} else {
+				probablyAvailableKeys = append(probablyAvailableKeys, keyInfo)
+			}
+			continue
+		}
+		availableKeys = append(availableKeys, keyInfo)
+	}
+
+	if len(availableKeys) == 0 {
+		availableKeys = probablyAvailableKeys // Try probably exceeded keys
+	}
+	if len(availableKeys) == 0 {
+		if len(trippedKeys) == 0 {
+			return "", 0, fmt.Errorf("no available keys for model %s", modelName)
+		}
+		availableKeys = trippedKeys // Errors beat no response at all
+	}
+	if estimatedTokens > 0 {
+		if keys := km.keysWithBudget(modelName, availableKeys, estimatedTokens); len(keys) > 0 {
+			availableKeys = keys
+		}
+	}
+	if availableKeys = km.applyKeyPolicy(modelName, availableKeys, estimatedTokens, priority); len(availableKeys) == 0 {
+		return "", 0, fmt.Errorf("key_policy leaves no key for model %s", modelName)
+	}
+	if priority == PriorityLow {
+		availableKeys = km.keysWithHeadroom(modelName, availableKeys, estimatedTokens, km.config.Priority.withDefaults().LowTPMShare)
+		if len(availableKeys) == 0 {
+			return "", 0, fmt.Errorf("no key for model %s has headroom for low-priority requests", modelName)
+		}
+	}
+
+	keyToUse, delay := km.soonestKey(modelName, availableKeys, estimatedTokens)
+	for !km.reserveSharedTPM(modelName, keyToUse.Key, estimatedTokens) {
+		// Other instances took the key's TPM since the last sync
+		availableKeys = slices.DeleteFunc(slices.Clone(availableKeys), func(k KeyInfo) bool { return k.Key == keyToUse.Key })
+		if len(availableKeys) == 0 {
+			return "", 0, fmt.Errorf("no key for model %s has TPM left across instances", modelName)
+		}
+		keyToUse, delay = km.soonestKey(modelName, availableKeys, estimatedTokens)
+	}
+	km.startBreakerTrial(modelName, keyToUse.Key, now)
+	usage := km.usage[modelName+"_"+keyToUse.Key]
+	usage.RecentRequests = append(usage.RecentRequests, km.now().Add(delay).UnixMilli())
+	usage.TodayRequests++
+
+	return keyToUse.Key, delay, nil
+}
+
+func (km *KeyManager) RecordUsage(modelName, key string, metadata GeminiUsageMetadata) {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+
+	usageKey := modelName + "_" + key
+	usage, ok := km.usage[usageKey]
+	if !ok {
+		return
+	}
+	lock := km.usageLock(usageKey)
+	lock.Lock()
+	defer lock.Unlock()
+	tokenCount := metadata.TotalTokenCount
+	cost := km.config.Models[modelName].cost(metadata)
+	usage.TotalCost += cost
+	usage.TodayCost += cost
+
+	now := km.now().Unix()
+	usage.TotalTokenUse += tokenCount
+	usage.TodayUsage += tokenCount
+	usage.Past24HoursTokenUsage.add(now, tokenCount)
+	km.appendEvents(UsageEvent{Timestamp: now, Model: modelName, Key: key, Tokens: tokenCount, Cost: cost}, true)
+	usage.JustHit429 = false // A successful request resets the flag
+	if !usage.ProbablyExceeded {
+		usage.CooldownLevel = 0 // and the backoff
+	}
+	UpdateLanguageModelUsage(usage, now)
+	km.learnTPMFromUsage(modelName, key, usage)
+	km.touchUsage(usage)
+}
+
+// markExceeded flags a key/model pair as out of daily quota until the next
+// reset. Must be called with km.mutex held.
+func (km *KeyManager) markExceeded(usage *LanguageModelUsage, modelName, key string) {
+	if usage.Exceeded {
+		return
+	}
+	usage.Exceeded = true
+	km.touchUsage(usage)
+	km.publish(Event{Type: KeyExhausted, Model: modelName, Key: key})
+}
+
+func (km *KeyManager) PermanentlyDisableKey(apiKey string) {
+	km.mutex.Lock()
+	if _, exists := km.permanentlyBannedKeys[apiKey]; !exists {
+		km.permanentlyBannedKeys[apiKey] = true
+		log.Printf("Permanently disabling key %s due to 403 Forbidden error.", MaskKey(apiKey))
+		km.publish(Event{Type: KeyInvalid, Key: apiKey})
+		// The key will be persisted in the next auto-save cycle.
+		km.markStatusChanged()
+	}
+	km.mutex.Unlock()
+}
+
+// cooldownSteps are the backoff durations for a key/model that keeps getting
+// rate limited. The last step repeats until a request succeeds.
+var cooldownSteps = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute, time.Hour}
+
+// HandleRateLimitError takes a key/model out of rotation after a 429, for as
+// long as the classified error suggests.
+func (km *KeyManager) HandleRateLimitError(modelName, key string, info RateLimitInfo) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	usageKey := modelName + "_" + key
+	usage, ok := km.usage[usageKey]
+	if !ok {
+		return
+	}
+
+	UpdateLanguageModelUsage(usage, km.now().Unix())
+	km.touchUsage(usage)
+	km.learnTPMFromRateLimit(modelName, key, usage, info)
+
+	if info.Scope == RateLimitPerDay {
+		km.markExceeded(usage, modelName, key)
+		log.Printf("Daily quota exhausted for model %s with key %s: %v. Marked as 'exceeded'.", modelName, MaskKey(key), info)
+		return
+	}
+
+	// If daily usage is over 4.1M tokens, a 429 error means the quota is likely exhausted.
+	if usage.TodayUsage >= 4100000 {
+		km.markExceeded(usage, modelName, key)
+		log.Printf("Rate limit hit for model %s with key %s and daily usage is over 4.1M. Marked as 'exceeded'.", modelName, MaskKey(key))
+		return
+	}
+
+	// Upstream said how long to wait, so sit out exactly that long
+	if info.RetryAfter > 0 {
+		usage.ProbablyExceeded = true
+		usage.CooldownUntil = km.now().Add(info.RetryAfter + time.Second - 1).Unix() // Round up
+		usage.JustHit429 = false
+		km.publish(Event{Type: KeyCooledDown, Model: modelName, Key: key, Until: time.Unix(usage.CooldownUntil, 0)})
+		log.Printf("Rate limit hit for model %s with key %s: %v. Marked as 'probably exceeded'.", modelName, MaskKey(key), info)
+		return
+	}
+
+	// This is the core of the new logic.
+	if usage.JustHit429 {
+		// This is the second consecutive 429 error after a delay. The delay mechanism failed.
+		// Disable the model for this key temporarily.
+		cooldown := cooldownSteps[min(usage.CooldownLevel, len(cooldownSteps)-1)]
+		usage.ProbablyExceeded = true
+		usage.CooldownUntil = km.now().Add(cooldown).Unix()
+		usage.CooldownLevel++
+		usage.JustHit429 = false // Reset the flag
+		km.publish(Event{Type: KeyCooledDown, Model: modelName, Key: key, Until: time.Unix(usage.CooldownUntil, 0)})
+		log.Printf("Consecutive rate limit hit for model %s with key %s after delay. Marked as 'probably exceeded' for %v.", modelName, MaskKey(key), cooldown)
+	} else {
+		// This is the first 429 error in a sequence. Set the flag.
+		// The proxy handler will now call GetKey, which will enforce a delay.
+		usage.JustHit429 = true
+		log.Printf("Rate limit hit for model %s with key %s. Delay mechanism will be used. If the next attempt also fails, the model will be disabled.", modelName, MaskKey(key))
+	}
+}
+
+func (km *KeyManager) EnableModel(modelName, key string) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	usageKey := modelName + "_" + key
+	usage, ok := km.usage[usageKey]
+	if !ok {
+		log.Printf("EnableModel: Usage key '%s' not found", usageKey)
+		return
+	}
+
+	if usage.ProbablyExceeded {
+		usage.ProbablyExceeded = false
+		usage.CooldownUntil = 0
+		usage.CooldownLevel = 0
+		usage.JustHit429 = false // Also reset the flag
+		km.touchUsage(usage)
+		log.Printf("Model %s for key %s has been re-enabled.", modelName, MaskKey(key))
+	}
+}
+
+// ResetQuotas resets daily quotas on demand, optionally only those of one model
+// or key, and recomputes the next scheduled reset from reset_after. Unlike the
+// scheduled reset it doesn't write a usage archive.
+func (km *KeyManager) ResetQuotas(modelName, key string) (int, time.Time, error) {
+	km.mutex.Lock()
+	if _, ok := km.config.Models[modelName]; modelName != "" && !ok {
+		km.mutex.Unlock()
+		return 0, time.Time{}, fmt.Errorf("unknown model '%s'", modelName)
+	}
+	known := key == ""
+	for _, k := range km.allKeys() {
+		known = known || k == key
+	}
+	if !known {
+		km.mutex.Unlock()
+		return 0, time.Time{}, fmt.Errorf("unknown key '%s'", MaskKey(key))
+	}
+	cleared := km.clearDailyUsage(modelName, key)
+	if modelName == "" && key == "" {
+		km.clientUsage = make(map[string]int)
+	}
+	km.mutex.Unlock()
+	log.Printf("Daily quotas of %d key/model pairs have been reset through the API.", len(cleared))
+
+	if km.sharedState != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := km.sharedState.clearToday(ctx, cleared); err != nil {
+			log.Printf("ERROR: failed to reset shared daily usage in Redis: %v", err)
+		}
+		cancel()
+	}
+	return len(cleared), km.scheduleNextReset(), nil
+}
+
+// configPath is the location of config.json, in the data directory. It can be
+// pointed into a mounted volume (e.g. a Kubernetes ConfigMap) with the
+// GEMINILOOPER_CONFIG environment variable.
+var configPath = "config.json"
+
+func LoadConfig() (*Config, error) {
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		// Create default config
+		defaultConfig := Config{
+			PriorityKeys:  []string{"PriorityKeysHere-Key1", "PriorityKeysHere-Key2"},
+			SecondaryKeys: []string{"SecondaryKeysHere-Key1", "SecondaryKeysHere-Key2"},
+			Models: map[string]LanguageModel{
+				"gemini-1.5-pro-latest":   {TpmLimit: 250000, TpdLimit: func(i int) *int { return &i }(6000000)},
+				"gemini-1.5-flash-latest": {TpmLimit: 250000, TpdLimit: nil},
+			},
+			ResetAfter:             "01:00",
+			NextQuotaResetDatetime: time.Now().AddDate(0, 0, 1).Format("2006-01-02") + " 01:00",
+			Timezone:               "UTC",
+			DefaultModel:           "gemini-1.5-pro-latest",
+		}
+		configData, err := json.MarshalIndent(defaultConfig, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal default config: %v", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create config directory: %v", err)
+		}
+		if err := writeFileAtomic(configPath, configData, false); err != nil {
+			return nil, fmt.Errorf("failed to write default config: %v", err)
+		}
+	}
+
+	return readConfigFile(configPath)
+}
+
+// readConfigFile reads and parses a config file. Unlike LoadConfig it doesn't
+// create a missing one.
+func readConfigFile(path string) (*Config, error) {
+	configData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var config Config
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %v", err)
+	}
+
+	for name, model := range config.Models {
+		model.ModelName = name
+		config.Models[name] = model
+	}
+
+	return &config, nil
+}
+
+// saveConfig writes the config to the config.json km was loaded from. A
+// KeyManager built by New or NewWithStore only keeps changes in memory. Must be
+// called with km.mutex held.
+func (km *KeyManager) saveConfig() error {
+	if km.configFile == "" {
+		return nil
+	}
+	configData, err := json.MarshalIndent(km.config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config for saving: %v", err)
+	}
+	if err := writeFileAtomic(km.configFile, configData, true); err != nil {
+		return fmt.Errorf("failed to write config to file: %v", err)
+	}
+	return nil
+}
+
+func LoadKeyUsage(config *Config) (map[string]*LanguageModelUsage, error) {
+	store := NewJSONUsageStore(DataFilePath(config, usageFileName(config)))
+
+	// Create a new usage map based on the current config. This is the source of truth.
+	newUsage := newPoolUsage(config)
+
+	// Load existing usage data if it exists, from the backup if the file is damaged
+	saved, found, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		// No usable file, so we'll just save the new one and return it
+		initial := UsageSnapshot{Usage: newUsage, PermanentlyBannedKeys: make(map[string]bool)}
+		if err := store.SaveDelta(initial, nil); err != nil {
+			log.Printf("Failed to write initial usage data: %v", err)
+		}
+		return newUsage, nil
+	}
+	// Copy old usage data into the new structure. Banned keys are restored by
+	// NewKeyManager.
+	applySavedUsage(newUsage, saved.Usage)
+	return newUsage, nil
+}
+
+// newPoolUsage creates an empty usage entry for every model/key pair in the config.
+func newPoolUsage(config *Config) map[string]*LanguageModelUsage {
+	usage := make(map[string]*LanguageModelUsage)
+	for modelName, model := range config.Models {
+		for _, keyInfo := range buildKeyInfos(config.PriorityKeys, config.SecondaryKeys) {
+			usage[modelName+"_"+keyInfo.Key] = newLanguageModelUsage(model)
+		}
+	}
+	return usage
+}
+
+// applySharedUsage overwrites local counters with the shared ones from Redis.
+func applySharedUsage(usage map[string]*LanguageModelUsage, shared map[string]*LanguageModelUsage) {
+	for usageKey, entry := range usage {
+		sharedEntry, ok := shared[usageKey]
+		if !ok {
+			entry.TodayUsage = 0
+			entry.Exceeded = false
+			entry.ProbablyExceeded = false
+			entry.Past24HoursTokenUsage = UsageWindow{}
+			continue
+		}
+		entry.TotalTokenUse = sharedEntry.TotalTokenUse
+		entry.TodayUsage = sharedEntry.TodayUsage
+		entry.Past24HoursTokenUsage = sharedEntry.Past24HoursTokenUsage
+		entry.Exceeded = sharedEntry.Exceeded
+		entry.ProbablyExceeded = sharedEntry.ProbablyExceeded
+	}
+}
+
+// applySavedUsage copies persisted counters into the entries that still exist.
+func applySavedUsage(usage map[string]*LanguageModelUsage, saved map[string]*LanguageModelUsage) {
+	for usageKey, entry := range usage {
+		if oldData, ok := saved[usageKey]; ok {
+			entry.TotalTokenUse = oldData.TotalTokenUse
+			entry.TodayUsage = oldData.TodayUsage
+			entry.TodayRequests = oldData.TodayRequests
+			entry.TotalCost = oldData.TotalCost
+			entry.TodayCost = oldData.TodayCost
+			entry.TotalImages = oldData.TotalImages
+			entry.TodayImages = oldData.TodayImages
+			entry.Past24HoursTokenUsage = oldData.Past24HoursTokenUsage
+			entry.ProbablyExceeded = oldData.ProbablyExceeded
+			entry.Exceeded = oldData.Exceeded
+			entry.CooldownUntil = oldData.CooldownUntil
+			entry.CooldownLevel = oldData.CooldownLevel
+			entry.LearnedTpmLimit = oldData.LearnedTpmLimit
+		}
+	}
+}
+
+func newLanguageModelUsage(model LanguageModel) *LanguageModelUsage {
+	return &LanguageModelUsage{
+		LanguageModel:    model,
+		TotalTokenUse:    0,
+		ProbablyExceeded: false,
+		Exceeded:         false,
+	}
+}
+
+func (km *KeyManager) SaveUsage() {
+	km.saveUsage(false)
+}
+
+// saveUsage persists usage; force skips the rate limit, for shutdown.
+func (km *KeyManager) saveUsage(force bool) {
+	if km.usageStore == nil {
+		return
+	}
+
+	km.mutex.Lock()
+
+	// Avoid saving too frequently
+	if !force && km.now().Sub(km.lastSaved) < 10*time.Second {
+		km.mutex.Unlock()
+		return
+	}
+
+	// Create a deep copy of the data to be saved, inside the lock
+	usageCopy := make(map[string]*LanguageModelUsage)
+	for k, v := range km.usage {
+		usageCopy[k] = v.deepCopy()
+	}
+	bannedKeysCopy := make(map[string]bool)
+	for k, v := range km.permanentlyBannedKeys {
+		bannedKeysCopy[k] = v
+	}
+	corpusKeysCopy := make(map[string]string)
+	for k, v := range km.corpusKeys {
+		corpusKeysCopy[k] = v
+	}
+	km.pruneFileKeys()
+	fileKeysCopy := make(map[string]FileKey)
+	for k, v := range km.fileKeys {
+		fileKeysCopy[k] = v
+	}
+	retiredUsageCopy := make(map[string]*LanguageModelUsage)
+	for k, v := range km.retiredUsage {
+		retiredUsageCopy[k] = v.deepCopy()
+	}
+	clientUsageCopy := make(map[string]int)
+	for k, v := range km.clientUsage {
+		clientUsageCopy[k] = v
+	}
+	km.eventsMutex.Lock()
+	events := km.pendingEvents
+	km.pendingEvents = nil
+	km.eventsMutex.Unlock()
+	km.lastSaved = km.now()
+
+	km.mutex.Unlock() // Unlock before I/O operations
+
+	// Create a combined struct to save usage, banned keys, corpus and file ownership, retired usage and client usage
+	dataToSave := UsageSnapshot{
+		Usage:                 usageCopy,
+		PermanentlyBannedKeys: bannedKeysCopy,
+		CorpusKeys:            corpusKeysCopy,
+		FileKeys:              fileKeysCopy,
+		RetiredUsage:          retiredUsageCopy,
+		ClientUsage:           clientUsageCopy,
+	}
+
+	if err := km.usageStore.SaveDelta(dataToSave, events); err != nil {
+		log.Printf("Error saving usage data: %v", err)
+		// Keep the events for the next attempt
+		km.eventsMutex.Lock()
+		km.pendingEvents = append(events, km.pendingEvents...)
+		km.eventsMutex.Unlock()
+		return
+	}
+
+	log.Println("Usage data saved.")
+}
+
+func UpdateLanguageModelUsage(usage *LanguageModelUsage, now int64) {
+	// Token usage ages out of its window by itself
+	cutoff := now*1000 - 60000
+	recentRequests := make([]int64, 0, len(usage.RecentRequests))
+	for _, ts := range usage.RecentRequests {
+		if ts >= cutoff {
+			recentRequests = append(recentRequests, ts)
+		}
+	}
+	usage.RecentRequests = recentRequests
+}
+
+// GetStatus returns a snapshot of the key usage for the status page. It only
+// reads, so polling dashboards don't hold up key selection for long.
+func (km *KeyManager) GetStatus() *StatusData {
+	km.mutex.RLock()
+	now := km.now().Unix()
+	grandTotalTokens := 0
+	grandTotalTodayUsage := 0
+	grandTotalCost, grandTodayCost := 0.0, 0.0
+	modelTodayCost := make(map[string]float64)
+	keyUsageStatus := make(map[string]KeyStatus)
+	rateLimitedKeys := make(map[string]bool)
+	quotaExhaustedKeys := make(map[string]bool)
+	unavailableKeys := make(map[string]bool)
+
+	allKeys := km.allKeys()
+	modelOrder := make([]string, 0, len(km.config.Models))
+	modelsConfig := make(map[string]ModelConfig)
+	for name, model := range km.config.Models {
+		modelOrder = append(modelOrder, name)
+		modelsConfig[name] = ModelConfig{TpmLimit: model.TpmLimit}
+	}
+	sort.Strings(modelOrder) // Sort model names alphabetically
+
+	for _, key := range allKeys {
+		if km.permanentlyBannedKeys[key] {
+			continue // Don't show banned keys in the main list
+		}
+		keyStatus := make(KeyStatus)
+		for _, modelName := range modelOrder {
+			usageKey := modelName + "_" + key
+			usage, ok := km.usage[usageKey]
+			if !ok {
+				continue
+			}
+			lock := km.usageLock(usageKey)
+			lock.Lock()
+
+			grandTotalTokens += usage.TotalTokenUse
+			grandTotalTodayUsage += usage.TodayUsage
+			grandTotalCost += usage.TotalCost
+			grandTodayCost += usage.TodayCost
+			modelTodayCost[modelName] += usage.TodayCost
+			tokensLastMinute := usage.Past24HoursTokenUsage.LastMinuteTokens(now)
+
+			keyStatus[modelName] = ModelUsageStatus{
+				TokensLastMinute:      tokensLastMinute,
+				TotalTokens:           usage.TotalTokenUse,
+				TodayUsage:            usage.TodayUsage,
+				TodayRequests:         usage.TodayRequests,
+				TotalCost:             usage.TotalCost,
+				TodayCost:             usage.TodayCost,
+				TotalImages:           usage.TotalImages,
+				TodayImages:           usage.TodayImages,
+				IsTemporarilyDisabled: usage.ProbablyExceeded,
+				CooldownUntil:         usage.CooldownUntil,
+				DailyQuotaExceeded:    usage.Exceeded,
+				CircuitBreaker:        km.breakerState(usageKey, now),
+				TpmLimit:              km.tpmLimit(modelName, usage),
+			}
+
+			if usage.ProbablyExceeded {
+				rateLimitedKeys[key] = true
+			}
+			if usage.Exceeded {
+				quotaExhaustedKeys[key] = true
+			}
+			lock.Unlock()
+		}
+		keyUsageStatus[key] = keyStatus
+	}
+
+	// Active Key Model Chart Data
+	currentMaskedKey := "None"
+	currentRawKey := ""
+	_, _, key, err := km.findBestKey(km.config.DefaultModel, now)
+	if err == nil && key != "" {
+		currentMaskedKey = MaskKey(key)
+		currentRawKey = key
+	}
+
+	activeKeyModelUsage := make(map[string][]UsageData)
+	if currentRawKey != "" {
+		for _, modelName := range modelOrder {
+			usageKey := modelName + "_" + currentRawKey
+			if usage, ok := km.usage[usageKey]; ok {
+				var historySlice []UsageData
+				lock := km.usageLock(usageKey)
+				lock.Lock()
+				for m := (now-3600)/60 + 1; m <= now/60; m++ {
+					if tokens := usage.Past24HoursTokenUsage.minute(m); tokens > 0 {
+						historySlice = append(historySlice, UsageData{Timestamp: int(m * 60), CostToken: tokens})
+					}
+				}
+				lock.Unlock()
+				activeKeyModelUsage[modelName] = historySlice
+			}
+		}
+	}
+	status := &StatusData{
+		GrandTotalTokens:      grandTotalTokens,
+		GrandTotalTodayUsage:  grandTotalTodayUsage,
+		GrandTotalCost:        grandTotalCost,
+		GrandTodayCost:        grandTodayCost,
+		CurrentMaskedKey:      currentMaskedKey,
+		CurrentRawKey:         currentRawKey,
+		KeyUsageStatus:        keyUsageStatus,
+		PriorityKeys:          km.poolKeys(true),
+		SecondaryKeys:         km.poolKeys(false),
+		RateLimitedKeys:       keysFromMap(rateLimitedKeys),
+		QuotaExhaustedKeys:    keysFromMap(quotaExhaustedKeys),
+		PermanentlyBannedKeys: keysFromMap(km.permanentlyBannedKeys),
+		PausedKeys:            append([]string{}, km.config.PausedKeys...),
+		UnavailableKeys:       keysFromMap(unavailableKeys),
+		ModelOrder:            modelOrder,
+		ModelsConfig:          modelsConfig,
+		ModelCostChartData:    costChartData(modelTodayCost, modelOrder),
+		QueuedRequests:        km.queued.Load(),
+	}
+	km.mutex.RUnlock()
+
+	// --- Chart Data Generation ---, from copies, without holding km.mutex
+	km.usageHistoryMutex.Lock()
+	status.ModelChartData = generateChartData(km.lastHourTokenUsage, now, modelOrder)
+	status.KeyChartData = generateChartData(km.lastHourKeyUsage, now, allKeys)
+	km.usageHistoryMutex.Unlock()
+	status.ActiveKeyModelChartData = generateChartData(activeKeyModelUsage, now, modelOrder)
+	return status
+}
+
+func (km *KeyManager) GetStatusDelta(since int64) *StatusDelta {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+
+	now := km.now().Unix()
+	delta := &StatusDelta{
+		Since:          since,
+		Timestamp:      now,
+		KeyUsageStatus: make(map[string]KeyStatus),
+		ModelUsage:     make(map[string][]UsageData),
+		KeyUsage:       make(map[string][]UsageData),
+	}
+	rateLimitedKeys := make(map[string]bool)
+	quotaExhaustedKeys := make(map[string]bool)
+
+	for _, key := range km.allKeys() {
+		if km.permanentlyBannedKeys[key] {
+			continue
+		}
+		for modelName := range km.config.Models {
+			usageKey := modelName + "_" + key
+			usage, ok := km.usage[usageKey]
+			if !ok {
+				continue
+			}
+			lock := km.usageLock(usageKey)
+			lock.Lock()
+
+			delta.GrandTotalTokens += usage.TotalTokenUse
+			delta.GrandTotalTodayUsage += usage.TodayUsage
+			delta.GrandTotalCost += usage.TotalCost
+			delta.GrandTodayCost += usage.TodayCost
+			if usage.ProbablyExceeded {
+				rateLimitedKeys[key] = true
+			}
+			if usage.Exceeded {
+				quotaExhaustedKeys[key] = true
+			}
+
+			// Entries with traffic in the last minute are always sent because their
+			// tokens_last_minute value keeps moving as the window rolls.
+			tokensLastMinute := usage.Past24HoursTokenUsage.LastMinuteTokens(now)
+			if usage.LastChanged <= since && tokensLastMinute == 0 {
+				lock.Unlock()
+				continue
+			}
+			if delta.KeyUsageStatus[key] == nil {
+				delta.KeyUsageStatus[key] = make(KeyStatus)
+			}
+			delta.KeyUsageStatus[key][modelName] = ModelUsageStatus{
+				TokensLastMinute:      tokensLastMinute,
+				TotalTokens:           usage.TotalTokenUse,
+				TodayUsage:            usage.TodayUsage,
+				TodayRequests:         usage.TodayRequests,
+				TotalCost:             usage.TotalCost,
+				TodayCost:             usage.TodayCost,
+				TotalImages:           usage.TotalImages,
+				TodayImages:           usage.TodayImages,
+				IsTemporarilyDisabled: usage.ProbablyExceeded,
+				CooldownUntil:         usage.CooldownUntil,
+				DailyQuotaExceeded:    usage.Exceeded,
+				CircuitBreaker:        km.breakerState(usageKey, now),
+				TpmLimit:              km.tpmLimit(modelName, usage),
+			}
+			lock.Unlock()
+		}
+	}
+
+	delta.RateLimitedKeys = keysFromMap(rateLimitedKeys)
+	delta.QuotaExhaustedKeys = keysFromMap(quotaExhaustedKeys)
+	delta.PermanentlyBannedKeys = keysFromMap(km.permanentlyBannedKeys)
+	delta.PausedKeys = append([]string{}, km.config.PausedKeys...)
+	km.usageHistoryMutex.Lock()
+	delta.ModelUsage = usagePointsSince(km.lastHourTokenUsage, since)
+	delta.KeyUsage = usagePointsSince(km.lastHourKeyUsage, since)
+	km.usageHistoryMutex.Unlock()
+
+	return delta
+}
+
+// usagePointsSince returns the history points recorded strictly after since.
+func usagePointsSince(source map[string][]UsageData, since int64) map[string][]UsageData {
+	result := make(map[string][]UsageData)
+	for name, history := range source {
+		var points []UsageData
+		for _, data := range history {
+			if int64(data.Timestamp) > since {
+				points = append(points, data)
+			}
+		}
+		if len(points) > 0 {
+			result[name] = points
+		}
+	}
+	return result
+}
+
+func generateChartData(usageSource map[string][]UsageData, now int64, seriesOrder []string) ChartData {
+	chartData := ChartData{
+		Labels:   []string{},
+		Datasets: []ChartDataset{},
+	}
+
+	// Generate all possible timestamps for the last hour (every minute)
+	timestamps := make(map[int64]bool)
+	allTimestampsSlice := make([]int64, 0, 60)
+	for i := 59; i >= 0; i-- {
+		ts := now - int64(i*60)
+		minuteTimestamp := (ts / 60) * 60 // Round to the minute
+		if !timestamps[minuteTimestamp] {
+			timestamps[minuteTimestamp] = true
+			allTimestampsSlice = append(allTimestampsSlice, minuteTimestamp)
+		}
+	}
+	sort.Slice(allTimestampsSlice, func(i, j int) bool { return allTimestampsSlice[i] < allTimestampsSlice[j] })
+
+	for _, ts := range allTimestampsSlice {
+		chartData.Labels = append(chartData.Labels, time.Unix(ts, 0).Format("15:04"))
+	}
+
+	// Define a broader palette of colors
+	modelColors := []string{
+		"rgba(54, 162, 235, 1)", "rgba(255, 99, 132, 1)", "rgba(75, 192, 192, 1)",
+		"rgba(255, 206, 86, 1)", "rgba(153, 102, 255, 1)", "rgba(255, 159, 64, 1)",
+		"rgba(99, 255, 132, 1)", "rgba(235, 54, 162, 1)", "rgba(86, 255, 206, 1)",
+		"rgba(102, 153, 255, 1)",
+	}
+	bgColors := []string{
+		"rgba(54, 162, 235, 0.2)", "rgba(255, 99, 132, 0.2)", "rgba(75, 192, 192, 0.2)",
+		"rgba(255, 206, 86, 0.2)", "rgba(153, 102, 255, 0.2)", "rgba(255, 159, 64, 0.2)",
+		"rgba(99, 255, 132, 0.2)", "rgba(235, 54, 162, 0.2)", "rgba(86, 255, 206, 0.2)",
+		"rgba(102, 153, 255, 0.2)",
+	}
+
+	colorIndex := 0
+	for _, seriesName := range seriesOrder {
+		history, ok := usageSource[seriesName]
+		if !ok || len(history) == 0 {
+			continue // Skip series with no data
+		}
+
+		// Check if there's any activity in the last hour
+		hasRecentActivity := false
+		for _, data := range history {
+			if int64(data.Timestamp) >= now-3600 {
+				hasRecentActivity = true
+				break
+			}
+		}
+		if !hasRecentActivity {
+			continue
+		}
+
+		dataset := ChartDataset{
+			Label:           seriesName,
+			Data:            make([]float64, len(allTimestampsSlice)),
+			Fill:            true,
+			BorderColor:     modelColors[colorIndex%len(modelColors)],
+			BackgroundColor: bgColors[colorIndex%len(bgColors)],
+			Tension:         0.4,
+		}
+		colorIndex++
+
+		usageMap := make(map[int64]int)
+		for _, data := range history {
+			minuteTimestamp := (int64(data.Timestamp) / 60) * 60
+			usageMap[minuteTimestamp] = data.CostToken
+		}
+
+		for j, ts := range allTimestampsSlice {
+			if val, ok := usageMap[ts]; ok {
+				dataset.Data[j] = float64(val)
+			} else {
+				dataset.Data[j] = 0
+			}
+		}
+		chartData.Datasets = append(chartData.Datasets, dataset)
+	}
+
+	return chartData
+}
+
+func (km *KeyManager) findBestKey(modelName string, now int64) (string, time.Duration, string, error) {
+	// This is a simplified, read-only version of GetKey logic for status reporting
+	if _, ok := km.config.Models[modelName]; !ok {
+		modelName = km.config.DefaultModel
+	}
+	model := km.config.Models[modelName]
+
+	var availableKeys []KeyInfo
+	var probablyAvailableKeys []KeyInfo
+
+	for _, keyInfo := range km.keys {
+		if km.permanentlyBannedKeys[keyInfo.Key] || !km.ownsKey(keyInfo.Key) || km.keyPaused(keyInfo.Key) || !km.keyServesModel(keyInfo.Key, modelName) {
+			continue
+		}
+		usageKey := modelName + "_" + keyInfo.Key
+		usage, ok := km.usage[usageKey]
+		if !ok {
+			continue
+		}
+		lock := km.usageLock(usageKey)
+		lock.Lock()
+		dailyTokens := usage.Past24HoursTokenUsage.LastDayTokens(now)
+		exceeded, probablyExceeded := usage.Exceeded, usage.ProbablyExceeded
+		lock.Unlock()
+
+		if model.TpdLimit != nil && *model.TpdLimit > 0 && dailyTokens >= *model.TpdLimit {
+			continue
+		}
+		if exceeded {
+			continue
+		}
+		if probablyExceeded || km.breakerState(usageKey, now) == breakerOpen {
+			probablyAvailableKeys = append(probablyAvailableKeys, keyInfo)
+			continue
+		}
+		availableKeys = append(availableKeys, keyInfo)
+	}
+
+	if len(availableKeys) == 0 {
+		if len(probablyAvailableKeys) == 0 {
+			return "", 0, "", fmt.Errorf("no available keys for model %s", modelName)
+		}
+		availableKeys = probablyAvailableKeys
+	}
+
+	return availableKeys[0].Key, 0, availableKeys[0].Key, nil
+}
+
+// MaskKey shortens a secret to its first and last four characters for display.
+func MaskKey(key string) string {
+	if len(key) <= 8 {
+		return key[:len(key)/2] + "..."
+	}
+	return key[:4] + "..." + key[len(key)-4:]
+}
+
+func keysFromMap(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // Sort for consistent order
+	return keys
+}
@@ -0,0 +1,201 @@
+package keymanager
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/file"
+	"github.com/expr-lang/expr/vm"
+)
+
+// key_policy is an expr-lang expression (https://expr-lang.org) that GetKey
+// evaluates for every key it could use, after the limits, cooldowns and
+// budgets have been applied. A boolean result keeps (true) or drops (false) the
+// key; a numeric result ranks the keys and only the highest scoring ones are
+// used. Either way the request goes to the first of the remaining keys with
+// room, as without a policy. For example, secondary keys are only used once
+// 80% of the priority keys are exhausted with
+//
+//	key.priority || count(keys, .priority && .exhausted) >= 0.8 * count(keys, .priority)
+
+// policyKey is a key as seen by key_policy.
+type policyKey struct {
+	Key                string  `expr:"key"` // Masked
+	Priority           bool    `expr:"priority"`
+	TodayRequests      int     `expr:"today_requests"`
+	TodayTokens        int     `expr:"today_tokens"`
+	TodayCost          float64 `expr:"today_cost"` // Estimated USD
+	TodayImages        int     `expr:"today_images"`
+	TokensLastMinute   int     `expr:"tokens_last_minute"`
+	RequestsLastMinute int     `expr:"requests_last_minute"`
+	TokensLastDay      int     `expr:"tokens_last_day"`
+	TpmLimit           int     `expr:"tpm_limit"` // 0 for no limit, the learned limit with adaptive_tpm
+	RpmLimit           int     `expr:"rpm_limit"`
+	RpdLimit           int     `expr:"rpd_limit"`
+	TpdLimit           int     `expr:"tpd_limit"`
+	Exhausted          bool    `expr:"exhausted"`    // Out of daily quota until the next reset
+	CoolingDown        bool    `expr:"cooling_down"` // Out of rotation after a 429
+}
+
+// policyEnv is what key_policy can refer to.
+type policyEnv struct {
+	Model           string      `expr:"model"`
+	EstimatedTokens int         `expr:"estimated_tokens"` // 0 unless token_estimation is on
+	LowPriority     bool        `expr:"low_priority"`
+	Key             policyKey   `expr:"key"`  // The key being judged
+	Keys            []policyKey `expr:"keys"` // Every key of the model, including exhausted ones
+}
+
+// keyPolicy is a compiled key_policy.
+type keyPolicy struct {
+	source  string
+	program *vm.Program
+}
+
+// CompileKeyPolicy checks a key_policy expression and compiles it.
+func CompileKeyPolicy(source string) (*vm.Program, error) {
+	program, err := expr.Compile(source, expr.Env(policyEnv{}))
+	var fileErr *file.Error
+	if errors.As(err, &fileErr) { // Without the multi-line snippet
+		return nil, fmt.Errorf("%s (column %d)", fileErr.Message, fileErr.Column+1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t := program.Node().Type(); t != nil {
+		switch t.Kind() {
+		case reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64, reflect.Interface:
+		default:
+			return nil, fmt.Errorf("must be a boolean or a number, not %s", t)
+		}
+	}
+	return program, nil
+}
+
+// keyPolicyProgram returns the compiled key_policy, or nil without one. It is
+// compiled again after a config reload changed it. Must be called with
+// km.mutex held.
+func (km *KeyManager) keyPolicyProgram() *vm.Program {
+	source := km.config.KeyPolicy
+	if source == "" {
+		return nil
+	}
+	if km.policy == nil || km.policy.source != source {
+		program, err := CompileKeyPolicy(source)
+		if err != nil { // The config was checked when loaded, so this is unlikely
+			log.Printf("ERROR: invalid key_policy, ignoring it: %v", err)
+			program = nil
+		}
+		km.policy = &keyPolicy{source: source, program: program}
+	}
+	return km.policy.program
+}
+
+// policyKeys describes every key that serves the model for key_policy. Must be
+// called with km.mutex held.
+func (km *KeyManager) policyKeys(modelName string, now int64) map[string]policyKey {
+	model := km.config.Models[modelName]
+	tpdLimit := 0
+	if model.TpdLimit != nil {
+		tpdLimit = *model.TpdLimit
+	}
+	keys := make(map[string]policyKey)
+	for _, keyInfo := range km.keys {
+		if km.permanentlyBannedKeys[keyInfo.Key] || !km.ownsKey(keyInfo.Key) || km.keyPaused(keyInfo.Key) || !km.keyServesModel(keyInfo.Key, modelName) {
+			continue
+		}
+		usage, ok := km.usage[modelName+"_"+keyInfo.Key]
+		if !ok {
+			continue
+		}
+		recentRequests := 0
+		for _, ms := range usage.RecentRequests {
+			if ms > (now-60)*1000 {
+				recentRequests++
+			}
+		}
+		keys[keyInfo.Key] = policyKey{
+			Key:                MaskKey(keyInfo.Key),
+			Priority:           keyInfo.IsPriority,
+			TodayRequests:      usage.TodayRequests,
+			TodayTokens:        usage.TodayUsage,
+			TodayCost:          usage.TodayCost,
+			TodayImages:        usage.TodayImages,
+			TokensLastMinute:   usage.Past24HoursTokenUsage.LastMinuteTokens(now),
+			RequestsLastMinute: recentRequests,
+			TokensLastDay:      usage.Past24HoursTokenUsage.LastDayTokens(now),
+			TpmLimit:           km.tpmLimit(modelName, usage),
+			RpmLimit:           model.RpmLimit,
+			RpdLimit:           model.RpdLimit,
+			TpdLimit:           tpdLimit,
+			Exhausted:          usage.Exceeded,
+			CoolingDown:        usage.ProbablyExceeded,
+		}
+	}
+	return keys
+}
+
+// applyKeyPolicy narrows the keys a request may use down to the ones key_policy
+// picks. If the policy fails to evaluate for a key, it is ignored for the
+// request rather than leaving it without a key. Must be called with km.mutex
+// held.
+func (km *KeyManager) applyKeyPolicy(modelName string, keys []KeyInfo, estimatedTokens int, priority Priority) []KeyInfo {
+	program := km.keyPolicyProgram()
+	if program == nil {
+		return keys
+	}
+	described := km.policyKeys(modelName, km.now().Unix())
+	env := policyEnv{Model: modelName, EstimatedTokens: estimatedTokens, LowPriority: priority == PriorityLow}
+	for _, keyInfo := range km.keys { // In rotation order, like the keys passed in
+		if k, ok := described[keyInfo.Key]; ok {
+			env.Keys = append(env.Keys, k)
+		}
+	}
+
+	var kept []KeyInfo
+	scores := make(map[string]float64)
+	for _, keyInfo := range keys {
+		env.Key = described[keyInfo.Key]
+		result, err := expr.Run(program, env)
+		if err != nil {
+			log.Printf("WARN: key_policy failed for key %s, ignoring it: %v", MaskKey(keyInfo.Key), err)
+			return keys
+		}
+		switch result := result.(type) {
+		case bool:
+			if result {
+				kept = append(kept, keyInfo)
+			}
+		case int:
+			scores[keyInfo.Key] = float64(result)
+			kept = append(kept, keyInfo)
+		case int64:
+			scores[keyInfo.Key] = float64(result)
+			kept = append(kept, keyInfo)
+		case float64:
+			scores[keyInfo.Key] = result
+			kept = append(kept, keyInfo)
+		default:
+			log.Printf("WARN: key_policy returned %T instead of a boolean or a number, ignoring it", result)
+			return keys
+		}
+	}
+	if len(scores) == 0 {
+		return kept
+	}
+
+	// Keep the highest scoring keys, in rotation order
+	sort.SliceStable(kept, func(i, j int) bool { return scores[kept[i].Key] > scores[kept[j].Key] })
+	best := kept[:1]
+	for _, keyInfo := range kept[1:] {
+		if scores[keyInfo.Key] < scores[best[0].Key] {
+			break
+		}
+		best = append(best, keyInfo)
+	}
+	return best
+}
@@ -0,0 +1,434 @@
+package keymanager
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KeyProvider fetches API keys from an external secret source so they don't
+// have to be stored in config.json.
+type KeyProvider interface {
+	Name() string
+	FetchKeys(ctx context.Context) ([]string, error)
+}
+
+type KeyProviderConfig struct {
+	Type      string `json:"type"`                // env, file, aws_secrets_manager, gcp_secret_manager, vault
+	Secondary bool   `json:"secondary,omitempty"` // Add the keys to the secondary pool instead of the priority pool
+	Variable  string `json:"variable,omitempty"`  // env: name of the environment variable
+	Path      string `json:"path,omitempty"`      // file: path of the file holding the keys; vault: secret path, e.g. secret/data/gemini
+	SecretID  string `json:"secret_id,omitempty"` // aws_secrets_manager: secret name or ARN; vault: AppRole secret ID
+	Region    string `json:"region,omitempty"`    // aws_secrets_manager: e.g. us-east-1
+	Name      string `json:"name,omitempty"`      // gcp_secret_manager: projects/*/secrets/*/versions/*
+
+	// vault only
+	Address    string `json:"address,omitempty"`     // Defaults to VAULT_ADDR
+	Namespace  string `json:"namespace,omitempty"`   // Defaults to VAULT_NAMESPACE
+	Field      string `json:"field,omitempty"`       // Field of the secret holding the keys; all string fields if empty
+	AuthMethod string `json:"auth_method,omitempty"` // token (default) or approle
+	Token      string `json:"token,omitempty"`       // Defaults to VAULT_TOKEN
+	RoleID     string `json:"role_id,omitempty"`     // Defaults to VAULT_ROLE_ID
+}
+
+// keyProviderEntry tracks a configured provider and the keys it returned last,
+// so a failed refresh keeps serving the previous keys.
+// tokenRenewer is a key provider that keeps its credentials alive on a schedule
+// of its own rather than on key refreshes.
+type tokenRenewer interface {
+	renewLoop(stop <-chan struct{})
+}
+
+type keyProviderEntry struct {
+	provider  KeyProvider
+	secondary bool
+	keys      []string
+}
+
+func newKeyProvider(config KeyProviderConfig) (KeyProvider, error) {
+	switch config.Type {
+	case "env":
+		if config.Variable == "" {
+			return nil, fmt.Errorf("env key provider requires 'variable'")
+		}
+		return &envKeyProvider{variable: config.Variable}, nil
+	case "file":
+		if config.Path == "" {
+			return nil, fmt.Errorf("file key provider requires 'path'")
+		}
+		return &fileKeyProvider{path: config.Path}, nil
+	case "aws_secrets_manager":
+		if config.SecretID == "" || config.Region == "" {
+			return nil, fmt.Errorf("aws_secrets_manager key provider requires 'secret_id' and 'region'")
+		}
+		return &awsSecretsManagerProvider{secretID: config.SecretID, region: config.Region, client: &http.Client{Timeout: 15 * time.Second}}, nil
+	case "gcp_secret_manager":
+		if config.Name == "" {
+			return nil, fmt.Errorf("gcp_secret_manager key provider requires 'name'")
+		}
+		return &gcpSecretManagerProvider{name: config.Name, client: &http.Client{Timeout: 15 * time.Second}}, nil
+	case "vault":
+		return newVaultKeyProvider(config)
+	default:
+		return nil, fmt.Errorf("unknown key provider type '%s'", config.Type)
+	}
+}
+
+// parseKeyList accepts a JSON array, a JSON object (all string values are used),
+// or plain text with one key per line/comma. Lines starting with # are ignored.
+func parseKeyList(data string) []string {
+	data = strings.TrimSpace(data)
+	var keys []string
+
+	if strings.HasPrefix(data, "[") {
+		if json.Unmarshal([]byte(data), &keys) == nil {
+			return keys
+		}
+	}
+	if strings.HasPrefix(data, "{") {
+		var object map[string]any
+		if json.Unmarshal([]byte(data), &object) == nil {
+			names := make([]string, 0, len(object))
+			for name := range object {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if value, ok := object[name].(string); ok && value != "" {
+					keys = append(keys, value)
+				}
+			}
+			return keys
+		}
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, key := range strings.Split(line, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+type envKeyProvider struct {
+	variable string
+}
+
+func (p *envKeyProvider) Name() string { return "env:" + p.variable }
+
+func (p *envKeyProvider) FetchKeys(ctx context.Context) ([]string, error) {
+	value, ok := os.LookupEnv(p.variable)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", p.variable)
+	}
+	return parseKeyList(value), nil
+}
+
+type fileKeyProvider struct {
+	path string
+}
+
+func (p *fileKeyProvider) Name() string { return "file:" + p.path }
+
+func (p *fileKeyProvider) FetchKeys(ctx context.Context) ([]string, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %v", err)
+	}
+	return parseKeyList(string(data)), nil
+}
+
+// awsSecretsManagerProvider reads a secret with GetSecretValue, using credentials
+// from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and the optional AWS_SESSION_TOKEN.
+type awsSecretsManagerProvider struct {
+	secretID string
+	region   string
+	client   *http.Client
+}
+
+func (p *awsSecretsManagerProvider) Name() string { return "aws_secrets_manager:" + p.secretID }
+
+func (p *awsSecretsManagerProvider) FetchKeys(ctx context.Context) ([]string, error) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+
+	body, _ := json.Marshal(map[string]string{"SecretId": p.secretID})
+	endpoint := fmt.Sprintf("https://secretsmanager.%s.amazonaws.com/", p.region)
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSRequest(req, body, "secretsmanager", p.region, accessKey, secretKey, os.Getenv("AWS_SESSION_TOKEN"), time.Now())
+
+	respBody, err := doSecretRequest(p.client, req)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		SecretString string `json:"SecretString"`
+		SecretBinary string `json:"SecretBinary"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse GetSecretValue response: %v", err)
+	}
+	if result.SecretString == "" && result.SecretBinary != "" {
+		decoded, err := base64.StdEncoding.DecodeString(result.SecretBinary)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode SecretBinary: %v", err)
+		}
+		return parseKeyList(string(decoded)), nil
+	}
+	return parseKeyList(result.SecretString), nil
+}
+
+// signAWSRequest adds an AWS Signature Version 4 Authorization header.
+func signAWSRequest(req *http.Request, body []byte, service, region, accessKey, secretKey, sessionToken string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	payloadHash := sha256.Sum256(body)
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	hmacSHA256 := func(key []byte, data string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(data))
+		return mac.Sum(nil)
+	}
+	signingKey := hmacSHA256(hmacSHA256(hmacSHA256(hmacSHA256([]byte("AWS4"+secretKey), date), region), service), "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// gcpSecretManagerProvider reads a secret version via the Secret Manager REST API.
+// The access token comes from GOOGLE_OAUTH_ACCESS_TOKEN or the GCE/GKE metadata server.
+type gcpSecretManagerProvider struct {
+	name   string
+	client *http.Client
+}
+
+func (p *gcpSecretManagerProvider) Name() string { return "gcp_secret_manager:" + p.name }
+
+func (p *gcpSecretManagerProvider) FetchKeys(ctx context.Context) ([]string, error) {
+	token, err := p.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://secretmanager.googleapis.com/v1/"+p.name+":access", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	respBody, err := doSecretRequest(p.client, req)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse secret access response: %v", err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(result.Payload.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode secret payload: %v", err)
+	}
+	return parseKeyList(string(decoded)), nil
+}
+
+func (p *gcpSecretManagerProvider) accessToken(ctx context.Context) (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	respBody, err := doSecretRequest(p.client, req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get access token from metadata server: %v", err)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(respBody, &token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("invalid token response from metadata server")
+	}
+	return token.AccessToken, nil
+}
+
+func doSecretRequest(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("secret request returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func newKeyProviderEntries(configs []KeyProviderConfig) ([]*keyProviderEntry, error) {
+	var entries []*keyProviderEntry
+	for _, config := range configs {
+		provider, err := newKeyProvider(config)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &keyProviderEntry{provider: provider, secondary: config.Secondary})
+	}
+	return entries, nil
+}
+
+// fetchProviderKeys refreshes every provider and returns the combined keys per pool.
+// Providers that fail keep the keys they returned last time.
+func fetchProviderKeys(entries []*keyProviderEntry) (priorityKeys, secondaryKeys []string) {
+	for _, entry := range entries {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		keys, err := entry.provider.FetchKeys(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Key provider %s: failed to fetch keys, keeping %d previous keys: %v", entry.provider.Name(), len(entry.keys), err)
+		} else {
+			entry.keys = keys
+		}
+
+		if entry.secondary {
+			secondaryKeys = append(secondaryKeys, entry.keys...)
+		} else {
+			priorityKeys = append(priorityKeys, entry.keys...)
+		}
+	}
+	return priorityKeys, secondaryKeys
+}
+
+// ProviderKeys fetches the keys of key providers once, per pool.
+func ProviderKeys(configs []KeyProviderConfig) (priorityKeys, secondaryKeys []string, err error) {
+	entries, err := newKeyProviderEntries(configs)
+	if err != nil {
+		return nil, nil, err
+	}
+	priorityKeys, secondaryKeys = fetchProviderKeys(entries)
+	return priorityKeys, secondaryKeys, nil
+}
+
+// setProviderKeys replaces the provider-supplied part of the key pool. Keys from
+// config.json are kept; new keys get fresh usage entries, and usage for removed
+// keys is retained in case they come back.
+func (km *KeyManager) setProviderKeys(priorityKeys, secondaryKeys []string) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	km.providerPriorityKeys = priorityKeys
+	km.providerSecondaryKeys = secondaryKeys
+	km.rebuildKeyPool()
+}
+
+// rebuildKeyPool recomputes km.keys from config.json and provider keys.
+// Must be called with km.mutex held.
+func (km *KeyManager) rebuildKeyPool() {
+	priority := append(append([]string{}, km.config.PriorityKeys...), km.providerPriorityKeys...)
+	secondary := append(append([]string{}, km.config.SecondaryKeys...), km.providerSecondaryKeys...)
+
+	oldCount := len(km.keys)
+	km.keys = buildKeyInfos(priority, secondary)
+	active := make(map[string]bool)
+	for _, keyInfo := range km.keys {
+		for modelName, model := range km.config.Models {
+			usageKey := modelName + "_" + keyInfo.Key
+			active[usageKey] = true
+			if _, ok := km.usage[usageKey]; ok {
+				continue
+			}
+			// A key that comes back picks up its retired usage
+			if retired, ok := km.retiredUsage[usageKey]; ok {
+				retired.LanguageModel = model
+				km.usage[usageKey] = retired
+				delete(km.retiredUsage, usageKey)
+				continue
+			}
+			km.usage[usageKey] = newLanguageModelUsage(model)
+		}
+	}
+	km.retireUsage(active)
+	if len(km.keys) != oldCount {
+		log.Printf("Key pool updated: %d keys (previously %d).", len(km.keys), oldCount)
+	}
+	km.markStatusChanged()
+}
+
+func (km *KeyManager) keyProviderRefresher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			priorityKeys, secondaryKeys := fetchProviderKeys(km.keyProviders)
+			km.setProviderKeys(priorityKeys, secondaryKeys)
+		case <-km.stopChan:
+			return
+		}
+	}
+}
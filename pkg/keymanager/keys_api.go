@@ -0,0 +1,148 @@
+package keymanager
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// minKeyLength is far below a real Gemini key, it only catches typos and keeps
+// MaskKey from showing most of the key.
+const minKeyLength = 8
+
+// CheckKey returns why key can't be a Gemini API key, or nil.
+func CheckKey(key string) error {
+	if strings.IndexFunc(key, func(r rune) bool { return r <= ' ' || r == 0x7f }) >= 0 {
+		return fmt.Errorf("contains whitespace or control characters")
+	}
+	if len(key) < minKeyLength {
+		return fmt.Errorf("is shorter than %d characters", minKeyLength)
+	}
+	return nil
+}
+
+// AddKeys adds keys to the priority or secondary pool and persists config.json.
+// Surrounding whitespace is trimmed. Keys already in either pool or failing
+// CheckKey are skipped.
+func (km *KeyManager) AddKeys(keys []string, priority bool) (added, skipped []string, err error) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	existing := make(map[string]bool)
+	for _, key := range km.config.PriorityKeys {
+		existing[key] = true
+	}
+	for _, key := range km.config.SecondaryKeys {
+		existing[key] = true
+	}
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if CheckKey(key) != nil || existing[key] {
+			skipped = append(skipped, key)
+			continue
+		}
+		existing[key] = true
+		added = append(added, key)
+	}
+	if len(added) == 0 {
+		return added, skipped, nil
+	}
+
+	if priority {
+		km.config.PriorityKeys = append(km.config.PriorityKeys, added...)
+	} else {
+		km.config.SecondaryKeys = append(km.config.SecondaryKeys, added...)
+	}
+	km.rebuildKeyPool()
+	log.Printf("Added %d keys through the API.", len(added))
+	return added, skipped, km.saveConfig()
+}
+
+// RemoveKeys removes keys from both pools and persists config.json. Their usage
+// is retired, not deleted, so it comes back if a key is added again.
+func (km *KeyManager) RemoveKeys(keys []string) (removed, skipped []string, err error) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	remove := make(map[string]bool)
+	for _, key := range keys {
+		remove[key] = true
+	}
+	found := make(map[string]bool)
+	filter := func(pool []string) []string {
+		kept := make([]string, 0, len(pool))
+		for _, key := range pool {
+			if remove[key] {
+				found[key] = true
+				continue
+			}
+			kept = append(kept, key)
+		}
+		return kept
+	}
+	km.config.PriorityKeys = filter(km.config.PriorityKeys)
+	km.config.SecondaryKeys = filter(km.config.SecondaryKeys)
+	reported := make(map[string]bool)
+	for _, key := range keys {
+		if reported[key] {
+			continue
+		}
+		reported[key] = true
+		if found[key] {
+			removed = append(removed, key)
+		} else {
+			skipped = append(skipped, key)
+		}
+	}
+	if len(removed) == 0 {
+		return removed, skipped, nil
+	}
+
+	km.rebuildKeyPool()
+	log.Printf("Removed %d keys through the API.", len(removed))
+	return removed, skipped, km.saveConfig()
+}
+
+// keyPaused reports whether the key was paused through the API. Must be called
+// with km.mutex held.
+func (km *KeyManager) keyPaused(key string) bool {
+	for _, k := range km.config.PausedKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// SetKeyPaused takes a key out of rotation or puts it back, keeping its usage,
+// and persists config.json. known is false if the key isn't in the pool.
+func (km *KeyManager) SetKeyPaused(key string, paused bool) (known bool, err error) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	for _, k := range km.allKeys() {
+		if k == key {
+			known = true
+			break
+		}
+	}
+	if !known || km.keyPaused(key) == paused {
+		return known, nil
+	}
+
+	if paused {
+		km.config.PausedKeys = append(km.config.PausedKeys, key)
+		log.Printf("Key %s paused.", MaskKey(key))
+	} else {
+		kept := make([]string, 0, len(km.config.PausedKeys))
+		for _, k := range km.config.PausedKeys {
+			if k != key {
+				kept = append(kept, k)
+			}
+		}
+		km.config.PausedKeys = kept
+		log.Printf("Key %s resumed.", MaskKey(key))
+	}
+	km.markStatusChanged()
+	return true, km.saveConfig()
+}
@@ -0,0 +1,11 @@
+package keymanager
+
+// max_output_tokens on a model caps maxOutputTokens in its requests, and sets
+// it in those that leave it out, so one runaway request can't use up a large
+// part of a key's daily tokens.
+
+func (km *KeyManager) MaxOutputTokens(model string) int {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	return km.config.Models[model].MaxOutputTokens
+}
@@ -0,0 +1,58 @@
+package keymanager
+
+import "time"
+
+// GET /v1beta/models and GET /v1beta/models/:model (models.list and models.get,
+// used by e.g. genai.list_models()) go through v1betaPassthroughHandler. With
+// list_configured_models set, the list only has the models in the config.
+// UIs poll the list, so it is cached for model_list_cache_seconds and served
+// from the cache without using a key.
+
+const defaultModelListCacheSeconds = 300
+
+func (km *KeyManager) ListsConfiguredModelsOnly() bool {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	return km.config.ListConfiguredModels
+}
+
+func (km *KeyManager) modelListCacheTTL() time.Duration {
+	km.mutex.RLock()
+	seconds := km.config.ModelListCacheSeconds
+	km.mutex.RUnlock()
+	if seconds == 0 {
+		seconds = defaultModelListCacheSeconds
+	}
+	if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// CachedModelList returns the cached upstream models.list response for the
+// query (page size and token), if there is a fresh one.
+func (km *KeyManager) CachedModelList(query string) ([]byte, bool) {
+	ttl := km.modelListCacheTTL()
+	if ttl <= 0 {
+		return nil, false
+	}
+	km.modelLists.mutex.Lock()
+	defer km.modelLists.mutex.Unlock()
+	entry, ok := km.modelLists.entries[query]
+	if !ok || km.now().Sub(entry.Created) > ttl {
+		return nil, false
+	}
+	return entry.Body, true
+}
+
+func (km *KeyManager) StoreModelList(query string, body []byte) {
+	if km.modelListCacheTTL() <= 0 {
+		return
+	}
+	km.modelLists.mutex.Lock()
+	defer km.modelLists.mutex.Unlock()
+	if km.modelLists.entries == nil {
+		km.modelLists.entries = make(map[string]cachedResponse)
+	}
+	km.modelLists.entries[query] = cachedResponse{Body: body, Created: km.now()}
+}
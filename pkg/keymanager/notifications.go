@@ -0,0 +1,130 @@
+package keymanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Notifications send short chat messages about events an operator should know
+// about. Every configured backend gets every enabled event.
+
+type NotificationsConfig struct {
+	Telegram *TelegramConfig `json:"telegram,omitempty"`
+	Discord  *DiscordConfig  `json:"discord,omitempty"`
+	// Events to send: "key_exhausted", "daily_reset" and "invalid_key". Default all.
+	Events []string `json:"events,omitempty"`
+}
+
+type TelegramConfig struct {
+	BotToken string `json:"bot_token"`
+	ChatID   string `json:"chat_id"`
+}
+
+type DiscordConfig struct {
+	WebhookURL string `json:"webhook_url"`
+}
+
+const (
+	eventKeyExhausted = "key_exhausted"
+	eventDailyReset   = "daily_reset"
+	eventInvalidKey   = "invalid_key"
+)
+
+// notifier is one chat backend.
+type notifier interface {
+	name() string
+	send(message string) error
+}
+
+type telegramNotifier struct {
+	config TelegramConfig
+}
+
+func (n telegramNotifier) name() string { return "Telegram" }
+
+func (n telegramNotifier) send(message string) error {
+	body, _ := json.Marshal(map[string]string{"chat_id": n.config.ChatID, "text": message})
+	return postNotification(fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", n.config.BotToken), body)
+}
+
+type discordNotifier struct {
+	config DiscordConfig
+}
+
+func (n discordNotifier) name() string { return "Discord" }
+
+func (n discordNotifier) send(message string) error {
+	body, _ := json.Marshal(map[string]string{"content": message})
+	return postNotification(n.config.WebhookURL, body)
+}
+
+func postNotification(url string, body []byte) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// notifiers returns the backends configured for an event. Must be called with
+// km.mutex held.
+func (km *KeyManager) notifiers(event string) []notifier {
+	config := km.config.Notifications
+	if config == nil {
+		return nil
+	}
+	if len(config.Events) > 0 {
+		enabled := false
+		for _, e := range config.Events {
+			enabled = enabled || e == event
+		}
+		if !enabled {
+			return nil
+		}
+	}
+	var result []notifier
+	if config.Telegram != nil && config.Telegram.BotToken != "" {
+		result = append(result, telegramNotifier{*config.Telegram})
+	}
+	if config.Discord != nil && config.Discord.WebhookURL != "" {
+		result = append(result, discordNotifier{*config.Discord})
+	}
+	return result
+}
+
+// notifyEvent sends the notifications for a key lifecycle event.
+func (km *KeyManager) notifyEvent(event Event) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+	switch event.Type {
+	case KeyExhausted:
+		km.notify(eventKeyExhausted, fmt.Sprintf("Key %s has used up its daily quota for model %s.", MaskKey(event.Key), event.Model))
+	case AllKeysDown:
+		km.notify(eventKeyExhausted, fmt.Sprintf("No available keys for model %s.", event.Model))
+	case QuotaReset:
+		km.notify(eventDailyReset, fmt.Sprintf("Daily quotas have been reset. Next reset at %s.", event.Until.Format("2006-01-02 15:04 MST")))
+	case KeyInvalid:
+		km.notify(eventInvalidKey, fmt.Sprintf("Key %s was rejected with 403 Forbidden and has been disabled.", MaskKey(event.Key)))
+	}
+}
+
+// notify sends a message for an event in the background. Must be called with
+// km.mutex held.
+func (km *KeyManager) notify(event, message string) {
+	for _, n := range km.notifiers(event) {
+		go func(n notifier) {
+			if err := n.send("GeminiLooper: " + message); err != nil {
+				log.Printf("ERROR: failed to send %s notification: %v", n.name(), err)
+			}
+		}(n)
+	}
+}
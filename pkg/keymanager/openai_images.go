@@ -0,0 +1,13 @@
+package keymanager
+
+// ImageModel picks the Imagen model for an OpenAI request: the requested one
+// if it is configured, else default_image_model (OpenAI names like dall-e-3
+// end up there).
+func (km *KeyManager) ImageModel(requested string) string {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	if _, ok := km.config.Models[requested]; ok {
+		return requested
+	}
+	return km.config.DefaultImageModel
+}
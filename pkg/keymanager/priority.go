@@ -0,0 +1,62 @@
+package keymanager
+
+import (
+	"context"
+)
+
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityLow
+)
+
+// PriorityConfig tunes how low-priority requests are held back.
+type PriorityConfig struct {
+	LowTPMShare int `json:"low_tpm_share,omitempty"` // Percent of a key's TPM limit low-priority requests may use, default 50
+	LowMaxWait  int `json:"low_max_wait,omitempty"`  // Seconds a low-priority request waits for headroom, default 60
+}
+
+func (config *PriorityConfig) withDefaults() PriorityConfig {
+	var c PriorityConfig
+	if config != nil {
+		c = *config
+	}
+	if c.LowTPMShare <= 0 || c.LowTPMShare > 100 {
+		c.LowTPMShare = 50
+	}
+	if c.LowMaxWait <= 0 {
+		c.LowMaxWait = 60
+	}
+	return c
+}
+
+type priorityContextKey struct{}
+
+// WithPriority returns a context that has WaitForKey treat the request as
+// priority.
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityContextKey{}, priority)
+}
+
+func priorityFromContext(ctx context.Context) Priority {
+	priority, _ := ctx.Value(priorityContextKey{}).(Priority)
+	return priority
+}
+
+// keysWithHeadroom returns the keys that used less than share percent of their
+// TPM limit in the last minute, counting the request. Must be called with km.mutex held.
+func (km *KeyManager) keysWithHeadroom(modelName string, keys []KeyInfo, estimatedTokens, share int) []KeyInfo {
+	if km.config.Models[modelName].TpmLimit <= 0 {
+		return keys
+	}
+	var result []KeyInfo
+	for _, keyInfo := range keys {
+		usage := km.usage[modelName+"_"+keyInfo.Key]
+		past60sTokens := usage.Past24HoursTokenUsage.LastMinuteTokens(km.now().Unix())
+		if past60sTokens+estimatedTokens < km.tpmLimit(modelName, usage)*share/100 {
+			result = append(result, keyInfo)
+		}
+	}
+	return result
+}
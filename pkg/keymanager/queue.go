@@ -0,0 +1,108 @@
+package keymanager
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// QueueConfig lets requests wait for a key instead of failing with 429 right
+// away when every key of a model is unavailable, which smooths out bursts.
+type QueueConfig struct {
+	MaxQueueWait int `json:"max_queue_wait"`       // Seconds a request waits for a key before failing
+	MaxQueued    int `json:"max_queued,omitempty"` // Requests waiting at once, further ones fail right away; default 100
+}
+
+// How often a waiting request checks for a key again
+const queuePollInterval = 500 * time.Millisecond
+
+// WaitForKey is GetKeyFor, except that with a queue configured a request that
+// finds no available key waits up to max_queue_wait for one to free up, e.g.
+// when a cooldown ends, a key is resumed or its daily window rolls on.
+// Low-priority requests (see priority.go) always wait, up to
+// priority.low_max_wait if that is longer. A routing rule matching the request
+// in ctx (see routing.go) can replace the model and restrict the keys.
+func (km *KeyManager) WaitForKey(ctx context.Context, modelName string, estimatedTokens int) (string, string, time.Duration, error) {
+	observe := km.keySelectionObserver
+	if observe == nil {
+		return km.waitForKey(ctx, modelName, estimatedTokens)
+	}
+	start := time.Now()
+	key, returnedModelName, delay, err := km.waitForKey(ctx, modelName, estimatedTokens)
+	observe(time.Since(start), delay)
+	return key, returnedModelName, delay, err
+}
+
+// ObserveKeySelection has f called with the time each WaitForKey call took and
+// the delay it returned. It must be set before keys are requested.
+func (km *KeyManager) ObserveKeySelection(f func(took, delay time.Duration)) {
+	km.keySelectionObserver = f
+}
+
+func (km *KeyManager) waitForKey(ctx context.Context, modelName string, estimatedTokens int) (string, string, time.Duration, error) {
+	priority := priorityFromContext(ctx)
+	group := ""
+	if rule := km.route(ctx, modelName); rule != nil {
+		if rule.Model != "" {
+			modelName = rule.Model
+		}
+		group = rule.KeyGroup
+	}
+	var key, returnedModelName string
+	var delay time.Duration
+	err := fmt.Errorf("interactive requests are waiting for a key for model %s", modelName)
+	if priority == PriorityNormal || km.queuedUrgent.Load() == 0 {
+		key, returnedModelName, delay, err = km.getKeyFor(modelName, estimatedTokens, priority, group)
+		if err == nil {
+			return key, returnedModelName, delay, nil
+		}
+	}
+
+	km.mutex.Lock()
+	config := km.config.Queue
+	priorityConfig := km.config.Priority.withDefaults()
+	km.mutex.Unlock()
+	maxWait, maxQueued := 0, 100
+	if config != nil {
+		maxWait = config.MaxQueueWait
+		if config.MaxQueued > 0 {
+			maxQueued = config.MaxQueued
+		}
+	}
+	if priority == PriorityLow && priorityConfig.LowMaxWait > maxWait {
+		maxWait = priorityConfig.LowMaxWait
+	}
+	if maxWait <= 0 {
+		return key, returnedModelName, delay, err
+	}
+	if km.queued.Add(1) > int64(maxQueued) {
+		km.queued.Add(-1)
+		return "", returnedModelName, 0, fmt.Errorf("%w, and the wait queue is full", err)
+	}
+	defer km.queued.Add(-1)
+	if priority == PriorityNormal {
+		km.queuedUrgent.Add(1)
+		defer km.queuedUrgent.Add(-1)
+	}
+
+	timeout := time.NewTimer(time.Duration(maxWait) * time.Second)
+	defer timeout.Stop()
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return "", returnedModelName, 0, ctx.Err()
+		case <-timeout.C:
+			return "", returnedModelName, 0, fmt.Errorf("%w after waiting %ds", err, maxWait)
+		case <-ticker.C:
+			if priority == PriorityLow && km.queuedUrgent.Load() > 0 {
+				continue // Interactive requests get the next free key
+			}
+			key, returnedModelName, delay, err = km.getKeyFor(modelName, estimatedTokens, priority, group)
+			if err == nil {
+				return key, returnedModelName, delay, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package keymanager
+
+import (
+	"fmt"
+	"time"
+)
+
+// Gemini answers 429 RESOURCE_EXHAUSTED both for per-minute rate limits and for
+// exhausted daily quotas. The error details tell them apart:
+//
+//	{"error": {"code": 429, "status": "RESOURCE_EXHAUSTED", "details": [
+//	  {"@type": "type.googleapis.com/google.rpc.QuotaFailure",
+//	   "violations": [{"quotaId": "GenerateRequestsPerDayPerProjectPerModel-FreeTier", ...}]},
+//	  {"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "33s"}]}}
+
+type RateLimitScope string
+
+const (
+	RateLimitUnknown   RateLimitScope = ""
+	RateLimitPerMinute RateLimitScope = "minute"
+	RateLimitPerDay    RateLimitScope = "day"
+)
+
+// RateLimitInfo is what a 429 response says about the limit that was hit.
+type RateLimitInfo struct {
+	Scope      RateLimitScope
+	QuotaID    string        // e.g. GenerateContentInputTokensPerModelPerMinute-FreeTier
+	RetryAfter time.Duration // From RetryInfo or the Retry-After header, 0 if not given
+}
+
+func (i RateLimitInfo) String() string {
+	s := "unclassified"
+	if i.Scope != RateLimitUnknown {
+		s = "per " + string(i.Scope)
+	}
+	if i.QuotaID != "" {
+		s += " (" + i.QuotaID + ")"
+	}
+	if i.RetryAfter > 0 {
+		s += ", retry after " + i.RetryAfter.String()
+	}
+	return s
+}
+
+// NoKeyError is returned by GetKey when no key is available for a model, with
+// an estimate of when one will be.
+type NoKeyError struct {
+	ModelName  string
+	RetryAfter time.Duration // 0 if unknown, e.g. when every key is paused or banned
+}
+
+func (e *NoKeyError) Error() string {
+	return fmt.Sprintf("no available keys for model %s", e.ModelName)
+}
+
+// keyAvailableIn estimates how long until a key of the model can be used again:
+// the end of a cooldown, the rolling daily window dropping below tpd_limit, or
+// the next quota reset for exhausted keys. Must be called with km.mutex held.
+func (km *KeyManager) keyAvailableIn(modelName string) time.Duration {
+	model := km.config.Models[modelName]
+	now := km.now()
+	var earliest time.Time
+	consider := func(t time.Time) {
+		if t.After(now) && (earliest.IsZero() || t.Before(earliest)) {
+			earliest = t
+		}
+	}
+	for _, keyInfo := range km.keys {
+		if km.permanentlyBannedKeys[keyInfo.Key] || !km.ownsKey(keyInfo.Key) || km.keyPaused(keyInfo.Key) || !km.keyServesModel(keyInfo.Key, modelName) {
+			continue
+		}
+		usage, ok := km.usage[modelName+"_"+keyInfo.Key]
+		if !ok {
+			continue
+		}
+		if usage.Exceeded {
+			consider(km.nextReset)
+			continue
+		}
+		if usage.ProbablyExceeded && usage.CooldownUntil > 0 {
+			consider(time.Unix(usage.CooldownUntil, 0))
+		}
+		if model.TpdLimit != nil && *model.TpdLimit > 0 {
+			window := &usage.Past24HoursTokenUsage
+			dailyTokens := window.LastDayTokens(now.Unix())
+			for m := now.Unix()/60 - usageWindowMinutes + 1; m <= now.Unix()/60 && dailyTokens >= *model.TpdLimit; m++ {
+				dailyTokens -= window.minute(m)
+				if dailyTokens < *model.TpdLimit {
+					consider(time.Unix((m+usageWindowMinutes)*60, 0)) // When minute m leaves the window
+				}
+			}
+		}
+	}
+	if earliest.IsZero() {
+		return 0
+	}
+	return earliest.Sub(now)
+}
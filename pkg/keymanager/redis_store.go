@@ -0,0 +1,436 @@
+package keymanager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Shared state for several instances behind a load balancer. Every instance
+// appends its usage events, flag changes and bans to one Redis stream and
+// replays the entries of the other instances into its own in-memory state, so
+// key selection sees the combined TPM/TPD usage. Daily and lifetime counters
+// are kept with atomic HINCRBY so a restarting instance starts from the shared
+// totals. Instances converge within one sync interval.
+//
+// Within that interval two instances could still hand out the same TPM
+// budget, so a request with a token estimate also reserves its tokens on the
+// picked key: a Lua script checks the key's reservations for the current
+// minute against its TPM limit and adds the request in one step. Requests
+// without an estimate aren't reserved and only converge with the sync.
+//
+// Keys used (prefix defaults to "geminilooper"):
+//
+//	{prefix}:events   stream of usage/flag/ban entries, trimmed to 24h
+//	{prefix}:today    hash modelName_key -> tokens since the last quota reset
+//	{prefix}:total    hash modelName_key -> lifetime tokens
+//	{prefix}:flags    hash modelName_key -> "exceeded,probably_exceeded" as 0/1
+//	{prefix}:banned   set of permanently banned keys
+//	{prefix}:reset:N  marker so only one instance clears the counters per reset
+//	{prefix}:tpm:U:M  tokens reserved on modelName_key U in Unix minute M
+
+type redisUsageStore struct {
+	client   *redis.Client
+	prefix   string
+	instance string // Identifies this instance's own stream entries
+	lastID   string // Last stream entry applied
+	storeClock
+}
+
+// usageFlags is the part of a usage entry's state that is shared.
+type usageFlags struct {
+	Exceeded         bool
+	ProbablyExceeded bool
+}
+
+func (f usageFlags) encode() string {
+	return fmt.Sprintf("%d,%d", boolToInt(f.Exceeded), boolToInt(f.ProbablyExceeded))
+}
+
+func decodeUsageFlags(s string) usageFlags {
+	exceeded, probably, _ := strings.Cut(s, ",")
+	return usageFlags{Exceeded: exceeded == "1", ProbablyExceeded: probably == "1"}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func openRedisUsageStore(config *UsageStoreConfig) (*redisUsageStore, error) {
+	address := config.Address
+	if address == "" {
+		address = "localhost:6379"
+	}
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = "geminilooper"
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     address,
+		Password: config.Password,
+		DB:       config.DB,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis at %s: %v", address, err)
+	}
+
+	id := make([]byte, 6)
+	rand.Read(id)
+	log.Printf("Usage state is shared through Redis at %s (prefix %s).", address, prefix)
+	return &redisUsageStore{client: client, prefix: prefix, instance: hex.EncodeToString(id), lastID: "0-0"}, nil
+}
+
+func (s *redisUsageStore) key(name string) string {
+	return s.prefix + ":" + name
+}
+
+// load reads the shared counters, flags and bans, and the last 24 hours of
+// usage events of all instances. found is false if Redis has no state yet.
+func (s *redisUsageStore) load(ctx context.Context) (saved UsageSnapshot, flags map[string]usageFlags, found bool, err error) {
+	saved = UsageSnapshot{
+		Usage:                 make(map[string]*LanguageModelUsage),
+		PermanentlyBannedKeys: make(map[string]bool),
+	}
+	flags = make(map[string]usageFlags)
+
+	today, err := s.client.HGetAll(ctx, s.key("today")).Result()
+	if err != nil {
+		return saved, nil, false, err
+	}
+	total, err := s.client.HGetAll(ctx, s.key("total")).Result()
+	if err != nil {
+		return saved, nil, false, err
+	}
+	flagValues, err := s.client.HGetAll(ctx, s.key("flags")).Result()
+	if err != nil {
+		return saved, nil, false, err
+	}
+	banned, err := s.client.SMembers(ctx, s.key("banned")).Result()
+	if err != nil {
+		return saved, nil, false, err
+	}
+
+	entry := func(usageKey string) *LanguageModelUsage {
+		if saved.Usage[usageKey] == nil {
+			saved.Usage[usageKey] = &LanguageModelUsage{}
+		}
+		return saved.Usage[usageKey]
+	}
+	for usageKey, value := range total {
+		entry(usageKey).TotalTokenUse, _ = strconv.Atoi(value)
+	}
+	for usageKey, value := range today {
+		entry(usageKey).TodayUsage, _ = strconv.Atoi(value)
+	}
+	for usageKey, value := range flagValues {
+		f := decodeUsageFlags(value)
+		entry(usageKey).Exceeded = f.Exceeded
+		entry(usageKey).ProbablyExceeded = f.ProbablyExceeded
+		flags[usageKey] = f
+	}
+	for _, key := range banned {
+		saved.PermanentlyBannedKeys[key] = true
+	}
+
+	minID := strconv.FormatInt(s.now().Add(-24*time.Hour).UnixMilli(), 10)
+	entries, err := s.client.XRange(ctx, s.key("events"), minID, "+").Result()
+	if err != nil {
+		return saved, nil, false, err
+	}
+	for _, e := range entries {
+		s.lastID = e.ID
+		if usageKey, tokens, ts, ok := parseUsageEntry(e.Values); ok {
+			usage := entry(usageKey)
+			usage.Past24HoursTokenUsage.add(ts, tokens)
+		}
+	}
+	if len(entries) == 0 {
+		// Start after the newest entry, older ones are already in the counters
+		if last, err := s.client.XRevRangeN(ctx, s.key("events"), "+", "-", 1).Result(); err == nil && len(last) > 0 {
+			s.lastID = last[0].ID
+		}
+	}
+
+	found = len(total) > 0 || len(banned) > 0
+	return saved, flags, found, nil
+}
+
+func parseUsageEntry(values map[string]any) (usageKey string, tokens int, ts int64, ok bool) {
+	usageKey, _ = values["u"].(string)
+	tokenValue, _ := values["t"].(string)
+	tsValue, _ := values["ts"].(string)
+	if usageKey == "" || tokenValue == "" {
+		return "", 0, 0, false
+	}
+	tokens, _ = strconv.Atoi(tokenValue)
+	ts, _ = strconv.ParseInt(tsValue, 10, 64)
+	return usageKey, tokens, ts, true
+}
+
+// reserveScript adds a request's tokens to a key's reservations unless they
+// would go over the TPM limit. The first reservation of a minute always
+// succeeds, like a key with no usage takes any request.
+var reserveScript = redis.NewScript(`
+local reserved = tonumber(redis.call("GET", KEYS[1]) or "0")
+local tokens = tonumber(ARGV[1])
+if reserved > 0 and reserved + tokens > tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("INCRBY", KEYS[1], tokens)
+redis.call("EXPIRE", KEYS[1], 120)
+return 1
+`)
+
+// reserve claims tokens of a key's TPM limit for the current minute. It
+// returns false if the instances already reserved too much of it.
+func (s *redisUsageStore) reserve(ctx context.Context, usageKey string, tokens, limit int) (bool, error) {
+	minute := s.now().Unix() / 60
+	reserved, err := reserveScript.Run(ctx, s.client, []string{s.key(fmt.Sprintf("tpm:%s:%d", usageKey, minute))}, tokens, limit).Int()
+	return reserved == 1, err
+}
+
+// sharedUpdate is what one instance publishes in a sync.
+type sharedUpdate struct {
+	events []UsageEvent
+	flags  map[string]usageFlags // usageKey -> new flags
+	banned []string
+}
+
+// publish writes this instance's changes in one MULTI/EXEC transaction.
+func (s *redisUsageStore) publish(ctx context.Context, update sharedUpdate) error {
+	if len(update.events) == 0 && len(update.flags) == 0 && len(update.banned) == 0 {
+		return nil
+	}
+	minID := strconv.FormatInt(s.now().Add(-24*time.Hour).UnixMilli(), 10)
+	add := func(pipe redis.Pipeliner, values map[string]any) {
+		values["i"] = s.instance
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: s.key("events"), MinID: minID, Approx: true, Values: values})
+	}
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, event := range update.events {
+			usageKey := event.Model + "_" + event.Key
+			pipe.HIncrBy(ctx, s.key("today"), usageKey, int64(event.Tokens))
+			pipe.HIncrBy(ctx, s.key("total"), usageKey, int64(event.Tokens))
+			add(pipe, map[string]any{"u": usageKey, "t": event.Tokens, "ts": event.Timestamp})
+		}
+		for usageKey, f := range update.flags {
+			pipe.HSet(ctx, s.key("flags"), usageKey, f.encode())
+			add(pipe, map[string]any{"f": usageKey, "v": f.encode()})
+		}
+		for _, key := range update.banned {
+			pipe.SAdd(ctx, s.key("banned"), key)
+			add(pipe, map[string]any{"b": key})
+		}
+		return nil
+	})
+	return err
+}
+
+// poll returns the stream entries other instances added since the last poll.
+func (s *redisUsageStore) poll(ctx context.Context) ([]redis.XMessage, error) {
+	var result []redis.XMessage
+	for {
+		streams, err := s.client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{s.key("events"), s.lastID},
+			Count:   1000,
+			Block:   -1, // Don't block
+		}).Result()
+		if err == redis.Nil {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+		if len(streams) == 0 || len(streams[0].Messages) == 0 {
+			return result, nil
+		}
+		messages := streams[0].Messages
+		s.lastID = messages[len(messages)-1].ID
+		for _, m := range messages {
+			if m.Values["i"] != s.instance {
+				result = append(result, m)
+			}
+		}
+		if len(messages) < 1000 {
+			return result, nil
+		}
+	}
+}
+
+// seed writes an instance's counters into an empty Redis. HSETNX keeps
+// whatever another instance starting at the same time wrote first.
+func (s *redisUsageStore) seed(ctx context.Context, usage map[string]*LanguageModelUsage) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for usageKey, u := range usage {
+			if u.TotalTokenUse == 0 && u.TodayUsage == 0 {
+				continue
+			}
+			pipe.HSetNX(ctx, s.key("today"), usageKey, u.TodayUsage)
+			pipe.HSetNX(ctx, s.key("total"), usageKey, u.TotalTokenUse)
+		}
+		return nil
+	})
+	return err
+}
+
+// resetDaily clears the shared daily counters and flags. Every instance calls
+// it at the quota reset, only the first one for a given reset does the work.
+func (s *redisUsageStore) resetDaily(ctx context.Context, reset time.Time) error {
+	won, err := s.client.SetNX(ctx, s.key(fmt.Sprintf("reset:%d", reset.Unix())), s.instance, 48*time.Hour).Result()
+	if err != nil || !won {
+		return err
+	}
+	return s.client.Del(ctx, s.key("today"), s.key("flags")).Err()
+}
+
+// clearToday removes the shared daily counters of entries reset by hand, so a
+// restarting instance doesn't load them again.
+func (s *redisUsageStore) clearToday(ctx context.Context, usageKeys []string) error {
+	if len(usageKeys) == 0 {
+		return nil
+	}
+	return s.client.HDel(ctx, s.key("today"), usageKeys...).Err()
+}
+
+func (s *redisUsageStore) Close() error {
+	return s.client.Close()
+}
+
+// reserveSharedTPM reserves a request's estimated tokens on the key in Redis.
+// A Redis error doesn't hold up the request. Must be called with km.mutex
+// held.
+func (km *KeyManager) reserveSharedTPM(modelName, key string, estimatedTokens int) bool {
+	if km.sharedState == nil || estimatedTokens <= 0 {
+		return true
+	}
+	usageKey := modelName + "_" + key
+	limit := km.tpmLimit(modelName, km.usage[usageKey])
+	if limit <= 0 {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reserved, err := km.sharedState.reserve(ctx, usageKey, estimatedTokens, limit)
+	if err != nil {
+		log.Printf("ERROR: failed to reserve tokens in Redis: %v", err)
+		return true
+	}
+	return reserved
+}
+
+// sharedStateSync publishes local changes and applies the other instances'
+// changes every interval.
+func (km *KeyManager) sharedStateSync(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			km.syncSharedState()
+		case <-km.stopChan:
+			return
+		}
+	}
+}
+
+func (km *KeyManager) syncSharedState() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	km.mutex.Lock()
+	km.eventsMutex.Lock()
+	update := sharedUpdate{events: km.sharedEvents, flags: make(map[string]usageFlags)}
+	km.sharedEvents = nil
+	km.eventsMutex.Unlock()
+	// Flags are published by diffing against what was last shared, so the
+	// places that change them don't need to know about Redis.
+	for usageKey, usage := range km.usage {
+		f := usageFlags{Exceeded: usage.Exceeded, ProbablyExceeded: usage.ProbablyExceeded}
+		if km.sharedFlags[usageKey] != f {
+			update.flags[usageKey] = f
+			km.sharedFlags[usageKey] = f
+		}
+	}
+	for key := range km.permanentlyBannedKeys {
+		if !km.sharedBans[key] {
+			update.banned = append(update.banned, key)
+			km.sharedBans[key] = true
+		}
+	}
+	km.mutex.Unlock()
+
+	if err := km.sharedState.publish(ctx, update); err != nil {
+		log.Printf("ERROR: failed to publish usage to Redis: %v", err)
+		km.mutex.Lock()
+		km.eventsMutex.Lock()
+		km.sharedEvents = append(update.events, km.sharedEvents...)
+		km.eventsMutex.Unlock()
+		for usageKey := range update.flags {
+			delete(km.sharedFlags, usageKey) // Retried on the next sync
+		}
+		for _, key := range update.banned {
+			delete(km.sharedBans, key)
+		}
+		km.mutex.Unlock()
+		return
+	}
+
+	messages, err := km.sharedState.poll(ctx)
+	if err != nil {
+		log.Printf("ERROR: failed to read shared usage from Redis: %v", err)
+	}
+	if len(messages) == 0 {
+		return
+	}
+
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+	for _, m := range messages {
+		if usageKey, tokens, ts, ok := parseUsageEntry(m.Values); ok {
+			if usage, exists := km.usage[usageKey]; exists {
+				usage.TotalTokenUse += tokens
+				usage.TodayUsage += tokens
+				usage.Past24HoursTokenUsage.add(ts, tokens)
+				km.touchUsage(usage)
+			}
+			continue
+		}
+		if usageKey, ok := m.Values["f"].(string); ok {
+			value, _ := m.Values["v"].(string)
+			f := decodeUsageFlags(value)
+			km.sharedFlags[usageKey] = f
+			if usage, exists := km.usage[usageKey]; exists {
+				usage.Exceeded = f.Exceeded
+				usage.ProbablyExceeded = f.ProbablyExceeded
+				if f.ProbablyExceeded && usage.CooldownUntil <= km.now().Unix() {
+					// The cooldown itself isn't shared, start with the first step
+					usage.CooldownUntil = km.now().Add(cooldownSteps[0]).Unix()
+				}
+				km.touchUsage(usage)
+			}
+			continue
+		}
+		if key, ok := m.Values["b"].(string); ok && !km.permanentlyBannedKeys[key] {
+			km.permanentlyBannedKeys[key] = true
+			km.sharedBans[key] = true
+			km.markStatusChanged()
+			log.Printf("Key %s was banned by another instance.", MaskKey(key))
+		}
+	}
+}
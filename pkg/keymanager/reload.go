@@ -0,0 +1,202 @@
+package keymanager
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// ReloadConfig re-reads the config.json km was loaded from and applies keys, models and limits without
+// a restart. The schedule of the next quota reset is runtime state and is kept.
+func (km *KeyManager) ReloadConfig() error {
+	km.reloading.Add(1)
+	defer km.reloading.Add(-1)
+	km.reloadMutex.Lock() // SIGHUP, the watcher and /api/reload may reload at once
+	defer km.reloadMutex.Unlock()
+
+	if km.configFile == "" {
+		return fmt.Errorf("not loaded from a config file")
+	}
+	newConfig, err := readConfigFile(km.configFile)
+	if err != nil {
+		return err
+	}
+	if err := validateReloadedConfig(newConfig); err != nil {
+		return err
+	}
+
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	newConfig.NextQuotaResetDatetime = km.config.NextQuotaResetDatetime
+	km.config = newConfig
+
+	// Existing usage entries pick up changed limits; new keys and models get fresh entries.
+	for _, usage := range km.usage {
+		if model, ok := newConfig.Models[usage.ModelName]; ok {
+			usage.LanguageModel = model
+		}
+	}
+	km.rebuildKeyPool()
+
+	if newConfig.FaultInjection != nil {
+		km.simulator.SetFaults(*newConfig.FaultInjection)
+	} else {
+		km.simulator.SetFaults(FaultInjectionConfig{})
+	}
+
+	log.Printf("Config reloaded: %d keys, %d models.", len(km.keys), len(newConfig.Models))
+	return nil
+}
+
+// retireUsage moves usage entries for removed keys or models out of the live
+// usage map. They are kept (and persisted) so their history isn't lost and is
+// restored if the key is added again. Must be called with km.mutex held.
+func (km *KeyManager) retireUsage(active map[string]bool) {
+	retired := 0
+	for usageKey, usage := range km.usage {
+		if active[usageKey] {
+			continue
+		}
+		km.retiredUsage[usageKey] = usage
+		delete(km.usage, usageKey)
+		retired++
+	}
+	if retired > 0 {
+		log.Printf("Archived usage of %d removed key/model pairs.", retired)
+	}
+}
+
+func validateReloadedConfig(config *Config) error {
+	if len(config.Models) == 0 {
+		return fmt.Errorf("no models configured")
+	}
+	if _, ok := config.Models[config.DefaultModel]; !ok {
+		return fmt.Errorf("default_model '%s' is not in models", config.DefaultModel)
+	}
+	for modelName, model := range config.Models {
+		for _, fallback := range model.FallbackModels {
+			if _, ok := config.Models[fallback]; !ok {
+				return fmt.Errorf("fallback model '%s' of '%s' is not in models", fallback, modelName)
+			}
+		}
+	}
+	for key, models := range config.KeyModels {
+		for _, modelName := range models {
+			if _, ok := config.Models[modelName]; !ok {
+				return fmt.Errorf("model '%s' in key_models of key %s is not in models", modelName, MaskKey(key))
+			}
+		}
+	}
+	if _, err := time.LoadLocation(config.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone: %v", err)
+	}
+	if err := ValidateUpstreamURLs(config); err != nil {
+		return err
+	}
+	if err := ValidateRouting(config); err != nil {
+		return err
+	}
+	if err := ValidateTestMode(config); err != nil {
+		return err
+	}
+	if config.KeyPolicy != "" {
+		if _, err := CompileKeyPolicy(config.KeyPolicy); err != nil {
+			return fmt.Errorf("invalid key_policy: %v", err)
+		}
+	}
+	return nil
+}
+
+// configWatcher polls the config file and reloads it when its content changes.
+// Content is hashed rather than relying on mtimes or inotify, because Kubernetes
+// updates mounted ConfigMaps by atomically swapping a ..data symlink, which
+// neither changes the watched file's inode nor produces a write event on it.
+//
+// A change is applied once the file stayed the same for a tick, and the
+// instance reports not ready from the moment the change is noticed, so
+// readiness probes see the reload.
+func (km *KeyManager) configWatcher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastHash, _ := hashFile(km.configFile)
+	var pendingHash, failedHash [32]byte
+	pending := false
+	log.Printf("Watching %s for changes every %v.", km.configFile, interval)
+
+	for {
+		select {
+		case <-ticker.C:
+			hash, err := hashFile(km.configFile)
+			if err != nil || hash == lastHash || hash == failedHash {
+				if pending { // Changed back, or unreadable
+					km.reloading.Add(-1)
+					pending = false
+				}
+				continue
+			}
+			if !pending || hash != pendingHash {
+				if !pending {
+					km.reloading.Add(1)
+					pending = true
+					log.Printf("Config file %s changed, reloading in %v...", km.configFile, interval)
+				}
+				pendingHash = hash
+				continue
+			}
+			err = km.ReloadConfig()
+			km.reloading.Add(-1)
+			pending = false
+			if err != nil {
+				// Only retried once the file changes again, e.g. when it is fixed
+				failedHash = hash
+				log.Printf("ERROR: config reload failed, keeping previous config: %v", err)
+				continue
+			}
+			lastHash = hash
+		case <-km.stopChan:
+			if pending {
+				km.reloading.Add(-1)
+			}
+			return
+		}
+	}
+}
+
+func hashFile(path string) ([32]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
+
+// reloadOnSIGHUP reloads the config whenever the process receives SIGHUP.
+func (km *KeyManager) reloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			log.Println("SIGHUP received, reloading config...")
+			if err := km.ReloadConfig(); err != nil {
+				log.Printf("ERROR: config reload failed, keeping previous config: %v", err)
+			}
+		case <-km.stopChan:
+			return
+		}
+	}
+}
+
+// Ready reports whether the KeyManager is serving, false from the moment a
+// config change is noticed until every pending reload has been applied.
+func (km *KeyManager) Ready() bool {
+	return km.reloading.Load() == 0
+}
@@ -0,0 +1,188 @@
+package keymanager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ResponseCacheConfig enables serving identical non-streaming generation requests
+// (generateContent, OpenAI chat completions) from a cache without calling
+// upstream, e.g. for evaluation scripts replaying the same prompts.
+type ResponseCacheConfig struct {
+	Enabled    bool   `json:"enabled"`
+	TTL        int    `json:"ttl,omitempty"`         // Seconds a response is served from the cache, default 3600
+	MaxEntries int    `json:"max_entries,omitempty"` // Kept in memory, default 1000
+	Dir        string `json:"dir,omitempty"`         // Also store responses as files here, relative to the data directory
+	Shared     bool   `json:"shared,omitempty"`      // Serve one client's cached responses to other clients too
+}
+
+type cachedResponse struct {
+	Body    []byte    `json:"body"`
+	Created time.Time `json:"created"`
+}
+
+type responseCache struct {
+	entries map[string]cachedResponse
+	mutex   sync.Mutex
+}
+
+func (km *KeyManager) ResponseCacheConfig() (ResponseCacheConfig, bool) {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	if km.config.ResponseCache == nil || !km.config.ResponseCache.Enabled {
+		return ResponseCacheConfig{}, false
+	}
+	config := *km.config.ResponseCache
+	if config.TTL <= 0 {
+		config.TTL = 3600
+	}
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = 1000
+	}
+	if config.Dir != "" {
+		config.Dir = DataFilePath(km.config, config.Dir)
+	}
+	return config, true
+}
+
+// responseCacheKey identifies a request by client, model, action and body. The
+// body is re-encoded so formatting and key order don't matter. client is empty
+// when the cache is shared.
+func responseCacheKey(client, model, action string, body []byte) string {
+	var parsed interface{}
+	if err := json.Unmarshal(body, &parsed); err == nil {
+		if normalized, err := json.Marshal(parsed); err == nil {
+			body = normalized
+		}
+	}
+	sum := sha256.Sum256([]byte(client + "\n" + model + ":" + action + "\n" + string(body)))
+	return hex.EncodeToString(sum[:])
+}
+
+// CachedResponseBody returns the cached response body for a request of the
+// client key, if the cache is enabled and has a fresh one. Callers only ask for
+// non-streaming generation requests.
+func (km *KeyManager) CachedResponseBody(client, model, action string, body []byte) ([]byte, bool) {
+	config, ok := km.ResponseCacheConfig()
+	if !ok {
+		return nil, false
+	}
+	if config.Shared {
+		client = ""
+	}
+	key := responseCacheKey(client, model, action, body)
+	ttl := time.Duration(config.TTL) * time.Second
+
+	cache := &km.responses
+	cache.mutex.Lock()
+	entry, found := cache.entries[key]
+	if found && km.now().Sub(entry.Created) > ttl {
+		delete(cache.entries, key)
+		found = false
+	}
+	cache.mutex.Unlock()
+	if !found && config.Dir != "" {
+		data, err := os.ReadFile(filepath.Join(config.Dir, key+".json"))
+		found = err == nil && json.Unmarshal(data, &entry) == nil && km.now().Sub(entry.Created) <= ttl
+	}
+	if !found {
+		return nil, false
+	}
+	return entry.Body, true
+}
+
+func (km *KeyManager) StoreResponseBody(client, model, action string, body, response []byte) {
+	config, ok := km.ResponseCacheConfig()
+	if !ok {
+		return
+	}
+	if config.Shared {
+		client = ""
+	}
+	key := responseCacheKey(client, model, action, body)
+	entry := cachedResponse{Body: response, Created: km.now()}
+
+	cache := &km.responses
+	cache.mutex.Lock()
+	if cache.entries == nil {
+		cache.entries = make(map[string]cachedResponse)
+	}
+	if len(cache.entries) >= config.MaxEntries {
+		// Make room by dropping the oldest entry
+		oldest := ""
+		for k, e := range cache.entries {
+			if oldest == "" || e.Created.Before(cache.entries[oldest].Created) {
+				oldest = k
+			}
+		}
+		delete(cache.entries, oldest)
+	}
+	cache.entries[key] = entry
+	cache.mutex.Unlock()
+
+	if config.Dir != "" {
+		data, _ := json.Marshal(entry)
+		if err := os.MkdirAll(config.Dir, 0755); err != nil {
+			log.Printf("Failed to create response cache directory: %v", err)
+		} else if err := os.WriteFile(filepath.Join(config.Dir, key+".json"), data, 0644); err != nil {
+			log.Printf("Failed to write response cache entry: %v", err)
+		}
+	}
+}
+
+func (km *KeyManager) responseCacheSweeper() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			km.sweepResponseCache()
+		case <-km.stopChan:
+			return
+		}
+	}
+}
+
+// sweepResponseCache drops expired responses from memory and from dir, which
+// would otherwise keep every response ever cached.
+func (km *KeyManager) sweepResponseCache() {
+	config, ok := km.ResponseCacheConfig()
+	if !ok {
+		return
+	}
+	expired := km.now().Add(-time.Duration(config.TTL) * time.Second)
+
+	cache := &km.responses
+	cache.mutex.Lock()
+	for key, entry := range cache.entries {
+		if entry.Created.Before(expired) {
+			delete(cache.entries, key)
+		}
+	}
+	cache.mutex.Unlock()
+
+	if config.Dir == "" {
+		return
+	}
+	files, err := os.ReadDir(config.Dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		if info, err := file.Info(); err == nil && info.ModTime().Before(expired) {
+			if err := os.Remove(filepath.Join(config.Dir, file.Name())); err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to remove expired response cache entry: %v", err)
+			}
+		}
+	}
+}
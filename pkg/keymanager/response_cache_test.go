@@ -0,0 +1,59 @@
+package keymanager
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func newResponseCacheTestKeyManager(t *testing.T, shared bool) (*KeyManager, *FakeClock, string) {
+	t.Helper()
+	dir := t.TempDir()
+	km, err := New(&Config{
+		PriorityKeys:           []string{"AIzaTestKey1"},
+		Models:                 map[string]LanguageModel{"m": {TpmLimit: 1000000}},
+		ResetAfter:             "01:00",
+		NextQuotaResetDatetime: "2099-01-02 01:00",
+		Timezone:               "UTC",
+		DefaultModel:           "m",
+		ResponseCache:          &ResponseCacheConfig{Enabled: true, TTL: 60, Dir: dir, Shared: shared},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(km.Stop)
+	clock := NewFakeClock(time.Now())
+	km.SetClock(clock)
+	return km, clock, dir
+}
+
+func TestResponseCachePerClient(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		km, _, _ := newResponseCacheTestKeyManager(t, shared)
+		km.StoreResponseBody("client-a", "m", "generateContent", []byte(`{"a":1}`), []byte("answer"))
+		if _, ok := km.CachedResponseBody("client-a", "m", "generateContent", []byte(`{ "a": 1 }`)); !ok {
+			t.Fatalf("shared=%v: no hit for the client that stored the response", shared)
+		}
+		if _, ok := km.CachedResponseBody("client-b", "m", "generateContent", []byte(`{"a":1}`)); ok != shared {
+			t.Fatalf("shared=%v: hit for another client is %v", shared, ok)
+		}
+	}
+}
+
+func TestResponseCacheSweep(t *testing.T) {
+	km, clock, dir := newResponseCacheTestKeyManager(t, false)
+	km.StoreResponseBody("client-a", "m", "generateContent", []byte(`{"a":1}`), []byte("answer"))
+
+	km.sweepResponseCache()
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("%d files after sweeping a fresh entry, want 1", len(files))
+	}
+	clock.Advance(61 * time.Second)
+	km.sweepResponseCache()
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("%d files after sweeping an expired entry, want 0", len(files))
+	}
+	if len(km.responses.entries) != 0 {
+		t.Fatalf("%d entries in memory after the sweep, want 0", len(km.responses.entries))
+	}
+}
@@ -0,0 +1,181 @@
+package keymanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// retrievalKeyUsable reports whether a key can still be used for retrieval calls.
+// Must be called with km.mutex held. Cluster ownership is not applied: a corpus
+// can only ever be reached through the key that created it.
+func (km *KeyManager) retrievalKeyUsable(key string) bool {
+	if km.permanentlyBannedKeys[key] {
+		return false
+	}
+	for _, k := range km.allKeys() {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (km *KeyManager) retrievalKeys() []string {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	var keys []string
+	for _, key := range km.allKeys() {
+		if !km.permanentlyBannedKeys[key] {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (km *KeyManager) SetCorpusKey(corpus, key string) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+	if km.corpusKeys[corpus] != key {
+		km.corpusKeys[corpus] = key
+		km.markStatusChanged()
+	}
+}
+
+func (km *KeyManager) DeleteCorpusKey(corpus string) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+	if _, ok := km.corpusKeys[corpus]; ok {
+		delete(km.corpusKeys, corpus)
+		km.markStatusChanged()
+	}
+}
+
+// KeyForNewCorpus picks the usable key owning the fewest corpora, since each
+// project only allows a handful of corpora.
+func (km *KeyManager) KeyForNewCorpus() (string, error) {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+
+	counts := make(map[string]int)
+	for _, key := range km.corpusKeys {
+		counts[key]++
+	}
+	best := ""
+	for _, key := range km.allKeys() {
+		if km.permanentlyBannedKeys[key] || km.keyPaused(key) {
+			continue
+		}
+		if best == "" || counts[key] < counts[best] {
+			best = key
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no usable API keys")
+	}
+	return best, nil
+}
+
+// CorpusKeys lists the known corpora by name with the key owning each.
+func (km *KeyManager) CorpusKeys() []CorpusKey {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	corpora := make([]CorpusKey, 0, len(km.corpusKeys))
+	for corpus, key := range km.corpusKeys {
+		corpora = append(corpora, CorpusKey{Corpus: corpus, Key: MaskKey(key), Available: km.retrievalKeyUsable(key)})
+	}
+	sort.Slice(corpora, func(i, j int) bool { return corpora[i].Corpus < corpora[j].Corpus })
+	return corpora
+}
+
+// ResolveCorpusKey returns the key owning a corpus, listing the corpora of every
+// key once if the corpus isn't known yet (e.g. it was created before the proxy).
+func (km *KeyManager) ResolveCorpusKey(target *url.URL, corpus string) (string, int, error) {
+	km.mutex.RLock()
+	key, known := km.corpusKeys[corpus]
+	usable := known && km.retrievalKeyUsable(key)
+	km.mutex.RUnlock()
+
+	if known && !usable {
+		return "", http.StatusServiceUnavailable, fmt.Errorf("%s belongs to key %s, which is no longer available", corpus, MaskKey(key))
+	}
+	if known {
+		return key, 0, nil
+	}
+
+	km.DiscoverCorpora(target)
+
+	km.mutex.RLock()
+	key, known = km.corpusKeys[corpus]
+	km.mutex.RUnlock()
+	if !known {
+		return "", http.StatusNotFound, fmt.Errorf("%s was not found under any configured key", corpus)
+	}
+	return key, 0, nil
+}
+
+// DiscoverCorpora lists the corpora of every usable key, records which key owns
+// each one and returns the merged list.
+func (km *KeyManager) DiscoverCorpora(target *url.URL) []json.RawMessage {
+	client := &http.Client{Timeout: 30 * time.Second}
+	var corpora []json.RawMessage
+
+	for _, key := range km.retrievalKeys() {
+		pageToken := ""
+		for {
+			listURL := km.UpstreamURL(target, key, "/v1beta/corpora")
+			q := url.Values{}
+			q.Set("pageSize", "20")
+			if pageToken != "" {
+				q.Set("pageToken", pageToken)
+			}
+			listURL.RawQuery = q.Encode()
+
+			req, err := http.NewRequest(http.MethodGet, listURL.String(), nil)
+			if err != nil {
+				break
+			}
+			SetUpstreamKey(req, key)
+			resp, err := client.Do(req)
+			if err != nil {
+				log.Printf("Failed to list corpora for key %s: %v", MaskKey(key), err)
+				break
+			}
+			var page struct {
+				Corpora       []json.RawMessage `json:"corpora"`
+				NextPageToken string            `json:"nextPageToken"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&page)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || err != nil {
+				log.Printf("Failed to list corpora for key %s: status %d", MaskKey(key), resp.StatusCode)
+				break
+			}
+
+			for _, raw := range page.Corpora {
+				var corpus struct {
+					Name string `json:"name"`
+				}
+				if json.Unmarshal(raw, &corpus) == nil && corpus.Name != "" {
+					km.SetCorpusKey(corpus.Name, key)
+				}
+				corpora = append(corpora, raw)
+			}
+			if page.NextPageToken == "" {
+				break
+			}
+			pageToken = page.NextPageToken
+		}
+	}
+	return corpora
+}
+
+type CorpusKey struct {
+	Corpus    string `json:"corpus"`
+	Key       string `json:"key"`       // Masked
+	Available bool   `json:"available"` // False once the key was removed or banned
+}
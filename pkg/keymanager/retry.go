@@ -0,0 +1,101 @@
+package keymanager
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryConfig controls how often a proxied request is sent upstream. 403s and
+// 429s always move on to another key without waiting; retryable statuses wait
+// for a backoff first.
+type RetryConfig struct {
+	MaxAttempts     int     `json:"max_attempts,omitempty"`           // Upstream attempts per request, default 5
+	BackoffMs       int     `json:"backoff_ms,omitempty"`             // Wait before the first retry of a retryable status, doubled on each further one; default 5000
+	MaxBackoffMs    int     `json:"max_backoff_ms,omitempty"`         // Default 30000
+	Jitter          float64 `json:"jitter,omitempty"`                 // Randomizes each backoff by up to this fraction, 0-1
+	DeadlineSeconds int     `json:"deadline_seconds,omitempty"`       // No new attempt is started after this long, 0 for no limit
+	RetryableStatus []int   `json:"retryable_status_codes,omitempty"` // Default [503]
+}
+
+func (r RetryConfig) withDefaults() RetryConfig {
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = 5
+	}
+	if r.BackoffMs <= 0 {
+		r.BackoffMs = 5000
+	}
+	if r.MaxBackoffMs <= 0 {
+		r.MaxBackoffMs = 30000
+	}
+	if r.Jitter < 0 {
+		r.Jitter = 0
+	}
+	if r.Jitter > 1 {
+		r.Jitter = 1
+	}
+	if len(r.RetryableStatus) == 0 {
+		r.RetryableStatus = []int{503}
+	}
+	return r
+}
+
+// RetryPolicy tracks the attempts of one proxied request.
+type RetryPolicy struct {
+	config   RetryConfig
+	start    time.Time
+	attempts int
+	backoffs int
+}
+
+func (km *KeyManager) NewRetryPolicy() *RetryPolicy {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+
+	var config RetryConfig
+	if km.config.Retry != nil {
+		config = *km.config.Retry
+	}
+	return &RetryPolicy{config: config.withDefaults(), start: time.Now()}
+}
+
+// Next reports whether another attempt may be made and counts it.
+func (p *RetryPolicy) Next() bool {
+	if p.attempts >= p.config.MaxAttempts || p.expired() {
+		return false
+	}
+	p.attempts++
+	return true
+}
+
+func (p *RetryPolicy) expired() bool {
+	return p.config.DeadlineSeconds > 0 && time.Since(p.start) >= time.Duration(p.config.DeadlineSeconds)*time.Second
+}
+
+// Retryable reports whether an upstream status is worth another attempt.
+func (p *RetryPolicy) Retryable(statusCode int) bool {
+	for _, code := range p.config.RetryableStatus {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff returns how long to wait before the next retry of a retryable status
+// and counts it. The wait never runs past the deadline.
+func (p *RetryPolicy) Backoff() time.Duration {
+	wait := time.Duration(p.config.BackoffMs) * time.Millisecond << min(p.backoffs, 16)
+	if maxWait := time.Duration(p.config.MaxBackoffMs) * time.Millisecond; wait > maxWait {
+		wait = maxWait
+	}
+	p.backoffs++
+	if p.config.Jitter > 0 {
+		wait = time.Duration(float64(wait) * (1 + p.config.Jitter*(2*rand.Float64()-1)))
+	}
+	if p.config.DeadlineSeconds > 0 {
+		if left := time.Until(p.start.Add(time.Duration(p.config.DeadlineSeconds) * time.Second)); wait > left {
+			wait = max(left, 0)
+		}
+	}
+	return wait
+}
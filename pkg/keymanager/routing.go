@@ -0,0 +1,193 @@
+package keymanager
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// Routing rules let one proxy serve several teams: the first rule matching a
+// request's path, headers, client key and requested model decides the model,
+// the key group and the upstream it gets, before a key is picked. Requests no
+// rule matches are served as without rules.
+
+// RoutingRule matches requests on every condition it sets and applies every
+// action it sets.
+type RoutingRule struct {
+	Name string `json:"name,omitempty"` // For config errors
+	// Conditions
+	PathPrefix  string            `json:"path_prefix,omitempty"`  // e.g. "/v1/" for OpenAI-format requests
+	Headers     map[string]string `json:"headers,omitempty"`      // Required header values, "*" for any value
+	ClientKeys  []string          `json:"client_keys,omitempty"`  // Names of client_keys entries
+	ModelPrefix string            `json:"model_prefix,omitempty"` // Of the requested model, e.g. "gemini-2.5-pro"
+	// Actions
+	Model       string `json:"model,omitempty"`        // Serve the request with this model instead
+	KeyGroup    string `json:"key_group,omitempty"`    // Only use the keys of this key_groups entry
+	UpstreamURL string `json:"upstream_url,omitempty"` // Send the request here instead of upstream_url and key_upstream_urls
+}
+
+// RouteRequest is what routing rules match on, besides the requested model.
+type RouteRequest struct {
+	Path      string
+	Header    http.Header
+	ClientKey string // Name of the client key, empty without client keys
+}
+
+// routeState is a request's RouteRequest and the rule WaitForKey matched for
+// it, which UpstreamURLFor applies.
+type routeState struct {
+	request RouteRequest
+	rule    atomic.Pointer[RoutingRule]
+}
+
+type routeContextKey struct{}
+
+// WithRouteRequest returns a context that has WaitForKey and UpstreamURLFor
+// apply the routing rules matching request.
+func WithRouteRequest(ctx context.Context, request RouteRequest) context.Context {
+	return context.WithValue(ctx, routeContextKey{}, &routeState{request: request})
+}
+
+func routeStateFromContext(ctx context.Context) *routeState {
+	state, _ := ctx.Value(routeContextKey{}).(*routeState)
+	return state
+}
+
+func (rule *RoutingRule) matches(request RouteRequest, modelName string) bool {
+	if rule.PathPrefix != "" && !strings.HasPrefix(request.Path, rule.PathPrefix) {
+		return false
+	}
+	for name, want := range rule.Headers {
+		got := request.Header.Get(name)
+		if got == "" || want != "*" && got != want {
+			return false
+		}
+	}
+	if len(rule.ClientKeys) > 0 {
+		found := false
+		for _, name := range rule.ClientKeys {
+			if name == request.ClientKey {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if rule.ModelPrefix != "" && !strings.HasPrefix(modelName, rule.ModelPrefix) {
+		return false
+	}
+	return true
+}
+
+// matchRoute returns the first routing rule matching the request for
+// modelName, or nil. Must be called with km.mutex held.
+func (km *KeyManager) matchRoute(state *routeState, modelName string) *RoutingRule {
+	if state == nil {
+		return nil
+	}
+	for i := range km.config.RoutingRules {
+		if rule := &km.config.RoutingRules[i]; rule.matches(state.request, modelName) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// route matches the routing rules for a request for modelName and remembers
+// the rule for UpstreamURLFor.
+func (km *KeyManager) route(ctx context.Context, modelName string) *RoutingRule {
+	state := routeStateFromContext(ctx)
+	if state == nil {
+		return nil
+	}
+	km.mutex.RLock()
+	rule := km.matchRoute(state, modelName)
+	km.mutex.RUnlock()
+	if rule != nil {
+		state.rule.Store(rule)
+	}
+	return rule
+}
+
+// RoutedModel returns the model the routing rule matched by WaitForKey for the
+// request in ctx serves it with instead of the requested one, or "".
+func RoutedModel(ctx context.Context) string {
+	if state := routeStateFromContext(ctx); state != nil {
+		if rule := state.rule.Load(); rule != nil {
+			return rule.Model
+		}
+	}
+	return ""
+}
+
+// keyInGroup reports whether the key is in the key_groups entry, or true for
+// no group. Must be called with km.mutex held.
+func (km *KeyManager) keyInGroup(group, key string) bool {
+	if group == "" {
+		return true
+	}
+	for _, k := range km.config.KeyGroups[group] {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// UpstreamURLFor is UpstreamURL for the request in ctx: the upstream_url of
+// its routing rule takes precedence. For requests that didn't pick their key
+// with WaitForKey, only rules without model_prefix apply.
+func (km *KeyManager) UpstreamURLFor(ctx context.Context, target *url.URL, key, path string) url.URL {
+	if state := routeStateFromContext(ctx); state != nil {
+		rule := state.rule.Load()
+		if rule == nil {
+			km.mutex.RLock()
+			rule = km.matchRoute(state, "")
+			km.mutex.RUnlock()
+		}
+		if rule != nil && rule.UpstreamURL != "" {
+			if configured, err := parseUpstreamURL(rule.UpstreamURL); err == nil { // Validated when the config is loaded
+				base := *configured
+				base.Path = strings.TrimSuffix(base.Path, "/") + path
+				base.RawPath = ""
+				return base
+			}
+		}
+	}
+	return km.UpstreamURL(target, key, path)
+}
+
+// ValidateRouting checks routing_rules and key_groups.
+func ValidateRouting(config *Config) error {
+	for group, keys := range config.KeyGroups {
+		if len(keys) == 0 {
+			return fmt.Errorf("key group '%s' has no keys", group)
+		}
+	}
+	for i, rule := range config.RoutingRules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if rule.Model == "" && rule.KeyGroup == "" && rule.UpstreamURL == "" {
+			return fmt.Errorf("routing rule %s sets none of model, key_group and upstream_url", name)
+		}
+		if _, ok := config.Models[rule.Model]; rule.Model != "" && !ok {
+			return fmt.Errorf("model '%s' of routing rule %s is not in models", rule.Model, name)
+		}
+		if _, ok := config.KeyGroups[rule.KeyGroup]; rule.KeyGroup != "" && !ok {
+			return fmt.Errorf("key_group '%s' of routing rule %s is not in key_groups", rule.KeyGroup, name)
+		}
+		if rule.UpstreamURL != "" {
+			if _, err := parseUpstreamURL(rule.UpstreamURL); err != nil {
+				return fmt.Errorf("invalid upstream_url of routing rule %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package keymanager
+
+// Many clients have no way to set Gemini's safety thresholds, and the default
+// blocking gets in the way of e.g. creative writing. safety_settings on a model
+// are put into each of its generation requests, replacing the threshold the
+// client sent for the same category.
+
+type GeminiSafetySetting struct {
+	Category  string `json:"category"`  // e.g. HARM_CATEGORY_HARASSMENT
+	Threshold string `json:"threshold"` // e.g. BLOCK_NONE
+}
+
+func (km *KeyManager) SafetySettings(model string) []GeminiSafetySetting {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	return km.config.Models[model].SafetySettings
+}
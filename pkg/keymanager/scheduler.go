@@ -0,0 +1,74 @@
+package keymanager
+
+import "time"
+
+// Keys are scheduled on the same sliding one-minute windows the limits are
+// counted in: a request goes to the first key (in priority order) whose last
+// minute of tokens and requests leaves room for it right now. When no key has
+// room, it goes to the key where room frees up first and waits exactly until
+// then, instead of a fixed wait once half the limit is used.
+
+// tpmWait returns how long until the last minute of usage leaves room for
+// tokens more under limit. A request larger than the limit fits once the window
+// is empty.
+func tpmWait(usage *LanguageModelUsage, limit, tokens int, now time.Time) time.Duration {
+	if limit <= 0 {
+		return 0
+	}
+	tokens = min(max(tokens, 1), limit)
+	window := &usage.Past24HoursTokenUsage
+	excess := tokens - limit + window.LastMinuteTokens(now.Unix())
+	if excess <= 0 {
+		return 0
+	}
+	for s := now.Unix() - 59; s <= now.Unix(); s++ { // Oldest first
+		excess -= window.second(s)
+		if excess <= 0 {
+			// Usage is counted for the 60 seconds starting at its second
+			return max(time.Unix(s+60, 0).Sub(now), 0)
+		}
+	}
+	return 0
+}
+
+// rpmWait returns how long until the last minute of requests leaves room for
+// another one under limit.
+func rpmWait(usage *LanguageModelUsage, limit int, now time.Time) time.Duration {
+	requests := usage.RecentRequests
+	if limit <= 0 || len(requests) < limit {
+		return 0
+	}
+	// The request that has to leave the window before another one fits
+	wait := time.UnixMilli(requests[len(requests)-limit] + 60000).Sub(now)
+	return max(wait, 0)
+}
+
+// keyWait returns how long a request for estimatedTokens has to wait for a key.
+// A key that just got a 429 is treated as being at its limit, so it waits for
+// its window to clear and other keys are preferred. Must be called with km.mutex
+// held.
+func (km *KeyManager) keyWait(modelName string, usage *LanguageModelUsage, estimatedTokens int, now time.Time) time.Duration {
+	limit := km.tpmLimit(modelName, usage)
+	if usage.JustHit429 {
+		estimatedTokens = limit
+	}
+	return max(tpmWait(usage, limit, estimatedTokens, now), rpmWait(usage, km.config.Models[modelName].RpmLimit, now))
+}
+
+// soonestKey returns the first key that can take a request for estimatedTokens
+// right away, or else the one that can take it first along with the time until
+// then. Must be called with km.mutex held.
+func (km *KeyManager) soonestKey(modelName string, keys []KeyInfo, estimatedTokens int) (KeyInfo, time.Duration) {
+	now := km.now()
+	best, bestWait := keys[0], time.Duration(-1)
+	for _, keyInfo := range keys {
+		wait := km.keyWait(modelName, km.usage[modelName+"_"+keyInfo.Key], estimatedTokens, now)
+		if wait == 0 {
+			return keyInfo, 0
+		}
+		if bestWait < 0 || wait < bestWait {
+			best, bestWait = keyInfo, wait
+		}
+	}
+	return best, bestWait
+}
@@ -0,0 +1,181 @@
+package keymanager
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrorSimulation makes the proxy treat matching requests as if the upstream had
+// returned StatusCode, without actually sending them. Used for chaos testing of
+// key rotation and rate-limit handling.
+type ErrorSimulation struct {
+	ModelName  string  `json:"model_name"` // Empty matches any model
+	APIKey     string  `json:"api_key"`    // Empty matches any key
+	StatusCode int     `json:"status_code"`
+	Remaining  int     `json:"remaining"`  // Number of errors still to inject, 0 = unlimited (percentage mode)
+	Percentage float64 `json:"percentage"` // Chance (0-100) that a matching request fails, 0 = always
+}
+
+// FaultInjectionConfig describes faults injected into successful upstream responses
+// in test mode, to exercise the translation layers and streaming parsers.
+// Fault injection can only be enabled with test_mode, which requires admin_auth,
+// since it corrupts the responses of every client.
+type FaultInjectionConfig struct {
+	Enabled             bool    `json:"enabled"`
+	LatencyMs           int     `json:"latency_ms"`           // Extra delay before the response is returned
+	LatencyPercentage   float64 `json:"latency_percentage"`   // Chance (0-100) of adding latency
+	TruncatePercentage  float64 `json:"truncate_percentage"`  // Chance (0-100) of cutting the body short
+	MalformedPercentage float64 `json:"malformed_percentage"` // Chance (0-100) of corrupting the body
+}
+
+// ValidateTestMode checks that test_mode is only on behind admin_auth and that
+// fault_injection is only enabled in test mode.
+func ValidateTestMode(config *Config) error {
+	if config.TestMode && !config.AdminAuth.Enabled() {
+		return fmt.Errorf("test_mode requires admin_auth")
+	}
+	if config.FaultInjection != nil && config.FaultInjection.Enabled && !config.TestMode {
+		return fmt.Errorf("fault_injection requires test_mode")
+	}
+	return nil
+}
+
+type ErrorSimulator struct {
+	simulations []*ErrorSimulation
+	faults      FaultInjectionConfig
+	mutex       sync.Mutex
+}
+
+// Simulator returns the error simulations and fault injection applied to
+// upstream responses.
+func (km *KeyManager) Simulator() *ErrorSimulator {
+	return &km.simulator
+}
+
+func (s *ErrorSimulator) SetFaults(faults FaultInjectionConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = faults
+}
+
+func (s *ErrorSimulator) Faults() FaultInjectionConfig {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.faults
+}
+
+func chance(percentage float64) bool {
+	return percentage > 0 && rand.Float64()*100 < percentage
+}
+
+// InjectFaults applies the configured faults to a successful upstream response.
+func (s *ErrorSimulator) InjectFaults(resp *http.Response) {
+	faults := s.Faults()
+	if !faults.Enabled || resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	if faults.LatencyMs > 0 && (faults.LatencyPercentage <= 0 || chance(faults.LatencyPercentage)) {
+		log.Printf("Fault injection: delaying response by %dms", faults.LatencyMs)
+		time.Sleep(time.Duration(faults.LatencyMs) * time.Millisecond)
+	}
+
+	if chance(faults.TruncatePercentage) {
+		limit := int64(1 + rand.Intn(1024))
+		if resp.ContentLength > 1 {
+			limit = 1 + rand.Int63n(resp.ContentLength-1)
+		}
+		log.Printf("Fault injection: truncating response after %d bytes", limit)
+		resp.Body = &faultBody{Reader: io.LimitReader(resp.Body, limit), Closer: resp.Body}
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+	}
+
+	if chance(faults.MalformedPercentage) {
+		offset := int64(rand.Intn(256))
+		log.Printf("Fault injection: corrupting response at byte %d", offset)
+		resp.Body = &faultBody{Reader: &corruptReader{r: resp.Body, offset: offset}, Closer: resp.Body}
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+	}
+}
+
+type faultBody struct {
+	io.Reader
+	io.Closer
+}
+
+// corruptReader inserts a non-JSON fragment into the stream once offset bytes have been read.
+type corruptReader struct {
+	r        io.Reader
+	offset   int64
+	read     int64
+	injected bool
+}
+
+func (cr *corruptReader) Read(p []byte) (int, error) {
+	if !cr.injected && cr.read >= cr.offset {
+		cr.injected = true
+		return copy(p, "}<<malformed>>{"), nil
+	}
+	if !cr.injected && int64(len(p)) > cr.offset-cr.read {
+		p = p[:cr.offset-cr.read]
+	}
+	n, err := cr.r.Read(p)
+	cr.read += int64(n)
+	return n, err
+}
+
+func (s *ErrorSimulator) Add(sim *ErrorSimulation) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.simulations = append(s.simulations, sim)
+}
+
+func (s *ErrorSimulator) Clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.simulations = nil
+}
+
+func (s *ErrorSimulator) List() []ErrorSimulation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := make([]ErrorSimulation, 0, len(s.simulations))
+	for _, sim := range s.simulations {
+		result = append(result, *sim)
+	}
+	return result
+}
+
+// Take returns the status code to simulate for this request, or 0 if the request
+// should be sent upstream normally.
+func (s *ErrorSimulator) Take(modelName, apiKey string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, sim := range s.simulations {
+		if sim.ModelName != "" && sim.ModelName != modelName {
+			continue
+		}
+		if sim.APIKey != "" && sim.APIKey != apiKey {
+			continue
+		}
+		if sim.Percentage > 0 && rand.Float64()*100 >= sim.Percentage {
+			continue
+		}
+		if sim.Remaining > 0 {
+			sim.Remaining--
+			if sim.Remaining == 0 {
+				s.simulations = append(s.simulations[:i], s.simulations[i+1:]...)
+			}
+		}
+		return sim.StatusCode
+	}
+	return 0
+}
@@ -0,0 +1,22 @@
+package keymanager
+
+import "strings"
+
+// system_prompt on a model or a client key is put in front of the system
+// instruction of every generation request for that model or from that client,
+// e.g. house rules on language or safety that clients can't leave out.
+
+// SystemPrompt returns the configured system prompts for a request to model
+// from a client key, the model's first, or "" when there are none.
+func (km *KeyManager) SystemPrompt(clientKey, model string) string {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	var prompts []string
+	if m, ok := km.config.Models[model]; ok && m.SystemPrompt != "" {
+		prompts = append(prompts, m.SystemPrompt)
+	}
+	if ck, ok := km.clientKeyFor(clientKey); ok && ck.SystemPrompt != "" {
+		prompts = append(prompts, ck.SystemPrompt)
+	}
+	return strings.Join(prompts, "\n\n")
+}
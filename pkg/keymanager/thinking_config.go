@@ -0,0 +1,37 @@
+package keymanager
+
+import "encoding/json"
+
+// Thinking tokens of Gemini 2.5 models count against the quota, and most
+// OpenAI and Ollama clients have no way to limit them. thinking_config on a
+// model is put into each of its requests, replacing what the client sent.
+
+type ThinkingConfig struct {
+	ThinkingBudget  *int  `json:"thinking_budget,omitempty"` // Tokens, 0 turns thinking off where the model allows it, -1 lets the model decide
+	IncludeThoughts *bool `json:"include_thoughts,omitempty"`
+}
+
+func (km *KeyManager) ThinkingConfig(model string) *ThinkingConfig {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	return km.config.Models[model].ThinkingConfig
+}
+
+// Apply sets the configured fields in a thinkingConfig object, named in camelCase
+// or snake_case like the client's request.
+func (t *ThinkingConfig) Apply(config map[string]json.RawMessage, snake bool) {
+	budget, include := "thinkingBudget", "includeThoughts"
+	if snake {
+		budget, include = "thinking_budget", "include_thoughts"
+	}
+	if t.ThinkingBudget != nil {
+		delete(config, "thinking_budget")
+		delete(config, "thinkingBudget")
+		config[budget], _ = json.Marshal(*t.ThinkingBudget)
+	}
+	if t.IncludeThoughts != nil {
+		delete(config, "include_thoughts")
+		delete(config, "includeThoughts")
+		config[include], _ = json.Marshal(*t.IncludeThoughts)
+	}
+}
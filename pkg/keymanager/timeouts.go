@@ -0,0 +1,70 @@
+package keymanager
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// TimeoutsConfig bounds how long the proxy waits on the upstream API and on its
+// own clients. Values are seconds.
+type TimeoutsConfig struct {
+	Connect        int `json:"connect,omitempty"`         // Connecting to the upstream API, default 10
+	ResponseHeader int `json:"response_header,omitempty"` // Waiting for upstream response headers after sending a request, default 600
+	Request        int `json:"request,omitempty"`         // Whole proxied request including retries and streaming, 0 for no limit
+
+	ClientReadHeader int `json:"client_read_header,omitempty"` // Reading a client's request headers, default 30
+	ClientIdle       int `json:"client_idle,omitempty"`        // Keeping an idle client connection open, default 120
+}
+
+func (t TimeoutsConfig) WithDefaults() TimeoutsConfig {
+	if t.Connect <= 0 {
+		t.Connect = 10
+	}
+	if t.ResponseHeader <= 0 {
+		t.ResponseHeader = 600
+	}
+	if t.ClientReadHeader <= 0 {
+		t.ClientReadHeader = 30
+	}
+	if t.ClientIdle <= 0 {
+		t.ClientIdle = 120
+	}
+	return t
+}
+
+func (km *KeyManager) Timeouts() TimeoutsConfig {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+
+	var config TimeoutsConfig
+	if km.config.Timeouts != nil {
+		config = *km.config.Timeouts
+	}
+	return config.WithDefaults()
+}
+
+// UpstreamClient returns the client for requests to the upstream API. Its
+// transport is shared so connections are reused, and rebuilt when the timeouts
+// change on a config reload.
+func (km *KeyManager) UpstreamClient() *http.Client {
+	config := km.Timeouts()
+
+	km.transportMutex.Lock()
+	defer km.transportMutex.Unlock()
+	if km.transport == nil || km.transportTimeouts != config {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = (&net.Dialer{
+			Timeout:   time.Duration(config.Connect) * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		transport.TLSHandshakeTimeout = time.Duration(config.Connect) * time.Second
+		transport.ResponseHeaderTimeout = time.Duration(config.ResponseHeader) * time.Second
+		if km.transport != nil {
+			km.transport.CloseIdleConnections()
+		}
+		km.transport = transport
+		km.transportTimeouts = config
+	}
+	return &http.Client{Transport: km.transport}
+}
@@ -0,0 +1,19 @@
+package keymanager
+
+// TLSConfig makes the server listen for HTTPS itself, with either a certificate
+// from files or one obtained from Let's Encrypt.
+type TLSConfig struct {
+	Address  string          `json:"address,omitempty"` // Listen address, default ":48888"
+	CertFile string          `json:"cert_file,omitempty"`
+	KeyFile  string          `json:"key_file,omitempty"`
+	Autocert *AutocertConfig `json:"autocert,omitempty"`
+}
+
+type AutocertConfig struct {
+	Domains  []string `json:"domains"`
+	Email    string   `json:"email,omitempty"`
+	CacheDir string   `json:"cache_dir,omitempty"` // Default "autocert-cache"
+	// Plain HTTP listener for the ACME HTTP-01 challenge, e.g. ":80". Without it
+	// only the TLS-ALPN-01 challenge is answered, which needs the server on port 443.
+	HTTPAddress string `json:"http_address,omitempty"`
+}
@@ -0,0 +1,83 @@
+package keymanager
+
+import (
+	"fmt"
+)
+
+// TokenEstimationConfig makes the proxy estimate a request's size before picking
+// a key, so the key can be chosen by its remaining TPM/TPD budget.
+type TokenEstimationConfig struct {
+	// Ask Gemini's countTokens endpoint for the prompt size of native and
+	// translated Gemini requests. Costs one extra upstream call per request.
+	CountTokens bool `json:"count_tokens"`
+	// Approximate the prompt size from the request text without calling upstream,
+	// when countTokens is off or fails.
+	Local bool `json:"local,omitempty"`
+}
+
+// LocalTokenEstimation reports whether requests are estimated locally, for the
+// OpenAI endpoints whose bodies countTokens can't take.
+func (km *KeyManager) LocalTokenEstimation() bool {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	return km.config.TokenEstimation != nil && km.config.TokenEstimation.Local
+}
+
+// CheckTokenEstimate returns an error for a request estimated at more tokens
+// than the TPM limit of its model and fallback models, which no key could ever
+// take, so it isn't retried into 429s.
+func (km *KeyManager) CheckTokenEstimate(modelName string, estimatedTokens int) error {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	model, ok := km.config.Models[modelName]
+	if !ok || estimatedTokens <= 0 {
+		return nil
+	}
+	limit := model.TpmLimit
+	for _, fallback := range model.FallbackModels {
+		limit = max(limit, km.config.Models[fallback].TpmLimit)
+	}
+	if km.config.AdaptiveTPM { // Learned limits can go above tpm_limit
+		limit = limit * tpmMaxLearnedShare / 100
+	}
+	if limit <= 0 || estimatedTokens <= limit {
+		return nil
+	}
+	return fmt.Errorf("request of about %d tokens exceeds the limit of %d tokens per minute of model %s", estimatedTokens, limit, modelName)
+}
+
+// CountTokensKey returns a usable key for a countTokens call, which has its own
+// quota and does not count as a request.
+func (km *KeyManager) CountTokensKey(modelName string) string {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	for _, keyInfo := range km.keys {
+		if km.permanentlyBannedKeys[keyInfo.Key] || !km.ownsKey(keyInfo.Key) || km.keyPaused(keyInfo.Key) {
+			continue
+		}
+		if km.keyServesModel(keyInfo.Key, modelName) {
+			return keyInfo.Key
+		}
+	}
+	return ""
+}
+
+// keysWithBudget returns the keys whose last minute and last day of usage leave
+// room for estimatedTokens more. Must be called with km.mutex held.
+func (km *KeyManager) keysWithBudget(modelName string, keys []KeyInfo, estimatedTokens int) []KeyInfo {
+	model := km.config.Models[modelName]
+	var result []KeyInfo
+	for _, keyInfo := range keys {
+		usage := km.usage[modelName+"_"+keyInfo.Key]
+		now := km.now().Unix()
+		past60sTokens := usage.Past24HoursTokenUsage.LastMinuteTokens(now)
+		if tpmLimit := km.tpmLimit(modelName, usage); tpmLimit > 0 && past60sTokens+estimatedTokens > tpmLimit {
+			continue
+		}
+		if model.TpdLimit != nil && *model.TpdLimit > 0 && usage.Past24HoursTokenUsage.LastDayTokens(now)+estimatedTokens > *model.TpdLimit {
+			continue
+		}
+		result = append(result, keyInfo)
+	}
+	return result
+}
@@ -0,0 +1,138 @@
+package keymanager
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultUpstreamURL is the Gemini API, used unless upstream_url is configured.
+const DefaultUpstreamURL = "https://generativelanguage.googleapis.com"
+
+// parseUpstreamURL checks a configured base URL. It may have a path, e.g. a
+// relay serving the API under https://relay.example.com/gemini.
+func parseUpstreamURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("'%s' is not an http(s) URL", raw)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("'%s' must not have a query or fragment", raw)
+	}
+	return u, nil
+}
+
+func ValidateUpstreamURLs(config *Config) error {
+	if config.UpstreamURL != "" {
+		if _, err := parseUpstreamURL(config.UpstreamURL); err != nil {
+			return fmt.Errorf("invalid upstream_url: %v", err)
+		}
+	}
+	for key, raw := range config.KeyUpstreamURLs {
+		if _, err := parseUpstreamURL(raw); err != nil {
+			return fmt.Errorf("invalid key_upstream_urls entry for key %s: %v", MaskKey(key), err)
+		}
+	}
+	return nil
+}
+
+// defaultForwardedHeaders are the client request headers passed on to Gemini.
+// Anything else (cookies, the client's own credentials, X-Forwarded-*, hop-by-hop
+// headers, Accept-Encoding, which the transport negotiates) stays at the proxy.
+// Host and Content-Length always come from the upstream request itself.
+var defaultForwardedHeaders = []string{
+	"Accept",
+	"Content-Type",
+	"Content-Encoding",
+	"User-Agent",
+	"X-Goog-Api-Client",
+	"X-Server-Timeout",
+	// Resumable uploads
+	"X-Goog-Upload-Protocol",
+	"X-Goog-Upload-Command",
+	"X-Goog-Upload-Offset",
+	"X-Goog-Upload-Header-Content-Length",
+	"X-Goog-Upload-Header-Content-Type",
+	"X-Goog-Upload-File-Name",
+}
+
+// HeaderPolicyConfig adjusts which request headers are forwarded upstream.
+type HeaderPolicyConfig struct {
+	Allow []string          `json:"allow,omitempty"` // Forwarded in addition to the defaults
+	Set   map[string]string `json:"set,omitempty"`   // Sent on every upstream request, replacing the client's value; "" removes the header
+}
+
+// ForwardHeaders returns the headers of an upstream request made for a client
+// request with headers src: the allowed ones, then the configured overrides.
+func (km *KeyManager) ForwardHeaders(src http.Header) http.Header {
+	km.mutex.RLock()
+	policy := km.config.HeaderPolicy
+	km.mutex.RUnlock()
+
+	allowed := defaultForwardedHeaders
+	if policy != nil {
+		allowed = append(allowed[:len(allowed):len(allowed)], policy.Allow...)
+	}
+	dst := http.Header{}
+	for _, name := range allowed {
+		if values := src.Values(name); len(values) > 0 {
+			dst[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+		}
+	}
+	if policy != nil {
+		for name, value := range policy.Set {
+			if value == "" {
+				dst.Del(name)
+			} else {
+				dst.Set(name, value)
+			}
+		}
+	}
+	return dst
+}
+
+// SetUpstreamKey authenticates an upstream request with key. It goes in the
+// x-goog-api-key header rather than the query, where it would end up in access
+// logs; credentials the client sent are dropped so they never reach Google.
+func SetUpstreamKey(req *http.Request, key string) {
+	if q := req.URL.Query(); q.Has("key") {
+		q.Del("key")
+		req.URL.RawQuery = q.Encode()
+	}
+	req.Header.Del("Authorization")
+	req.Header.Del("x-api-key")
+	req.Header.Set("x-goog-api-key", key)
+}
+
+// UpstreamURL returns the URL of an upstream API path for requests with key:
+// under the key's entry in key_upstream_urls, else upstream_url, else target.
+// The caller sets the query.
+func (km *KeyManager) UpstreamURL(target *url.URL, key, path string) url.URL {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+	return ConfigUpstreamURL(km.config, target, key, path)
+}
+
+// ConfigUpstreamURL is UpstreamURL for a config that isn't loaded into a
+// KeyManager.
+func ConfigUpstreamURL(config *Config, target *url.URL, key, path string) url.URL {
+	raw := config.KeyUpstreamURLs[key]
+	if raw == "" {
+		raw = config.UpstreamURL
+	}
+
+	base := *target
+	if raw != "" {
+		if configured, err := parseUpstreamURL(raw); err == nil { // Validated when the config is loaded
+			base = *configured
+		}
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + path
+	base.RawPath = ""
+	base.RawQuery = ""
+	return base
+}
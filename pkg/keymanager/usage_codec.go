@@ -0,0 +1,121 @@
+package keymanager
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With usage_store.format "gob", usage is saved to key_usage.gob.gz instead of
+// key_usage.json: gob, compressed with gzip. Indented JSON of every key and
+// model gets slow to write and read once there are many of them; the binary file
+// is a fraction of the size and encodes several times faster. It can't be
+// edited by hand, which is why JSON stays the default.
+
+const gobUsageSuffix = ".gob.gz"
+
+// usageFileName returns the name of the usage file for the configured format.
+func usageFileName(config *Config) string {
+	if config.UsageStore != nil && config.UsageStore.Format == "gob" {
+		return "key_usage" + gobUsageSuffix
+	}
+	return "key_usage.json"
+}
+
+// ValidUsageFormat reports whether format is a known usage file format.
+func ValidUsageFormat(format string) bool {
+	return format == "" || format == "json" || format == "gob"
+}
+
+// encodeUsageFile encodes v in the format the usage file at path is written in.
+func encodeUsageFile(path string, v any) ([]byte, error) {
+	if !strings.HasSuffix(path, gobUsageSuffix) {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := gob.NewEncoder(zw).Encode(v); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readUsageWithBackup is readJSONWithBackup for usage files in either format.
+// When a binary usage file doesn't exist yet, key_usage.json next to it is read,
+// so switching the format keeps the usage.
+func readUsageWithBackup(path string, v any) error {
+	if !strings.HasSuffix(path, gobUsageSuffix) {
+		return readJSONWithBackup(path, v)
+	}
+	err := readGobFile(path, v)
+	if err == nil {
+		return nil
+	}
+	backupPath := path + ".bak"
+	if backupErr := readGobFile(backupPath, v); backupErr == nil {
+		log.Printf("WARN: %s could not be read (%v), loaded the backup %s instead.", path, err, backupPath)
+		return nil
+	}
+	if os.IsNotExist(err) {
+		jsonPath := filepath.Join(filepath.Dir(path), "key_usage.json")
+		if jsonErr := readJSONWithBackup(jsonPath, v); jsonErr == nil {
+			log.Printf("Loaded usage from %s, it will be saved to %s from now on.", jsonPath, path)
+			return nil
+		}
+	}
+	return err
+}
+
+func readGobFile(path string, v any) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if err := gob.NewDecoder(zr).Decode(v); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// GobEncode stores the window as its usage points, like MarshalJSON, each as a
+// varint timestamp and token count.
+func (w UsageWindow) GobEncode() ([]byte, error) {
+	var b []byte
+	for _, d := range w.points() {
+		b = binary.AppendVarint(b, int64(d.Timestamp))
+		b = binary.AppendVarint(b, int64(d.CostToken))
+	}
+	return b, nil
+}
+
+func (w *UsageWindow) GobDecode(b []byte) error {
+	*w = UsageWindow{}
+	for len(b) > 0 {
+		ts, n := binary.Varint(b)
+		if n <= 0 {
+			return fmt.Errorf("invalid usage window")
+		}
+		tokens, m := binary.Varint(b[n:])
+		if m <= 0 {
+			return fmt.Errorf("invalid usage window")
+		}
+		w.add(ts, int(tokens))
+		b = b[n+m:]
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package keymanager
+
+import "sync"
+
+// Usage counters are updated after every response, so RecordUsage doesn't take
+// km.mutex for writing: it holds it for reading, like the status readers, plus
+// the lock of the usage entry it updates. Responses for different keys and
+// models are then counted in parallel and don't wait for a status snapshot.
+//
+// The rules for usage entries (the values of km.usage):
+//   - With km.mutex held for writing, an entry can be read and changed freely.
+//   - With km.mutex held for reading, an entry is only read or changed while
+//     holding km.usageLock(usageKey).
+//
+// km.mutex is always taken before an entry lock, and at most one entry lock is
+// held at a time.
+
+const usageLockShards = 64
+
+type usageLocks [usageLockShards]sync.Mutex
+
+// usageLock returns the lock of a usage entry. Entries share the locks in
+// shards, by a hash of their key.
+func (km *KeyManager) usageLock(usageKey string) *sync.Mutex {
+	h := uint32(2166136261) // FNV-1a
+	for i := 0; i < len(usageKey); i++ {
+		h ^= uint32(usageKey[i])
+		h *= 16777619
+	}
+	return &km.usageLocks[h%usageLockShards]
+}
+
+// appendEvents queues usage events for the usage store and for Redis. Safe to
+// call with km.mutex held for reading.
+func (km *KeyManager) appendEvents(event UsageEvent, shared bool) {
+	km.eventsMutex.Lock()
+	defer km.eventsMutex.Unlock()
+	if km.usageStore != nil {
+		km.pendingEvents = append(km.pendingEvents, event)
+	}
+	if shared && km.sharedState != nil {
+		event.Cost = 0 // Redis only counts tokens
+		km.sharedEvents = append(km.sharedEvents, event)
+	}
+}
@@ -0,0 +1,196 @@
+package keymanager
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UsageQuery selects persisted usage for GET /api/usage. Empty model or key
+// match everything.
+type UsageQuery struct {
+	Model       string
+	Key         string
+	From        time.Time
+	To          time.Time // Exclusive
+	Granularity string    // "minute", "hour" or "day"
+	PerKey      bool      // One bucket per model and key instead of summing them
+}
+
+type UsageBucket struct {
+	Start    string  `json:"start"`           // RFC 3339, in the configured timezone
+	Model    string  `json:"model,omitempty"` // Set with PerKey
+	Key      string  `json:"key,omitempty"`
+	Tokens   int     `json:"tokens"`
+	Requests int     `json:"requests"`
+	Cost     float64 `json:"cost"` // Estimated USD
+}
+
+// usageBuckets sums usage into buckets of the query's granularity.
+type usageBuckets struct {
+	query    UsageQuery
+	location *time.Location
+	buckets  map[usageBucketID]*UsageBucket
+}
+
+type usageBucketID struct {
+	start      int64
+	model, key string
+}
+
+func (b *usageBuckets) start(t time.Time) time.Time {
+	t = t.In(b.location)
+	switch b.query.Granularity {
+	case "minute":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, b.location)
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, b.location)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, b.location)
+}
+
+func (b *usageBuckets) add(t time.Time, model, key string, tokens, requests int, cost float64) {
+	if (b.query.Model != "" && model != b.query.Model) || (b.query.Key != "" && key != b.query.Key) {
+		return
+	}
+	start := b.start(t)
+	id := usageBucketID{start: start.Unix()}
+	if b.query.PerKey {
+		id.model, id.key = model, key
+	}
+	bucket := b.buckets[id]
+	if bucket == nil {
+		bucket = &UsageBucket{Start: start.Format(time.RFC3339), Model: id.model, Key: id.key}
+		b.buckets[id] = bucket
+	}
+	bucket.Tokens += tokens
+	bucket.Requests += requests
+	bucket.Cost += cost
+}
+
+// sorted returns the buckets oldest first, then by model and key.
+func (b *usageBuckets) sorted() []UsageBucket {
+	ids := make([]usageBucketID, 0, len(b.buckets))
+	for id := range b.buckets {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].start != ids[j].start {
+			return ids[i].start < ids[j].start
+		}
+		if ids[i].model != ids[j].model {
+			return ids[i].model < ids[j].model
+		}
+		return ids[i].key < ids[j].key
+	})
+	result := make([]UsageBucket, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, *b.buckets[id])
+	}
+	return result
+}
+
+// QueryUsage aggregates persisted usage. With a store that keeps events, like
+// SQLite (for event_retention_days), minute and hour buckets come from the
+// events, and with the SQLite store day buckets from the daily rollups.
+// Otherwise requests of the last 24 hours are kept in memory without their
+// cost, and day buckets come from the usage archives and the current day's
+// counters.
+func (km *KeyManager) QueryUsage(query UsageQuery) ([]UsageBucket, error) {
+	km.mutex.Lock()
+	buckets := &usageBuckets{query: query, location: km.nextReset.Location(), buckets: make(map[usageBucketID]*UsageBucket)}
+	store := km.usageStore
+	rollups, hasRollups := store.(usageRollupStore)
+	km.eventsMutex.Lock()
+	pending := append([]UsageEvent(nil), km.pendingEvents...)
+	km.eventsMutex.Unlock()
+	var samples []UsageEvent
+	if query.Granularity != "day" {
+		// Used unless the store keeps events
+		for _, usageMap := range []map[string]*LanguageModelUsage{km.usage, km.retiredUsage} {
+			for usageKey, usage := range usageMap {
+				model, key, _ := strings.Cut(usageKey, "_") // Model names have no underscores
+				for _, data := range usage.Past24HoursTokenUsage.points() {
+					samples = append(samples, UsageEvent{Timestamp: int64(data.Timestamp), Model: model, Key: key, Tokens: data.CostToken})
+				}
+			}
+		}
+	}
+	archivePaths := make(map[string]string)
+	var current *DailyUsageArchive
+	if !hasRollups && query.Granularity == "day" {
+		for day := buckets.start(query.From); km.usageFile != "" && day.Before(query.To); day = day.AddDate(0, 0, 1) {
+			date := day.Format("2006-01-02")
+			archivePaths[date] = km.usageArchivePath(date)
+		}
+		current = km.dailyUsageArchive()
+	}
+	km.mutex.Unlock()
+
+	// Timestamps are whole seconds, so the second To falls in counts when To isn't on a boundary
+	toUnix := query.To.Add(time.Second - 1).Unix()
+	inRange := func(ts int64) bool {
+		return ts >= query.From.Unix() && ts < toUnix
+	}
+
+	addEvents := func(events []UsageEvent) {
+		for _, event := range events {
+			if inRange(event.Timestamp) {
+				buckets.add(time.Unix(event.Timestamp, 0), event.Model, event.Key, event.Tokens, 1, event.Cost)
+			}
+		}
+	}
+	if hasRollups && query.Granularity == "day" {
+		rows, err := rollups.queryDaily(buckets.start(query.From).Format("2006-01-02"), query.To.In(buckets.location).Format("2006-01-02"))
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			day, err := time.ParseInLocation("2006-01-02", row.day, buckets.location)
+			if err == nil && day.Before(query.To) {
+				buckets.add(day, row.model, row.key, row.tokens, row.requests, row.cost)
+			}
+		}
+		addEvents(pending)
+		return buckets.sorted(), nil
+	}
+	if store != nil && query.Granularity != "day" {
+		events, err := store.QueryRange(query.From.Unix(), toUnix)
+		switch {
+		case err == nil:
+			addEvents(append(events, pending...))
+			return buckets.sorted(), nil
+		case !errors.Is(err, ErrUsageEventsNotKept):
+			return nil, err
+		}
+	}
+
+	if query.Granularity == "day" {
+		archives := []*DailyUsageArchive{current}
+		for date, path := range archivePaths {
+			var archive DailyUsageArchive
+			if date != current.Date && readJSONFile(path, &archive) == nil {
+				archives = append(archives, &archive)
+			}
+		}
+		for _, archive := range archives {
+			day, err := time.ParseInLocation("2006-01-02", archive.Date, buckets.location)
+			if err != nil || day.Before(buckets.start(query.From)) || !day.Before(query.To) {
+				continue
+			}
+			for key, models := range archive.Keys {
+				for model, usage := range models {
+					buckets.add(day, model, key, usage.Tokens, usage.Requests, usage.Cost)
+				}
+			}
+		}
+		return buckets.sorted(), nil
+	}
+	for _, sample := range samples {
+		if inRange(sample.Timestamp) {
+			buckets.add(time.Unix(sample.Timestamp, 0), sample.Model, sample.Key, sample.Tokens, 1, 0)
+		}
+	}
+	return buckets.sorted(), nil
+}
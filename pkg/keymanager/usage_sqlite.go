@@ -0,0 +1,395 @@
+package keymanager
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteUsageStore keeps usage as an append-only event table plus per-day
+// rollups, instead of a JSON file that grows with every request in the last 24h.
+type sqliteUsageStore struct {
+	db            *sql.DB
+	location      *time.Location // Days of the rollup table are in the configured timezone
+	retentionDays int
+	storeClock
+}
+
+const sqliteUsageSchema = `
+CREATE TABLE IF NOT EXISTS usage_events (
+	ts      INTEGER NOT NULL,
+	model   TEXT    NOT NULL,
+	api_key TEXT    NOT NULL,
+	tokens  INTEGER NOT NULL,
+	cost    REAL    NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS usage_events_ts ON usage_events (ts);
+CREATE TABLE IF NOT EXISTS usage_daily (
+	day      TEXT    NOT NULL,
+	model    TEXT    NOT NULL,
+	api_key  TEXT    NOT NULL,
+	tokens   INTEGER NOT NULL,
+	requests INTEGER NOT NULL,
+	cost     REAL    NOT NULL DEFAULT 0,
+	PRIMARY KEY (day, model, api_key)
+);
+CREATE TABLE IF NOT EXISTS usage_state (
+	usage_key         TEXT PRIMARY KEY,
+	retired           INTEGER NOT NULL,
+	total_tokens      INTEGER NOT NULL,
+	today_usage       INTEGER NOT NULL,
+	today_requests    INTEGER NOT NULL DEFAULT 0,
+	probably_exceeded INTEGER NOT NULL,
+	exceeded          INTEGER NOT NULL,
+	cooldown_until    INTEGER NOT NULL DEFAULT 0,
+	cooldown_level    INTEGER NOT NULL DEFAULT 0,
+	total_cost        REAL    NOT NULL DEFAULT 0,
+	today_cost        REAL    NOT NULL DEFAULT 0,
+	total_images      INTEGER NOT NULL DEFAULT 0,
+	today_images      INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS banned_keys (
+	api_key TEXT PRIMARY KEY
+);
+CREATE TABLE IF NOT EXISTS corpus_keys (
+	corpus  TEXT PRIMARY KEY,
+	api_key TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS file_keys (
+	file       TEXT PRIMARY KEY,
+	api_key    TEXT    NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS client_usage (
+	client_key TEXT PRIMARY KEY,
+	tokens     INTEGER NOT NULL
+);
+`
+
+var sqliteUsageColumns = []struct{ table, column string }{
+	{"usage_state", "today_requests INTEGER NOT NULL DEFAULT 0"},
+	{"usage_state", "cooldown_until INTEGER NOT NULL DEFAULT 0"},
+	{"usage_state", "cooldown_level INTEGER NOT NULL DEFAULT 0"},
+	{"usage_state", "total_cost REAL NOT NULL DEFAULT 0"},
+	{"usage_state", "today_cost REAL NOT NULL DEFAULT 0"},
+	{"usage_state", "total_images INTEGER NOT NULL DEFAULT 0"},
+	{"usage_state", "today_images INTEGER NOT NULL DEFAULT 0"},
+	{"usage_events", "cost REAL NOT NULL DEFAULT 0"},
+	{"usage_daily", "cost REAL NOT NULL DEFAULT 0"},
+}
+
+func openSQLiteUsageStore(config *UsageStoreConfig, location *time.Location) (*sqliteUsageStore, error) {
+	path := config.Path
+	if path == "" {
+		path = "key_usage.db"
+	}
+	retentionDays := config.EventRetentionDays
+	if retentionDays <= 0 {
+		retentionDays = 30
+	}
+
+	dsn := fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)", url.PathEscape(path))
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage database: %v", err)
+	}
+	db.SetMaxOpenConns(1) // SQLite allows a single writer
+	if _, err := db.Exec(sqliteUsageSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create usage database schema: %v", err)
+	}
+	// Columns added after the first release, missing in older databases
+	for _, column := range sqliteUsageColumns {
+		if _, err := db.Exec(`ALTER TABLE ` + column.table + ` ADD COLUMN ` + column.column); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate usage database schema: %v", err)
+		}
+	}
+	log.Printf("Usage is stored in SQLite database %s.", path)
+	return &sqliteUsageStore{db: db, location: location, retentionDays: retentionDays}, nil
+}
+
+// Load reads the saved state. found is false for a new, empty database.
+func (s *sqliteUsageStore) Load() (saved UsageSnapshot, found bool, err error) {
+	saved = UsageSnapshot{
+		Usage:                 make(map[string]*LanguageModelUsage),
+		PermanentlyBannedKeys: make(map[string]bool),
+		CorpusKeys:            make(map[string]string),
+		FileKeys:              make(map[string]FileKey),
+		RetiredUsage:          make(map[string]*LanguageModelUsage),
+		ClientUsage:           make(map[string]int),
+	}
+
+	rows, err := s.db.Query(`SELECT usage_key, retired, total_tokens, today_usage, today_requests, probably_exceeded, exceeded, cooldown_until, cooldown_level, total_cost, today_cost, total_images, today_images FROM usage_state`)
+	if err != nil {
+		return saved, false, err
+	}
+	for rows.Next() {
+		var usageKey string
+		var retired bool
+		usage := &LanguageModelUsage{}
+		if err := rows.Scan(&usageKey, &retired, &usage.TotalTokenUse, &usage.TodayUsage, &usage.TodayRequests, &usage.ProbablyExceeded, &usage.Exceeded, &usage.CooldownUntil, &usage.CooldownLevel, &usage.TotalCost, &usage.TodayCost, &usage.TotalImages, &usage.TodayImages); err != nil {
+			rows.Close()
+			return saved, false, err
+		}
+		if retired {
+			saved.RetiredUsage[usageKey] = usage
+		} else {
+			saved.Usage[usageKey] = usage
+		}
+		found = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return saved, false, err
+	}
+
+	// The last 24 hours of usage are rebuilt from the event log
+	rows, err = s.db.Query(`SELECT ts, model, api_key, tokens FROM usage_events WHERE ts >= ? ORDER BY ts`, s.now().Add(-24*time.Hour).Unix())
+	if err != nil {
+		return saved, false, err
+	}
+	for rows.Next() {
+		var event UsageEvent
+		if err := rows.Scan(&event.Timestamp, &event.Model, &event.Key, &event.Tokens); err != nil {
+			rows.Close()
+			return saved, false, err
+		}
+		if usage, ok := saved.Usage[event.Model+"_"+event.Key]; ok {
+			usage.Past24HoursTokenUsage.add(event.Timestamp, event.Tokens)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return saved, false, err
+	}
+
+	rows, err = s.db.Query(`SELECT api_key FROM banned_keys`)
+	if err != nil {
+		return saved, false, err
+	}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return saved, false, err
+		}
+		saved.PermanentlyBannedKeys[key] = true
+	}
+	rows.Close()
+
+	rows, err = s.db.Query(`SELECT corpus, api_key FROM corpus_keys`)
+	if err != nil {
+		return saved, false, err
+	}
+	for rows.Next() {
+		var corpus, key string
+		if err := rows.Scan(&corpus, &key); err != nil {
+			rows.Close()
+			return saved, false, err
+		}
+		saved.CorpusKeys[corpus] = key
+	}
+	rows.Close()
+
+	rows, err = s.db.Query(`SELECT file, api_key, expires_at FROM file_keys`)
+	if err != nil {
+		return saved, false, err
+	}
+	for rows.Next() {
+		var file string
+		var entry FileKey
+		if err := rows.Scan(&file, &entry.Key, &entry.ExpiresAt); err != nil {
+			rows.Close()
+			return saved, false, err
+		}
+		saved.FileKeys[file] = entry
+	}
+	rows.Close()
+
+	rows, err = s.db.Query(`SELECT client_key, tokens FROM client_usage`)
+	if err != nil {
+		return saved, false, err
+	}
+	for rows.Next() {
+		var clientKey string
+		var tokens int
+		if err := rows.Scan(&clientKey, &tokens); err != nil {
+			rows.Close()
+			return saved, false, err
+		}
+		saved.ClientUsage[clientKey] = tokens
+	}
+	rows.Close()
+
+	return saved, found, rows.Err()
+}
+
+// Snapshot reads the saved state, e.g. for a report while the proxy runs.
+func (s *sqliteUsageStore) Snapshot() (UsageSnapshot, error) {
+	saved, _, err := s.Load()
+	return saved, err
+}
+
+// SaveDelta appends the queued events, updates the daily rollups and replaces the
+// current counters, all in one transaction.
+func (s *sqliteUsageStore) SaveDelta(data UsageSnapshot, events []UsageEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	type rollupKey struct{ day, model, key string }
+	type rollup struct {
+		tokens, requests int
+		cost             float64
+	}
+	rollups := make(map[rollupKey]*rollup)
+	for _, event := range events {
+		if _, err := tx.Exec(`INSERT INTO usage_events (ts, model, api_key, tokens, cost) VALUES (?, ?, ?, ?, ?)`,
+			event.Timestamp, event.Model, event.Key, event.Tokens, event.Cost); err != nil {
+			return err
+		}
+		k := rollupKey{time.Unix(event.Timestamp, 0).In(s.location).Format("2006-01-02"), event.Model, event.Key}
+		if rollups[k] == nil {
+			rollups[k] = &rollup{}
+		}
+		rollups[k].tokens += event.Tokens
+		rollups[k].requests++
+		rollups[k].cost += event.Cost
+	}
+	for k, r := range rollups {
+		if _, err := tx.Exec(`INSERT INTO usage_daily (day, model, api_key, tokens, requests, cost) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (day, model, api_key) DO UPDATE SET tokens = tokens + excluded.tokens, requests = requests + excluded.requests, cost = cost + excluded.cost`,
+			k.day, k.model, k.key, r.tokens, r.requests, r.cost); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM usage_state`); err != nil {
+		return err
+	}
+	for retired, usageMap := range map[bool]map[string]*LanguageModelUsage{false: data.Usage, true: data.RetiredUsage} {
+		for usageKey, usage := range usageMap {
+			if _, err := tx.Exec(`INSERT INTO usage_state (usage_key, retired, total_tokens, today_usage, today_requests, probably_exceeded, exceeded, cooldown_until, cooldown_level, total_cost, today_cost, total_images, today_images) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				usageKey, retired, usage.TotalTokenUse, usage.TodayUsage, usage.TodayRequests, usage.ProbablyExceeded, usage.Exceeded, usage.CooldownUntil, usage.CooldownLevel, usage.TotalCost, usage.TodayCost, usage.TotalImages, usage.TodayImages); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM banned_keys`); err != nil {
+		return err
+	}
+	for key, banned := range data.PermanentlyBannedKeys {
+		if banned {
+			if _, err := tx.Exec(`INSERT INTO banned_keys (api_key) VALUES (?)`, key); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM corpus_keys`); err != nil {
+		return err
+	}
+	for corpus, key := range data.CorpusKeys {
+		if _, err := tx.Exec(`INSERT INTO corpus_keys (corpus, api_key) VALUES (?, ?)`, corpus, key); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM file_keys`); err != nil {
+		return err
+	}
+	for file, entry := range data.FileKeys {
+		if _, err := tx.Exec(`INSERT INTO file_keys (file, api_key, expires_at) VALUES (?, ?, ?)`, file, entry.Key, entry.ExpiresAt); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM client_usage`); err != nil {
+		return err
+	}
+	for clientKey, tokens := range data.ClientUsage {
+		if _, err := tx.Exec(`INSERT INTO client_usage (client_key, tokens) VALUES (?, ?)`, clientKey, tokens); err != nil {
+			return err
+		}
+	}
+
+	cutoff := s.now().AddDate(0, 0, -s.retentionDays).Unix()
+	if _, err := tx.Exec(`DELETE FROM usage_events WHERE ts < ?`, cutoff); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// importUsageEvents turns the last-24h usage points of key_usage.json into
+// events, so switching to SQLite doesn't forget today's recent usage.
+func importUsageEvents(config *Config, saved map[string]*LanguageModelUsage) []UsageEvent {
+	var events []UsageEvent
+	for modelName := range config.Models {
+		for _, keyInfo := range buildKeyInfos(config.PriorityKeys, config.SecondaryKeys) {
+			usage, ok := saved[modelName+"_"+keyInfo.Key]
+			if !ok {
+				continue
+			}
+			for _, point := range usage.Past24HoursTokenUsage.points() {
+				events = append(events, UsageEvent{Timestamp: int64(point.Timestamp), Model: modelName, Key: keyInfo.Key, Tokens: point.CostToken})
+			}
+		}
+	}
+	return events
+}
+
+func (s *sqliteUsageStore) Close() error {
+	return s.db.Close()
+}
+
+// QueryRange returns the events logged in [from, to), in Unix seconds.
+func (s *sqliteUsageStore) QueryRange(from, to int64) ([]UsageEvent, error) {
+	rows, err := s.db.Query(`SELECT ts, model, api_key, tokens, cost FROM usage_events WHERE ts >= ? AND ts < ? ORDER BY ts`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []UsageEvent
+	for rows.Next() {
+		var event UsageEvent
+		if err := rows.Scan(&event.Timestamp, &event.Model, &event.Key, &event.Tokens, &event.Cost); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+type usageDailyRow struct {
+	day, model, key  string
+	tokens, requests int
+	cost             float64
+}
+
+// queryDaily returns the daily rollups from fromDay to toDay inclusive (YYYY-MM-DD).
+func (s *sqliteUsageStore) queryDaily(fromDay, toDay string) ([]usageDailyRow, error) {
+	rows, err := s.db.Query(`SELECT day, model, api_key, tokens, requests, cost FROM usage_daily WHERE day >= ? AND day <= ? ORDER BY day`, fromDay, toDay)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []usageDailyRow
+	for rows.Next() {
+		var row usageDailyRow
+		if err := rows.Scan(&row.day, &row.model, &row.key, &row.tokens, &row.requests, &row.cost); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
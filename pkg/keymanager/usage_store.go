@@ -0,0 +1,188 @@
+package keymanager
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+)
+
+// UsageEvent is one recorded request, queued in memory until the next save.
+type UsageEvent struct {
+	Timestamp int64
+	Model     string
+	Key       string
+	Tokens    int
+	Cost      float64 // Estimated USD
+}
+
+// ErrUsageEventsNotKept is returned by QueryRange of stores that only keep the
+// counters, not every request.
+var ErrUsageEventsNotKept = errors.New("usage store doesn't keep usage events")
+
+// UsageStore persists the usage of a KeyManager. The JSON file (or gob file),
+// SQLite and in-memory stores implement it; NewWithStore takes any other.
+type UsageStore interface {
+	// Load reads the saved state at startup. found is false when nothing was
+	// saved yet.
+	Load() (saved UsageSnapshot, found bool, err error)
+	// SaveDelta saves the current state along with the requests recorded since
+	// the previous save. Stores that only keep the counters ignore events.
+	SaveDelta(data UsageSnapshot, events []UsageEvent) error
+	// QueryRange returns the requests saved in [from, to), in Unix seconds, or
+	// ErrUsageEventsNotKept.
+	QueryRange(from, to int64) ([]UsageEvent, error)
+	// Snapshot reads the saved state, e.g. for a report while the proxy runs.
+	Snapshot() (UsageSnapshot, error)
+	Close() error
+}
+
+// usageRollupStore is a UsageStore that also keeps per-day totals, which
+// QueryUsage uses for day buckets instead of the usage archives.
+type usageRollupStore interface {
+	UsageStore
+	queryDaily(fromDay, toDay string) ([]usageDailyRow, error)
+}
+
+// jsonUsageStore keeps usage in key_usage.json, or in the gob file with
+// usage_store.format gob, rewriting the whole file on every save.
+type jsonUsageStore struct {
+	path string
+}
+
+// NewJSONUsageStore returns the store of the usage file at path. A path ending
+// in .gob is written in the gob format.
+func NewJSONUsageStore(path string) UsageStore {
+	return &jsonUsageStore{path: path}
+}
+
+func (s *jsonUsageStore) Load() (UsageSnapshot, bool, error) {
+	var saved UsageSnapshot
+	err := readUsageWithBackup(s.path, &saved)
+	switch {
+	case os.IsNotExist(err):
+		return UsageSnapshot{}, false, nil
+	case err != nil:
+		log.Printf("Failed to read usage file and its backup, reinitializing: %v", err)
+		return UsageSnapshot{}, false, nil
+	}
+	return saved, true, nil
+}
+
+func (s *jsonUsageStore) SaveDelta(data UsageSnapshot, events []UsageEvent) error {
+	usageData, err := encodeUsageFile(s.path, data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, usageData, true)
+}
+
+func (s *jsonUsageStore) QueryRange(from, to int64) ([]UsageEvent, error) {
+	return nil, ErrUsageEventsNotKept
+}
+
+func (s *jsonUsageStore) Snapshot() (UsageSnapshot, error) {
+	var saved UsageSnapshot
+	err := readUsageWithBackup(s.path, &saved)
+	return saved, err
+}
+
+func (s *jsonUsageStore) Close() error {
+	return nil
+}
+
+// MemoryUsageStore keeps usage in memory only, e.g. for tests or a KeyManager
+// embedded in a short-lived program. The zero value is an empty store.
+type MemoryUsageStore struct {
+	mutex  sync.Mutex
+	saved  *UsageSnapshot
+	events []UsageEvent
+}
+
+// NewMemoryUsageStore returns an empty in-memory store.
+func NewMemoryUsageStore() *MemoryUsageStore {
+	return &MemoryUsageStore{}
+}
+
+func (s *MemoryUsageStore) Load() (UsageSnapshot, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.saved == nil {
+		return UsageSnapshot{}, false, nil
+	}
+	return s.saved.deepCopy(), true, nil
+}
+
+func (s *MemoryUsageStore) SaveDelta(data UsageSnapshot, events []UsageEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	saved := data.deepCopy()
+	s.saved = &saved
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func (s *MemoryUsageStore) QueryRange(from, to int64) ([]UsageEvent, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var events []UsageEvent
+	for _, event := range s.events {
+		if event.Timestamp >= from && event.Timestamp < to {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (s *MemoryUsageStore) Snapshot() (UsageSnapshot, error) {
+	saved, _, err := s.Load()
+	return saved, err
+}
+
+func (s *MemoryUsageStore) Close() error {
+	return nil
+}
+
+// deepCopy copies the snapshot, so a store's copy isn't changed by the
+// KeyManager that loaded it.
+func (d UsageSnapshot) deepCopy() UsageSnapshot {
+	copyUsage := func(usage map[string]*LanguageModelUsage) map[string]*LanguageModelUsage {
+		if usage == nil {
+			return nil
+		}
+		result := make(map[string]*LanguageModelUsage, len(usage))
+		for k, v := range usage {
+			result[k] = v.deepCopy()
+		}
+		return result
+	}
+	result := UsageSnapshot{
+		Usage:        copyUsage(d.Usage),
+		RetiredUsage: copyUsage(d.RetiredUsage),
+	}
+	if d.PermanentlyBannedKeys != nil {
+		result.PermanentlyBannedKeys = make(map[string]bool, len(d.PermanentlyBannedKeys))
+		for k, v := range d.PermanentlyBannedKeys {
+			result.PermanentlyBannedKeys[k] = v
+		}
+	}
+	if d.CorpusKeys != nil {
+		result.CorpusKeys = make(map[string]string, len(d.CorpusKeys))
+		for k, v := range d.CorpusKeys {
+			result.CorpusKeys[k] = v
+		}
+	}
+	if d.FileKeys != nil {
+		result.FileKeys = make(map[string]FileKey, len(d.FileKeys))
+		for k, v := range d.FileKeys {
+			result.FileKeys[k] = v
+		}
+	}
+	if d.ClientUsage != nil {
+		result.ClientUsage = make(map[string]int, len(d.ClientUsage))
+		for k, v := range d.ClientUsage {
+			result.ClientUsage[k] = v
+		}
+	}
+	return result
+}
@@ -0,0 +1,92 @@
+package keymanager
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func testUsageSnapshot() UsageSnapshot {
+	return UsageSnapshot{
+		Usage: map[string]*LanguageModelUsage{
+			"m_AIzaTestKey1": {TotalTokenUse: 1500, TodayUsage: 500, TodayRequests: 3, TodayCost: 0.25, Exceeded: true},
+		},
+		PermanentlyBannedKeys: map[string]bool{"AIzaBannedKey": true},
+		ClientUsage:           map[string]int{"client": 42},
+	}
+}
+
+func checkUsageSnapshot(t *testing.T, got UsageSnapshot) {
+	t.Helper()
+	usage := got.Usage["m_AIzaTestKey1"]
+	if usage == nil {
+		t.Fatalf("usage entry missing: %+v", got.Usage)
+	}
+	if usage.TotalTokenUse != 1500 || usage.TodayUsage != 500 || usage.TodayRequests != 3 || usage.TodayCost != 0.25 || !usage.Exceeded {
+		t.Errorf("usage entry %+v doesn't match what was saved", usage)
+	}
+	if !got.PermanentlyBannedKeys["AIzaBannedKey"] {
+		t.Errorf("banned keys %v, want AIzaBannedKey", got.PermanentlyBannedKeys)
+	}
+	if got.ClientUsage["client"] != 42 {
+		t.Errorf("client usage %v, want client: 42", got.ClientUsage)
+	}
+}
+
+func TestUsageStoreRoundTrip(t *testing.T) {
+	// Separate directories, the gob store falls back to a key_usage.json next to it
+	stores := map[string]UsageStore{
+		"memory": NewMemoryUsageStore(),
+		"json":   NewJSONUsageStore(filepath.Join(t.TempDir(), "key_usage.json")),
+		"gob":    NewJSONUsageStore(filepath.Join(t.TempDir(), "key_usage"+gobUsageSuffix)),
+	}
+	events := []UsageEvent{
+		{Timestamp: 100, Model: "m", Key: "AIzaTestKey1", Tokens: 1000, Cost: 0.2},
+		{Timestamp: 200, Model: "m", Key: "AIzaTestKey1", Tokens: 500, Cost: 0.05},
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			defer store.Close()
+			if _, found, err := store.Load(); err != nil || found {
+				t.Fatalf("empty store: found %v, err %v", found, err)
+			}
+
+			if err := store.SaveDelta(testUsageSnapshot(), events); err != nil {
+				t.Fatal(err)
+			}
+			saved, found, err := store.Load()
+			if err != nil || !found {
+				t.Fatalf("after saving: found %v, err %v", found, err)
+			}
+			checkUsageSnapshot(t, saved)
+			snapshot, err := store.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkUsageSnapshot(t, snapshot)
+
+			// The loaded state is the caller's, changing it doesn't change the store
+			saved.Usage["m_AIzaTestKey1"].TodayUsage = 0
+			if saved, _, _ = store.Load(); saved.Usage["m_AIzaTestKey1"].TodayUsage != 500 {
+				t.Error("changing the loaded usage changed the store")
+			}
+
+			kept, err := store.QueryRange(150, 300)
+			if name != "memory" {
+				if !errors.Is(err, ErrUsageEventsNotKept) {
+					t.Errorf("QueryRange: %v, want ErrUsageEventsNotKept", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(kept) != 1 || kept[0] != events[1] {
+				t.Errorf("QueryRange(150, 300) = %+v, want the event at 200", kept)
+			}
+			if kept, _ = store.QueryRange(0, 100); len(kept) != 0 {
+				t.Errorf("QueryRange(0, 100) = %+v, want none, the range excludes its end", kept)
+			}
+		})
+	}
+}
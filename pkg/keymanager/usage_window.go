@@ -0,0 +1,123 @@
+package keymanager
+
+import "encoding/json"
+
+// UsageWindow counts the tokens of a key and model over the last day in
+// per-minute buckets and over the last minute in per-second buckets. TPM and
+// TPD checks then cost the same however many requests were made, instead of
+// scanning one entry per request.
+//
+// Each ring only holds the minutes (seconds) up to the latest one counted;
+// buckets are cleared when the ring moves on, so reading never writes.
+type UsageWindow struct {
+	minutes    [usageWindowMinutes]int // Indexed by Unix minute mod usageWindowMinutes
+	seconds    [usageWindowSeconds]int // Indexed by Unix second mod usageWindowSeconds
+	lastMinute int64                   // Latest Unix minute counted
+	lastSecond int64
+}
+
+const (
+	usageWindowMinutes = 1440
+	usageWindowSeconds = 60
+)
+
+// add counts tokens used at Unix time ts. Usage older than the window is dropped.
+func (w *UsageWindow) add(ts int64, tokens int) {
+	advance(w.minutes[:], &w.lastMinute, ts/60)
+	if m := ts / 60; m > w.lastMinute-usageWindowMinutes {
+		w.minutes[m%usageWindowMinutes] += tokens
+	}
+	advance(w.seconds[:], &w.lastSecond, ts)
+	if ts > w.lastSecond-usageWindowSeconds {
+		w.seconds[ts%usageWindowSeconds] += tokens
+	}
+}
+
+// advance moves a ring on to slot now, clearing the slots it skips.
+func advance(ring []int, last *int64, now int64) {
+	if now <= *last {
+		return
+	}
+	if now-*last >= int64(len(ring)) {
+		clear(ring)
+	} else {
+		for slot := *last + 1; slot <= now; slot++ {
+			ring[slot%int64(len(ring))] = 0
+		}
+	}
+	*last = now
+}
+
+// minute returns the tokens counted in Unix minute m.
+func (w *UsageWindow) minute(m int64) int {
+	if m > w.lastMinute || m <= w.lastMinute-usageWindowMinutes || m < 0 {
+		return 0
+	}
+	return w.minutes[m%usageWindowMinutes]
+}
+
+// second returns the tokens counted in Unix second s.
+func (w *UsageWindow) second(s int64) int {
+	if s > w.lastSecond || s <= w.lastSecond-usageWindowSeconds || s < 0 {
+		return 0
+	}
+	return w.seconds[s%usageWindowSeconds]
+}
+
+// LastMinuteTokens returns the tokens used in the 60 seconds up to Unix time now.
+func (w *UsageWindow) LastMinuteTokens(now int64) int {
+	tokens := 0
+	for s := now - usageWindowSeconds + 1; s <= now; s++ {
+		tokens += w.second(s)
+	}
+	return tokens
+}
+
+// LastDayTokens returns the tokens used in the 24 hours up to Unix time now.
+func (w *UsageWindow) LastDayTokens(now int64) int {
+	tokens := 0
+	for m := now/60 - usageWindowMinutes + 1; m <= now/60; m++ {
+		tokens += w.minute(m)
+	}
+	return tokens
+}
+
+// points returns the usage in the window, oldest first: one point per second of
+// the last minute and one per minute before it.
+func (w *UsageWindow) points() []UsageData {
+	data := []UsageData{}
+	for m := w.lastMinute - usageWindowMinutes + 1; m <= w.lastMinute; m++ {
+		tokens := w.minute(m)
+		for s := m * 60; s < m*60+60; s++ {
+			tokens -= w.second(s) // Stored per second below
+		}
+		if tokens > 0 {
+			data = append(data, UsageData{Timestamp: int(m * 60), CostToken: tokens})
+		}
+	}
+	for s := w.lastSecond - usageWindowSeconds + 1; s <= w.lastSecond; s++ {
+		if tokens := w.second(s); tokens > 0 {
+			data = append(data, UsageData{Timestamp: int(s), CostToken: tokens})
+		}
+	}
+	return data
+}
+
+// MarshalJSON stores the window as the usage data list key_usage.json always had.
+func (w UsageWindow) MarshalJSON() ([]byte, error) {
+	return json.Marshal(w.points())
+}
+
+// UnmarshalJSON reads a usage data list, including the per-request lists of
+// older versions.
+func (w *UsageWindow) UnmarshalJSON(b []byte) error {
+	var data []UsageData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	*w = UsageWindow{}
+	for _, d := range data {
+		w.add(int64(d.Timestamp), d.CostToken)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package keymanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultKeyProvider reads keys from a HashiCorp Vault KV secret (v1 or v2). It
+// authenticates with a token or AppRole, renews its token lease before it
+// expires and logs in again when renewal is no longer possible. Renewal runs on
+// a timer of its own (renewLoop), so a key_refresh_interval longer than the
+// lease doesn't let the token expire.
+type vaultKeyProvider struct {
+	address   string
+	path      string
+	field     string
+	namespace string
+	auth      string // token or approle
+	roleID    string
+	secretID  string
+	client    *http.Client
+
+	mutex       sync.Mutex
+	token       string
+	renewAt     time.Time // Zero if the token does not expire
+	renewable   bool
+	lastVersion int
+}
+
+func newVaultKeyProvider(config KeyProviderConfig) (*vaultKeyProvider, error) {
+	p := &vaultKeyProvider{
+		address:   strings.TrimRight(config.Address, "/"),
+		path:      strings.Trim(config.Path, "/"),
+		field:     config.Field,
+		namespace: config.Namespace,
+		auth:      config.AuthMethod,
+		roleID:    config.RoleID,
+		secretID:  config.SecretID,
+		token:     config.Token,
+		client:    &http.Client{Timeout: 15 * time.Second},
+	}
+	if p.address == "" {
+		p.address = strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	}
+	if p.namespace == "" {
+		p.namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	if p.auth == "" {
+		p.auth = "token"
+	}
+	if p.address == "" || p.path == "" {
+		return nil, fmt.Errorf("vault key provider requires 'address' (or VAULT_ADDR) and 'path'")
+	}
+
+	switch p.auth {
+	case "token":
+		if p.token == "" {
+			p.token = os.Getenv("VAULT_TOKEN")
+		}
+		if p.token == "" {
+			return nil, fmt.Errorf("vault token auth requires 'token' or VAULT_TOKEN")
+		}
+		p.renewable = true // Until renewing it on the first fetch fails, e.g. for a root token
+	case "approle":
+		if p.roleID == "" {
+			p.roleID = os.Getenv("VAULT_ROLE_ID")
+		}
+		if p.secretID == "" {
+			p.secretID = os.Getenv("VAULT_SECRET_ID")
+		}
+		if p.roleID == "" || p.secretID == "" {
+			return nil, fmt.Errorf("vault approle auth requires 'role_id' and 'secret_id' (or VAULT_ROLE_ID/VAULT_SECRET_ID)")
+		}
+	default:
+		return nil, fmt.Errorf("unknown vault auth method '%s'", p.auth)
+	}
+	return p, nil
+}
+
+func (p *vaultKeyProvider) Name() string { return "vault:" + p.path }
+
+func (p *vaultKeyProvider) FetchKeys(ctx context.Context) ([]string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.ensureToken(ctx); err != nil {
+		return nil, err
+	}
+
+	var secret struct {
+		Data map[string]any `json:"data"`
+	}
+	status, err := p.do(ctx, "GET", "/v1/"+p.path, nil, &secret)
+	if status == http.StatusForbidden && p.auth == "approle" {
+		// The token was revoked or expired early, log in again once.
+		p.token = ""
+		if err = p.ensureToken(ctx); err == nil {
+			_, err = p.do(ctx, "GET", "/v1/"+p.path, nil, &secret)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret: %v", err)
+	}
+
+	// KV v2 nests the secret under data.data with a metadata block alongside it.
+	data := secret.Data
+	if inner, ok := data["data"].(map[string]any); ok {
+		if metadata, ok := data["metadata"].(map[string]any); ok {
+			if version, ok := metadata["version"].(float64); ok && int(version) != p.lastVersion {
+				if p.lastVersion != 0 {
+					log.Printf("Vault secret %s changed (version %d -> %d), rotating key pool.", p.path, p.lastVersion, int(version))
+				}
+				p.lastVersion = int(version)
+			}
+			data = inner
+		}
+	}
+
+	if p.field != "" {
+		switch value := data[p.field].(type) {
+		case string:
+			return parseKeyList(value), nil
+		case []any:
+			var keys []string
+			for _, item := range value {
+				if key, ok := item.(string); ok && key != "" {
+					keys = append(keys, key)
+				}
+			}
+			return keys, nil
+		default:
+			return nil, fmt.Errorf("field '%s' not found in secret %s", p.field, p.path)
+		}
+	}
+	encoded, _ := json.Marshal(data)
+	return parseKeyList(string(encoded)), nil
+}
+
+// ensureToken logs in or renews the token lease when needed. Must be called with p.mutex held.
+func (p *vaultKeyProvider) ensureToken(ctx context.Context) error {
+	if p.token == "" {
+		return p.login(ctx)
+	}
+	if p.renewable && (p.renewAt.IsZero() || time.Now().After(p.renewAt)) {
+		var result vaultAuthResponse
+		if _, err := p.do(ctx, "POST", "/v1/auth/token/renew-self", map[string]any{}, &result); err != nil {
+			if p.auth == "approle" {
+				log.Printf("Vault token renewal failed, logging in again: %v", err)
+				return p.login(ctx)
+			}
+			// Static tokens may be non-renewable (e.g. root tokens); keep using them.
+			log.Printf("Vault token renewal failed: %v", err)
+			p.renewable = false
+			return nil
+		}
+		p.applyAuth(result)
+	}
+	return nil
+}
+
+// renewLoop renews the token when half of its lease has passed, until stop is
+// closed. Tokens without a lease are looked at again every minute, since an
+// AppRole login can replace them.
+func (p *vaultKeyProvider) renewLoop(stop <-chan struct{}) {
+	retry := time.Duration(0)
+	for {
+		wait := time.Minute
+		p.mutex.Lock()
+		if p.renewable && !p.renewAt.IsZero() {
+			wait = max(time.Until(p.renewAt), retry)
+		}
+		p.mutex.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		p.mutex.Lock()
+		err := p.ensureToken(ctx)
+		p.mutex.Unlock()
+		cancel()
+		retry = 0
+		if err != nil {
+			log.Printf("Vault token renewal failed, retrying in 30s: %v", err)
+			retry = 30 * time.Second
+		}
+	}
+}
+
+type vaultAuthResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+func (p *vaultKeyProvider) login(ctx context.Context) error {
+	var result vaultAuthResponse
+	if _, err := p.do(ctx, "POST", "/v1/auth/approle/login", map[string]string{"role_id": p.roleID, "secret_id": p.secretID}, &result); err != nil {
+		return fmt.Errorf("vault approle login failed: %v", err)
+	}
+	p.applyAuth(result)
+	log.Printf("Logged in to Vault with AppRole, token lease %ds.", result.Auth.LeaseDuration)
+	return nil
+}
+
+func (p *vaultKeyProvider) applyAuth(result vaultAuthResponse) {
+	if result.Auth.ClientToken != "" {
+		p.token = result.Auth.ClientToken
+	}
+	p.renewable = result.Auth.Renewable
+	p.renewAt = time.Time{}
+	if result.Auth.LeaseDuration > 0 {
+		// Renew once half of the lease has passed
+		p.renewAt = time.Now().Add(time.Duration(result.Auth.LeaseDuration) * time.Second / 2)
+	} else {
+		p.renewable = false
+	}
+}
+
+func (p *vaultKeyProvider) do(ctx context.Context, method, path string, body any, out any) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, _ := json.Marshal(body)
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.address+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	if p.token != "" && path != "/v1/auth/approle/login" {
+		req.Header.Set("X-Vault-Token", p.token)
+	}
+	if p.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.namespace)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("vault returned %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return resp.StatusCode, json.Unmarshal(respBody, out)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// Requests are interactive unless they come with "X-Priority: low" (or
+// "batch"), or from a client key with priority "low". Low-priority requests
+// only use keys with TPM headroom left, leaving the rest of each key's limit to
+// interactive ones, and wait for headroom instead of failing right away. While
+// interactive requests are queued for a key, low-priority ones don't take one.
+
+const priorityHeader = "X-Priority"
+
+func parsePriority(value string) keymanager.Priority {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "low", "batch":
+		return keymanager.PriorityLow
+	}
+	return keymanager.PriorityNormal
+}
+
+// requestPriorityClass puts the priority of a request, from its X-Priority header
+// or its client key, into the request context, where WaitForKey picks it up.
+func requestPriorityClass(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value := c.GetHeader(priorityHeader)
+		if value == "" {
+			if ck, _, ok := km.ClientKey(c.GetString("client_key")); ok {
+				value = ck.Priority
+			}
+		}
+		if priority := parsePriority(value); priority != keymanager.PriorityNormal {
+			c.Request = c.Request.WithContext(keymanager.WithPriority(c.Request.Context(), priority))
+		}
+		c.Next()
+	}
+}
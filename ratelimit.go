@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// parseRateLimitError classifies a 429 response from its body and headers.
+func parseRateLimitError(header http.Header, body []byte) keymanager.RateLimitInfo {
+	var info keymanager.RateLimitInfo
+	var parsed struct {
+		Error struct {
+			Message string `json:"message"`
+			Details []struct {
+				Type       string `json:"@type"`
+				RetryDelay string `json:"retryDelay"`
+				Violations []struct {
+					QuotaMetric string `json:"quotaMetric"`
+					QuotaID     string `json:"quotaId"`
+				} `json:"violations"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &parsed) == nil {
+		for _, detail := range parsed.Error.Details {
+			switch {
+			case strings.HasSuffix(detail.Type, "google.rpc.RetryInfo"):
+				if delay, err := time.ParseDuration(detail.RetryDelay); err == nil && delay > 0 {
+					info.RetryAfter = delay
+				}
+			case strings.HasSuffix(detail.Type, "google.rpc.QuotaFailure"):
+				for _, violation := range detail.Violations {
+					id := violation.QuotaID + " " + violation.QuotaMetric
+					switch {
+					case strings.Contains(id, "PerDay"):
+						info.Scope = keymanager.RateLimitPerDay // A daily violation outweighs a per-minute one
+						info.QuotaID = violation.QuotaID
+					case strings.Contains(id, "PerMinute") && info.Scope == keymanager.RateLimitUnknown:
+						info.Scope = keymanager.RateLimitPerMinute
+						info.QuotaID = violation.QuotaID
+					}
+				}
+			}
+		}
+		if info.Scope == keymanager.RateLimitUnknown && strings.Contains(strings.ToLower(parsed.Error.Message), "per day") {
+			info.Scope = keymanager.RateLimitPerDay
+		}
+	}
+
+	if info.RetryAfter == 0 {
+		if value := header.Get("Retry-After"); value != "" {
+			if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+				info.RetryAfter = time.Duration(seconds) * time.Second
+			} else if t, err := http.ParseTime(value); err == nil && time.Until(t) > 0 {
+				info.RetryAfter = time.Until(t)
+			}
+		}
+	}
+	return info
+}
+
+// setRetryAfter sets the Retry-After header, in whole seconds rounded up, when
+// the error says when a key will be available.
+func setRetryAfter(c *gin.Context, err error) {
+	var noKey *keymanager.NoKeyError
+	if errors.As(err, &noKey) && noKey.RetryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int((noKey.RetryAfter+time.Second-1)/time.Second)))
+	}
+}
+
+// The no-key 429 in each API's error format
+func geminiNoKeyError(c *gin.Context, message string, err error) {
+	setRetryAfter(c, err)
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": gin.H{"code": http.StatusTooManyRequests, "message": fmt.Sprintf("%s: %v", message, err), "status": "RESOURCE_EXHAUSTED"}})
+}
+
+func openAINoKeyError(c *gin.Context, message string, err error) {
+	setRetryAfter(c, err)
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": gin.H{"message": fmt.Sprintf("%s: %v", message, err), "type": "rate_limit_error", "code": "rate_limit_exceeded"}})
+}
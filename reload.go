@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+func reloadHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := km.ReloadConfig(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Config reload failed, keeping previous config: %v", err)})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "reloaded"})
+	}
+}
+
+func healthzHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// readyzHandler reports 503 while a config reload is pending or applied, so a
+// Kubernetes readiness probe takes the instance out of rotation meanwhile.
+func readyzHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !km.Ready() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "reloading"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ready"})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// withRequestOverrides applies what the config enforces on the Gemini
+// generation requests for model, whichever API format they came in: the
+// system prompts, the safety settings, the default generationConfig, the
+// output token cap and the thinking config.
+func withRequestOverrides(c *gin.Context, km *keymanager.KeyManager, model string, body []byte) ([]byte, error) {
+	var err error
+	if prompt := km.SystemPrompt(c.GetString("client_key"), model); prompt != "" {
+		if body, err = withSystemPrompt(body, prompt); err != nil {
+			return nil, err
+		}
+	}
+	if settings := km.SafetySettings(model); len(settings) > 0 {
+		if body, err = withSafetySettings(body, settings); err != nil {
+			return nil, err
+		}
+	}
+	if defaults := km.DefaultGenerationConfig(model); len(defaults) > 0 {
+		if body, err = withDefaultGenerationConfig(body, defaults); err != nil {
+			return nil, err
+		}
+	}
+	if limit := km.MaxOutputTokens(model); limit > 0 {
+		if body, err = withMaxOutputTokens(body, limit); err != nil {
+			return nil, err
+		}
+	}
+	if thinking := km.ThinkingConfig(model); thinking != nil {
+		if body, err = withThinkingConfig(body, thinking); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// withOpenAIRequestOverrides is withRequestOverrides for OpenAI chat completions
+// bodies, which go to Gemini's OpenAI-compatible endpoint as they are. Safety
+// settings have no counterpart there.
+func withOpenAIRequestOverrides(c *gin.Context, km *keymanager.KeyManager, model string, body []byte) ([]byte, error) {
+	var err error
+	if prompt := km.SystemPrompt(c.GetString("client_key"), model); prompt != "" {
+		if body, err = withOpenAISystemPrompt(body, prompt); err != nil {
+			return nil, err
+		}
+	}
+	if defaults := km.DefaultGenerationConfig(model); len(defaults) > 0 {
+		if body, err = withOpenAIDefaultGenerationConfig(body, defaults); err != nil {
+			return nil, err
+		}
+	}
+	if limit := km.MaxOutputTokens(model); limit > 0 {
+		if body, err = withOpenAIMaxOutputTokens(body, limit); err != nil {
+			return nil, err
+		}
+	}
+	if thinking := km.ThinkingConfig(model); thinking != nil {
+		if body, err = withOpenAIThinkingConfig(body, thinking); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
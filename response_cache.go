@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// Set on the context when a response came from the cache; recordUsage skips it
+const responseCacheHitKey = "response_cache_hit"
+
+const responseCacheHeader = "X-Cache"
+
+// cacheResponseBody stores a successful response in the cache once it has been
+// read in full, so the caller can stream it as usual.
+func cacheResponseBody(c *gin.Context, km *keymanager.KeyManager, model, action string, body []byte, resp *http.Response) {
+	if _, ok := km.ResponseCacheConfig(); !ok {
+		return
+	}
+	client := c.GetString("client_key")
+	resp.Body = &cachingBody{ReadCloser: resp.Body, store: func(response []byte) {
+		km.StoreResponseBody(client, model, action, body, response)
+	}}
+}
+
+type cachingBody struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	store func([]byte)
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF && b.store != nil {
+		b.store(b.buf.Bytes())
+		b.store = nil
+	}
+	return n, err
+}
+
+// serveCachedResponse answers a request from the cache, if it has the response.
+func serveCachedResponse(c *gin.Context, km *keymanager.KeyManager, model, action string, body []byte) bool {
+	response, ok := km.CachedResponseBody(c.GetString("client_key"), model, action, body)
+	if !ok {
+		return false
+	}
+	c.Set(responseCacheHitKey, true)
+	c.Set("history_model", model)
+	c.Header(responseCacheHeader, "HIT")
+	c.Data(http.StatusOK, "application/json; charset=UTF-8", response)
+	return true
+}
+
+// cacheHitResponse stands in for the upstream response of a cached request.
+func cacheHitResponse(c *gin.Context, model string, response []byte) *http.Response {
+	c.Set(responseCacheHitKey, true)
+	c.Set("history_model", model)
+	c.Header(responseCacheHeader, "HIT")
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json; charset=UTF-8"}},
+		Body:       io.NopCloser(bytes.NewReader(response)),
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// Semantic retriever resources (corpora, documents, chunks) live in the Google
+// Cloud project of the key that created them and can't be reached with keys from
+// other projects. The proxy remembers which key owns each corpus and always uses
+// that key for the corpus and for generateAnswer calls that retrieve from it.
+
+// corpusName extracts the "corpora/{id}" prefix from a resource name such as
+// "corpora/abc/documents/def" or "corpora/abc:query".
+func corpusName(resource string) string {
+	rest, ok := strings.CutPrefix(strings.TrimPrefix(resource, "/"), "corpora/")
+	if !ok {
+		return ""
+	}
+	if i := strings.IndexAny(rest, "/:"); i >= 0 {
+		rest = rest[:i]
+	}
+	if rest == "" {
+		return ""
+	}
+	return "corpora/" + rest
+}
+
+// retrievalAffinityKey returns the key owning the corpus a generateAnswer
+// request retrieves from, or "" when the request uses inline passages.
+func retrievalAffinityKey(c *gin.Context, km *keymanager.KeyManager, target *url.URL) (string, int, error) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return "", http.StatusInternalServerError, fmt.Errorf("failed to read request body")
+	}
+	c.Request.Body = io.NopCloser(bytes.NewBuffer(body)) // Restore body
+
+	var req struct {
+		SemanticRetriever *struct {
+			Source string `json:"source"`
+		} `json:"semanticRetriever"`
+	}
+	if json.Unmarshal(body, &req) != nil || req.SemanticRetriever == nil {
+		return "", 0, nil
+	}
+	corpus := corpusName(req.SemanticRetriever.Source)
+	if corpus == "" {
+		return "", 0, nil
+	}
+	return km.ResolveCorpusKey(target, corpus)
+}
+
+// retrievalProxyHandler proxies /v1beta/corpora and everything below it.
+func retrievalProxyHandler(km *keymanager.KeyManager, target *url.URL) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := km.UpstreamClient()
+		subPath := c.Param("path")
+		corpus := corpusName("corpora" + subPath)
+
+		// Listing spans every key's project
+		if corpus == "" && c.Request.Method == http.MethodGet {
+			corpora := km.DiscoverCorpora(target)
+			if corpora == nil {
+				corpora = []json.RawMessage{}
+			}
+			c.JSON(http.StatusOK, gin.H{"corpora": corpora})
+			return
+		}
+
+		var apiKey string
+		var err error
+		if corpus == "" {
+			if c.Request.Method != http.MethodPost {
+				c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Only GET and POST are supported on /v1beta/corpora"})
+				return
+			}
+			apiKey, err = km.KeyForNewCorpus()
+			if err != nil {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("Failed to get API key: %v", err)})
+				return
+			}
+		} else {
+			var status int
+			apiKey, status, err = km.ResolveCorpusKey(target, corpus)
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read request body"})
+			return
+		}
+
+		upstreamURL := km.UpstreamURLFor(c.Request.Context(), target, apiKey, c.Request.URL.Path)
+		upstreamURL.RawQuery = c.Request.URL.RawQuery
+
+		proxyReq, err := http.NewRequest(c.Request.Method, upstreamURL.String(), bytes.NewReader(body))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create proxy request"})
+			return
+		}
+		proxyReq.Header = km.ForwardHeaders(c.Request.Header)
+
+		resp, err := sendUpstream(c, km, client, proxyReq, "", apiKey)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send request to upstream server"})
+			return
+		}
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to read upstream response"})
+			return
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			switch {
+			case corpus == "":
+				var created struct {
+					Name string `json:"name"`
+				}
+				if json.Unmarshal(respBody, &created) == nil && created.Name != "" {
+					km.SetCorpusKey(created.Name, apiKey)
+					log.Printf("Corpus %s created with key %s.", created.Name, keymanager.MaskKey(apiKey))
+				}
+			case c.Request.Method == http.MethodDelete && "corpora"+subPath == corpus:
+				km.DeleteCorpusKey(corpus)
+			}
+		} else {
+			log.Printf("Retrieval proxy: upstream server returned error: %d %s", resp.StatusCode, string(respBody))
+		}
+
+		for k, v := range resp.Header {
+			c.Writer.Header()[k] = v
+		}
+		c.Writer.WriteHeader(resp.StatusCode)
+		c.Writer.Write(respBody)
+	}
+}
+
+func corpusKeysHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"corpora": km.CorpusKeys()})
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// routeRequests puts what routing_rules match on, the request's path, headers
+// and client key name, into the request context, where WaitForKey matches them
+// along with the requested model before it picks a key.
+func routeRequests(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(km.Config().RoutingRules) == 0 {
+			c.Next()
+			return
+		}
+		request := keymanager.RouteRequest{Path: c.Request.URL.Path, Header: c.Request.Header}
+		if ck, _, ok := km.ClientKey(c.GetString("client_key")); ok {
+			request.ClientKey = ck.Name
+		}
+		c.Request = c.Request.WithContext(keymanager.WithRouteRequest(c.Request.Context(), request))
+		c.Next()
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+)
+
+// withSafetySettings sets the thresholds of a Gemini request body for the
+// configured categories, keeping the client's settings for the others.
+func withSafetySettings(body []byte, settings []keymanager.GeminiSafetySetting) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	name := "safetySettings"
+	if _, ok := fields["safety_settings"]; ok {
+		name = "safety_settings"
+	}
+	var sent []keymanager.GeminiSafetySetting
+	if raw, ok := fields[name]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &sent); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, setting := range settings {
+		replaced := false
+		for i := range sent {
+			if sent[i].Category == setting.Category {
+				sent[i].Threshold = setting.Threshold
+				replaced = true
+			}
+		}
+		if !replaced {
+			sent = append(sent, setting)
+		}
+	}
+	encoded, err := json.Marshal(sent)
+	if err != nil {
+		return nil, err
+	}
+	fields[name] = encoded
+	return json.Marshal(fields)
+}
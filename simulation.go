@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+func simulatedResponse(statusCode int) *http.Response {
+	status := "UNKNOWN"
+	switch statusCode {
+	case http.StatusTooManyRequests:
+		status = "RESOURCE_EXHAUSTED"
+	case http.StatusServiceUnavailable:
+		status = "UNAVAILABLE"
+	case http.StatusInternalServerError:
+		status = "INTERNAL"
+	}
+	body := fmt.Sprintf(`{"error":{"code":%d,"message":"Simulated upstream error injected by GeminiLooper","status":"%s"}}`, statusCode, status)
+	return &http.Response{
+		StatusCode:    statusCode,
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		Header:        http.Header{"Content-Type": []string{"application/json; charset=UTF-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+// sendUpstream sends the request to the upstream server unless an error simulation
+// matches the model/key pair, in which case a synthetic error response is returned.
+func sendUpstream(c *gin.Context, km *keymanager.KeyManager, client *http.Client, req *http.Request, modelName, apiKey string) (*http.Response, error) {
+	return sendUpstreamContext(c.Request.Context(), c, km, client, req, modelName, apiKey)
+}
+
+// sendUpstreamContext is sendUpstream with a context of its own, for requests
+// that can be cancelled before the client's, like the loser of a hedged request.
+func sendUpstreamContext(ctx context.Context, c *gin.Context, km *keymanager.KeyManager, client *http.Client, req *http.Request, modelName, apiKey string) (*http.Response, error) {
+	c.Set("history_model", modelName)
+	c.Set("history_key", apiKey)
+	keymanager.SetUpstreamKey(req, apiKey)
+	if statusCode := km.Simulator().Take(modelName, apiKey); statusCode != 0 {
+		log.Printf("Simulating upstream %d for model %s with key %s", statusCode, modelName, keymanager.MaskKey(apiKey))
+		km.RecordUpstreamResult(modelName, apiKey, statusCode, nil)
+		return simulatedResponse(statusCode), nil
+	}
+	release, err := km.AcquireModelSlot(ctx, modelName)
+	if err != nil {
+		return nil, err
+	}
+	// Cancelled with the client's request, or when the request timeout is up
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		release()
+		if ctx.Err() == nil { // Not the key's fault when the client left or ran out of time
+			km.RecordUpstreamResult(modelName, apiKey, 0, nil)
+		}
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	var errorBody []byte
+	if resp.StatusCode == http.StatusBadRequest { // The error reason tells an invalid key from a bad request
+		errorBody, _ = io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body = &peekedBody{Reader: io.MultiReader(bytes.NewReader(errorBody), resp.Body), Closer: resp.Body}
+	}
+	km.RecordUpstreamResult(modelName, apiKey, resp.StatusCode, errorBody)
+	km.Simulator().InjectFaults(resp)
+	return resp, nil
+}
+
+// peekedBody is a response body whose start was already read.
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+func simulateErrorHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req keymanager.ErrorSimulation
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+		// A simulated 403 would permanently disable real keys
+		if req.StatusCode != http.StatusTooManyRequests && (req.StatusCode < 500 || req.StatusCode > 599) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status_code must be 429 or a 5xx code"})
+			return
+		}
+		if req.Remaining <= 0 && req.Percentage <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Either remaining or percentage must be set"})
+			return
+		}
+		if req.Percentage > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "percentage must be between 0 and 100"})
+			return
+		}
+
+		km.Simulator().Add(&req)
+		log.Printf("Error simulation added: status %d, model '%s', remaining %d, percentage %.1f", req.StatusCode, req.ModelName, req.Remaining, req.Percentage)
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "simulations": km.Simulator().List()})
+	}
+}
+
+func listSimulationsHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"simulations": km.Simulator().List()})
+	}
+}
+
+func getFaultInjectionHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, km.Simulator().Faults())
+	}
+}
+
+func setFaultInjectionHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Validated to require admin_auth, so only admins can corrupt responses
+		if !km.Config().TestMode {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Fault injection can only be changed with test_mode on"})
+			return
+		}
+		var req keymanager.FaultInjectionConfig
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+		for _, p := range []float64{req.LatencyPercentage, req.TruncatePercentage, req.MalformedPercentage} {
+			if p < 0 || p > 100 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Percentages must be between 0 and 100"})
+				return
+			}
+		}
+
+		km.Simulator().SetFaults(req)
+		log.Printf("Fault injection updated: enabled=%v latency=%dms truncate=%.1f%% malformed=%.1f%%", req.Enabled, req.LatencyMs, req.TruncatePercentage, req.MalformedPercentage)
+		c.JSON(http.StatusOK, req)
+	}
+}
+
+func clearSimulationsHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		km.Simulator().Clear()
+		log.Println("All error simulations cleared.")
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
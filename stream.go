@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+)
+
+// Incremental decoding of upstream response bodies. Gemini and its OpenAI
+// endpoint answer either with a single JSON object, a JSON array of chunks
+// (streamGenerateContent without alt=sse) or server-sent events. The decoders
+// here work on the bytes as they are forwarded, so nothing is buffered beyond
+// the chunk currently being parsed.
+
+// flushWriter is the part of gin.ResponseWriter used for streaming.
+type flushWriter interface {
+	io.Writer
+	http.Flusher
+}
+
+// copyFlushing forwards a response body chunk by chunk, flushing after every
+// read so streamed tokens reach the client as soon as upstream sends them.
+func copyFlushing(dst flushWriter, src io.Reader) (int64, error) {
+	bufp := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(bufp)
+	buf := *bufp
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			w, writeErr := dst.Write(buf[:n])
+			written += int64(w)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			dst.Flush()
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// sseEvent is one dispatched server-sent event.
+type sseEvent struct {
+	Event string
+	Data  []byte // data: lines joined with "\n"
+	ID    string
+}
+
+// sseDecoder implements the field parsing rules of the SSE spec for one line
+// at a time and reports when a blank line dispatches an event.
+type sseDecoder struct {
+	event   sseEvent
+	data    []byte
+	hasData bool
+}
+
+func (d *sseDecoder) line(line []byte) (sseEvent, bool) {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(line) == 0 {
+		return d.dispatch()
+	}
+	if line[0] == ':' { // Comment
+		return sseEvent{}, false
+	}
+
+	field, value, _ := bytes.Cut(line, []byte(":"))
+	value = bytes.TrimPrefix(value, []byte(" "))
+	switch string(field) {
+	case "data":
+		if d.hasData {
+			d.data = append(d.data, '\n')
+		}
+		d.data = append(d.data, value...)
+		d.hasData = true
+	case "event":
+		d.event.Event = string(value)
+	case "id":
+		d.event.ID = string(value)
+	}
+	return sseEvent{}, false
+}
+
+func (d *sseDecoder) dispatch() (sseEvent, bool) {
+	if !d.hasData {
+		d.event = sseEvent{}
+		return sseEvent{}, false
+	}
+	event := d.event
+	event.Data = d.data
+	d.event = sseEvent{}
+	d.data = nil
+	d.hasData = false
+	return event, true
+}
+
+// sseReader pulls events from a stream, for handlers that translate them.
+type sseReader struct {
+	reader  *bufio.Reader
+	decoder sseDecoder
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	return &sseReader{reader: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Next returns the next event, or io.EOF once the stream is exhausted. An
+// event not terminated by a blank line before EOF is still returned.
+func (r *sseReader) Next() (sseEvent, error) {
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if event, ok := r.decoder.line(bytes.TrimSuffix(line, []byte("\n"))); ok {
+				return event, nil
+			}
+		}
+		if err != nil {
+			if event, ok := r.decoder.dispatch(); ok {
+				return event, nil
+			}
+			return sseEvent{}, err
+		}
+	}
+}
+
+// sseParser is the push counterpart of sseReader: bytes written to it are
+// split into events as they arrive.
+type sseParser struct {
+	decoder sseDecoder
+	partial []byte
+	onEvent func(sseEvent)
+}
+
+func (p *sseParser) Write(b []byte) (int, error) {
+	data := b
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			p.partial = append(p.partial, data...)
+			break
+		}
+		line := data[:i]
+		if len(p.partial) > 0 {
+			line = append(p.partial, line...)
+			p.partial = p.partial[:0]
+		}
+		if event, ok := p.decoder.line(line); ok {
+			p.onEvent(event)
+		}
+		data = data[i+1:]
+	}
+	return len(b), nil
+}
+
+func (p *sseParser) Close() error {
+	if len(p.partial) > 0 {
+		if event, ok := p.decoder.line(p.partial); ok {
+			p.onEvent(event)
+		}
+		p.partial = nil
+	}
+	if event, ok := p.decoder.dispatch(); ok {
+		p.onEvent(event)
+	}
+	return nil
+}
+
+// newSSEFilter returns a parser that re-emits each event to w, except those for
+// which drop returns true, flushing after every event.
+func newSSEFilter(w flushWriter, drop func(sseEvent) bool) *sseParser {
+	return &sseParser{onEvent: func(event sseEvent) {
+		if drop(event) {
+			return
+		}
+		if event.Event != "" {
+			fmt.Fprintf(w, "event: %s\n", event.Event)
+		}
+		for _, line := range bytes.Split(event.Data, []byte("\n")) {
+			fmt.Fprintf(w, "data: %s\n", line)
+		}
+		io.WriteString(w, "\n")
+		w.Flush()
+	}}
+}
+
+// jsonObjectSplitter emits each complete top-level JSON object, or each object
+// element of a top-level array, as soon as its closing brace is written.
+type jsonObjectSplitter struct {
+	depth    int
+	arrayTop bool // The stream is a JSON array of objects
+	inString bool
+	escaped  bool
+	current  []byte
+	onObject func([]byte)
+}
+
+var errMalformedJSONStream = errors.New("malformed JSON stream")
+
+func (s *jsonObjectSplitter) Write(b []byte) (int, error) {
+	for _, ch := range b {
+		objectDepth := 0
+		if s.arrayTop {
+			objectDepth = 1
+		}
+		collecting := s.depth > objectDepth || (s.depth == objectDepth && ch == '{')
+		if collecting {
+			s.current = append(s.current, ch)
+		}
+
+		if s.inString {
+			switch {
+			case s.escaped:
+				s.escaped = false
+			case ch == '\\':
+				s.escaped = true
+			case ch == '"':
+				s.inString = false
+			}
+			continue
+		}
+
+		switch ch {
+		case '"':
+			s.inString = true
+		case '[':
+			if s.depth == 0 {
+				s.arrayTop = true
+			}
+			s.depth++
+		case '{':
+			s.depth++
+		case '}', ']':
+			s.depth--
+			if s.depth < 0 {
+				return 0, errMalformedJSONStream
+			}
+			if ch == '}' && s.depth == objectDepth {
+				s.onObject(s.current)
+				s.current = s.current[:0]
+			}
+		}
+	}
+	return len(b), nil
+}
+
+// usageSniffer watches a response body as it is forwarded to the client and
+// keeps the usage of the last chunk that reported it. Streaming chunks carry
+// cumulative usage, so the last one is the total for the request.
+type usageSniffer struct {
+	extract func(data []byte) (keymanager.GeminiUsageMetadata, bool)
+	sink    io.WriteCloser
+	usage   keymanager.GeminiUsageMetadata
+	found   bool
+	failed  bool
+}
+
+func newUsageSniffer(extract func(data []byte) (keymanager.GeminiUsageMetadata, bool)) *usageSniffer {
+	return &usageSniffer{extract: extract}
+}
+
+func (u *usageSniffer) chunk(data []byte) {
+	if usage, ok := u.extract(data); ok {
+		u.usage = usage
+		u.found = true
+	}
+}
+
+func (u *usageSniffer) Write(b []byte) (int, error) {
+	if u.failed {
+		return len(b), nil
+	}
+	if u.sink == nil {
+		// Pick the format from the first significant byte
+		trimmed := bytes.TrimLeft(b, " \t\r\n")
+		if len(trimmed) == 0 {
+			return len(b), nil
+		}
+		if trimmed[0] == '{' || trimmed[0] == '[' {
+			u.sink = nopCloser{&jsonObjectSplitter{onObject: u.chunk}}
+		} else {
+			u.sink = &sseParser{onEvent: func(event sseEvent) { u.chunk(event.Data) }}
+		}
+	}
+	if _, err := u.sink.Write(b); err != nil {
+		u.failed = true // Still forward the body, just stop looking for usage
+	}
+	// Never fail the tee, the client must get the full response
+	return len(b), nil
+}
+
+// Total flushes any trailing event and returns the last reported usage.
+func (u *usageSniffer) Total() (keymanager.GeminiUsageMetadata, bool) {
+	if u.sink != nil && !u.failed {
+		u.sink.Close()
+	}
+	return u.usage, u.found
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// geminiUsageTokens reads usageMetadata from a Gemini response chunk.
+func geminiUsageTokens(data []byte) (keymanager.GeminiUsageMetadata, bool) {
+	var chunk struct {
+		UsageMetadata *keymanager.GeminiUsageMetadata `json:"usageMetadata"`
+	}
+	if json.Unmarshal(data, &chunk) != nil || chunk.UsageMetadata == nil {
+		return keymanager.GeminiUsageMetadata{}, false
+	}
+	return *chunk.UsageMetadata, true
+}
+
+// openAIUsageOnlyChunk reports whether a streamed chat completion chunk only
+// carries usage, which is what stream_options.include_usage adds at the end.
+func openAIUsageOnlyChunk(event sseEvent) bool {
+	var chunk struct {
+		Choices []json.RawMessage `json:"choices"`
+		Usage   json.RawMessage   `json:"usage"`
+	}
+	if json.Unmarshal(event.Data, &chunk) != nil {
+		return false
+	}
+	return len(chunk.Choices) == 0 && len(chunk.Usage) > 0 && string(chunk.Usage) != "null"
+}
+
+// openAIUsageTokens reads usage from an OpenAI-format response chunk.
+func openAIUsageTokens(data []byte) (keymanager.GeminiUsageMetadata, bool) {
+	var chunk struct {
+		Usage *OpenAIUsage `json:"usage"`
+	}
+	if json.Unmarshal(data, &chunk) != nil || chunk.Usage == nil || chunk.Usage.TotalTokens == 0 {
+		return keymanager.GeminiUsageMetadata{}, false
+	}
+	return keymanager.GeminiUsageMetadata{
+		PromptTokenCount:     chunk.Usage.PromptTokens,
+		CandidatesTokenCount: chunk.Usage.CompletionTokens,
+		TotalTokenCount:      chunk.Usage.TotalTokens,
+	}, true
+}
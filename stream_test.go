@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// eventStrings renders events as "event|data" so table cases stay readable.
+func eventStrings(events []sseEvent) []string {
+	var result []string
+	for _, event := range events {
+		result = append(result, event.Event+"|"+string(event.Data))
+	}
+	return result
+}
+
+var sseCases = []struct {
+	name   string
+	chunks []string
+	want   []string
+}{
+	{
+		name:   "single event",
+		chunks: []string{"data: {\"a\":1}\n\n"},
+		want:   []string{`|{"a":1}`},
+	},
+	{
+		name:   "split across writes",
+		chunks: []string{"da", "ta: {\"a\"", ":1}\n", "\n", "data: 2\n\n"},
+		want:   []string{`|{"a":1}`, "|2"},
+	},
+	{
+		name:   "split between CR and LF",
+		chunks: []string{"data: 1\r", "\n\r", "\n"},
+		want:   []string{"|1"},
+	},
+	{
+		name:   "CRLF line endings",
+		chunks: []string{"event: message\r\ndata: 1\r\n\r\ndata: 2\r\n\r\n"},
+		want:   []string{"message|1", "|2"},
+	},
+	{
+		name:   "multi-line data",
+		chunks: []string{"data: a\ndata: b\n\n"},
+		want:   []string{"|a\nb"},
+	},
+	{
+		name:   "comments and events without data",
+		chunks: []string{": keep-alive\n\nevent: ping\n\ndata: 1\n\n"},
+		want:   []string{"|1"},
+	},
+	{
+		name:   "trailing event without a blank line",
+		chunks: []string{"data: 1\n\ndata: 2\n"},
+		want:   []string{"|1", "|2"},
+	},
+	{
+		name:   "trailing line without a newline",
+		chunks: []string{"data: 1\n\ndata: 2"},
+		want:   []string{"|1", "|2"},
+	},
+}
+
+func TestSSEParser(t *testing.T) {
+	for _, tc := range sseCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var events []sseEvent
+			parser := &sseParser{onEvent: func(event sseEvent) { events = append(events, event) }}
+			for _, chunk := range tc.chunks {
+				parser.Write([]byte(chunk))
+			}
+			parser.Close()
+			if got := eventStrings(events); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSSEReader(t *testing.T) {
+	for _, tc := range sseCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := newSSEReader(strings.NewReader(strings.Join(tc.chunks, "")))
+			var events []sseEvent
+			for {
+				event, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				events = append(events, event)
+			}
+			if got := eventStrings(events); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestJSONObjectSplitter(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		chunks  []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "single object",
+			chunks: []string{`{"a":{"b":1}}`},
+			want:   []string{`{"a":{"b":1}}`},
+		},
+		{
+			name:   "array split across writes",
+			chunks: []string{"[{\"a\":", "1}\n,", "{\"b\"", ":[2]}", "]"},
+			want:   []string{`{"a":1}`, `{"b":[2]}`},
+		},
+		{
+			name:   "braces and escaped quotes in strings",
+			chunks: []string{`[{"t":"}{\"]["},{"t":"\\"}]`},
+			want:   []string{`{"t":"}{\"]["}`, `{"t":"\\"}`},
+		},
+		{
+			name:   "escape split across writes",
+			chunks: []string{`{"t":"a\`, `"}"}`},
+			want:   []string{`{"t":"a\"}"}`},
+		},
+		{
+			name:    "unbalanced close",
+			chunks:  []string{`{"a":1}}`},
+			want:    []string{`{"a":1}`},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var objects []string
+			splitter := &jsonObjectSplitter{onObject: func(object []byte) { objects = append(objects, string(object)) }}
+			var err error
+			for _, chunk := range tc.chunks {
+				if _, err = splitter.Write([]byte(chunk)); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("error %v, want error %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(objects, tc.want) {
+				t.Fatalf("got %q, want %q", objects, tc.want)
+			}
+		})
+	}
+}
+
+func TestUsageSnifferFormats(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		chunks []string
+		want   int
+	}{
+		{
+			name:   "single object",
+			chunks: []string{`{"usageMetadata":{"totalTokenCount":7}}`},
+			want:   7,
+		},
+		{
+			name:   "JSON array",
+			chunks: []string{"\n  ", `[{"usageMetadata":{"totalTokenCount":3}}`, `,{"usageMetadata":{"totalTokenCount":9}}]`},
+			want:   9,
+		},
+		{
+			name:   "SSE",
+			chunks: []string{"data: {\"usageMetadata\":{\"totalTokenCount\":3}}\r\n\r\n", "data: {\"usageMetadata\":{\"totalTokenCount\":5}}"},
+			want:   5,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			usage := newUsageSniffer(geminiUsageTokens)
+			for _, chunk := range tc.chunks {
+				usage.Write([]byte(chunk))
+			}
+			metadata, ok := usage.Total()
+			if !ok || metadata.TotalTokenCount != tc.want {
+				t.Fatalf("got %d (found %v), want %d", metadata.TotalTokenCount, ok, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import "encoding/json"
+
+// withSystemPrompt prepends prompt to the systemInstruction of a Gemini request
+// body, keeping everything else as sent.
+func withSystemPrompt(body []byte, prompt string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	name := "systemInstruction"
+	if _, ok := fields["system_instruction"]; ok {
+		name = "system_instruction"
+	}
+	instruction := make(map[string]json.RawMessage)
+	if raw, ok := fields[name]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &instruction); err != nil {
+			return nil, err
+		}
+	}
+	var parts []json.RawMessage
+	if raw, ok := instruction["parts"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &parts); err != nil {
+			return nil, err
+		}
+	}
+	part, err := json.Marshal(GeminiPart{Text: prompt})
+	if err != nil {
+		return nil, err
+	}
+	if instruction["parts"], err = json.Marshal(append([]json.RawMessage{part}, parts...)); err != nil {
+		return nil, err
+	}
+	if fields[name], err = json.Marshal(instruction); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// withOpenAISystemPrompt adds prompt as the first message of an OpenAI chat
+// completions request body.
+func withOpenAISystemPrompt(body []byte, prompt string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	var messages []json.RawMessage
+	if raw, ok := fields["messages"]; ok {
+		if err := json.Unmarshal(raw, &messages); err != nil {
+			return nil, err
+		}
+	}
+	message, err := json.Marshal(map[string]string{"role": "system", "content": prompt})
+	if err != nil {
+		return nil, err
+	}
+	if fields["messages"], err = json.Marshal(append([]json.RawMessage{message}, messages...)); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+)
+
+// testKeyBody is the smallest generation request, sent to check a key.
+const testKeyBody = `{"contents":[{"parts":[{"text":"test"}]}]}`
+
+// testKey sends testKeyBody to a generateContent URL with key. The caller closes
+// the response body.
+func testKey(ctx context.Context, client *http.Client, upstreamURL url.URL, key string) (*http.Response, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", upstreamURL.String(), strings.NewReader(testKeyBody))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	keymanager.SetUpstreamKey(httpReq, key)
+	return client.Do(httpReq)
+}
+
+// keyTestResult is the outcome of testing one key with `geminilooper test-keys`.
+type keyTestResult struct {
+	Key        string
+	Result     string // valid, invalid, quota exhausted, rate limited, restricted, model not found or error
+	StatusCode int    // 0 if the request failed
+	Detail     string
+}
+
+// runTestKeys tests API keys against upstream without starting the server and
+// prints a table of the results. It exits with status 1 when a key is invalid
+// or restricted.
+func runTestKeys(args []string) {
+	fs := flag.NewFlagSet("test-keys", flag.ExitOnError)
+	dataDir := keymanager.DataDir()
+	fs.StringVar(&dataDir, "data-dir", dataDir, "directory for config.json (env GEMINILOOPER_DATA_DIR)")
+	model := fs.String("model", "", "model to test with (default default_model from config.json)")
+	concurrency := fs.Int("concurrency", 8, "keys tested at the same time")
+	timeout := fs.Duration("timeout", 20*time.Second, "timeout of each test request")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: geminilooper test-keys [flags] [key ...]")
+		fmt.Fprintln(os.Stderr, "Tests the given keys, the keys read from stdin with -, or else every key in config.json.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	keymanager.SetDataDir(dataDir)
+
+	// The config is optional when keys and a model are given
+	config := &keymanager.Config{}
+	if data, err := os.ReadFile(keymanager.ConfigPath()); err == nil {
+		if err := json.Unmarshal(data, config); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v, run geminilooper validate for details\n", keymanager.ConfigPath(), err)
+			os.Exit(1)
+		}
+	} else if fs.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", keymanager.ConfigPath(), err)
+		os.Exit(1)
+	}
+	if *model == "" {
+		*model = config.DefaultModel
+	}
+	if *model == "" {
+		fmt.Fprintln(os.Stderr, "No model to test with, pass -model")
+		os.Exit(1)
+	}
+
+	keys, err := keysToTest(config, fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(keys) == 0 {
+		fmt.Fprintln(os.Stderr, "No keys to test")
+		os.Exit(1)
+	}
+
+	target, _ := url.Parse(keymanager.DefaultUpstreamURL)
+	client := &http.Client{Timeout: *timeout}
+	path := fmt.Sprintf("/v1beta/models/%s:generateContent", *model)
+	results := make([]keyTestResult, len(keys))
+	sem := make(chan struct{}, max(*concurrency, 1))
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			results[i] = runKeyTest(client, keymanager.ConfigUpstreamURL(config, target, key, path), key)
+		}()
+	}
+	wg.Wait()
+
+	fmt.Printf("Tested %d key(s) with %s\n\n", len(keys), *model)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tRESULT\tHTTP\tDETAIL")
+	counts := make(map[string]int)
+	var order []string
+	for _, r := range results {
+		status := "-"
+		if r.StatusCode != 0 {
+			status = fmt.Sprint(r.StatusCode)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", keymanager.MaskKey(r.Key), r.Result, status, r.Detail)
+		if counts[r.Result] == 0 {
+			order = append(order, r.Result)
+		}
+		counts[r.Result]++
+	}
+	w.Flush()
+
+	summary := make([]string, 0, len(order))
+	for _, result := range order {
+		summary = append(summary, fmt.Sprintf("%d %s", counts[result], result))
+	}
+	fmt.Printf("\n%s\n", strings.Join(summary, ", "))
+	if counts["invalid"] > 0 || counts["restricted"] > 0 {
+		os.Exit(1)
+	}
+}
+
+// keysToTest returns the keys given as arguments, read from stdin for "-", or
+// else the configured keys, including those of key providers. Duplicates are
+// tested once.
+func keysToTest(config *keymanager.Config, args []string) ([]string, error) {
+	var keys []string
+	for _, arg := range args {
+		if arg != "-" {
+			keys = append(keys, arg)
+			continue
+		}
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				keys = append(keys, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading keys from stdin: %v", err)
+		}
+	}
+	if len(args) == 0 {
+		keys = append(append(keys, config.PriorityKeys...), config.SecondaryKeys...)
+		if len(config.KeyProviders) > 0 {
+			priorityKeys, secondaryKeys, err := keymanager.ProviderKeys(config.KeyProviders)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(append(keys, priorityKeys...), secondaryKeys...)
+		}
+	}
+
+	seen := make(map[string]bool)
+	unique := keys[:0]
+	for _, key := range keys {
+		if key != "" && !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique, nil
+}
+
+func runKeyTest(client *http.Client, upstreamURL url.URL, key string) keyTestResult {
+	resp, err := testKey(context.Background(), client, upstreamURL, key)
+	if err != nil {
+		return keyTestResult{Key: key, Result: "error", Detail: err.Error()}
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	result, detail := classifyKeyTest(resp.StatusCode, resp.Header, body)
+	return keyTestResult{Key: key, Result: result, StatusCode: resp.StatusCode, Detail: detail}
+}
+
+// classifyKeyTest tells from the response to a test request whether the key
+// works, and if not, why.
+func classifyKeyTest(statusCode int, header http.Header, body []byte) (result, detail string) {
+	var parsed struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+			Details []struct {
+				Reason string `json:"reason"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	json.Unmarshal(body, &parsed)
+	reason := parsed.Error.Status
+	for _, d := range parsed.Error.Details {
+		if d.Reason != "" {
+			reason = d.Reason
+			break
+		}
+	}
+	detail = parsed.Error.Message
+	if reason != "" && detail != "" {
+		detail = reason + ": " + detail
+	} else if reason != "" {
+		detail = reason
+	}
+	if len(detail) > 120 {
+		detail = detail[:117] + "..."
+	}
+
+	switch {
+	case statusCode == http.StatusOK:
+		return "valid", ""
+	case reason == "API_KEY_INVALID" || strings.Contains(parsed.Error.Message, "API key not valid") || statusCode == http.StatusUnauthorized:
+		return "invalid", detail
+	case statusCode == http.StatusForbidden:
+		return "restricted", detail // Blocked for the API, the referrer or the IP, or the project is suspended
+	case statusCode == http.StatusTooManyRequests:
+		info := parseRateLimitError(header, body)
+		if info.Scope == keymanager.RateLimitPerDay {
+			return "quota exhausted", info.String()
+		}
+		return "rate limited", info.String()
+	case statusCode == http.StatusNotFound:
+		return "model not found", detail
+	default:
+		return "error", detail
+	}
+}
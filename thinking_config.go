@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+)
+
+// jsonObject decodes the object at fields[name], an empty one if it's missing.
+func jsonObject(fields map[string]json.RawMessage, name string) (map[string]json.RawMessage, error) {
+	object := make(map[string]json.RawMessage)
+	if raw, ok := fields[name]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return nil, err
+		}
+	}
+	return object, nil
+}
+
+// withThinkingConfig sets generationConfig.thinkingConfig in a Gemini request body.
+func withThinkingConfig(body []byte, thinking *keymanager.ThinkingConfig) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	name := "generationConfig"
+	if _, ok := fields["generation_config"]; ok {
+		name = "generation_config"
+	}
+	config, err := jsonObject(fields, name)
+	if err != nil {
+		return nil, err
+	}
+	thinkingName := "thinkingConfig"
+	if _, ok := config["thinking_config"]; ok {
+		thinkingName = "thinking_config"
+	}
+	thinkingFields, err := jsonObject(config, thinkingName)
+	if err != nil {
+		return nil, err
+	}
+	thinking.Apply(thinkingFields, thinkingName == "thinking_config")
+
+	if config[thinkingName], err = json.Marshal(thinkingFields); err != nil {
+		return nil, err
+	}
+	if fields[name], err = json.Marshal(config); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// withOpenAIThinkingConfig sets extra_body.google.thinking_config in an OpenAI
+// chat completions body, which Gemini's OpenAI-compatible endpoint reads.
+// reasoning_effort would conflict with it and is dropped.
+func withOpenAIThinkingConfig(body []byte, thinking *keymanager.ThinkingConfig) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	extra, err := jsonObject(fields, "extra_body")
+	if err != nil {
+		return nil, err
+	}
+	google, err := jsonObject(extra, "google")
+	if err != nil {
+		return nil, err
+	}
+	thinkingFields, err := jsonObject(google, "thinking_config")
+	if err != nil {
+		return nil, err
+	}
+	thinking.Apply(thinkingFields, true)
+
+	if google["thinking_config"], err = json.Marshal(thinkingFields); err != nil {
+		return nil, err
+	}
+	if extra["google"], err = json.Marshal(google); err != nil {
+		return nil, err
+	}
+	if fields["extra_body"], err = json.Marshal(extra); err != nil {
+		return nil, err
+	}
+	delete(fields, "reasoning_effort")
+	return json.Marshal(fields)
+}
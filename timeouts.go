@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// requestTimeout puts the overall request deadline on proxied requests. Upstream
+// calls use the request context, so they are cut off with it.
+func requestTimeout(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := km.Timeouts()
+		if config.Request <= 0 {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(config.Request)*time.Second)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// applyServerTimeouts sets the client-side timeouts on the HTTP server. There is
+// no write timeout, since streamed responses can take minutes.
+func applyServerTimeouts(srv *http.Server, config *keymanager.TimeoutsConfig) {
+	var timeouts keymanager.TimeoutsConfig
+	if config != nil {
+		timeouts = *config
+	}
+	timeouts = timeouts.WithDefaults()
+	srv.ReadHeaderTimeout = time.Duration(timeouts.ClientReadHeader) * time.Second
+	srv.IdleTimeout = time.Duration(timeouts.ClientIdle) * time.Second
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// listenAndServe serves HTTP, or HTTPS when TLS is configured.
+func listenAndServe(srv *http.Server, config *keymanager.TLSConfig) error {
+	if config == nil {
+		log.Printf("Starting server on %s", srv.Addr)
+		return srv.ListenAndServe()
+	}
+	if config.Address != "" {
+		srv.Addr = config.Address
+	}
+
+	if config.Autocert != nil {
+		if len(config.Autocert.Domains) == 0 {
+			return fmt.Errorf("tls.autocert.domains is empty")
+		}
+		cacheDir := config.Autocert.CacheDir
+		if cacheDir == "" {
+			cacheDir = "autocert-cache"
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(config.Autocert.Domains...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      config.Autocert.Email,
+		}
+		srv.TLSConfig = manager.TLSConfig()
+		if config.Autocert.HTTPAddress != "" {
+			go func() {
+				// Answers ACME challenges and redirects everything else to HTTPS
+				if err := http.ListenAndServe(config.Autocert.HTTPAddress, manager.HTTPHandler(nil)); err != nil {
+					log.Printf("ERROR: ACME HTTP challenge listener stopped: %v", err)
+				}
+			}()
+		}
+		log.Printf("Starting HTTPS server on %s with Let's Encrypt certificates for %v", srv.Addr, config.Autocert.Domains)
+		return srv.ListenAndServeTLS("", "")
+	}
+
+	if config.CertFile == "" || config.KeyFile == "" {
+		return fmt.Errorf("tls needs cert_file and key_file, or autocert")
+	}
+	log.Printf("Starting HTTPS server on %s", srv.Addr)
+	return srv.ListenAndServeTLS(config.CertFile, config.KeyFile)
+}
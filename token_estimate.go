@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+// Gemini counts an image as 258 tokens. Other media depend on their length,
+// which isn't known before sending, so they are counted like an image.
+const mediaPartTokens = 258
+
+// countTokens calls give up after this, the request goes on without an estimate
+const countTokensTimeout = 10 * time.Second
+
+// Clients can send their own estimate, which is used instead of countTokens.
+const tokenEstimateHeader = "X-Token-Estimate"
+
+// requestTokenEstimate returns the expected token count of a request: the
+// client's X-Token-Estimate header, or countTokens or the local estimate for a
+// Gemini request body when enabled. 0 means unknown.
+func requestTokenEstimate(c *gin.Context, km *keymanager.KeyManager, target *url.URL, modelName string, geminiBody []byte) int {
+	if header := c.GetHeader(tokenEstimateHeader); header != "" {
+		c.Request.Header.Del(tokenEstimateHeader) // Not for upstream
+		if estimate, err := strconv.Atoi(header); err == nil && estimate > 0 {
+			return estimate
+		}
+		return 0
+	}
+	if geminiBody == nil {
+		return 0
+	}
+
+	config := km.Config().TokenEstimation
+	apiKey := km.CountTokensKey(modelName)
+	if config == nil {
+		return 0
+	}
+	if config.CountTokens && apiKey != "" {
+		estimate, err := countTokens(c.Request.Context(), km.UpstreamClient(), km.UpstreamURLFor(c.Request.Context(), target, apiKey, fmt.Sprintf("/v1beta/models/%s:countTokens", modelName)), modelName, apiKey, geminiBody)
+		if err == nil {
+			return estimate
+		}
+		if !config.Local {
+			log.Printf("WARN: countTokens for model %s failed, picking a key without an estimate: %v", modelName, err)
+			return 0
+		}
+		log.Printf("WARN: countTokens for model %s failed, estimating locally: %v", modelName, err)
+	}
+	if !config.Local {
+		return 0
+	}
+	return estimateRequestTokens(geminiBody)
+}
+
+// estimateRequestTokens approximates the prompt tokens of a Gemini or OpenAI
+// request body: the text of its strings, and mediaPartTokens for each image or
+// file. 0 means the body couldn't be read.
+func estimateRequestTokens(body []byte) int {
+	var parsed any
+	if json.Unmarshal(body, &parsed) != nil {
+		return 0
+	}
+	return estimateJSONTokens(parsed)
+}
+
+func estimateJSONTokens(value any) int {
+	tokens := 0
+	switch v := value.(type) {
+	case string:
+		tokens = estimateTextTokens(v)
+	case []any:
+		for _, item := range v {
+			tokens += estimateJSONTokens(item)
+		}
+	case map[string]any:
+		for key, field := range v {
+			switch key {
+			case "inlineData", "inline_data", "fileData", "file_data", "image_url", "input_audio": // Media, possibly as base64
+				tokens += mediaPartTokens
+			case "model", "role", "mimeType", "mime_type", "safetySettings", "safety_settings":
+			default:
+				tokens += estimateJSONTokens(field)
+			}
+		}
+	}
+	return tokens
+}
+
+// estimatedPromptUsage is the usage recorded for a response that reported none,
+// e.g. a stream cut off by an upstream error.
+func estimatedPromptUsage(estimatedTokens int) keymanager.GeminiUsageMetadata {
+	return keymanager.GeminiUsageMetadata{PromptTokenCount: estimatedTokens, TotalTokenCount: estimatedTokens}
+}
+
+// countTokens asks Gemini how many tokens a generateContent request body holds.
+func countTokens(ctx context.Context, client *http.Client, upstreamURL url.URL, modelName, apiKey string, geminiBody []byte) (int, error) {
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal(geminiBody, &request); err != nil {
+		return 0, fmt.Errorf("invalid request body: %v", err)
+	}
+	request["model"], _ = json.Marshal("models/" + modelName)
+	body, err := json.Marshal(map[string]any{"generateContentRequest": request})
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, countTokensTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, upstreamURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	keymanager.SetUpstreamKey(req, apiKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var result struct {
+		TotalTokens int `json:"totalTokens"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.TotalTokens, nil
+}
+
+// estimatedUsage estimates the usage of a generation request whose response
+// reported none, from the length of its text and of the output text.
+func estimatedUsage(req *GeminiRequest, output string) keymanager.GeminiUsageMetadata {
+	prompt := 0
+	if req.SystemInstruction != nil {
+		for _, part := range req.SystemInstruction.Parts {
+			prompt += estimateTextTokens(part.Text)
+		}
+	}
+	for _, content := range req.Contents {
+		for _, part := range content.Parts {
+			prompt += estimateTextTokens(part.Text)
+		}
+	}
+	candidates := estimateTextTokens(output)
+	return keymanager.GeminiUsageMetadata{PromptTokenCount: prompt, CandidatesTokenCount: candidates, TotalTokenCount: prompt + candidates}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+	"github.com/gin-gonic/gin"
+)
+
+type usageQueryResponse struct {
+	Model         string                   `json:"model,omitempty"`
+	Key           string                   `json:"key,omitempty"` // Masked
+	From          string                   `json:"from"`
+	To            string                   `json:"to"`
+	Granularity   string                   `json:"granularity"`
+	TotalTokens   int                      `json:"total_tokens"`
+	TotalRequests int                      `json:"total_requests"`
+	TotalCost     float64                  `json:"total_cost"`
+	Buckets       []keymanager.UsageBucket `json:"buckets"` // Only buckets with usage, oldest first
+}
+
+// parseUsageTime accepts Unix seconds, RFC 3339 or a date in the configured timezone.
+func parseUsageTime(value string, location *time.Location) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, location); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s', use Unix seconds, RFC 3339 or YYYY-MM-DD", value)
+}
+
+// parseUsageQuery reads the model, key, from, to and granularity parameters.
+// to defaults to now and from to defaultRange before to. It answers 400 and
+// returns false on invalid parameters.
+func parseUsageQuery(c *gin.Context, location *time.Location, defaultRange time.Duration) (keymanager.UsageQuery, bool) {
+	query := keymanager.UsageQuery{
+		Model:       c.Query("model"),
+		Key:         c.Query("key"),
+		To:          time.Now(),
+		Granularity: c.DefaultQuery("granularity", "hour"),
+	}
+	if query.Granularity != "minute" && query.Granularity != "hour" && query.Granularity != "day" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "granularity must be minute, hour or day"})
+		return query, false
+	}
+	var err error
+	if to := c.Query("to"); to != "" {
+		if query.To, err = parseUsageTime(to, location); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return query, false
+		}
+	}
+	query.From = query.To.Add(-defaultRange)
+	if from := c.Query("from"); from != "" {
+		if query.From, err = parseUsageTime(from, location); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return query, false
+		}
+	}
+	if !query.From.Before(query.To) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return query, false
+	}
+	return query, true
+}
+
+func usageQueryHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		location := km.NextReset().Location()
+
+		query, ok := parseUsageQuery(c, location, 24*time.Hour)
+		if !ok {
+			return
+		}
+		buckets, err := km.QueryUsage(query)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to query usage: %v", err)})
+			return
+		}
+		response := usageQueryResponse{
+			Model:       query.Model,
+			From:        query.From.In(location).Format(time.RFC3339),
+			To:          query.To.In(location).Format(time.RFC3339),
+			Granularity: query.Granularity,
+			Buckets:     buckets,
+		}
+		if query.Key != "" {
+			response.Key = keymanager.MaskKey(query.Key)
+		}
+		for _, bucket := range buckets {
+			response.TotalTokens += bucket.Tokens
+			response.TotalRequests += bucket.Requests
+			response.TotalCost += bucket.Cost
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// usageExportHandler serves daily usage per key and model as a CSV download,
+// for the last 30 days unless from and to are given.
+func usageExportHandler(km *keymanager.KeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		location := km.NextReset().Location()
+
+		query, ok := parseUsageQuery(c, location, 30*24*time.Hour)
+		if !ok {
+			return
+		}
+		query.Granularity = "day"
+		query.PerKey = true
+		buckets, err := km.QueryUsage(query)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to query usage: %v", err)})
+			return
+		}
+
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"date", "model", "key", "tokens", "requests", "cost_usd"})
+		for _, bucket := range buckets {
+			start, _ := time.Parse(time.RFC3339, bucket.Start)
+			w.Write([]string{
+				start.Format("2006-01-02"),
+				bucket.Model,
+				keymanager.MaskKey(bucket.Key),
+				strconv.Itoa(bucket.Tokens),
+				strconv.Itoa(bucket.Requests),
+				strconv.FormatFloat(bucket.Cost, 'f', 6, 64),
+			})
+		}
+		w.Flush()
+
+		filename := fmt.Sprintf("usage-%s-%s.csv", query.From.In(location).Format("2006-01-02"), query.To.In(location).Format("2006-01-02"))
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+	}
+}
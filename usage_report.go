@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+)
+
+// usageReportRow is one line of `geminilooper usage`: the usage of a model and
+// key, or their total when grouped.
+type usageReportRow struct {
+	Model         string  `json:"model,omitempty"`
+	Key           string  `json:"key,omitempty"` // Masked
+	Retired       bool    `json:"retired,omitempty"`
+	TodayTokens   int     `json:"today_tokens"`
+	TodayRequests int     `json:"today_requests"`
+	Past24hTokens int     `json:"past_24h_tokens"`
+	TotalTokens   int     `json:"total_tokens"`
+	TodayCost     float64 `json:"today_cost"` // Estimated USD
+	TotalCost     float64 `json:"total_cost"`
+}
+
+func (r *usageReportRow) add(other usageReportRow) {
+	r.TodayTokens += other.TodayTokens
+	r.TodayRequests += other.TodayRequests
+	r.Past24hTokens += other.Past24hTokens
+	r.TotalTokens += other.TotalTokens
+	r.TodayCost += other.TodayCost
+	r.TotalCost += other.TotalCost
+}
+
+// runUsage prints the usage saved by the proxy, per model and key, without the
+// server running: from the usage file, the SQLite database or Redis, whichever
+// usage_store selects.
+func runUsage(args []string) {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	dataDir := keymanager.DataDir()
+	fs.StringVar(&dataDir, "data-dir", dataDir, "directory for config.json and the usage data (env GEMINILOOPER_DATA_DIR)")
+	by := fs.String("by", "entry", "group by entry (model and key), model or key")
+	modelFilter := fs.String("model", "", "only report this model")
+	keyFilter := fs.String("key", "", "only report keys starting with this prefix")
+	retired := fs.Bool("retired", false, "include keys no longer in the config")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: geminilooper usage [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	keymanager.SetDataDir(dataDir)
+	if *by != "entry" && *by != "model" && *by != "key" {
+		fmt.Fprintf(os.Stderr, "Unknown -by %q, use entry, model or key\n", *by)
+		os.Exit(2)
+	}
+
+	data, err := os.ReadFile(keymanager.ConfigPath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", keymanager.ConfigPath(), err)
+		os.Exit(1)
+	}
+	var config keymanager.Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v, run geminilooper validate for details\n", keymanager.ConfigPath(), err)
+		os.Exit(1)
+	}
+	usage, retiredUsage, source, err := keymanager.ReadSavedUsage(&config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Today's counters are only reset by a running proxy, so they are stale once
+	// the reset time has passed
+	now := time.Now()
+	todayStale := false
+	if loc, err := time.LoadLocation(config.Timezone); err == nil {
+		if nextReset, err := time.ParseInLocation("2006-01-02 15:04", config.NextQuotaResetDatetime, loc); err == nil && now.After(nextReset) {
+			todayStale = true
+		}
+	}
+
+	rows := usageReportRows(usage, retiredUsage, *retired, now.Unix(), todayStale)
+	filtered := rows[:0]
+	for _, row := range rows {
+		if (*modelFilter == "" || row.Model == *modelFilter) && strings.HasPrefix(row.Key, *keyFilter) {
+			filtered = append(filtered, row)
+		}
+	}
+	rows = groupUsageReportRows(filtered, *by)
+	var total usageReportRow
+	for _, row := range rows {
+		total.add(row)
+	}
+	for i := range rows {
+		if rows[i].Key != "" {
+			rows[i].Key = keymanager.MaskKey(rows[i].Key)
+		}
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(struct {
+			Source string           `json:"source"`
+			Rows   []usageReportRow `json:"rows"`
+			Total  usageReportRow   `json:"total"`
+		}{source, rows, total}, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	fmt.Printf("Usage from %s\n", source)
+	if todayStale {
+		fmt.Printf("The quota reset at %s has passed since the usage was saved, today's counters are shown as 0.\n", config.NextQuotaResetDatetime)
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	var header []string
+	switch *by {
+	case "entry":
+		header = []string{"MODEL", "KEY"}
+	case "model":
+		header = []string{"MODEL"}
+	case "key":
+		header = []string{"KEY"}
+	}
+	header = append(header, "TODAY", "REQUESTS", "24H", "LIFETIME", "TODAY COST", "LIFETIME COST")
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	line := func(labels []string, r usageReportRow) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t$%.2f\t$%.2f\n", strings.Join(labels, "\t"), r.TodayTokens, r.TodayRequests, r.Past24hTokens, r.TotalTokens, r.TodayCost, r.TotalCost)
+	}
+	for _, r := range rows {
+		key := r.Key
+		if r.Retired {
+			key += " (retired)"
+		}
+		switch *by {
+		case "entry":
+			line([]string{r.Model, key}, r)
+		case "model":
+			line([]string{r.Model}, r)
+		case "key":
+			line([]string{key}, r)
+		}
+	}
+	labels := []string{"TOTAL"}
+	if *by == "entry" {
+		labels = append(labels, "")
+	}
+	line(labels, total)
+	w.Flush()
+}
+
+// usageReportRows turns saved usage into report rows sorted by model and key,
+// with the unmasked key.
+func usageReportRows(usage, retiredUsage map[string]*keymanager.LanguageModelUsage, includeRetired bool, now int64, todayStale bool) []usageReportRow {
+	var rows []usageReportRow
+	addEntries := func(entries map[string]*keymanager.LanguageModelUsage, retired bool) {
+		for usageKey, usage := range entries {
+			model, key, _ := strings.Cut(usageKey, "_") // Model names have no underscores
+			row := usageReportRow{
+				Model:         model,
+				Key:           key,
+				Retired:       retired,
+				TodayTokens:   usage.TodayUsage,
+				TodayRequests: usage.TodayRequests,
+				Past24hTokens: usage.Past24HoursTokenUsage.LastDayTokens(now),
+				TotalTokens:   usage.TotalTokenUse,
+				TodayCost:     usage.TodayCost,
+				TotalCost:     usage.TotalCost,
+			}
+			if todayStale {
+				row.TodayTokens, row.TodayRequests, row.TodayCost = 0, 0, 0
+			}
+			rows = append(rows, row)
+		}
+	}
+	addEntries(usage, false)
+	if includeRetired {
+		addEntries(retiredUsage, true)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Model != rows[j].Model {
+			return rows[i].Model < rows[j].Model
+		}
+		return rows[i].Key < rows[j].Key
+	})
+	return rows
+}
+
+// groupUsageReportRows sums rows per model or per key; "entry" keeps them as
+// they are.
+func groupUsageReportRows(rows []usageReportRow, by string) []usageReportRow {
+	if by == "entry" {
+		return rows
+	}
+	index := make(map[string]int)
+	var grouped []usageReportRow
+	for _, row := range rows {
+		id := row.Model
+		group := usageReportRow{Model: row.Model}
+		if by == "key" {
+			id = row.Key
+			group = usageReportRow{Key: row.Key, Retired: row.Retired}
+		}
+		i, ok := index[id]
+		if !ok {
+			i = len(grouped)
+			index[id] = i
+			grouped = append(grouped, group)
+		}
+		if !row.Retired {
+			grouped[i].Retired = false // Retired for some models only
+		}
+		grouped[i].add(row)
+	}
+	if by == "key" {
+		sort.Slice(grouped, func(i, j int) bool { return grouped[i].Key < grouped[j].Key })
+	}
+	return grouped
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Toukaiteio/GeminiLooper/pkg/keymanager"
+)
+
+// configProblem is one finding of `geminilooper validate`.
+type configProblem struct {
+	Warning bool   // Startup works, but probably not as intended
+	Field   string // JSON path of the setting, e.g. models.gemini-2.5-pro.tpm_limit
+	Message string
+}
+
+// runValidate checks config.json without starting the server and prints every
+// problem it finds, not just the first. It exits with status 1 on errors.
+func runValidate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	dataDir := keymanager.DataDir()
+	fs.StringVar(&dataDir, "data-dir", dataDir, "directory for config.json (env GEMINILOOPER_DATA_DIR)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: geminilooper validate [-data-dir dir] [config.json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	keymanager.SetDataDir(dataDir)
+	path := keymanager.ConfigPath()
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		os.Exit(1)
+	}
+	problems := validateConfigData(data)
+
+	errorCount := 0
+	for _, p := range problems {
+		if !p.Warning {
+			errorCount++
+		}
+	}
+	if len(problems) == 0 {
+		fmt.Printf("%s: OK\n", path)
+		return
+	}
+	fmt.Printf("%s: %d error(s), %d warning(s)\n", path, errorCount, len(problems)-errorCount)
+	for _, p := range problems {
+		severity := "error  "
+		if p.Warning {
+			severity = "warning"
+		}
+		if p.Field != "" {
+			fmt.Printf("  %s %s: %s\n", severity, p.Field, p.Message)
+		} else {
+			fmt.Printf("  %s %s\n", severity, p.Message)
+		}
+	}
+	if errorCount > 0 {
+		os.Exit(1)
+	}
+}
+
+// validateConfigData parses a config file and checks it.
+func validateConfigData(data []byte) []configProblem {
+	var config keymanager.Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return []configProblem{{Message: describeJSONError(data, err)}}
+	}
+	var problems []configProblem
+	// Settings the proxy doesn't know are ignored, usually a typo
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&keymanager.Config{}); err != nil {
+		problems = append(problems, configProblem{Warning: true, Message: strings.TrimPrefix(err.Error(), "json: ") + ", it is ignored"})
+	}
+	return append(problems, checkConfig(&config)...)
+}
+
+// describeJSONError turns a JSON decoding error into a message with the line
+// and column it refers to.
+func describeJSONError(data []byte, err error) string {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+		return fmt.Sprintf("line %s: %s must be %s, not a %s", lineAndColumn(data, offset), typeErr.Field, jsonTypeName(typeErr.Type), typeErr.Value)
+	default:
+		return fmt.Sprintf("invalid JSON: %v", err)
+	}
+	return fmt.Sprintf("line %s: invalid JSON: %v", lineAndColumn(data, offset), err)
+}
+
+// jsonTypeName describes the JSON value expected for a Go type.
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Slice:
+		return "an array"
+	case reflect.Pointer:
+		return jsonTypeName(t.Elem())
+	default:
+		return "an object"
+	}
+}
+
+func lineAndColumn(data []byte, offset int64) string {
+	offset = min(max(offset, 0), int64(len(data)))
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("%d, column %d", line, column)
+}
+
+// checkConfig checks the settings the proxy needs to start and schedule keys.
+func checkConfig(config *keymanager.Config) []configProblem {
+	var problems []configProblem
+	problem := func(field, format string, args ...any) {
+		problems = append(problems, configProblem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	warning := func(field, format string, args ...any) {
+		problems = append(problems, configProblem{Warning: true, Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	loc, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		problem("timezone", "unknown time zone %q, use an IANA name like \"UTC\" or \"America/Los_Angeles\"", config.Timezone)
+		loc = time.UTC
+	}
+	if _, err := time.Parse("15:04", config.ResetAfter); err != nil {
+		problem("reset_after", "%q is not a time of day, use HH:MM like \"01:00\"", config.ResetAfter)
+	}
+	if _, err := time.ParseInLocation("2006-01-02 15:04", config.NextQuotaResetDatetime, loc); err != nil {
+		problem("next_quota_reset_datetime", "%q is not a date and time, use YYYY-MM-DD HH:MM like %q", config.NextQuotaResetDatetime, time.Now().In(loc).AddDate(0, 0, 1).Format("2006-01-02")+" 01:00")
+	}
+
+	// Models
+	modelNames := make([]string, 0, len(config.Models))
+	for name := range config.Models {
+		modelNames = append(modelNames, name)
+	}
+	sort.Strings(modelNames)
+	if len(modelNames) == 0 {
+		problem("models", "no models configured")
+	}
+	if _, ok := config.Models[config.DefaultModel]; !ok && len(modelNames) > 0 {
+		problem("default_model", "%q is not in models, pick one of %s", config.DefaultModel, strings.Join(modelNames, ", "))
+	}
+	if _, ok := config.Models[config.DefaultImageModel]; config.DefaultImageModel != "" && !ok {
+		problem("default_image_model", "%q is not in models", config.DefaultImageModel)
+	}
+	if _, ok := config.Models[config.DefaultEmbeddingModel]; config.DefaultEmbeddingModel != "" && !ok {
+		problem("default_embedding_model", "%q is not in models", config.DefaultEmbeddingModel)
+	}
+	for _, name := range modelNames {
+		model := config.Models[name]
+		field := "models." + name
+		if strings.Contains(name, "_") {
+			warning(field, "model names with underscores can't be told apart from their keys in usage queries")
+		}
+		for _, limit := range []struct {
+			name  string
+			value int
+		}{{"tpm_limit", model.TpmLimit}, {"rpm_limit", model.RpmLimit}, {"rpd_limit", model.RpdLimit}, {"ipd_limit", model.IpdLimit}, {"max_concurrency", model.MaxConcurrency}, {"max_output_tokens", model.MaxOutputTokens}} {
+			if limit.value < 0 {
+				problem(field+"."+limit.name, "must not be negative, use 0 for no limit")
+			}
+		}
+		if model.TpmLimit == 0 {
+			warning(field+".tpm_limit", "is 0, keys are used without a tokens per minute limit")
+		}
+		if model.TpdLimit != nil {
+			switch {
+			case *model.TpdLimit < 0:
+				problem(field+".tpd_limit", "must not be negative, use null for no limit")
+			case *model.TpdLimit > 0 && *model.TpdLimit < model.TpmLimit:
+				warning(field+".tpd_limit", "%d is below tpm_limit %d", *model.TpdLimit, model.TpmLimit)
+			}
+		}
+		for _, fallback := range model.FallbackModels {
+			// Only one level of fallback is followed, so models falling back to
+			// each other can't loop
+			switch _, ok := config.Models[fallback]; {
+			case !ok:
+				problem(field+".fallback_models", "%q is not in models", fallback)
+			case fallback == name:
+				problem(field+".fallback_models", "a model can't fall back to itself")
+			}
+		}
+	}
+
+	// Keys
+	if len(config.PriorityKeys)+len(config.SecondaryKeys) == 0 && len(config.KeyProviders) == 0 {
+		problem("priority_keys", "no API keys configured in priority_keys, secondary_keys or key_providers")
+	}
+	seen := make(map[string]string)
+	for _, list := range []struct {
+		field string
+		keys  []string
+	}{{"priority_keys", config.PriorityKeys}, {"secondary_keys", config.SecondaryKeys}} {
+		for i, key := range list.keys {
+			entry := fmt.Sprintf("%s[%d]", list.field, i)
+			keyErr := keymanager.CheckKey(key)
+			switch {
+			case strings.TrimSpace(key) == "":
+				problem(entry, "empty key")
+			case strings.Contains(key, "KeysHere"):
+				problem(entry, "%q is a placeholder from the default config, replace it with a Gemini API key", key)
+			case keyErr != nil:
+				problem(entry, "key %s %v", keymanager.MaskKey(key), keyErr)
+			case seen[key] != "":
+				warning(entry, "key %s is also %s, it is only used once", keymanager.MaskKey(key), seen[key])
+			default:
+				seen[key] = entry
+			}
+		}
+	}
+	for key, models := range config.KeyModels {
+		for _, name := range models {
+			if _, ok := config.Models[name]; !ok {
+				problem("key_models", "model %q of key %s is not in models", name, keymanager.MaskKey(key))
+			}
+		}
+	}
+
+	if err := keymanager.ValidateUpstreamURLs(config); err != nil {
+		problem("", "%v", err)
+	}
+	if err := keymanager.ValidateRouting(config); err != nil {
+		problem("routing_rules", "%v", err)
+	}
+	if err := keymanager.ValidateTestMode(config); err != nil {
+		problem("test_mode", "%v", err)
+	}
+	for group, keys := range config.KeyGroups {
+		for _, key := range keys {
+			if seen[key] == "" && len(config.KeyProviders) == 0 {
+				warning("key_groups."+group, "key %s is in neither priority_keys nor secondary_keys, it is never used", keymanager.MaskKey(key))
+			}
+		}
+	}
+	if config.KeyPolicy != "" {
+		if _, err := keymanager.CompileKeyPolicy(config.KeyPolicy); err != nil {
+			problem("key_policy", "%v", err)
+		}
+	}
+	if store := config.UsageStore; store != nil {
+		switch store.Type {
+		case "", "json", "sqlite", "redis":
+		default:
+			problem("usage_store.type", "unknown type %q, use json, sqlite or redis", store.Type)
+		}
+		if !keymanager.ValidUsageFormat(store.Format) {
+			problem("usage_store.format", "unknown format %q, use json or gob", store.Format)
+		}
+	}
+	return problems
+}